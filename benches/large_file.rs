@@ -0,0 +1,40 @@
+//! Ignore files generated from huge repositories run to hundreds of
+//! thousands of lines. Adding a pattern to them should take time
+//! proportional to the file size, and matching should not depend on it
+//! beyond the compilation of the patterns.
+
+use criterion::{black_box, criterion_group, criterion_main, Criterion};
+use stignore::{IgnoreFile, Matcher};
+
+/// Content of a generated ignore file with `lines` patterns
+fn generated(lines: usize) -> String {
+    (0..lines)
+        .map(|i| format!("/vendor/pkg{i}/build\n"))
+        .collect()
+}
+
+fn add(c: &mut Criterion) {
+    for lines in [1_000, 100_000] {
+        let content = generated(lines);
+        c.bench_function(&format!("add a pattern to {lines} lines"), |b| {
+            b.iter(|| {
+                let mut file = IgnoreFile::parse(black_box(&content));
+                if file.find("*.tmp").is_none() {
+                    file.push("*.tmp");
+                }
+                file.to_string()
+            })
+        });
+    }
+}
+
+fn matching(c: &mut Criterion) {
+    let lines: Vec<String> = generated(100_000).lines().map(str::to_owned).collect();
+    let matcher = Matcher::new(&lines);
+    c.bench_function("match against 100000 patterns", |b| {
+        b.iter(|| matcher.matches(black_box("vendor/pkg99999/build/out.o")))
+    });
+}
+
+criterion_group!(benches, add, matching);
+criterion_main!(benches);
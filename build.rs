@@ -0,0 +1,47 @@
+//! Records build metadata reported by `stignore version`
+
+use std::{
+    process::Command,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// Trimmed stdout of the command, empty if it can't be run
+fn output(program: &str, args: &[&str]) -> String {
+    Command::new(program)
+        .args(args)
+        .output()
+        .ok()
+        .filter(|o| o.status.success())
+        .map(|o| String::from_utf8_lossy(&o.stdout).trim().to_owned())
+        .unwrap_or_default()
+}
+
+fn main() {
+    let commit = output("git", &["rev-parse", "--short=12", "HEAD"]);
+    // the commit changes along with HEAD or the branch it points to, which
+    // cargo doesn't watch otherwise
+    if !commit.is_empty() {
+        let branch = output("git", &["symbolic-ref", "-q", "HEAD"]);
+        for name in ["HEAD", &branch].into_iter().filter(|n| !n.is_empty()) {
+            let path = output("git", &["rev-parse", "--git-path", name]);
+            println!("cargo:rerun-if-changed={path}");
+        }
+        println!("cargo:rerun-if-changed=build.rs");
+        println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+    }
+    // reproducible builds pin the date
+    let date = std::env::var("SOURCE_DATE_EPOCH").unwrap_or_else(|_| {
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs())
+            .to_string()
+    });
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_owned());
+    let rustc = output(&rustc, &["--version"]);
+    let target = std::env::var("TARGET").unwrap_or_default();
+
+    println!("cargo:rustc-env=STIGNORE_COMMIT={commit}");
+    println!("cargo:rustc-env=STIGNORE_BUILD_DATE={date}");
+    println!("cargo:rustc-env=STIGNORE_RUSTC={rustc}");
+    println!("cargo:rustc-env=STIGNORE_BUILD_TARGET={target}");
+}
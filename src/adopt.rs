@@ -0,0 +1,75 @@
+use crate::{includes::included_path, pattern::Pattern, text, LINE_ENDING};
+
+/// Result of splitting an ignore file
+pub struct Adoption {
+    /// New content of the file
+    pub kept: String,
+    /// Lines to append to another file
+    pub moved: String,
+}
+
+/// Splits ignore file content into patterns that stay (`keep` returns true)
+/// and patterns moving to another file, e.g. from .stignore to .stignore_sync.
+/// Comments directly above a moved pattern are moved along with it. `include`
+/// directive, if given, takes the place of the first moved pattern, so the
+/// evaluation order is preserved as much as possible. Added line breaks match
+/// the ones of `content`.
+pub fn split(content: &str, include: Option<&str>, mut keep: impl FnMut(&str) -> bool) -> Adoption {
+    let mut adoption = Adoption {
+        kept: String::new(),
+        moved: String::new(),
+    };
+    let ending = text::line_ending(content).unwrap_or(LINE_ENDING);
+    let mut include = include.map(|i| text::with_line_ending(i, ending));
+    let mut comments = String::new();
+
+    for line in content.split_inclusive('\n') {
+        let trimmed = line.trim();
+        if trimmed.starts_with("//") {
+            comments.push_str(line);
+            continue;
+        }
+        if included_path(trimmed).is_some() || Pattern::parse(trimmed).is_none() || keep(trimmed) {
+            adoption.kept.push_str(&comments);
+            adoption.kept.push_str(line);
+        } else {
+            if let Some(include) = include.take() {
+                adoption.kept.push_str(&include);
+            }
+            adoption.moved.push_str(&comments);
+            adoption.moved.push_str(line);
+            if !line.ends_with('\n') {
+                adoption.moved.push_str(ending);
+            }
+        }
+        comments.clear();
+    }
+    adoption.kept.push_str(&comments);
+    adoption
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn comments_move_with_their_pattern() {
+        let content = "// local\n*.local\n\n// build output\nbuild\n*.tmp\n";
+        let adoption = split(content, Some("#include .stignore_sync\n"), |p| {
+            p == "*.local"
+        });
+        assert_eq!(
+            adoption.kept,
+            "// local\n*.local\n\n#include .stignore_sync\n"
+        );
+        assert_eq!(adoption.moved, "// build output\nbuild\n*.tmp\n");
+    }
+
+    #[test]
+    fn includes_stay_and_line_endings_are_kept() {
+        let content = "#include other\r\n*.tmp";
+        let adoption = split(content, None, |_| false);
+        assert_eq!(adoption.kept, "#include other\r\n");
+        assert_eq!(adoption.moved, "*.tmp\r\n");
+    }
+}
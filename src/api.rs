@@ -0,0 +1,618 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::{bail, Context, Result};
+use reqwest::{
+    blocking::{Client as HttpClient, RequestBuilder},
+    Certificate, Identity, StatusCode,
+};
+use serde_json::Value;
+
+use crate::files;
+
+/// Client of the Syncthing REST API (https://docs.syncthing.net/dev/rest)
+pub struct Client {
+    http: HttpClient,
+    url: String,
+    key: String,
+}
+
+/// TLS settings for connecting to remote Syncthing instances
+pub struct Tls {
+    /// Accept self-signed and otherwise invalid certificates
+    pub insecure: bool,
+    /// Additional root certificate (PEM), e.g. Syncthing's https-cert.pem
+    pub ca_cert: Option<PathBuf>,
+    /// Client certificate and key (PEM) for authenticating to a proxy
+    pub client_cert: Option<(PathBuf, PathBuf)>,
+}
+
+/// Device from Syncthing's configuration
+pub struct Device {
+    pub id: String,
+    /// Configured name, or the first part of the ID if there is none
+    pub name: String,
+}
+
+/// Folder from Syncthing's configuration
+pub struct Folder {
+    pub id: String,
+    pub label: String,
+    pub path: PathBuf,
+}
+
+impl Client {
+    pub fn new(url: &str, key: &str, tls: &Tls) -> Result<Self> {
+        let read = |path: &Path| {
+            std::fs::read(path).with_context(|| format!("Can't read {}", path.display()))
+        };
+        let mut builder = HttpClient::builder().danger_accept_invalid_certs(tls.insecure);
+        if let Some(path) = &tls.ca_cert {
+            let cert = Certificate::from_pem(&read(path)?)
+                .with_context(|| format!("Invalid certificate {}", path.display()))?;
+            builder = builder.add_root_certificate(cert);
+        }
+        if let Some((cert, key)) = &tls.client_cert {
+            let mut pem = read(cert)?;
+            pem.extend(read(key)?);
+            let identity = Identity::from_pem(&pem)
+                .with_context(|| format!("Invalid client certificate {}", cert.display()))?;
+            builder = builder.identity(identity);
+        }
+        Ok(Client {
+            http: builder.build().context("Can't create HTTP client")?,
+            url: url.trim_end_matches('/').to_owned(),
+            key: key.to_owned(),
+        })
+    }
+
+    fn request(&self, request: RequestBuilder, endpoint: &str) -> Result<(StatusCode, String)> {
+        let response = request
+            .header("X-API-Key", &self.key)
+            .send()
+            .with_context(|| format!("Can't connect to Syncthing at {}", self.url))?;
+        let status = response.status();
+        let body = response
+            .text()
+            .with_context(|| format!("Can't read response of {endpoint}"))?;
+        Ok((status, body))
+    }
+
+    fn send(&self, request: RequestBuilder, endpoint: &str) -> Result<Value> {
+        let (status, body) = self.request(request, endpoint)?;
+        if !status.is_success() {
+            bail!("{endpoint} failed with {status}: {}", body.trim());
+        }
+        if body.trim().is_empty() {
+            return Ok(Value::Null);
+        }
+        serde_json::from_str(&body).with_context(|| format!("Invalid response of {endpoint}"))
+    }
+
+    fn get(&self, endpoint: &str, query: &[(&str, &str)]) -> Result<Value> {
+        let url = format!("{}{endpoint}", self.url);
+        self.send(self.http.get(&url).query(query), endpoint)
+    }
+
+    fn post(&self, endpoint: &str, query: &[(&str, &str)], body: &Value) -> Result<Value> {
+        let url = format!("{}{endpoint}", self.url);
+        let body = serde_json::to_string(body).context("Can't serialize request")?;
+        self.send(self.http.post(&url).query(query).body(body), endpoint)
+    }
+
+    fn patch(&self, endpoint: &str, body: &Value) -> Result<Value> {
+        let url = format!("{}{endpoint}", self.url);
+        let body = serde_json::to_string(body).context("Can't serialize request")?;
+        self.send(self.http.patch(&url).body(body), endpoint)
+    }
+
+    /// Folders configured in Syncthing
+    pub fn folders(&self) -> Result<Vec<Folder>> {
+        let folders = self.get("/rest/config/folders", &[])?;
+        let folders = folders
+            .as_array()
+            .context("Invalid response of /rest/config/folders")?;
+        Ok(folders
+            .iter()
+            .map(|f| Folder {
+                id: f["id"].as_str().unwrap_or_default().to_owned(),
+                label: f["label"].as_str().unwrap_or_default().to_owned(),
+                path: expand_home(f["path"].as_str().unwrap_or_default()),
+            })
+            .collect())
+    }
+
+    /// Lines of the folder's .stignore, as written in the file
+    pub fn ignores(&self, folder: &str) -> Result<Vec<String>> {
+        self.ignores_field(folder, "ignore")
+    }
+
+    /// Patterns Syncthing evaluates for the folder, with includes expanded
+    pub fn effective_ignores(&self, folder: &str) -> Result<Vec<String>> {
+        self.ignores_field(folder, "expanded")
+    }
+
+    fn ignores_field(&self, folder: &str, field: &str) -> Result<Vec<String>> {
+        let ignores = self.get("/rest/db/ignores", &[("folder", folder)])?;
+        Ok(match ignores[field].as_array() {
+            Some(lines) => lines
+                .iter()
+                .filter_map(|l| l.as_str().map(str::to_owned))
+                .collect(),
+            // folder without .stignore
+            None => Vec::new(),
+        })
+    }
+
+    /// Replaces the folder's .stignore, Syncthing reloads the patterns
+    /// (including the ones from included files) immediately
+    pub fn set_ignores(&self, folder: &str, lines: &[String]) -> Result<()> {
+        let mut body = serde_json::Map::new();
+        body.insert("ignore".to_owned(), Value::from(lines.to_vec()));
+        self.post(
+            "/rest/db/ignores",
+            &[("folder", folder)],
+            &Value::from(body),
+        )?;
+        Ok(())
+    }
+
+    /// Checks if Syncthing considers the file ignored, `None` if Syncthing
+    /// doesn't know about the file
+    pub fn is_ignored(&self, folder: &str, file: &str) -> Result<Option<bool>> {
+        let endpoint = "/rest/db/file";
+        let url = format!("{}{endpoint}", self.url);
+        let request = self
+            .http
+            .get(&url)
+            .query(&[("folder", folder), ("file", file)]);
+        let (status, body) = self.request(request, endpoint)?;
+        if status == StatusCode::NOT_FOUND {
+            return Ok(None);
+        }
+        if !status.is_success() {
+            bail!("{endpoint} failed with {status}: {}", body.trim());
+        }
+        let info: Value = serde_json::from_str(&body)
+            .with_context(|| format!("Invalid response of {endpoint}"))?;
+        Ok(info["local"]["ignored"].as_bool())
+    }
+
+    /// Paths Syncthing hasn't synchronized yet: items it still needs to pull
+    /// and items that failed to sync, relative to the folder root
+    pub fn out_of_sync(&self, folder: &str) -> Result<Vec<String>> {
+        let mut names = Vec::new();
+        let need = self.get("/rest/db/need", &[("folder", folder)])?;
+        for section in ["progress", "queued", "rest"] {
+            let items = need[section]
+                .as_array()
+                .map(Vec::as_slice)
+                .unwrap_or_default();
+            names.extend(items.iter().filter_map(|i| i["name"].as_str()));
+        }
+        let errors = self.get("/rest/folder/errors", &[("folder", folder)])?;
+        let errors = errors["errors"]
+            .as_array()
+            .map(Vec::as_slice)
+            .unwrap_or_default();
+        names.extend(errors.iter().filter_map(|e| e["path"].as_str()));
+
+        let mut paths: Vec<String> = Vec::new();
+        for name in names {
+            let path = name.replace('\\', "/");
+            if !paths.contains(&path) {
+                paths.push(path);
+            }
+        }
+        Ok(paths)
+    }
+
+    /// Asks Syncthing to rescan the folder, or only `sub` path inside of it
+    pub fn scan(&self, folder: &str, sub: Option<&str>) -> Result<()> {
+        let mut query = vec![("folder", folder)];
+        if let Some(sub) = sub {
+            query.push(("sub", sub));
+        }
+        self.post("/rest/db/scan", &query, &Value::Null)?;
+        Ok(())
+    }
+
+    pub fn is_paused(&self, folder: &str) -> Result<bool> {
+        let config = self.get(&format!("/rest/config/folders/{folder}"), &[])?;
+        Ok(config["paused"].as_bool().unwrap_or(false))
+    }
+
+    /// Pauses or resumes the folder
+    pub fn set_paused(&self, folder: &str, paused: bool) -> Result<()> {
+        let mut body = serde_json::Map::new();
+        body.insert("paused".to_owned(), Value::from(paused));
+        self.patch(
+            &format!("/rest/config/folders/{folder}"),
+            &Value::from(body),
+        )?;
+        Ok(())
+    }
+
+    pub fn is_receive_only(&self, folder: &str) -> Result<bool> {
+        let config = self.get(&format!("/rest/config/folders/{folder}"), &[])?;
+        Ok(config["type"].as_str() == Some("receiveonly"))
+    }
+
+    /// Files of a receive-only folder changed on this device
+    pub fn local_changes(&self, folder: &str) -> Result<Vec<String>> {
+        let changed = self.get("/rest/db/localchanged", &[("folder", folder)])?;
+        let files = changed["files"]
+            .as_array()
+            .map(Vec::as_slice)
+            .unwrap_or_default();
+        Ok(files
+            .iter()
+            .filter_map(|f| f["name"].as_str().map(str::to_owned))
+            .collect())
+    }
+
+    /// Reverts local changes of a receive-only folder: files added on this
+    /// device are deleted, changed and deleted ones are fetched again
+    pub fn revert(&self, folder: &str) -> Result<()> {
+        self.post("/rest/db/revert", &[("folder", folder)], &Value::Null)?;
+        Ok(())
+    }
+
+    /// Device running this Syncthing instance
+    pub fn this_device(&self) -> Result<Device> {
+        let status = self.get("/rest/system/status", &[])?;
+        let id = status["myID"]
+            .as_str()
+            .context("Invalid response of /rest/system/status")?;
+        let config = self.get(&format!("/rest/config/devices/{id}"), &[])?;
+        Ok(device(id, &config))
+    }
+
+    /// Devices the folder is shared with, including this one
+    pub fn folder_devices(&self, folder: &str) -> Result<Vec<Device>> {
+        let config = self.get(&format!("/rest/config/folders/{folder}"), &[])?;
+        let devices = self.get("/rest/config/devices", &[])?;
+        let devices = devices.as_array().map(Vec::as_slice).unwrap_or_default();
+        let shared = config["devices"]
+            .as_array()
+            .map(Vec::as_slice)
+            .unwrap_or_default();
+        Ok(shared
+            .iter()
+            .filter_map(|d| d["deviceID"].as_str())
+            .map(
+                |id| match devices.iter().find(|d| d["deviceID"].as_str() == Some(id)) {
+                    Some(config) => device(id, config),
+                    None => device(id, &Value::Null),
+                },
+            )
+            .collect())
+    }
+
+    /// Finds the folder by its ID or label
+    pub fn folder_named(&self, name: &str) -> Result<Folder> {
+        find_folder(self.folders()?, name)
+    }
+
+    /// Finds the folder located at `path`
+    pub fn folder_at(&self, path: &Path) -> Result<Folder> {
+        let path = files::canonicalize(path).unwrap_or_else(|_| path.to_owned());
+        self.folders()?
+            .into_iter()
+            .find(|f| files::canonicalize(&f.path).unwrap_or_else(|_| f.path.clone()) == path)
+            .with_context(|| format!("Syncthing has no folder at {}", path.display()))
+    }
+}
+
+fn device(id: &str, config: &Value) -> Device {
+    let name = match config["name"].as_str() {
+        Some(name) if !name.is_empty() => name,
+        _ => id.split('-').next().unwrap_or(id),
+    };
+    Device {
+        id: id.to_owned(),
+        name: name.to_owned(),
+    }
+}
+
+/// Picks the folder with the ID or label
+pub fn find_folder(folders: Vec<Folder>, name: &str) -> Result<Folder> {
+    let mut found: Vec<Folder> = folders
+        .into_iter()
+        .filter(|f| f.id == name || f.label == name)
+        .collect();
+    match found.len() {
+        0 => bail!("Syncthing has no folder with ID or label {name}"),
+        1 => Ok(found.remove(0)),
+        _ => bail!(
+            "Several folders are labeled {name}, use the ID instead: {}",
+            found
+                .iter()
+                .map(|f| f.id.as_str())
+                .collect::<Vec<_>>()
+                .join(", ")
+        ),
+    }
+}
+
+/// Syncthing allows folder paths starting with `~`
+pub fn expand_home(path: &str) -> PathBuf {
+    let home = std::env::var_os(if cfg!(windows) { "USERPROFILE" } else { "HOME" });
+    match (path.strip_prefix('~'), home) {
+        (Some(rest), Some(home)) => Path::new(&home).join(rest.trim_start_matches(['/', '\\'])),
+        _ => PathBuf::from(path),
+    }
+}
+
+/// Fake Syncthing REST API for tests
+#[cfg(test)]
+pub mod fake {
+    use std::{
+        io::{BufRead, BufReader, Read, Write},
+        net::{TcpListener, TcpStream},
+        sync::{Arc, Mutex},
+    };
+
+    use super::{Client, Tls};
+
+    /// Request received by the fake
+    #[derive(Clone, Debug)]
+    pub struct Request {
+        pub method: String,
+        pub path: String,
+        pub query: Vec<(String, String)>,
+        pub key: String,
+        pub body: String,
+    }
+
+    impl Request {
+        /// Value of the query parameter
+        pub fn param(&self, name: &str) -> Option<&str> {
+            self.query
+                .iter()
+                .find(|(n, _)| n == name)
+                .map(|(_, v)| v.as_str())
+        }
+    }
+
+    /// Syncthing listening on a local port, `respond` returns the status and
+    /// the body of the response to each request
+    pub struct Syncthing {
+        pub url: String,
+        requests: Arc<Mutex<Vec<Request>>>,
+    }
+
+    impl Syncthing {
+        pub fn start(respond: impl Fn(&Request) -> (u16, String) + Send + 'static) -> Syncthing {
+            let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+            let url = format!("http://{}", listener.local_addr().unwrap());
+            let requests = Arc::new(Mutex::new(Vec::new()));
+            let received = requests.clone();
+            std::thread::spawn(move || {
+                for mut stream in listener.incoming().flatten() {
+                    let Some(request) = read(&mut stream) else {
+                        continue;
+                    };
+                    let (status, body) = respond(&request);
+                    received.lock().unwrap().push(request);
+                    write!(
+                        stream,
+                        "HTTP/1.1 {status} Fake\r\nContent-Type: application/json\r\n\
+                        Content-Length: {}\r\nConnection: close\r\n\r\n{body}",
+                        body.len()
+                    )
+                    .ok();
+                }
+            });
+            Syncthing { url, requests }
+        }
+
+        pub fn client(&self) -> Client {
+            let tls = Tls {
+                insecure: false,
+                ca_cert: None,
+                client_cert: None,
+            };
+            Client::new(&self.url, "key", &tls).unwrap()
+        }
+
+        /// Requests received so far, in order
+        pub fn requests(&self) -> Vec<Request> {
+            self.requests.lock().unwrap().clone()
+        }
+    }
+
+    fn read(stream: &mut TcpStream) -> Option<Request> {
+        let mut reader = BufReader::new(stream);
+        let mut line = String::new();
+        reader.read_line(&mut line).ok()?;
+        let mut parts = line.split_whitespace();
+        let method = parts.next()?.to_owned();
+        let target = parts.next()?.to_owned();
+        let (path, query) = target.split_once('?').unwrap_or((&target, ""));
+        let mut length = 0;
+        let mut key = String::new();
+        loop {
+            line.clear();
+            reader.read_line(&mut line).ok()?;
+            let Some((name, value)) = line.trim_end().split_once(':') else {
+                break;
+            };
+            match name.to_ascii_lowercase().as_str() {
+                "content-length" => length = value.trim().parse().ok()?,
+                "x-api-key" => key = value.trim().to_owned(),
+                _ => {}
+            }
+        }
+        let mut body = vec![0; length];
+        reader.read_exact(&mut body).ok()?;
+        Some(Request {
+            method,
+            path: decode(path),
+            query: query
+                .split('&')
+                .filter(|p| !p.is_empty())
+                .map(|p| {
+                    let (name, value) = p.split_once('=').unwrap_or((p, ""));
+                    (decode(name), decode(value))
+                })
+                .collect(),
+            key,
+            body: String::from_utf8_lossy(&body).into_owned(),
+        })
+    }
+
+    /// Decodes `%XX` escapes and `+` of URLs
+    fn decode(s: &str) -> String {
+        let mut bytes = Vec::new();
+        let mut rest = s.as_bytes();
+        while let Some((&b, tail)) = rest.split_first() {
+            rest = tail;
+            match b {
+                b'+' => bytes.push(b' '),
+                b'%' if rest.len() >= 2 => {
+                    let hex = std::str::from_utf8(&rest[..2]).unwrap_or_default();
+                    bytes.push(u8::from_str_radix(hex, 16).unwrap_or(b'%'));
+                    rest = &rest[2..];
+                }
+                b => bytes.push(b),
+            }
+        }
+        String::from_utf8_lossy(&bytes).into_owned()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{fake::Syncthing, *};
+
+    #[test]
+    fn ignores_are_read_and_replaced() {
+        let syncthing = Syncthing::start(|r| match r.method.as_str() {
+            "GET" => (
+                200,
+                serde_json::json!({
+                    "ignore": ["#include .stignore_sync", "*.tmp"],
+                    "expanded": ["*.tmp", "*.log"]
+                })
+                .to_string(),
+            ),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        assert_eq!(
+            api.ignores("photos").unwrap(),
+            ["#include .stignore_sync", "*.tmp"]
+        );
+        assert_eq!(api.effective_ignores("photos").unwrap(), ["*.tmp", "*.log"]);
+        api.set_ignores("photos", &["*.tmp".to_owned(), "build".to_owned()])
+            .unwrap();
+        let requests = syncthing.requests();
+        assert!(requests.iter().all(|r| r.key == "key"));
+        assert!(requests
+            .iter()
+            .all(|r| r.path == "/rest/db/ignores" && r.param("folder") == Some("photos")));
+        let posted: Value = serde_json::from_str(&requests[2].body).unwrap();
+        assert_eq!(requests[2].method, "POST");
+        assert_eq!(posted["ignore"], Value::from(vec!["*.tmp", "build"]));
+    }
+
+    #[test]
+    fn errors_of_syncthing_are_reported() {
+        let syncthing = Syncthing::start(|_| (403, "CSRF Error".to_owned()));
+        let e = syncthing.client().ignores("photos").unwrap_err();
+        assert!(format!("{e:#}").contains("CSRF Error"), "{e:#}");
+    }
+
+    #[test]
+    fn folders_are_found_by_id_label_or_path() {
+        let dir = std::env::temp_dir().join(format!("stignore-api-folders-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.to_string_lossy().into_owned();
+        let syncthing = Syncthing::start(move |_| {
+            let folders = serde_json::json!([
+                { "id": "abcd-1234", "label": "Photos", "path": path },
+                { "id": "efgh-5678", "label": "Music", "path": "~/Music" },
+                { "id": "ijkl-9012", "label": "Music", "path": "/srv/music" },
+            ]);
+            (200, folders.to_string())
+        });
+        let api = syncthing.client();
+        let folders = api.folders().unwrap();
+        assert_eq!(folders.len(), 3);
+        assert_eq!(folders[1].path, expand_home("~/Music"));
+        assert_ne!(folders[1].path, Path::new("~/Music"));
+        assert_eq!(api.folder_named("Photos").unwrap().id, "abcd-1234");
+        assert_eq!(
+            api.folder_named("ijkl-9012").unwrap().path,
+            Path::new("/srv/music")
+        );
+        let e = api.folder_named("Music").err().unwrap().to_string();
+        assert!(e.contains("efgh-5678, ijkl-9012"), "{e}");
+        assert!(api.folder_named("Videos").is_err());
+        assert_eq!(api.folder_at(&dir).unwrap().id, "abcd-1234");
+        assert!(api.folder_at(Path::new("/srv")).is_err());
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn out_of_sync_items_are_merged() {
+        let syncthing = Syncthing::start(|r| match r.path.as_str() {
+            "/rest/db/need" => (
+                200,
+                serde_json::json!({
+                    "progress": [{ "name": "video.mkv" }],
+                    "queued": [],
+                    "rest": [{ "name": "raw\\1.cr2" }, { "name": "video.mkv" }],
+                })
+                .to_string(),
+            ),
+            "/rest/folder/errors" => (
+                200,
+                serde_json::json!({ "errors": [{ "path": "locked.db", "error": "denied" }] })
+                    .to_string(),
+            ),
+            _ => (404, String::new()),
+        });
+        assert_eq!(
+            syncthing.client().out_of_sync("photos").unwrap(),
+            ["video.mkv", "raw/1.cr2", "locked.db"]
+        );
+    }
+
+    #[test]
+    fn receive_only_folders_are_reverted() {
+        let syncthing = Syncthing::start(|r| match r.path.as_str() {
+            "/rest/config/folders/photos" => (
+                200,
+                serde_json::json!({ "id": "photos", "type": "receiveonly" }).to_string(),
+            ),
+            "/rest/config/folders/music" => (
+                200,
+                serde_json::json!({ "id": "music", "type": "sendreceive" }).to_string(),
+            ),
+            "/rest/db/localchanged" => (
+                200,
+                serde_json::json!({ "files": [{ "name": ".DS_Store" }, { "name": "a/b.tmp" }] })
+                    .to_string(),
+            ),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        assert!(api.is_receive_only("photos").unwrap());
+        assert!(!api.is_receive_only("music").unwrap());
+        assert_eq!(
+            api.local_changes("photos").unwrap(),
+            [".DS_Store", "a/b.tmp"]
+        );
+        api.revert("photos").unwrap();
+        let revert = syncthing.requests().pop().unwrap();
+        assert_eq!(
+            (
+                revert.method.as_str(),
+                revert.path.as_str(),
+                revert.param("folder")
+            ),
+            ("POST", "/rest/db/revert", Some("photos"))
+        );
+    }
+}
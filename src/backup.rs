@@ -0,0 +1,327 @@
+use std::path::{Component, Path};
+
+use anyhow::Result;
+use regex::Regex;
+
+use crate::{add, api, find_syncthing_dir, read_to_string, AddOptions};
+
+/// Result of converting exclude patterns of backup tools
+pub struct Imported {
+    pub patterns: Vec<String>,
+    /// Lines that couldn't be converted, with the reason
+    pub skipped: Vec<String>,
+}
+
+/// Location of an absolute exclude pattern within the syncthing folder
+enum Relocated {
+    /// Pattern anchored to the folder root
+    Anchored(String),
+    /// Pattern matching at any depth inside of the folder
+    Anywhere(String),
+}
+
+impl Relocated {
+    fn map(self, f: impl FnOnce(&str) -> String) -> Self {
+        match self {
+            Relocated::Anchored(p) => Relocated::Anchored(f(&p)),
+            Relocated::Anywhere(p) => Relocated::Anywhere(f(&p)),
+        }
+    }
+
+    fn into_pattern(self) -> String {
+        match self {
+            // leading `**/` matches zero or more directories, same as no anchor
+            Relocated::Anchored(p) => match p.strip_prefix("**/") {
+                Some(p) => p.to_owned(),
+                None => format!("/{p}"),
+            },
+            Relocated::Anywhere(p) => p,
+        }
+    }
+}
+
+const OUTSIDE: &str = "outside of syncthing folder";
+
+/// Converts borgbackup's `--exclude-from` or `--patterns-from` file.
+///
+/// Borg matches patterns against absolute paths, so only patterns pointing
+/// inside of the syncthing folder `root` (or starting with a wildcard) are
+/// converted. `fm:` (default for plain exclude lines), `sh:`, `pp:` and `pf:`
+/// styles are supported, `re:` patterns are skipped.
+pub fn import_borg(content: &str, root: &Path) -> Imported {
+    let root = root_components(root);
+    let mut imported = Imported {
+        patterns: Vec::new(),
+        skipped: Vec::new(),
+    };
+    // default style of prefixed lines in --patterns-from files, changed with `P`
+    let mut default_style = "sh";
+
+    for line in content.lines() {
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        if let Some(comment) = line.strip_prefix('#') {
+            imported.patterns.push(format!("//{comment}"));
+            continue;
+        }
+        if let Some(style) = line.strip_prefix("P ") {
+            default_style = match style.trim() {
+                "fm" => "fm",
+                "sh" => "sh",
+                "pp" => "pp",
+                "pf" => "pf",
+                "re" => "re",
+                _ => {
+                    imported.skipped.push(format!("{line} (unknown style)"));
+                    default_style
+                }
+            };
+            continue;
+        }
+        if line.starts_with("R ") {
+            // recursion roots are irrelevant for ignores
+            continue;
+        }
+
+        let (negated, pattern, style) = match line.split_at(line.len().min(2)) {
+            ("+ ", rest) => (true, rest.trim_start(), default_style),
+            ("- " | "! ", rest) => (false, rest.trim_start(), default_style),
+            _ => (false, line, "fm"),
+        };
+        let (style, pattern) = match pattern.split_once(':') {
+            Some((s @ ("fm" | "sh" | "pp" | "pf" | "re"), p)) => (s, p),
+            _ => (style, pattern),
+        };
+
+        let relocated = match style {
+            "re" => {
+                imported
+                    .skipped
+                    .push(format!("{line} (regular expressions aren't supported)"));
+                continue;
+            }
+            "pp" | "pf" => relocate(&escape_glob(pattern), &root),
+            "fm" => match pattern.trim_start_matches('/') {
+                p if p.starts_with('*') => {
+                    let p = p.trim_start_matches('*');
+                    Some(Relocated::Anywhere(match p.strip_prefix('/') {
+                        Some(rest) => fnmatch_to_glob(rest),
+                        None => fnmatch_to_glob(&format!("*{p}")),
+                    }))
+                }
+                _ => relocate(pattern, &root).map(|r| r.map(fnmatch_to_glob)),
+            },
+            _ => relocate(pattern, &root),
+        };
+        match relocated {
+            Some(Relocated::Anywhere(p) | Relocated::Anchored(p)) if p.is_empty() => imported
+                .skipped
+                .push(format!("{line} (matches the whole folder)")),
+            Some(r) => imported.patterns.push(format!(
+                "{}{}",
+                if negated { "!" } else { "" },
+                r.into_pattern()
+            )),
+            None => imported.skipped.push(format!("{line} ({OUTSIDE})")),
+        }
+    }
+    imported
+}
+
+/// Converts restic's `--exclude-file`.
+///
+/// Relative restic patterns match at any depth, just like unanchored
+/// syncthing ones; absolute patterns are converted if they point inside of
+/// the syncthing folder `root`. Environment variables are expanded as restic
+/// does.
+pub fn import_restic(content: &str, root: &Path) -> Imported {
+    let root = root_components(root);
+    let mut imported = Imported {
+        patterns: Vec::new(),
+        skipped: Vec::new(),
+    };
+
+    for line in content.lines() {
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        if let Some(comment) = line.strip_prefix('#') {
+            imported.patterns.push(format!("//{comment}"));
+            continue;
+        }
+        let (negated, pattern) = match line.strip_prefix('!') {
+            Some(p) => ("!", p),
+            None => ("", line),
+        };
+        let pattern = expand_env(pattern);
+        let pattern = pattern.trim_end_matches('/');
+
+        if !pattern.starts_with('/') {
+            imported.patterns.push(format!("{negated}{pattern}"));
+            continue;
+        }
+        match relocate(pattern, &root) {
+            Some(Relocated::Anywhere(p) | Relocated::Anchored(p)) if p.is_empty() => imported
+                .skipped
+                .push(format!("{line} (matches the whole folder)")),
+            Some(r) => imported
+                .patterns
+                .push(format!("{negated}{}", r.into_pattern())),
+            None => imported.skipped.push(format!("{line} ({OUTSIDE})")),
+        }
+    }
+    imported
+}
+
+fn root_components(root: &Path) -> Vec<String> {
+    root.components()
+        .filter_map(|c| match c {
+            Component::Normal(c) => Some(c.to_string_lossy().into_owned()),
+            _ => None,
+        })
+        .collect()
+}
+
+/// Matches leading components of absolute `pattern` against the folder root
+/// and returns the rest of the pattern relative to it
+fn relocate(pattern: &str, root: &[String]) -> Option<Relocated> {
+    let components: Vec<&str> = pattern.split('/').filter(|c| !c.is_empty()).collect();
+    for (i, root_component) in root.iter().enumerate() {
+        match components.get(i) {
+            // `**` may swallow the root and any of its subdirectories
+            Some(&"**") => return Some(Relocated::Anywhere(components[i + 1..].join("/"))),
+            Some(c) if component_matches(c, root_component) => continue,
+            _ => return None,
+        }
+    }
+    Some(Relocated::Anchored(components[root.len()..].join("/")))
+}
+
+/// Matches a single path component against a glob
+fn component_matches(glob: &str, name: &str) -> bool {
+    let mut re = String::from("^");
+    let mut chars = glob.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' => re.push_str(".*"),
+            '?' => re.push('.'),
+            '\\' => re.push_str(&regex::escape(&chars.next().unwrap_or('\\').to_string())),
+            '[' => {
+                let class: String = chars.by_ref().take_while(|&c| c != ']').collect();
+                let class = class.replace('\\', "\\\\");
+                re.push('[');
+                match class.strip_prefix('!') {
+                    Some(negated) => {
+                        re.push('^');
+                        re.push_str(negated);
+                    }
+                    None => re.push_str(&class),
+                }
+                re.push(']');
+            }
+            c => re.push_str(&regex::escape(&c.to_string())),
+        }
+    }
+    re.push('$');
+    Regex::new(&re).map_or(glob == name, |re| re.is_match(name))
+}
+
+/// Unlike syncthing's `*`, fnmatch wildcard matches path separators as well
+fn fnmatch_to_glob(pattern: &str) -> String {
+    if pattern.contains('/') {
+        Regex::new(r"\*+")
+            .unwrap()
+            .replace_all(pattern, "**")
+            .into_owned()
+    } else {
+        // unanchored syncthing pattern without slashes matches at any depth
+        pattern.to_owned()
+    }
+}
+
+/// Escapes syncthing glob metacharacters in a literal path
+fn escape_glob(path: &str) -> String {
+    let mut escaped = String::with_capacity(path.len());
+    for c in path.chars() {
+        if matches!(c, '*' | '?' | '[' | ']' | '{' | '}' | '\\') {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+/// Expands `$VAR` and `${VAR}`, unset variables expand to empty strings
+fn expand_env(s: &str) -> String {
+    let re = Regex::new(r"\$(?:\{(\w+)\}|(\w+))").unwrap();
+    re.replace_all(s, |c: &regex::Captures| {
+        let name = c.get(1).or_else(|| c.get(2)).unwrap().as_str();
+        std::env::var(name).unwrap_or_default()
+    })
+    .into_owned()
+}
+
+/// Adds the exclude patterns of a backup tool from `file`, converted by
+/// `convert`, e.g. [import_borg]
+pub fn import(
+    file: &Path,
+    convert: fn(&str, &Path) -> Imported,
+    opts: &AddOptions,
+    api: Option<&api::Client>,
+    silent: bool,
+) -> Result<()> {
+    let content = read_to_string(file)?;
+    let (st_dir, _) = find_syncthing_dir()?;
+    let imported = convert(&content, &st_dir);
+    if !silent && !imported.skipped.is_empty() {
+        eprintln!("NOTE: skipped patterns:\n{}", imported.skipped.join("\n"));
+    }
+    // converted patterns are already relative to the folder root
+    add(&imported.patterns, true, opts, api, silent)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn root() -> std::path::PathBuf {
+        Path::new(Component::RootDir.as_os_str()).join("home/me/sync")
+    }
+
+    #[test]
+    fn borg_patterns_inside_of_folder() {
+        let content = "# build output\n\
+            /home/me/sync/build\n\
+            *.pyc\n\
+            /home/me/other/x\n\
+            re:^/home/.*\\.tmp$\n\
+            sh:/home/me/sync/**/cache\n\
+            + pp:/home/me/sync/keep\n\
+            /home/me/sync\n";
+        let imported = import_borg(content, &root());
+        assert_eq!(
+            imported.patterns,
+            ["// build output", "/build", "*.pyc", "cache", "!/keep"]
+        );
+        assert_eq!(imported.skipped.len(), 3);
+    }
+
+    #[test]
+    fn restic_patterns() {
+        std::env::set_var("STIGNORE_TEST_RESTIC_ROOT", root());
+        let content = "*.tmp\n\
+            !/home/me/sync/keep\n\
+            /home/me/sync/cache/\n\
+            ${STIGNORE_TEST_RESTIC_ROOT}/x\n\
+            /etc/passwd\n";
+        let imported = import_restic(content, &root());
+        assert_eq!(imported.patterns, ["*.tmp", "!/keep", "/cache", "/x"]);
+        assert_eq!(
+            imported.skipped,
+            ["/etc/passwd (outside of syncthing folder)"]
+        );
+    }
+}
@@ -0,0 +1,158 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{Context, Result};
+use regex::Regex;
+
+use crate::{files, versions};
+
+/// Copy of an ignore file saved by `--backup`, `NAME.bak.YYYYMMDDTHHMMSS`
+pub struct Backup {
+    pub path: PathBuf,
+    /// The file it's a copy of
+    pub original: PathBuf,
+    /// UTC time the backup was made, `YYYYMMDDTHHMMSS`
+    pub created: String,
+}
+
+impl Backup {
+    /// Creation time in a readable form, e.g. `2024-01-01 12:00:00 UTC`
+    pub fn date(&self) -> String {
+        let c = &self.created;
+        format!(
+            "{}-{}-{} {}:{}:{} UTC",
+            &c[..4],
+            &c[4..6],
+            &c[6..8],
+            &c[9..11],
+            &c[11..13],
+            &c[13..15]
+        )
+    }
+}
+
+/// Directory of the backups in a folder, inside of .stfolder which Syncthing
+/// never syncs. Backups of files in subdirectories go to the same
+/// subdirectories of it.
+pub const DIR: &str = ".stfolder/stignore-backups";
+
+/// Directory of the backups of the file: under [DIR] of the innermost folder
+/// containing it (found by any of the `markers`), or next to it outside of
+/// folders
+fn dir_of(file: &Path, markers: &[String]) -> PathBuf {
+    let parent = file.parent().unwrap_or_else(|| Path::new("."));
+    crate::folder_roots_marked(parent, markers)
+        .first()
+        .map_or_else(
+            || parent.to_owned(),
+            |root| {
+                root.join(DIR)
+                    .join(parent.strip_prefix(root).unwrap_or(parent))
+            },
+        )
+}
+
+/// Saves the file's `content` to a timestamped backup and deletes its
+/// oldest backups, keeping `keep` of them. If the file was already backed
+/// up within the same second, the earlier copy is kept.
+pub fn save(file: &Path, content: &[u8], keep: usize) -> Result<()> {
+    let name = file.file_name().unwrap_or_default().to_string_lossy();
+    let dir = dir_of(file, crate::markers());
+    fs::create_dir_all(&dir).with_context(|| format!("Can't create {}", dir.display()))?;
+    let path = dir.join(format!("{name}.bak.{}", timestamp(versions::now())));
+    if !path.exists() {
+        fs::write(&path, content).with_context(|| format!("Can't back up {}", file.display()))?;
+    }
+
+    let parent = file.parent().unwrap_or_else(|| Path::new("."));
+    let mut backups: Vec<Backup> = list_in(&dir, parent)?
+        .into_iter()
+        .filter(|b| b.original == file)
+        .collect();
+    backups.reverse();
+    for old in backups.iter().skip(keep.max(1)) {
+        fs::remove_file(&old.path)
+            .with_context(|| format!("Can't delete {}", old.path.display()))?;
+    }
+    Ok(())
+}
+
+/// Backups of the ignore files of the folder, oldest first
+pub fn list(root: &Path) -> Result<Vec<Backup>> {
+    let dir = root.join(DIR);
+    let mut backups = Vec::new();
+    if dir.is_dir() {
+        for file in files::walk(&dir)? {
+            let Some(parent) = file.parent() else {
+                continue;
+            };
+            let relative = parent.strip_prefix(&dir).unwrap_or(Path::new(""));
+            if let Some(backup) = parse(&file, &root.join(relative)) {
+                backups.push(backup);
+            }
+        }
+    }
+    backups.sort_by(|a, b| (&a.created, &a.path).cmp(&(&b.created, &b.path)));
+    Ok(backups)
+}
+
+/// Backups in the directory of copies of files in `original_dir`, oldest
+/// first
+fn list_in(dir: &Path, original_dir: &Path) -> Result<Vec<Backup>> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Can't read {}", dir.display())),
+    };
+    let mut backups = Vec::new();
+    for entry in entries {
+        let entry = entry.with_context(|| format!("Can't read {}", dir.display()))?;
+        if let Some(backup) = parse(&entry.path(), original_dir) {
+            backups.push(backup);
+        }
+    }
+    backups.sort_by(|a, b| (&a.created, &a.path).cmp(&(&b.created, &b.path)));
+    Ok(backups)
+}
+
+/// Backup at the path, `NAME.bak.YYYYMMDDTHHMMSS` of `original_dir/NAME`
+fn parse(path: &Path, original_dir: &Path) -> Option<Backup> {
+    let re = Regex::new(r"^(.+)\.bak\.(\d{8}T\d{6})$").unwrap();
+    let name = path.file_name()?.to_string_lossy();
+    let c = re.captures(&name)?;
+    Some(Backup {
+        path: path.to_owned(),
+        original: original_dir.join(&c[1]),
+        created: c[2].to_owned(),
+    })
+}
+
+/// `YYYYMMDDTHHMMSS` in UTC for seconds since the Unix epoch
+fn timestamp(secs: u64) -> String {
+    let [year, month, day, h, m, s] = versions::utc(secs);
+    format!("{year:04}{month:02}{day:02}T{h:02}{m:02}{s:02}")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn backups_go_to_folder_found_by_custom_marker() {
+        let root = std::env::temp_dir().join(format!("stignore-backups-{}", std::process::id()));
+        fs::create_dir_all(root.join(".marker")).unwrap();
+        fs::create_dir_all(root.join("sub")).unwrap();
+        let markers = [".stfolder".to_owned(), ".marker".to_owned()];
+        assert_eq!(
+            dir_of(&root.join("sub/.stignore_sub"), &markers),
+            root.join(DIR).join("sub")
+        );
+        assert_eq!(
+            dir_of(&root.join("sub/.stignore_sub"), &markers[..1]),
+            root.join("sub")
+        );
+        fs::remove_dir_all(root).ok();
+    }
+}
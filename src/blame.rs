@@ -0,0 +1,103 @@
+use std::{path::Path, process::Command};
+
+use crate::{journal::Entry, versions};
+
+/// Where a line of an ignore file came from
+pub enum Origin<'a> {
+    /// Operation of stignore that added the line
+    Journal(&'a Entry),
+    /// Commit that added the line, for ignore files kept in git
+    Git {
+        commit: String,
+        author: String,
+        /// Seconds since the Unix epoch
+        time: u64,
+        summary: String,
+    },
+}
+
+impl Origin<'_> {
+    /// Date, device or author, and command or commit summary
+    pub fn describe(&self) -> String {
+        let date = |secs| versions::format_utc(secs)[..10].to_owned();
+        match self {
+            Origin::Journal(e) => format!("{} {}: {}", date(e.time), e.host, e.command),
+            Origin::Git {
+                commit,
+                author,
+                time,
+                summary,
+            } => format!("{} {author}: git {} {summary}", date(*time), &commit[..8]),
+        }
+    }
+}
+
+/// Origins of the lines of the file (with symlinks resolved): the latest
+/// operation of the journal that added the line, otherwise the commit of
+/// `git blame`
+pub fn blame<'a>(path: &Path, content: &str, journal: &'a [Entry]) -> Vec<Option<Origin<'a>>> {
+    let mut git = None;
+    content
+        .lines()
+        .enumerate()
+        .map(|(i, line)| {
+            let line = line.trim();
+            if let Some(entry) = journal.iter().rev().find(|e| added(e, path, line)) {
+                return Some(Origin::Journal(entry));
+            }
+            git.get_or_insert_with(|| git_blame(path))
+                .get_mut(i)
+                .and_then(Option::take)
+        })
+        .collect()
+}
+
+/// Checks if the operation added the line to the file
+fn added(entry: &Entry, path: &Path, line: &str) -> bool {
+    entry.changes.iter().any(|c| {
+        c.path == path && c.added_lines().contains(&line) && !c.removed_lines().contains(&line)
+    })
+}
+
+/// Commits of the file's lines, empty if it isn't in a git repository
+fn git_blame(path: &Path) -> Vec<Option<Origin<'static>>> {
+    let (Some(dir), Some(name)) = (path.parent(), path.file_name()) else {
+        return Vec::new();
+    };
+    let output = match Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(["blame", "--line-porcelain", "--"])
+        .arg(name)
+        .output()
+    {
+        Ok(output) if output.status.success() => output,
+        _ => return Vec::new(),
+    };
+
+    let mut lines = Vec::new();
+    let (mut commit, mut author, mut time) = (String::new(), String::new(), 0);
+    for line in String::from_utf8_lossy(&output.stdout).lines() {
+        if let Some(summary) = line.strip_prefix("summary ") {
+            // uncommitted lines have a zero hash
+            let committed = !commit.trim_matches('0').is_empty();
+            lines.push(committed.then(|| Origin::Git {
+                commit: commit.clone(),
+                author: author.clone(),
+                time,
+                summary: summary.to_owned(),
+            }));
+        } else if let Some(name) = line.strip_prefix("author ") {
+            author = name.to_owned();
+        } else if let Some(t) = line.strip_prefix("author-time ") {
+            time = t.parse().unwrap_or_default();
+        } else {
+            // each line starts with a header: hash, original and final line numbers
+            let first = line.split(' ').next().unwrap_or_default();
+            if first.len() >= 40 && first.chars().all(|c| c.is_ascii_hexdigit()) {
+                commit = first.to_owned();
+            }
+        }
+    }
+    lines
+}
@@ -0,0 +1,85 @@
+use clap_complete::Shell;
+
+/// Completes values clap doesn't know about, like folder labels and
+/// patterns, by asking `stignore __complete`, and falls back to the
+/// generated completion otherwise
+const BASH: &str = r#"
+_stignore_dynamic() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" values=
+    case "$prev" in
+        --folder) values=folders ;;
+        -F|--fragment) values=fragments ;;
+        -t|--target) values=targets ;;
+        --profile) values=profiles ;;
+        *)
+            if [[ "$cur" != -* ]]; then
+                case "${COMP_WORDS[1]}" in
+                    promote) values=stignore ;;
+                    demote) values=stignore-sync ;;
+                esac
+            fi
+            ;;
+    esac
+    if [[ -z "$values" ]]; then
+        _stignore "$@"
+        return
+    fi
+    # mapfile keeps patterns from being expanded as globs
+    local IFS=$'\n'
+    mapfile -t COMPREPLY < <(compgen -W "$(stignore __complete "$values" 2>/dev/null)" -- "$cur")
+}
+complete -F _stignore_dynamic -o bashdefault -o default stignore
+"#;
+
+const ZSH: &str = r#"
+_stignore_dynamic() {
+    local values
+    case "${words[CURRENT-1]}" in
+        --folder) values=folders ;;
+        -F|--fragment) values=fragments ;;
+        -t|--target) values=targets ;;
+        --profile) values=profiles ;;
+        *)
+            if [[ "${words[CURRENT]}" != -* ]]; then
+                case "${words[2]}" in
+                    promote) values=stignore ;;
+                    demote) values=stignore-sync ;;
+                esac
+            fi
+            ;;
+    esac
+    if [[ -z "$values" ]]; then
+        _stignore "$@"
+        return
+    fi
+    local -a candidates
+    candidates=("${(@f)$(stignore __complete "$values" 2>/dev/null)}")
+    compadd -- "${candidates[@]}"
+}
+compdef _stignore_dynamic stignore
+"#;
+
+const FISH: &str = r#"
+complete -c stignore -l folder -x -a '(stignore __complete folders 2>/dev/null)'
+complete -c stignore -s F -l fragment -x -a '(stignore __complete fragments 2>/dev/null)'
+complete -c stignore -s t -l target -x -a '(stignore __complete targets 2>/dev/null)'
+complete -c stignore -l profile -x -a '(stignore __complete profiles 2>/dev/null)'
+complete -c stignore -n '__fish_seen_subcommand_from promote' -f -a '(stignore __complete stignore 2>/dev/null)'
+complete -c stignore -n '__fish_seen_subcommand_from demote' -f -a '(stignore __complete stignore-sync 2>/dev/null)'
+"#;
+
+/// Adds completion of folders, fragments, targets, profiles and patterns to
+/// the script generated by clap. Other shells get only the static one.
+pub fn dynamic(shell: Shell, script: &str) -> String {
+    match shell {
+        Shell::Bash => format!("{script}{BASH}"),
+        Shell::Fish => format!("{script}{FISH}"),
+        // the script is autoloaded as the _stignore function, completing
+        // right away at its end: the wrapper has to complete instead
+        Shell::Zsh => match script.trim_end().strip_suffix("_stignore \"$@\"") {
+            Some(script) => format!("{script}{}\n_stignore_dynamic \"$@\"\n", ZSH.trim_start()),
+            None => format!("{script}{ZSH}"),
+        },
+        _ => script.to_owned(),
+    }
+}
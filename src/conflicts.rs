@@ -0,0 +1,282 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::{bail, Context, Result};
+use regex::Regex;
+
+use crate::{
+    add, api, assume_yes, confirm_destructive, delete_file, diff, files, find_syncthing_dir,
+    includes, pattern, read_locked, relative, AddOptions, IgnoreFile,
+};
+
+/// File created by Syncthing when a file was changed on several devices,
+/// `name.sync-conflict-YYYYMMDD-HHMMSS-DEVICE.ext`
+pub struct Conflict {
+    pub path: PathBuf,
+    /// The file this one is a conflicting copy of
+    pub original: PathBuf,
+    /// When the conflict happened, `YYYY-MM-DD HH:MM:SS`
+    pub date: String,
+    /// Short ID of the device whose change lost
+    pub device: String,
+    pub size: u64,
+}
+
+/// Conflict files in the directory and its subdirectories, sorted by path
+pub fn find(dir: &Path) -> Result<Vec<Conflict>> {
+    let re = Regex::new(r"^(.*)\.sync-conflict-(\d{8})-(\d{6})-(\w+)(\.[^.]*)?$").unwrap();
+    let mut conflicts = Vec::new();
+    for path in files::walk(dir)? {
+        let name = path
+            .file_name()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .into_owned();
+        let c = match re.captures(&name) {
+            Some(c) => c,
+            None => continue,
+        };
+        let (date, time) = (&c[2], &c[3]);
+        let size = path
+            .metadata()
+            .with_context(|| format!("Can't read {}", path.display()))?
+            .len();
+        conflicts.push(Conflict {
+            original: path.with_file_name(format!(
+                "{}{}",
+                &c[1],
+                c.get(5).map_or("", |e| e.as_str())
+            )),
+            date: format!(
+                "{}-{}-{} {}:{}:{}",
+                &date[..4],
+                &date[4..6],
+                &date[6..],
+                &time[..2],
+                &time[2..4],
+                &time[4..]
+            ),
+            device: c[4].to_owned(),
+            size,
+            path,
+        });
+    }
+    Ok(conflicts)
+}
+
+/// Lists the conflict files of the folder grouped by the original file, then
+/// deletes them or adds patterns ignoring them
+pub fn run(
+    delete: bool,
+    ignore: bool,
+    opts: &AddOptions,
+    api: Option<&api::Client>,
+    silent: bool,
+) -> Result<()> {
+    if opts.trash && !delete {
+        bail!("--trash requires --delete");
+    }
+    let (st_dir, _) = find_syncthing_dir()?;
+    let found = find(&st_dir)?;
+    if found.is_empty() {
+        if !silent {
+            println!("No conflict files");
+        }
+        return Ok(());
+    }
+
+    let mut groups: Vec<(&Path, Vec<&Conflict>)> = Vec::new();
+    for c in &found {
+        match groups
+            .iter_mut()
+            .find(|(original, _)| *original == c.original)
+        {
+            Some((_, group)) => group.push(c),
+            None => groups.push((&c.original, vec![c])),
+        }
+    }
+    let total: u64 = found.iter().map(|c| c.size).sum();
+    // files to delete are always listed before asking
+    if !silent || !(delete || ignore) || (delete && !assume_yes()) {
+        for (original, group) in &groups {
+            let missing = if original.exists() { "" } else { " (missing)" };
+            println!("{}{missing}", relative(&st_dir, original));
+            for c in group {
+                println!(
+                    "  {}  {}  {:>9}  {}",
+                    c.date,
+                    c.device,
+                    files::format_size(c.size),
+                    c.path.file_name().unwrap_or_default().to_string_lossy()
+                );
+            }
+        }
+        println!(
+            "{} conflict files, {}",
+            found.len(),
+            files::format_size(total)
+        );
+    }
+
+    if delete {
+        let action = if opts.trash { "Move" } else { "Delete" };
+        if !confirm_destructive(&format!("{action} all of them?")) {
+            println!("Aborting.");
+            return Ok(());
+        }
+        for c in &found {
+            delete_file(&c.path, opts.trash)?;
+        }
+        if !silent {
+            println!(
+                "{} {} files",
+                if opts.trash { "Trashed" } else { "Deleted" },
+                found.len()
+            );
+        }
+    } else if ignore {
+        let patterns: Vec<String> = found
+            .iter()
+            .map(|c| pattern::literal(&relative(&st_dir, &c.path)))
+            .collect();
+        add(&patterns, true, opts, api, silent)?;
+    }
+    Ok(())
+}
+
+/// Conflict copies of .stignore and the files it includes, grouped by the
+/// (canonical) path of the ignore file
+fn ignore_file_copies(st_dir: &Path) -> Result<Vec<(PathBuf, Vec<Conflict>)>> {
+    let ignore_files: Vec<PathBuf> = includes::readable_files(&st_dir.join(".stignore"))
+        .iter()
+        .filter_map(|p| files::canonicalize(p).ok())
+        .collect();
+    let mut groups: Vec<(PathBuf, Vec<Conflict>)> = Vec::new();
+    for conflict in find(st_dir)? {
+        let Ok(original) = files::canonicalize(&conflict.original) else {
+            continue;
+        };
+        if !ignore_files.contains(&original) {
+            continue;
+        }
+        match groups.iter_mut().find(|(path, _)| *path == original) {
+            Some((_, copies)) => copies.push(conflict),
+            None => groups.push((original, vec![conflict])),
+        }
+    }
+    Ok(groups)
+}
+
+/// Merges conflict copies of the folder's ignore files into the files,
+/// see `stignore resolve`
+pub fn resolve(to_trash: bool, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let groups = ignore_file_copies(&st_dir)?;
+    if groups.is_empty() {
+        if !silent {
+            println!("No conflict copies of ignore files");
+        }
+        return Ok(());
+    }
+
+    let mut merges = Vec::new();
+    for (path, copies) in groups {
+        let lock = files::lock(&path)?;
+        let file = read_locked(&lock, &path)?;
+        let mut merged = file.clone();
+        for copy in &copies {
+            merged.merge(&IgnoreFile::load(&copy.path)?);
+        }
+        files::ensure_writable(&path)?;
+        println!(
+            "{} with {}:",
+            relative(&st_dir, &path),
+            copies
+                .iter()
+                .map(|c| format!(
+                    "{} from {} at {}",
+                    relative(&st_dir, &c.path),
+                    c.device,
+                    c.date
+                ))
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+        match diff::diff(&file.to_string(), &merged.to_string()) {
+            diff if diff.is_empty() => println!("nothing to add, the copies have no other lines"),
+            diff => println!("{diff}"),
+        }
+        merges.push((lock, file, merged, copies));
+    }
+    if !confirm_destructive(&format!(
+        "Write the merged files and {} the conflict copies?",
+        if to_trash { "trash" } else { "delete" }
+    )) {
+        println!("Aborting.");
+        return Ok(());
+    }
+    // the copies go only once all merged files are written
+    files::transaction(|| {
+        for (lock, file, merged, _) in &merges {
+            if merged != file {
+                lock.write(merged.to_string())?;
+            }
+        }
+        Ok(())
+    })?;
+    for copy in merges.into_iter().flat_map(|(.., copies)| copies) {
+        delete_file(&copy.path, to_trash)?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn conflicts_are_grouped_by_original() {
+        let dir = std::env::temp_dir().join(format!("stignore-conflicts-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("sub")).unwrap();
+        for name in [
+            "notes.sync-conflict-20240102-030405-ABCDEFG.txt",
+            "sub/.stignore.sync-conflict-20231231-235959-XYZ1234",
+            "notes.txt",
+            "sync-conflict.txt",
+        ] {
+            std::fs::write(dir.join(name), "x").unwrap();
+        }
+        let mut found = find(&dir).unwrap();
+        std::fs::remove_dir_all(&dir).ok();
+        found.sort_by(|a, b| a.path.cmp(&b.path));
+        assert_eq!(found.len(), 2);
+        assert_eq!(found[0].original, dir.join("notes.txt"));
+        assert_eq!(found[0].date, "2024-01-02 03:04:05");
+        assert_eq!(found[0].device, "ABCDEFG");
+        assert_eq!(found[0].size, 1);
+        assert_eq!(found[1].original, dir.join("sub/.stignore"));
+    }
+
+    #[test]
+    fn only_copies_of_ignore_files_are_resolved() {
+        let dir = std::env::temp_dir().join(format!("stignore-resolve-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let dir = files::canonicalize(&dir).unwrap();
+        std::fs::write(dir.join(".stignore"), "#include .stignore_sync\n").unwrap();
+        std::fs::write(dir.join(".stignore_sync"), "*.tmp\n").unwrap();
+        std::fs::write(dir.join("notes.txt"), "").unwrap();
+        for name in [
+            ".stignore_sync.sync-conflict-20240102-030405-ABCDEFG",
+            ".stignore_sync.sync-conflict-20240103-030405-XYZ1234",
+            "notes.sync-conflict-20240102-030405-ABCDEFG.txt",
+            // the ignore file itself is gone, nothing to merge into
+            ".stignore_old.sync-conflict-20240102-030405-ABCDEFG",
+        ] {
+            std::fs::write(dir.join(name), "*.bak\n").unwrap();
+        }
+        let groups = ignore_file_copies(&dir).unwrap();
+        std::fs::remove_dir_all(&dir).ok();
+        assert_eq!(groups.len(), 1);
+        assert_eq!(groups[0].0, dir.join(".stignore_sync"));
+        assert_eq!(groups[0].1.len(), 2);
+    }
+}
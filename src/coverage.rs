@@ -0,0 +1,130 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::Result;
+use regex::Regex;
+use stignore::ignore_file::Kind;
+
+use crate::{files, includes, pattern::Pattern, simulate, IgnoreFile};
+
+/// Pattern of an ignore file with the files of the folder it matches
+struct Rule {
+    /// `FILE:LINE` relative to the folder root
+    location: String,
+    line: String,
+    /// `None` if the glob can't be converted, such patterns match nothing
+    regex: Option<Regex>,
+    /// Files the pattern matches, whether or not an earlier one decides them
+    matches: usize,
+    /// Files the pattern is the first match for, the ones it decides
+    decides: usize,
+}
+
+/// Appends the patterns of the file and the files it includes, in the order
+/// Syncthing evaluates them. Files that can't be read, or are included again,
+/// are skipped; fix-includes and doctor report them.
+fn collect(path: &Path, root: &Path, seen: &mut Vec<PathBuf>, rules: &mut Vec<Rule>) {
+    let canonical = files::canonicalize(path).unwrap_or_else(|_| path.to_owned());
+    if seen.contains(&canonical) {
+        return;
+    }
+    seen.push(canonical);
+    let Ok(file) = IgnoreFile::load(path) else {
+        return;
+    };
+    for (index, entry) in file.entries().iter().enumerate() {
+        match entry.kind() {
+            Kind::Include(target) => collect(&includes::resolve(path, target), root, seen, rules),
+            Kind::Pattern(pattern) => rules.push(Rule {
+                location: format!("{}:{}", crate::relative(root, path), index + 1),
+                line: entry.line().trim().to_owned(),
+                regex: pattern.as_ref().and_then(Pattern::regex),
+                matches: 0,
+                decides: 0,
+            }),
+            Kind::Blank | Kind::Comment => {}
+        }
+    }
+}
+
+/// Patterns of the folder in the order Syncthing evaluates them, with the
+/// files they match and decide, and the number of files of the folder
+fn count(root: &Path) -> Result<(Vec<Rule>, usize)> {
+    let mut rules = Vec::new();
+    collect(&root.join(".stignore"), root, &mut Vec::new(), &mut rules);
+    let all = simulate::files(root)?;
+    for file in &all {
+        let mut decided = false;
+        for rule in &mut rules {
+            if rule
+                .regex
+                .as_ref()
+                .is_some_and(|re| re.is_match(&file.path))
+            {
+                rule.matches += 1;
+                if !decided {
+                    rule.decides += 1;
+                    decided = true;
+                }
+            }
+        }
+    }
+    Ok((rules, all.len()))
+}
+
+/// Prints how many files of the folder each pattern matches and decides,
+/// in the order Syncthing evaluates the patterns. With `unused`, only the
+/// patterns matching no files are shown.
+pub fn print(root: &Path, unused: bool) -> Result<()> {
+    let (rules, files) = count(root)?;
+    println!("{:>8} {:>8}  {:<24} PATTERN", "MATCHES", "DECIDES", "LINE");
+    for rule in rules.iter().filter(|r| !unused || r.matches == 0) {
+        println!(
+            "{:>8} {:>8}  {:<24} {}",
+            rule.matches, rule.decides, rule.location, rule.line
+        );
+    }
+    println!(
+        "{files} files, {} of {} patterns match none of them",
+        rules.iter().filter(|r| r.matches == 0).count(),
+        rules.len()
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn patterns_are_counted_in_order_of_evaluation() {
+        let dir = std::env::temp_dir().join(format!("stignore-coverage-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("logs")).unwrap();
+        for file in ["a.log", "logs/b.log", "c.txt"] {
+            std::fs::write(dir.join(file), "").unwrap();
+        }
+        std::fs::write(
+            dir.join(".stignore"),
+            "!a.log\n#include common\n// logs\n*.tmp\n",
+        )
+        .unwrap();
+        // included again, its patterns are counted once
+        std::fs::write(dir.join("common"), "*.log\n#include .stignore\n").unwrap();
+
+        let (rules, files) = count(&dir).unwrap();
+        // the included file is synced like any other
+        assert_eq!(files, 4);
+        let counts: Vec<(&str, &str, usize, usize)> = rules
+            .iter()
+            .map(|r| (r.location.as_str(), r.line.as_str(), r.matches, r.decides))
+            .collect();
+        assert_eq!(
+            counts,
+            [
+                (".stignore:1", "!a.log", 1, 1),
+                ("common:1", "*.log", 2, 1),
+                (".stignore:4", "*.tmp", 0, 0),
+            ]
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+}
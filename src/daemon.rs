@@ -0,0 +1,348 @@
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
+
+use anyhow::{bail, Context, Result};
+use serde_json::{json, Value};
+
+use crate::{files, includes, pattern::Matcher};
+
+/// Socket of the daemon: `$STIGNORE_SOCKET`, `$XDG_RUNTIME_DIR/stignore.sock`,
+/// or `daemon.sock` in the state directory next to the journal
+pub fn socket_path() -> Result<PathBuf> {
+    if let Some(socket) = crate::config::var("STIGNORE_SOCKET") {
+        return Ok(PathBuf::from(socket));
+    }
+    if let Some(dir) = std::env::var_os("XDG_RUNTIME_DIR") {
+        return Ok(PathBuf::from(dir).join("stignore.sock"));
+    }
+    let journal = crate::journal::dir()?;
+    Ok(journal.with_file_name("daemon.sock"))
+}
+
+/// Parsed ignore patterns of a folder
+struct Folder {
+    matcher: Matcher,
+    /// .stignore and the files it includes with their modification times,
+    /// the patterns are parsed again once any of them changes
+    files: Vec<(PathBuf, Option<SystemTime>)>,
+}
+
+impl Folder {
+    fn load(root: &Path) -> Result<Self> {
+        let stignore = root.join(".stignore");
+        let mut files = Vec::new();
+        let mut nodes = vec![includes::tree(&stignore)];
+        while let Some(node) = nodes.pop() {
+            files.push((node.path.clone(), modified(&node.path)));
+            nodes.extend(node.includes);
+        }
+        Ok(Folder {
+            matcher: Matcher::new(&includes::flatten(&stignore)?),
+            files,
+        })
+    }
+
+    fn is_stale(&self) -> bool {
+        self.files
+            .iter()
+            .any(|(path, time)| modified(path) != *time)
+    }
+}
+
+fn modified(path: &Path) -> Option<SystemTime> {
+    fs::metadata(path).and_then(|m| m.modified()).ok()
+}
+
+/// Folder roots and patterns kept between requests
+#[derive(Default)]
+struct Cache {
+    /// Folder root of each directory asked about, `None` outside of folders
+    roots: HashMap<PathBuf, Option<PathBuf>>,
+    folders: HashMap<PathBuf, Folder>,
+}
+
+impl Cache {
+    /// Folder root containing the directory
+    fn root(&mut self, dir: &Path) -> Option<PathBuf> {
+        self.roots
+            .entry(dir.to_owned())
+            .or_insert_with(|| crate::folder_roots(dir).into_iter().next())
+            .clone()
+    }
+
+    fn folder(&mut self, root: &Path) -> Result<&Folder> {
+        if self.folders.get(root).is_none_or(Folder::is_stale) {
+            self.folders.insert(root.to_owned(), Folder::load(root)?);
+        }
+        Ok(&self.folders[root])
+    }
+
+    /// Forgets everything, e.g. after folders were created or moved
+    fn clear(&mut self) {
+        *self = Cache::default();
+    }
+
+    /// Folder root and the path relative to it, `None` outside of folders
+    fn locate(&mut self, path: &Path) -> Result<Option<(PathBuf, String)>> {
+        let path =
+            files::canonicalize(path).with_context(|| format!("Can't open {}", path.display()))?;
+        let dir = if path.is_dir() {
+            path.clone()
+        } else {
+            path.parent().unwrap_or(&path).to_owned()
+        };
+        Ok(self
+            .root(&dir)
+            .map(|root| (root.clone(), crate::relative(&root, &path))))
+    }
+
+    /// Whether the path is in a folder and ignored, and the deciding pattern
+    fn check(&mut self, path: &Path) -> Result<Value> {
+        let Some((root, relative)) = self.locate(path)? else {
+            return Ok(json!({ "folder": null }));
+        };
+        let matched = match relative.as_str() {
+            "" => None,
+            relative => self.folder(&root)?.matcher.first_match(relative),
+        };
+        Ok(json!({
+            "folder": root.to_string_lossy(),
+            "path": relative,
+            "ignored": matches!(matched, Some((_, false))),
+            "pattern": matched.map(|(line, _)| line),
+        }))
+    }
+
+    /// Entries of the directory and whether each of them is ignored
+    fn ls(&mut self, dir: &Path) -> Result<Value> {
+        let Some((root, relative)) = self.locate(dir)? else {
+            return Ok(json!({ "folder": null }));
+        };
+        let mut names: Vec<String> = fs::read_dir(dir)
+            .with_context(|| format!("Can't read {}", dir.display()))?
+            .filter_map(|e| Some(e.ok()?.file_name().to_string_lossy().into_owned()))
+            .collect();
+        names.sort();
+        let matcher = &self.folder(&root)?.matcher;
+        let entries: Vec<Value> = names
+            .iter()
+            .map(|name| {
+                let path = if relative.is_empty() {
+                    name.clone()
+                } else {
+                    format!("{relative}/{name}")
+                };
+                json!({ "name": name, "ignored": matcher.is_ignored(&path) })
+            })
+            .collect();
+        Ok(json!({ "folder": root.to_string_lossy(), "entries": entries }))
+    }
+}
+
+/// Whether the path is ignored, as the `check` request of the daemon
+/// answers it, but computed by this process
+pub fn check(path: &Path) -> Result<Value> {
+    Cache::default().check(path)
+}
+
+/// Answers a request, a JSON object with the `command` and its arguments:
+///
+/// - `check` with `path`: whether the path is ignored
+/// - `ls` with `path`: entries of the directory, each marked ignored or not
+/// - `add` with `path` and `patterns`: adds the patterns as if running
+///   `stignore` in the directory
+/// - `reload`: forgets cached folders and patterns
+fn handle(
+    cache: &mut Cache,
+    request: &str,
+    add: &mut dyn FnMut(&Path, &[String]) -> Result<()>,
+) -> Value {
+    match answer(cache, request, add) {
+        Ok(mut value) => {
+            value["ok"] = json!(true);
+            value
+        }
+        Err(e) => json!({ "ok": false, "error": format!("{e:#}") }),
+    }
+}
+
+fn answer(
+    cache: &mut Cache,
+    request: &str,
+    add: &mut dyn FnMut(&Path, &[String]) -> Result<()>,
+) -> Result<Value> {
+    let request: Value = serde_json::from_str(request).context("Invalid request")?;
+    let path = || {
+        request["path"]
+            .as_str()
+            .map(Path::new)
+            .context("Request has no path")
+    };
+    match request["command"].as_str() {
+        Some("check") => cache.check(path()?),
+        Some("ls") => cache.ls(path()?),
+        Some("add") => {
+            let patterns: Vec<String> = request["patterns"]
+                .as_array()
+                .context("Request has no patterns")?
+                .iter()
+                .filter_map(|p| p.as_str().map(str::to_owned))
+                .collect();
+            add(path()?, &patterns)?;
+            Ok(json!({}))
+        }
+        Some("reload") => {
+            cache.clear();
+            Ok(json!({}))
+        }
+        _ => bail!("Unknown command"),
+    }
+}
+
+/// Serves requests on the socket, one JSON object per line, until
+/// interrupted. Clients are served one at a time.
+#[cfg(unix)]
+pub fn serve(
+    socket: &Path,
+    silent: bool,
+    add: &mut dyn FnMut(&Path, &[String]) -> Result<()>,
+) -> Result<()> {
+    use std::{
+        io::{BufRead, BufReader, Write},
+        os::unix::net::{UnixListener, UnixStream},
+    };
+
+    if let Some(dir) = socket.parent() {
+        fs::create_dir_all(dir).with_context(|| format!("Can't create {}", dir.display()))?;
+    }
+    if UnixStream::connect(socket).is_ok() {
+        bail!("Daemon is already running on {}", socket.display());
+    }
+    // left over by a daemon that was killed
+    let _ = fs::remove_file(socket);
+    // other users could add patterns through it otherwise. The socket is
+    // created with the umask applied, so it's never accessible to them, not
+    // even between binding and changing the permissions.
+    let umask = unsafe { libc::umask(0o177) };
+    let listener = UnixListener::bind(socket);
+    unsafe { libc::umask(umask) };
+    let listener = listener.with_context(|| format!("Can't listen on {}", socket.display()))?;
+    if !silent {
+        println!("Listening on {}", socket.display());
+    }
+
+    let mut cache = Cache::default();
+    for stream in listener.incoming() {
+        let Ok(stream) = stream else { continue };
+        // e.g. root connecting through a socket path of another user
+        let uid = unsafe { libc::geteuid() };
+        match peer_uid(&stream) {
+            Ok(peer) if peer == uid => {}
+            _ => continue,
+        }
+        let Ok(mut writer) = stream.try_clone() else {
+            continue;
+        };
+        for line in BufReader::new(stream).lines() {
+            let Ok(line) = line else { break };
+            if line.trim().is_empty() {
+                continue;
+            }
+            let answer = handle(&mut cache, &line, add);
+            if writeln!(writer, "{answer}").is_err() {
+                break;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// User ID of the process on the other end of the socket
+#[cfg(any(target_os = "linux", target_os = "android"))]
+fn peer_uid(stream: &std::os::unix::net::UnixStream) -> std::io::Result<u32> {
+    use std::os::unix::io::AsRawFd;
+
+    let mut cred = libc::ucred {
+        pid: 0,
+        uid: 0,
+        gid: 0,
+    };
+    let mut len = std::mem::size_of::<libc::ucred>() as libc::socklen_t;
+    let res = unsafe {
+        libc::getsockopt(
+            stream.as_raw_fd(),
+            libc::SOL_SOCKET,
+            libc::SO_PEERCRED,
+            &mut cred as *mut libc::ucred as *mut libc::c_void,
+            &mut len,
+        )
+    };
+    if res != 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(cred.uid)
+}
+
+/// User ID of the process on the other end of the socket
+#[cfg(all(unix, not(any(target_os = "linux", target_os = "android"))))]
+fn peer_uid(stream: &std::os::unix::net::UnixStream) -> std::io::Result<u32> {
+    use std::os::unix::io::AsRawFd;
+
+    let (mut uid, mut gid) = (0, 0);
+    if unsafe { libc::getpeereid(stream.as_raw_fd(), &mut uid, &mut gid) } != 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(uid)
+}
+
+/// Sends the request to the running daemon and returns its answer. Fails
+/// quickly if there is no daemon or it's busy.
+#[cfg(unix)]
+pub fn query(socket: &Path, request: &Value) -> Result<Value> {
+    use std::{
+        io::{BufRead, BufReader, Write},
+        os::unix::net::UnixStream,
+        time::Duration,
+    };
+
+    let mut stream = UnixStream::connect(socket)
+        .with_context(|| format!("Can't connect to {}", socket.display()))?;
+    stream.set_read_timeout(Some(Duration::from_millis(100)))?;
+    writeln!(stream, "{request}")?;
+    let mut answer = String::new();
+    BufReader::new(stream).read_line(&mut answer)?;
+    let answer: Value = serde_json::from_str(&answer).context("Invalid answer of the daemon")?;
+    if answer["ok"].as_bool() != Some(true) {
+        bail!("{}", answer["error"].as_str().unwrap_or("Daemon failed"));
+    }
+    Ok(answer)
+}
+
+#[cfg(not(unix))]
+pub fn query(_socket: &Path, _request: &Value) -> Result<Value> {
+    bail!("daemon is only supported on systems with Unix sockets")
+}
+
+#[cfg(not(unix))]
+pub fn serve(
+    _socket: &Path,
+    _silent: bool,
+    _add: &mut dyn FnMut(&Path, &[String]) -> Result<()>,
+) -> Result<()> {
+    bail!("daemon is only supported on systems with Unix sockets")
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn peer_is_this_user() {
+        let (client, _server) = std::os::unix::net::UnixStream::pair().unwrap();
+        assert_eq!(peer_uid(&client).unwrap(), unsafe { libc::geteuid() });
+    }
+}
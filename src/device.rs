@@ -0,0 +1,80 @@
+use std::{path::Path, process::Command};
+
+use anyhow::{bail, Context, Result};
+use regex::Regex;
+
+/// Short hostname of this device, without the domain part
+/// (`laptop.local` becomes `laptop`)
+pub fn hostname() -> Result<String> {
+    let full = match std::env::var("COMPUTERNAME") {
+        Ok(name) if cfg!(windows) => name,
+        _ => {
+            let output = Command::new("hostname")
+                .output()
+                .context("Can't determine hostname")?;
+            if !output.status.success() {
+                bail!("Can't determine hostname: `hostname` failed");
+            }
+            String::from_utf8_lossy(&output.stdout).into_owned()
+        }
+    };
+    let name = full.trim().split('.').next().unwrap_or_default();
+    if name.is_empty() || name.contains(['/', '\\']) {
+        bail!("Unsupported hostname: {:?}", full.trim());
+    }
+    Ok(name.to_owned())
+}
+
+/// Expands `${OS}`, `${HOSTNAME}` and `${HOME_BASENAME}` (name of the home
+/// directory, usually the user name) in the pattern
+pub fn expand_vars(pattern: &str) -> Result<String> {
+    let re = Regex::new(r"\$\{(\w*)\}").unwrap();
+    let mut expanded = String::with_capacity(pattern.len());
+    let mut last = 0;
+    for c in re.captures_iter(pattern) {
+        let whole = c.get(0).unwrap();
+        let value = match &c[1] {
+            "OS" => std::env::consts::OS.to_owned(),
+            "HOSTNAME" => hostname()?,
+            "HOME_BASENAME" => home_basename()?,
+            name => bail!(
+                "Unknown variable ${{{name}}} in {pattern}, supported are \
+                ${{OS}}, ${{HOSTNAME}} and ${{HOME_BASENAME}}"
+            ),
+        };
+        expanded.push_str(&pattern[last..whole.start()]);
+        expanded.push_str(&value);
+        last = whole.end();
+    }
+    expanded.push_str(&pattern[last..]);
+    Ok(expanded)
+}
+
+fn home_basename() -> Result<String> {
+    let home = std::env::var_os(if cfg!(windows) { "USERPROFILE" } else { "HOME" })
+        .context("Can't determine home directory")?;
+    Ok(Path::new(&home)
+        .file_name()
+        .context("Can't determine home directory name")?
+        .to_string_lossy()
+        .into_owned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn variables_are_expanded() {
+        assert_eq!(
+            expand_vars("/${OS}/cache").unwrap(),
+            format!("/{}/cache", std::env::consts::OS)
+        );
+        assert_eq!(
+            expand_vars("${HOSTNAME}_${HOME_BASENAME}").unwrap(),
+            format!("{}_{}", hostname().unwrap(), home_basename().unwrap())
+        );
+        assert_eq!(expand_vars("$OS {OS} $").unwrap(), "$OS {OS} $");
+        assert!(expand_vars("${USER}").is_err());
+    }
+}
@@ -0,0 +1,192 @@
+use std::path::Path;
+
+use anyhow::{bail, Context, Result};
+
+use crate::{
+    api, assume_yes, confirm, diff, files, find_syncthing_dir, folder_id, includes, journal,
+    sync_file, ApiOptions, Selected, SELECTED_FOLDER, STIGNORE_DEVICE,
+};
+
+/// Shows the effective patterns of the folder that only some of the devices
+/// have, see `stignore diff-devices`
+pub fn diff(api: &api::Client, instances: &[String], opts: &ApiOptions) -> Result<()> {
+    let folder = folder_id(api)?;
+    let mut devices = vec![(api.this_device()?.name, api.effective_ignores(&folder)?)];
+    for spec in instances {
+        let other = opts.connect_to(spec)?;
+        let name = other.this_device()?.name;
+        let patterns = other
+            .effective_ignores(&folder)
+            .with_context(|| format!("Can't get patterns of {folder} from {name}"))?;
+        devices.push((name, patterns));
+    }
+
+    let table = diff::compare(&devices);
+    if table.is_empty() {
+        println!(
+            "Folder {folder} has the same {} patterns on all {} devices",
+            devices[0].1.len(),
+            devices.len()
+        );
+    } else {
+        print!("{table}");
+    }
+    Ok(())
+}
+
+/// Checks that every device sharing the folder includes the synchronized
+/// patterns, see `stignore check-devices`
+pub fn check(
+    api: &api::Client,
+    instances: &[String],
+    opts: &ApiOptions,
+    silent: bool,
+) -> Result<()> {
+    let folder = folder_id(api)?;
+    let mut unchecked = api.folder_devices(&folder)?;
+    let mut broken = Vec::new();
+    let mut clients = vec![api];
+    let others = instances
+        .iter()
+        .map(|spec| opts.connect_to(spec))
+        .collect::<Result<Vec<_>>>()?;
+    clients.extend(&others);
+
+    // included files are synced, indirect includes are followed through this
+    // device's copy of them
+    let st_dir = find_syncthing_dir().map(|(dir, _)| dir).unwrap_or_default();
+    for client in clients {
+        let device = client.this_device()?;
+        unchecked.retain(|d| d.id != device.id);
+        let lines = client
+            .ignores(&folder)
+            .with_context(|| format!("Can't get .stignore of {folder} from {}", device.name))?;
+        if includes_shared(&st_dir, &lines) {
+            if !silent {
+                println!("{}: OK", device.name);
+            }
+        } else {
+            println!("{}: .stignore doesn't include {}", device.name, sync_file());
+            broken.push(device.name);
+        }
+    }
+    if !silent {
+        for device in unchecked {
+            println!(
+                "{}: not checked, pass the URL of its Syncthing",
+                device.name
+            );
+        }
+    }
+    if !broken.is_empty() {
+        bail!("Convention is broken on {}", broken.join(", "));
+    }
+    Ok(())
+}
+
+/// Whether the lines of .stignore include .stignore_sync (or the
+/// .stignore_device rendered from it), directly or through other files
+fn includes_shared(st_dir: &Path, lines: &[String]) -> bool {
+    let tree = includes::tree_with(&st_dir.join(".stignore"), lines);
+    tree.includes(&st_dir.join(sync_file())) || tree.includes(&st_dir.join(STIGNORE_DEVICE))
+}
+
+/// Inserts the effective patterns of any of the devices into .stignore of
+/// the devices lacking them, see `stignore merge-devices`
+pub fn merge(
+    api: &api::Client,
+    instances: &[String],
+    opts: &ApiOptions,
+    silent: bool,
+) -> Result<()> {
+    let folder = folder_id(api)?;
+    let others = instances
+        .iter()
+        .map(|spec| opts.connect_to(spec))
+        .collect::<Result<Vec<_>>>()?;
+    let mut devices = Vec::new();
+    for client in std::iter::once(api).chain(&others) {
+        let name = client.this_device()?.name;
+        let patterns = client
+            .effective_ignores(&folder)
+            .with_context(|| format!("Can't get patterns of {folder} from {name}"))?;
+        let stignore = client
+            .ignores(&folder)
+            .with_context(|| format!("Can't get .stignore of {folder} from {name}"))?;
+        devices.push((client, name, patterns, stignore));
+    }
+
+    let lists: Vec<&[String]> = devices.iter().map(|(_, _, p, _)| p.as_slice()).collect();
+    let merged = crate::merge::order(&lists)?;
+    let mut pushes = Vec::new();
+    for (client, name, patterns, mut stignore) in devices.iter().cloned() {
+        let missing = crate::merge::insert(&mut stignore, &patterns, &merged)
+            .with_context(|| format!("Can't merge patterns into .stignore on {name}"))?;
+        if !missing.is_empty() {
+            pushes.push((client, name, missing, stignore));
+        }
+    }
+    if pushes.is_empty() {
+        if !silent {
+            println!(
+                "Folder {folder} has the same {} patterns on all {} devices",
+                merged.len(),
+                devices.len()
+            );
+        }
+        return Ok(());
+    }
+    // --silent only hides the diff when nobody is asked about it
+    if !silent || !assume_yes() {
+        for (_, name, missing, _) in &pushes {
+            println!("Adding to .stignore on {name}:\n{}", missing.join("\n"));
+        }
+    }
+    if !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+
+    // this device's .stignore is written by Syncthing, record it for undo
+    let local = match SELECTED_FOLDER.get() {
+        Some(Selected::Remote(_)) => None,
+        _ => Some(find_syncthing_dir()?.0.join(".stignore")),
+    };
+    for (client, name, _, lines) in pushes {
+        let is_local = std::ptr::eq(client, api);
+        let before = local
+            .as_ref()
+            .filter(|_| is_local)
+            .and_then(|path| std::fs::read(path).ok());
+        client
+            .set_ignores(&folder, &lines)
+            .with_context(|| format!("Can't change .stignore of {folder} on {name}"))?;
+        if let Some(path) = local.as_ref().filter(|_| is_local) {
+            if let Ok(after) = std::fs::read(path) {
+                let path = files::canonicalize(path).unwrap_or(path.clone());
+                journal::record(&path, before.as_deref(), Some(&after));
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shared_file_included_indirectly() {
+        let dir = std::env::temp_dir().join(format!("stignore-devices-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("common"), "#include .stignore_sync\n").unwrap();
+        let lines = ["*.tmp".to_owned(), "#include common".to_owned()];
+        assert!(includes_shared(&dir, &lines));
+        assert!(!includes_shared(&dir, &lines[..1]));
+        assert!(includes_shared(
+            &dir,
+            &["#include /.stignore_device".to_owned()]
+        ));
+        std::fs::remove_dir_all(dir).ok();
+    }
+}
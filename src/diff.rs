@@ -0,0 +1,228 @@
+/// Number of unchanged lines shown around changes
+const CONTEXT: usize = 3;
+
+enum Op<'a> {
+    Keep(&'a str),
+    Remove(&'a str),
+    Add(&'a str),
+}
+
+/// Unified diff of two texts, empty if they are equal
+pub fn diff(old: &str, new: &str) -> String {
+    let old: Vec<&str> = old.lines().collect();
+    let new: Vec<&str> = new.lines().collect();
+    let ops = ops(&old, &new);
+
+    let mut out = String::new();
+    let mut k = 0;
+    let (mut old_line, mut new_line) = (1, 1);
+    while k < ops.len() {
+        if let Op::Keep(_) = ops[k] {
+            k += 1;
+            old_line += 1;
+            new_line += 1;
+            continue;
+        }
+        // hunk spans changes separated by less than 2 * CONTEXT unchanged lines
+        let start = k.saturating_sub(CONTEXT);
+        let mut end = k;
+        let mut unchanged = 0;
+        while end < ops.len() && unchanged <= 2 * CONTEXT {
+            match ops[end] {
+                Op::Keep(_) => unchanged += 1,
+                _ => unchanged = 0,
+            }
+            end += 1;
+        }
+        let end = end - unchanged.saturating_sub(CONTEXT);
+
+        let context_before = k - start;
+        let (hunk_old, hunk_new) = (old_line - context_before, new_line - context_before);
+        let mut body = String::new();
+        let (mut old_count, mut new_count) = (0, 0);
+        for op in &ops[start..end] {
+            match op {
+                Op::Keep(l) => {
+                    body.push_str(&format!(" {l}\n"));
+                    old_count += 1;
+                    new_count += 1;
+                }
+                Op::Remove(l) => {
+                    body.push_str(&format!("-{l}\n"));
+                    old_count += 1;
+                }
+                Op::Add(l) => {
+                    body.push_str(&format!("+{l}\n"));
+                    new_count += 1;
+                }
+            }
+        }
+        out.push_str(&format!(
+            "@@ -{hunk_old},{old_count} +{hunk_new},{new_count} @@\n{body}"
+        ));
+        old_line = hunk_old + old_count;
+        new_line = hunk_new + new_count;
+        k = end;
+    }
+    out
+}
+
+/// Edit script turning the old lines into the new ones
+fn ops<'a>(old: &[&'a str], new: &[&'a str]) -> Vec<Op<'a>> {
+    // unchanged ends are kept as they are, so that the table below stays
+    // small when lines are appended to a large file
+    let prefix = old.iter().zip(new).take_while(|(o, n)| o == n).count();
+    let suffix = old[prefix..]
+        .iter()
+        .rev()
+        .zip(new[prefix..].iter().rev())
+        .take_while(|(o, n)| o == n)
+        .count();
+    let (head, tail) = (&old[..prefix], &old[old.len() - suffix..]);
+    let old = &old[prefix..old.len() - suffix];
+    let new = &new[prefix..new.len() - suffix];
+
+    // longest common subsequence lengths of the suffixes
+    let mut lcs = vec![vec![0usize; new.len() + 1]; old.len() + 1];
+    for i in (0..old.len()).rev() {
+        for j in (0..new.len()).rev() {
+            lcs[i][j] = if old[i] == new[j] {
+                lcs[i + 1][j + 1] + 1
+            } else {
+                lcs[i + 1][j].max(lcs[i][j + 1])
+            };
+        }
+    }
+
+    let mut ops: Vec<Op> = head.iter().map(|l| Op::Keep(l)).collect();
+    let (mut i, mut j) = (0, 0);
+    while i < old.len() || j < new.len() {
+        if i < old.len() && j < new.len() && old[i] == new[j] {
+            ops.push(Op::Keep(old[i]));
+            i += 1;
+            j += 1;
+        } else if i < old.len() && (j == new.len() || lcs[i + 1][j] >= lcs[i][j + 1]) {
+            ops.push(Op::Remove(old[i]));
+            i += 1;
+        } else {
+            ops.push(Op::Add(new[j]));
+            j += 1;
+        }
+    }
+    ops.extend(tail.iter().map(|l| Op::Keep(l)));
+    ops
+}
+
+/// Lines of the old text starting at `at` (zero-based) replaced with other
+/// lines
+pub struct Hunk<'a> {
+    pub at: usize,
+    pub removed: Vec<&'a str>,
+    pub added: Vec<&'a str>,
+}
+
+/// Changed runs of lines between two texts. Lines keep their endings, so
+/// either text can be rebuilt exactly from the other one.
+pub fn hunks<'a>(old: &'a str, new: &'a str) -> Vec<Hunk<'a>> {
+    let old: Vec<&str> = old.split_inclusive('\n').collect();
+    let new: Vec<&str> = new.split_inclusive('\n').collect();
+    let mut hunks: Vec<Hunk> = Vec::new();
+    let (mut line, mut in_hunk) = (0, false);
+    for op in ops(&old, &new) {
+        if let Op::Keep(_) = op {
+            line += 1;
+            in_hunk = false;
+            continue;
+        }
+        if !in_hunk {
+            hunks.push(Hunk {
+                at: line,
+                removed: Vec::new(),
+                added: Vec::new(),
+            });
+            in_hunk = true;
+        }
+        let hunk = hunks.last_mut().expect("pushed above");
+        match op {
+            Op::Remove(l) => {
+                hunk.removed.push(l);
+                line += 1;
+            }
+            Op::Add(l) => hunk.added.push(l),
+            Op::Keep(_) => {}
+        }
+    }
+    hunks
+}
+
+/// Table of patterns that only some of the devices have, one column per
+/// device (`+` present, `-` missing). Empty if all devices have the same
+/// patterns.
+pub fn compare(devices: &[(String, Vec<String>)]) -> String {
+    let mut patterns: Vec<&str> = Vec::new();
+    for (_, lines) in devices {
+        for line in lines {
+            if !patterns.contains(&line.as_str()) {
+                patterns.push(line);
+            }
+        }
+    }
+    let differing: Vec<&str> = patterns
+        .into_iter()
+        .filter(|p| {
+            !devices
+                .iter()
+                .all(|(_, lines)| lines.iter().any(|l| l == p))
+        })
+        .collect();
+    if differing.is_empty() {
+        return String::new();
+    }
+
+    let names: Vec<&str> = devices.iter().map(|(name, _)| name.as_str()).collect();
+    let mut out = names.join(" ") + "\n";
+    for pattern in differing {
+        for (name, lines) in devices {
+            let mark = if lines.iter().any(|l| l == pattern) {
+                '+'
+            } else {
+                '-'
+            };
+            out.push_str(&format!("{mark:^width$} ", width = name.chars().count()));
+        }
+        out.push_str(pattern);
+        out.push('\n');
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn device(name: &str, patterns: &[&str]) -> (String, Vec<String>) {
+        (
+            name.to_owned(),
+            patterns.iter().map(|p| (*p).to_owned()).collect(),
+        )
+    }
+
+    #[test]
+    fn compare_lists_differing_patterns() {
+        let devices = [
+            device("laptop", &["/build", "*.tmp"]),
+            device("nas", &["/build", "*.tmp", "*.iso"]),
+            device("phone", &["*.tmp"]),
+        ];
+        assert_eq!(
+            compare(&devices),
+            "laptop nas phone\n  +     +    -   /build\n  -     +    -   *.iso\n"
+        );
+    }
+
+    #[test]
+    fn compare_same_patterns_is_empty() {
+        let devices = [device("a", &["x", "y"]), device("b", &["y", "x"])];
+        assert_eq!(compare(&devices), "");
+    }
+}
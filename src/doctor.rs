@@ -0,0 +1,154 @@
+use std::path::Path;
+
+use anyhow::{bail, Result};
+
+use crate::{
+    files, ignore_file,
+    includes::{self, Node, Problem},
+    ApiOptions,
+};
+
+/// Results of the checks printed so far
+struct Report {
+    failed: usize,
+    silent: bool,
+}
+
+impl Report {
+    fn pass(&self, check: &str) {
+        if !self.silent {
+            println!("ok    {check}");
+        }
+    }
+
+    /// Prints the failed check with a hint how to fix it
+    fn fail(&mut self, check: &str, hint: &str) {
+        self.failed += 1;
+        println!("FAIL  {check}");
+        println!("      {hint}");
+    }
+}
+
+/// Checks the setup stignore depends on: the folder, its ignore files and
+/// includes, and the API if it's enabled
+pub fn run(opts: &ApiOptions, silent: bool) -> Result<()> {
+    let mut report = Report { failed: 0, silent };
+
+    let api = match opts.connect() {
+        Ok(Some(api)) => match api.this_device() {
+            Ok(device) => {
+                report.pass(&format!("API is reachable, device {}", device.name));
+                Some(api)
+            }
+            Err(e) => {
+                report.fail(
+                    &format!("API isn't reachable: {e:#}"),
+                    "check that Syncthing is running and --api-url and --api-key",
+                );
+                None
+            }
+        },
+        Ok(None) => {
+            report.pass("API isn't used, enable it with --api");
+            None
+        }
+        Err(e) => {
+            report.fail(
+                &format!("API can't be used: {e:#}"),
+                "pass --api-url and --api-key, or --api-config",
+            );
+            None
+        }
+    };
+
+    let selected = match (&api, &opts.folder) {
+        (_, None) => Ok(()),
+        (Some(api), Some(name)) => crate::select_folder(api, opts.remote(), Some(name)).map(|_| ()),
+        (None, Some(name)) => crate::select_configured_folder(opts, name),
+    };
+    let root = match selected.and_then(|_| crate::find_syncthing_dir()) {
+        Ok((root, _)) => {
+            report.pass(&format!("folder {}", root.display()));
+            Some(root)
+        }
+        Err(e) => {
+            report.fail(
+                &format!("folder isn't found: {e:#}"),
+                "run stignore inside a Syncthing folder, pass --folder, or --marker \
+                if the folder uses a custom marker",
+            );
+            None
+        }
+    };
+
+    if let Some(root) = root {
+        let stignore = root.join(".stignore");
+        let tree = includes::tree(&stignore);
+        check_files(&tree, &root, &mut report);
+
+        let sync_file = root.join(crate::sync_file());
+        let device = root.join(crate::STIGNORE_DEVICE);
+        if !sync_file.exists() {
+            report.pass(&format!("{} isn't used", crate::sync_file()));
+        } else if tree.includes(&sync_file) || tree.includes(&device) {
+            report.pass(&format!("{} is included", crate::sync_file()));
+        } else {
+            report.fail(
+                &format!("{} isn't included from .stignore", crate::sync_file()),
+                &format!("add `#include {}` to .stignore", crate::sync_file()),
+            );
+        }
+    }
+
+    if report.failed > 0 {
+        bail!(
+            "{} check{} failed",
+            report.failed,
+            if report.failed == 1 { "" } else { "s" }
+        );
+    }
+    Ok(())
+}
+
+/// Checks the ignore file and the files it includes
+fn check_files(node: &Node, root: &Path, report: &mut Report) {
+    let name = node.path.strip_prefix(root).unwrap_or(&node.path).display();
+    match &node.problem {
+        // .stignore itself is optional
+        Some(Problem::Missing) if node.path == root.join(".stignore") => {
+            report.pass(&format!("{name} doesn't exist yet"));
+        }
+        Some(Problem::Missing) => report.fail(
+            &format!("{name} is included, but missing"),
+            "run `stignore fix-includes`",
+        ),
+        Some(Problem::IncludedAgain) => report.fail(
+            &format!("{name} is included more than once"),
+            "remove the extra #include, Syncthing rejects such ignore files",
+        ),
+        Some(Problem::Unreadable(e)) => report.fail(
+            &format!("{name} can't be read: {e}"),
+            "fix its permissions, or its encoding if it isn't UTF-8",
+        ),
+        None => {
+            match files::ensure_writable(&node.path) {
+                Ok(()) => report.pass(&format!("{name} is readable and writable")),
+                Err(e) => report.fail(
+                    &format!("{e:#}"),
+                    "fix permissions of the file and its directory",
+                ),
+            }
+            let content = ignore_file::read(&node.path).unwrap_or_default();
+            let crlf = content.matches("\r\n").count();
+            if crlf > 0 && crlf < content.matches('\n').count() {
+                report.fail(
+                    &format!("{name} mixes \\r\\n and \\n line endings"),
+                    "convert it to one kind of line endings in an editor",
+                );
+            }
+        }
+    }
+    for child in &node.includes {
+        check_files(child, root, report);
+    }
+}
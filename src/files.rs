@@ -0,0 +1,618 @@
+use std::{
+    cell::{OnceCell, RefCell},
+    fs,
+    io::{Seek, SeekFrom, Write},
+    path::{Component, Path, PathBuf},
+    thread,
+    time::{Duration, Instant},
+};
+
+use anyhow::{bail, Context, Result};
+
+use crate::{backups, hooks, ignore_file, journal, text};
+
+/// Syncthing's own directories, never synced
+pub const INTERNAL: [&str; 2] = [".stfolder", ".stversions"];
+
+/// Regular files in the directory and its subdirectories, excluding
+/// Syncthing's internal directories. Symlinks aren't followed.
+pub fn walk(dir: &Path) -> Result<Vec<PathBuf>> {
+    Ok(walk_limited(dir, usize::MAX)?.0)
+}
+
+/// Like [walk], but stops reading directories once `limit` files are
+/// found. Returns whether all files were found.
+pub fn walk_limited(dir: &Path, limit: usize) -> Result<(Vec<PathBuf>, bool)> {
+    let mut files = Vec::new();
+    let mut dirs = vec![dir.to_owned()];
+    while let Some(dir) = dirs.pop() {
+        if files.len() >= limit {
+            files.sort();
+            return Ok((files, false));
+        }
+        let entries =
+            fs::read_dir(&dir).with_context(|| format!("Can't read {}", dir.display()))?;
+        for entry in entries {
+            let entry = entry.with_context(|| format!("Can't read {}", dir.display()))?;
+            let file_type = entry
+                .file_type()
+                .with_context(|| format!("Can't read {}", entry.path().display()))?;
+            if file_type.is_dir() {
+                if !INTERNAL.iter().any(|i| entry.file_name() == *i) {
+                    dirs.push(entry.path());
+                }
+            } else if file_type.is_file() {
+                files.push(entry.path());
+            }
+        }
+    }
+    files.sort();
+    Ok((files, true))
+}
+
+/// Absolute path with symlinks resolved. On Windows the result is kept in
+/// the usual `C:\dir` or `\\server\share\dir` form instead of the verbatim
+/// `\\?\C:\dir` one, so it can be compared with paths from other sources.
+pub fn canonicalize(path: &Path) -> std::io::Result<PathBuf> {
+    let canonical = fs::canonicalize(path)?;
+    Ok(match simplify(&canonical.to_string_lossy()) {
+        Some(simple) if cfg!(windows) => PathBuf::from(simple),
+        _ => canonical,
+    })
+}
+
+/// Resolves `.` and `..` components without touching the filesystem, so
+/// `dir/../../x` can't pass for a path inside `dir`
+pub fn lexical(path: &Path) -> PathBuf {
+    let mut normalized = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::CurDir => {}
+            Component::ParentDir => {
+                normalized.pop();
+            }
+            c => normalized.push(c),
+        }
+    }
+    normalized
+}
+
+/// Drops the verbatim prefix of drive and UNC paths
+fn simplify(path: &str) -> Option<String> {
+    let rest = path.strip_prefix(r"\\?\")?;
+    if let Some(unc) = rest.strip_prefix(r"UNC\") {
+        return Some(format!(r"\\{unc}"));
+    }
+    let mut chars = rest.chars();
+    match (chars.next(), chars.next()) {
+        (Some(drive), Some(':')) if drive.is_ascii_alphabetic() => Some(rest.to_owned()),
+        // e.g. \\?\Volume{GUID}\ has no other form
+        _ => None,
+    }
+}
+
+/// Replaces the file content through a temporary file in the same directory,
+/// so a crash or a concurrent syncthing scan never sees a truncated file.
+/// Symlinks are followed, the file they point to is replaced. With `--fsync`
+/// the data and the directory entry are flushed to disk, with `--backup` the
+/// old content is saved first.
+pub fn write(path: &Path, content: impl AsRef<[u8]>) -> Result<()> {
+    let target = follow_symlink(path)?;
+    let before = match fs::read(&target) {
+        Ok(before) => Some(before),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+        Err(e) => return Err(e).with_context(|| format!("Can't read {}", path.display())),
+    };
+    replace(path, before.as_deref(), content.as_ref())
+}
+
+/// [write] for callers that have read the file already: `before` is its
+/// content, `None` if it didn't exist. The file isn't read again.
+fn replace(path: &Path, before: Option<&[u8]>, content: &[u8]) -> Result<()> {
+    let target = follow_symlink(path)?;
+    let tmp = temp_path(&target)?;
+
+    let fsync = crate::FSYNC.get() == Some(&true);
+    let original = before.map(|_| target.as_path());
+    if let (Some(before), Some(&keep)) = (before, crate::KEEP_BACKUPS.get()) {
+        backups::save(&target, before, keep)?;
+    }
+    if let Some(hook) = crate::PRE_WRITE.get() {
+        let text = |c: &[u8]| String::from_utf8_lossy(c).into_owned();
+        let change = journal::Change {
+            path: canonicalize(&target).unwrap_or(target.clone()),
+            before: before.map(text),
+            after: Some(text(content)),
+        };
+        let folder = crate::find_syncthing_dir().ok().map(|(root, _)| root);
+        hooks::run("pre-write", hook, folder.as_deref(), &[change])
+            .with_context(|| format!("{} wasn't changed", path.display()))?;
+    }
+    let result = write_file(&tmp, content, original, fsync).and_then(|_| fs::rename(&tmp, &target));
+    if result.is_err() {
+        let _ = fs::remove_file(&tmp);
+    }
+    result.map_err(|e| not_writable(path, &directory(&target), e))?;
+    TRANSACTION.with(|t| {
+        if let Some(written) = t.borrow_mut().as_mut() {
+            if !written.iter().any(|(p, _)| *p == target) {
+                written.push((target.clone(), before.map(<[u8]>::to_vec)));
+            }
+        }
+    });
+    journal::record(
+        &canonicalize(&target).unwrap_or(target.clone()),
+        before,
+        Some(content),
+    );
+    if fsync {
+        sync_dir(&target).with_context(|| format!("Can't sync {}", path.display()))?;
+    }
+    Ok(())
+}
+
+/// File written in a transaction with its content before it, `None` if the
+/// transaction created it
+type Written = (PathBuf, Option<Vec<u8>>);
+
+thread_local! {
+    /// Files written by the transaction running on this thread
+    static TRANSACTION: RefCell<Option<Vec<Written>>> = const { RefCell::new(None) };
+}
+
+/// Runs `f` changing several files as a unit: if it fails, the files it has
+/// written with [write] get their previous content back, and the ones it
+/// has created are deleted. A transaction inside of another one is rolled
+/// back along with the outer one.
+pub fn transaction<T>(f: impl FnOnce() -> Result<T>) -> Result<T> {
+    let outer = TRANSACTION.with(|t| t.replace(Some(Vec::new())));
+    let result = f();
+    let written = TRANSACTION.with(|t| t.replace(outer)).unwrap_or_default();
+    match &result {
+        Ok(_) => TRANSACTION.with(|t| {
+            if let Some(outer) = t.borrow_mut().as_mut() {
+                for (path, before) in written {
+                    if !outer.iter().any(|(p, _)| *p == path) {
+                        outer.push((path, before));
+                    }
+                }
+            }
+        }),
+        Err(_) => rollback(written),
+    }
+    result
+}
+
+/// Gives every file changed by this invocation so far, as recorded in the
+/// journal, its previous content back, like a failed [transaction] does
+pub fn roll_back_pending() {
+    rollback(
+        journal::pending()
+            .into_iter()
+            .map(|c| (c.path, c.before.map(String::into_bytes)))
+            .collect(),
+    );
+}
+
+/// Restores the files written by a failed transaction, the last written
+/// first. Files that can't be restored are reported and left as they are.
+fn rollback(written: Vec<Written>) {
+    for (path, before) in written.into_iter().rev() {
+        let canonical = canonicalize(&path).unwrap_or(path.clone());
+        let current = fs::read(&path).ok();
+        let restored = match &before {
+            Some(before) => restore(&path, before),
+            None => match fs::remove_file(&path) {
+                Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                    Err(e).with_context(|| format!("Can't delete {}", path.display()))
+                }
+                _ => Ok(()),
+            },
+        };
+        match restored {
+            Ok(()) => {
+                journal::record(&canonical, current.as_deref(), before.as_deref());
+                eprintln!(
+                    "NOTE: {} {} because of the error",
+                    if before.is_some() {
+                        "restored"
+                    } else {
+                        "deleted"
+                    },
+                    path.display()
+                );
+            }
+            Err(e) => eprintln!("NOTE: {e:#}, it's left changed"),
+        }
+    }
+}
+
+/// Puts the content back like [write], without backups, hooks or the journal
+fn restore(path: &Path, content: &[u8]) -> Result<()> {
+    let tmp = temp_path(path)?;
+    let fsync = crate::FSYNC.get() == Some(&true);
+    let result = write_file(&tmp, content, Some(path), fsync).and_then(|_| fs::rename(&tmp, path));
+    if result.is_err() {
+        let _ = fs::remove_file(&tmp);
+    }
+    result.with_context(|| format!("Can't restore {}", path.display()))
+}
+
+/// Checks that the file can be changed with [write], so the user learns
+/// about missing permissions before confirming anything
+pub fn ensure_writable(path: &Path) -> Result<()> {
+    let target = follow_symlink(path)?;
+    if target.exists() {
+        fs::File::options()
+            .write(true)
+            .open(&target)
+            .map_err(|e| not_writable(path, &target, e))?;
+    }
+    // missing directories are created along with the file
+    if !directory(&target).exists() {
+        return Ok(());
+    }
+    let tmp = temp_path(&target)?;
+    fs::File::options()
+        .write(true)
+        .create_new(true)
+        .open(&tmp)
+        .map_err(|e| not_writable(path, &directory(&target), e))?;
+    let _ = fs::remove_file(&tmp);
+    Ok(())
+}
+
+fn follow_symlink(path: &Path) -> Result<PathBuf> {
+    Ok(match fs::symlink_metadata(path) {
+        Ok(meta) if meta.file_type().is_symlink() => fs::canonicalize(path)
+            .with_context(|| format!("Can't resolve symlink {}", path.display()))?,
+        _ => path.to_owned(),
+    })
+}
+
+/// Temporary file to write the new content of the file to
+fn temp_path(target: &Path) -> Result<PathBuf> {
+    let name = target
+        .file_name()
+        .with_context(|| format!("{} is not a file", target.display()))?;
+    // syncthing treats `.syncthing.*.tmp` files as its own temporary ones
+    // and never syncs them
+    Ok(target.with_file_name(format!(
+        ".syncthing.{}.{}.tmp",
+        name.to_string_lossy(),
+        std::process::id()
+    )))
+}
+
+fn directory(file: &Path) -> PathBuf {
+    match file.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir.to_owned(),
+        _ => PathBuf::from("."),
+    }
+}
+
+/// Error of writing to `path`. If it's caused by permissions of `denied`
+/// (the file or its directory), explains who may change it instead of the
+/// bare OS error.
+fn not_writable(path: &Path, denied: &Path, e: std::io::Error) -> anyhow::Error {
+    if e.kind() != std::io::ErrorKind::PermissionDenied {
+        return anyhow::Error::new(e).context(format!("Can't write to {}", path.display()));
+    }
+    let mut message = format!("Can't write to {}: permission denied", path.display());
+    if let Ok(meta) = fs::metadata(denied) {
+        let what = if meta.is_dir() { "Directory" } else { "File" };
+        message.push_str(&format!(
+            "\n{what} {} {}",
+            denied.display(),
+            describe_access(&meta)
+        ));
+    }
+    message.push_str(
+        "\nFix its permissions, or run stignore as a user allowed to change it (e.g. with sudo)",
+    );
+    anyhow::Error::msg(message)
+}
+
+#[cfg(unix)]
+fn describe_access(meta: &fs::Metadata) -> String {
+    use std::os::unix::fs::MetadataExt;
+    format!(
+        "is owned by {}:{} with mode {:04o}",
+        account_name("/etc/passwd", meta.uid()),
+        account_name("/etc/group", meta.gid()),
+        meta.mode() & 0o7777
+    )
+}
+
+#[cfg(not(unix))]
+fn describe_access(meta: &fs::Metadata) -> String {
+    if meta.permissions().readonly() {
+        "is read-only".to_owned()
+    } else {
+        "isn't writable by this user".to_owned()
+    }
+}
+
+/// Name of the user or group with the id from `/etc/passwd` or
+/// `/etc/group`, or the id itself for accounts from other sources (e.g. LDAP)
+#[cfg(unix)]
+fn account_name(file: &str, id: u32) -> String {
+    fs::read_to_string(file)
+        .ok()
+        .and_then(|content| {
+            content.lines().find_map(|line| {
+                let fields: Vec<&str> = line.split(':').collect();
+                (fields.get(2) == Some(&id.to_string().as_str())).then(|| fields[0].to_owned())
+            })
+        })
+        .unwrap_or_else(|| id.to_string())
+}
+
+fn write_file(
+    path: &Path,
+    content: &[u8],
+    original: Option<&Path>,
+    fsync: bool,
+) -> std::io::Result<()> {
+    let mut file = fs::File::create(path)?;
+    file.write_all(content)?;
+    if let Some(original) = original {
+        copy_metadata(original, path)?;
+    }
+    if fsync {
+        file.sync_all()?;
+    }
+    Ok(())
+}
+
+/// Carries mode bits, ownership and extended attributes of the replaced file
+/// over to its replacement, as far as the user is allowed to
+fn copy_metadata(from: &Path, to: &Path) -> std::io::Result<()> {
+    let meta = fs::metadata(from)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::{chown, MetadataExt};
+
+        // only root can give files away, others may still keep the group
+        if chown(to, Some(meta.uid()), Some(meta.gid())).is_err() {
+            let _ = chown(to, None, Some(meta.gid()));
+        }
+        // the filesystem may not support attributes, and ones of protected
+        // namespaces (e.g. `security.`) may be rejected
+        for name in xattr::list(from).into_iter().flatten() {
+            if let Ok(Some(value)) = xattr::get(from, &name) {
+                let _ = xattr::set(to, &name, &value);
+            }
+        }
+    }
+    // last, as read-only mode would prevent changing attributes
+    fs::set_permissions(to, meta.permissions())
+}
+
+/// Flushes the directory entry of the file, so the rename survives a crash.
+/// Windows can't open directories as files and doesn't need it.
+fn sync_dir(file: &Path) -> std::io::Result<()> {
+    match file.parent() {
+        Some(dir) if cfg!(unix) => fs::File::open(dir)?.sync_all(),
+        _ => Ok(()),
+    }
+}
+
+/// How long to wait for other programs to release the lock of a file
+const LOCK_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Exclusive advisory lock of a file, released when dropped. The file is
+/// read once, through the lock, and written from the content read.
+pub struct Lock {
+    file: fs::File,
+    path: PathBuf,
+    /// The file was created by locking it
+    created: bool,
+    content: OnceCell<Vec<u8>>,
+}
+
+impl Lock {
+    /// Content of the locked file. On Windows locks are mandatory, so other
+    /// handles (even of this process) can't read it. Fails for files that
+    /// can't be ignore files, see [ignore_file::read_from].
+    pub fn read(&self) -> std::io::Result<&[u8]> {
+        if let Some(content) = self.content.get() {
+            return Ok(content);
+        }
+        let mut file = &self.file;
+        file.seek(SeekFrom::Start(0))?;
+        let content = ignore_file::read_from(file)?;
+        Ok(self.content.get_or_init(|| content))
+    }
+
+    /// Text content of the locked file, without the byte order mark
+    pub fn read_to_string(&self) -> std::io::Result<String> {
+        String::from_utf8(self.read()?.to_vec())
+            .map(text::strip_bom)
+            .map_err(std::io::Error::other)
+    }
+
+    /// Replaces the content of the file like [write]. A file created by
+    /// locking it counts as a new one.
+    pub fn write(&self, content: impl AsRef<[u8]>) -> Result<()> {
+        let before = match self.created {
+            true => None,
+            false => Some(
+                self.read()
+                    .with_context(|| format!("Can't read {}", self.path.display()))?,
+            ),
+        };
+        replace(&self.path, before, content.as_ref())
+    }
+}
+
+/// Locks the file against concurrent stignore invocations and editors that
+/// honor advisory locks, creating the file if needed. Fails if the file is
+/// still locked after a few seconds.
+pub fn lock(path: &Path) -> Result<Lock> {
+    let deadline = Instant::now() + LOCK_TIMEOUT;
+    let created = !path.exists();
+    loop {
+        let file = fs::File::options()
+            .read(true)
+            .write(true)
+            .create(true)
+            .truncate(false)
+            .open(path)
+            .map_err(|e| {
+                let denied = if path.exists() {
+                    path.to_owned()
+                } else {
+                    directory(path)
+                };
+                not_writable(path, &denied, e)
+            })?;
+        match file.try_lock() {
+            Ok(()) if is_same_file(&file, path) => {
+                return Ok(Lock {
+                    file,
+                    path: path.to_owned(),
+                    created,
+                    content: OnceCell::new(),
+                })
+            }
+            // replaced by the previous lock holder, the new file has to be locked
+            Ok(()) => {}
+            Err(fs::TryLockError::WouldBlock) if Instant::now() < deadline => {
+                thread::sleep(Duration::from_millis(100))
+            }
+            Err(fs::TryLockError::WouldBlock) => bail!(
+                "{} is busy: another stignore or an editor is changing it",
+                path.display()
+            ),
+            Err(fs::TryLockError::Error(e)) => {
+                return Err(e).with_context(|| format!("Can't lock {}", path.display()))
+            }
+        }
+    }
+}
+
+/// Checks if the path still leads to the opened file. Windows lacks stable
+/// file ids, there it's assumed to.
+fn is_same_file(file: &fs::File, path: &Path) -> bool {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::MetadataExt;
+        match (file.metadata(), fs::metadata(path)) {
+            (Ok(a), Ok(b)) => a.dev() == b.dev() && a.ino() == b.ino(),
+            _ => false,
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = (file, path);
+        true
+    }
+}
+
+/// Size in human-readable units, e.g. `1.5 MiB`
+pub fn format_size(bytes: u64) -> String {
+    const UNITS: [&str; 5] = ["B", "KiB", "MiB", "GiB", "TiB"];
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit + 1 < UNITS.len() {
+        size /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{bytes} B")
+    } else {
+        format!("{size:.1} {}", UNITS[unit])
+    }
+}
+
+/// Parses sizes like `500M`, `2G` or `1.5GiB` (binary units)
+pub fn parse_size(s: &str) -> Result<u64> {
+    let s = s.trim();
+    let split = s
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(s.len());
+    let (number, unit) = s.split_at(split);
+    let number: f64 = number
+        .parse()
+        .with_context(|| format!("Invalid size {s}, expected e.g. 500M or 2G"))?;
+    let power = match unit.trim().to_ascii_uppercase().trim_end_matches("IB") {
+        "" | "B" => 0,
+        "K" => 1,
+        "M" => 2,
+        "G" => 3,
+        "T" => 4,
+        _ => bail!("Invalid size {s}, expected e.g. 500M or 2G"),
+    };
+    Ok((number * 1024f64.powi(power)) as u64)
+}
+
+/// Parses durations like `30d`, `12h` or `2w`
+pub fn parse_age(s: &str) -> Result<Duration> {
+    let s = s.trim();
+    let (number, unit) = s.split_at(s.len().saturating_sub(1));
+    let number: u64 = number
+        .parse()
+        .with_context(|| format!("Invalid age {s}, expected e.g. 30d or 12h"))?;
+    let seconds = match unit {
+        "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 24 * 60 * 60,
+        "w" => 7 * 24 * 60 * 60,
+        _ => bail!("Invalid age {s}, expected e.g. 30d or 12h (units are s, m, h, d and w)"),
+    };
+    Ok(Duration::from_secs(number * seconds))
+}
+
+/// ID of the filesystem the path is on. Mount points aren't detected on
+/// other platforms, there all paths are reported to be on one filesystem.
+#[cfg(unix)]
+pub fn filesystem(path: &Path) -> Option<u64> {
+    use std::os::unix::fs::MetadataExt;
+    fs::metadata(path).ok().map(|m| m.dev())
+}
+
+#[cfg(not(unix))]
+pub fn filesystem(_path: &Path) -> Option<u64> {
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn simplify_drive_paths() {
+        assert_eq!(
+            simplify(r"\\?\C:\Users\me").as_deref(),
+            Some(r"C:\Users\me")
+        );
+        assert_eq!(simplify(r"\\?\C:\").as_deref(), Some(r"C:\"));
+    }
+
+    #[test]
+    fn simplify_unc_paths() {
+        assert_eq!(
+            simplify(r"\\?\UNC\server\share\dir").as_deref(),
+            Some(r"\\server\share\dir")
+        );
+    }
+
+    #[test]
+    fn keep_other_paths() {
+        assert_eq!(simplify(r"\\?\Volume{1234}\dir"), None);
+        assert_eq!(simplify(r"C:\dir"), None);
+        assert_eq!(simplify("/home/me"), None);
+    }
+
+    #[test]
+    fn lexical_resolves_parent_components() {
+        let dir = Path::new("/st/folder");
+        assert_eq!(lexical(&dir.join("a/./b/../c")), dir.join("a/c"));
+        assert_eq!(lexical(&dir.join("../other")), Path::new("/st/other"));
+        assert!(!lexical(&dir.join("a/../../folder2/x")).starts_with(dir));
+        // joining an absolute path replaces the folder
+        assert_eq!(lexical(&dir.join("/etc/passwd")), Path::new("/etc/passwd"));
+    }
+}
@@ -0,0 +1,196 @@
+use std::{
+    collections::BTreeSet,
+    io::{self, Write},
+};
+
+use anyhow::{Context, Result};
+use crossterm::{
+    cursor,
+    event::{self, Event, KeyCode, KeyEventKind, KeyModifiers},
+    queue,
+    style::{Attribute, Print, SetAttribute},
+    terminal::{self, ClearType},
+};
+
+use crate::tui::Screen;
+
+const KEYS: &str = "tab select  enter done  \u{2191}/\u{2193} move  esc cancel";
+
+/// Score of the item matching the query like fzf does: every word of the
+/// query has to appear in the item, its letters in order but not
+/// necessarily adjacent.
+/// Matches right after a separator or the previous match score higher.
+/// Ignores case unless the query has uppercase letters. `None` if it
+/// doesn't match.
+fn score(query: &str, item: &str) -> Option<i64> {
+    let case_sensitive = query.chars().any(char::is_uppercase);
+    let fold = |c: char| {
+        if case_sensitive {
+            c
+        } else {
+            c.to_lowercase().next().unwrap_or(c)
+        }
+    };
+    let item: Vec<char> = item.chars().map(fold).collect();
+    let mut total = 0;
+    for word in query.split_whitespace() {
+        let mut score = 0;
+        let mut pos = 0;
+        let mut previous: Option<usize> = None;
+        for c in word.chars().map(fold) {
+            let found = pos + item[pos..].iter().position(|&i| i == c)?;
+            score += match (found, previous) {
+                (f, Some(p)) if f == p + 1 => 8,
+                (0, _) => 6,
+                (f, _) if matches!(item[f - 1], '/' | '.' | '_' | '-' | ' ') => 6,
+                _ => 1,
+            };
+            // gaps make the match worse
+            score -= previous.map_or(0, |p| (found - p - 1).min(4) as i64);
+            previous = Some(found);
+            pos = found + 1;
+        }
+        total += score;
+    }
+    Some(total)
+}
+
+/// Items matching the query, best first, shorter ones first among equals
+fn filter(items: &[String], query: &str) -> Vec<usize> {
+    let mut matched: Vec<(i64, usize)> = items
+        .iter()
+        .enumerate()
+        .filter_map(|(i, item)| Some((score(query, item)?, i)))
+        .collect();
+    matched.sort_by_key(|&(score, i)| (-score, items[i].len(), i));
+    matched.into_iter().map(|(_, i)| i).collect()
+}
+
+/// Lets the user pick some of the items with a fuzzy search, returns their
+/// indices in the order of the items. Enter without selecting anything
+/// picks the highlighted item, Esc picks nothing.
+pub fn select(items: &[String]) -> Result<Vec<usize>> {
+    let screen = Screen::enter()?;
+    let mut out = io::stdout();
+    let mut query = String::new();
+    let mut shown = filter(items, &query);
+    let mut cursor = 0;
+    let mut selected = BTreeSet::new();
+    loop {
+        draw(&mut out, items, &query, &shown, cursor, &selected)
+            .context("Can't draw the screen")?;
+        let Event::Key(key) = event::read().context("Can't read the keyboard")? else {
+            continue;
+        };
+        if key.kind != KeyEventKind::Press {
+            continue;
+        }
+        let ctrl = key.modifiers.contains(KeyModifiers::CONTROL);
+        match key.code {
+            KeyCode::Esc => return Ok(Vec::new()),
+            KeyCode::Char('c') if ctrl => return Ok(Vec::new()),
+            KeyCode::Enter => {
+                if selected.is_empty() {
+                    selected.extend(shown.get(cursor));
+                }
+                drop(screen);
+                return Ok(selected.into_iter().collect());
+            }
+            KeyCode::Tab => {
+                if let Some(&i) = shown.get(cursor) {
+                    if !selected.remove(&i) {
+                        selected.insert(i);
+                    }
+                    cursor = (cursor + 1).min(shown.len().saturating_sub(1));
+                }
+            }
+            KeyCode::Up => cursor = cursor.saturating_sub(1),
+            KeyCode::Char('p') if ctrl => cursor = cursor.saturating_sub(1),
+            KeyCode::Down => cursor = (cursor + 1).min(shown.len().saturating_sub(1)),
+            KeyCode::Char('n') if ctrl => cursor = (cursor + 1).min(shown.len().saturating_sub(1)),
+            KeyCode::Backspace => {
+                query.pop();
+                shown = filter(items, &query);
+                cursor = 0;
+            }
+            KeyCode::Char(c) if !ctrl => {
+                query.push(c);
+                shown = filter(items, &query);
+                cursor = 0;
+            }
+            _ => {}
+        }
+    }
+}
+
+fn draw(
+    out: &mut impl Write,
+    items: &[String],
+    query: &str,
+    shown: &[usize],
+    cursor: usize,
+    selected: &BTreeSet<usize>,
+) -> io::Result<()> {
+    let (width, height) = terminal::size()?;
+    let (width, height) = (usize::from(width), usize::from(height));
+    // the query at the top, the counts at the bottom
+    let visible = height.saturating_sub(2);
+    let cut = |line: &str| line.chars().take(width).collect::<String>();
+
+    queue!(out, terminal::Clear(ClearType::All), cursor::MoveTo(0, 0))?;
+    queue!(out, Print(cut(&format!("> {query}"))))?;
+    let offset = (cursor + 1).saturating_sub(visible);
+    for (y, &i) in shown.iter().skip(offset).take(visible).enumerate() {
+        queue!(out, cursor::MoveTo(0, (y + 1) as u16))?;
+        if offset + y == cursor {
+            queue!(out, SetAttribute(Attribute::Reverse))?;
+        }
+        let mark = if selected.contains(&i) { '*' } else { ' ' };
+        queue!(
+            out,
+            Print(cut(&format!("{mark} {}", items[i]))),
+            SetAttribute(Attribute::Reset)
+        )?;
+    }
+    let status = format!(
+        "{}/{} ({} selected)   {KEYS}",
+        shown.len(),
+        items.len(),
+        selected.len()
+    );
+    queue!(
+        out,
+        cursor::MoveTo(0, height.saturating_sub(1) as u16),
+        Print(cut(&status))
+    )?;
+    out.flush()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn fuzzy_scores() {
+        assert!(score("smr", "src/main.rs").is_some());
+        assert!(score("msr", "src/main.rs").is_none());
+        // each word matches on its own
+        assert!(score("main src", "src/main.rs").is_some());
+        assert!(score("main lib", "src/main.rs").is_none());
+        // consecutive letters and word starts beat scattered ones
+        assert!(score("main", "src/main.rs") > score("main", "my_animal.rs"));
+        // uppercase makes the search case sensitive
+        assert!(score("readme", "README.md").is_some());
+        assert!(score("Readme", "README.md").is_none());
+    }
+
+    #[test]
+    fn best_and_shortest_matches_first() {
+        let items: Vec<String> = ["docs/main.md", "src/main.rs", "src/domain.rs", "main.rs"]
+            .map(str::to_owned)
+            .to_vec();
+        assert_eq!(filter(&items, "main"), [3, 1, 0, 2]);
+        assert_eq!(filter(&items, "rs main"), [3, 1, 2]);
+        assert_eq!(filter(&items, "").len(), items.len());
+    }
+}
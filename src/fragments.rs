@@ -0,0 +1,76 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+
+/// Directory with pattern fragments, relative to syncthing folder root
+pub const DIR: &str = ".stignore.d";
+const EXTENSION: &str = "stignore";
+
+/// Path to the fragment file, `media` and `media.stignore` refer to the same
+/// `.stignore.d/media.stignore`
+pub fn path(st_dir: &Path, name: &str) -> Result<PathBuf> {
+    let name = name.strip_suffix(".stignore").unwrap_or(name);
+    if name.is_empty() || name.contains(['/', '\\']) || name.starts_with('.') {
+        bail!("Invalid fragment name: {name}");
+    }
+    Ok(st_dir.join(DIR).join(format!("{name}.{EXTENSION}")))
+}
+
+/// Fragment files present in the folder, sorted by name
+pub fn list(st_dir: &Path) -> Result<Vec<PathBuf>> {
+    let dir = st_dir.join(DIR);
+    let entries = match fs::read_dir(&dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Can't read {}", dir.display())),
+    };
+    let mut fragments = Vec::new();
+    for entry in entries {
+        let path = entry
+            .with_context(|| format!("Can't read {}", dir.display()))?
+            .path();
+        if path.is_file() && path.extension() == Some(EXTENSION.as_ref()) {
+            fragments.push(path);
+        }
+    }
+    fragments.sort();
+    Ok(fragments)
+}
+
+/// Checks if the path points into the fragment directory
+pub fn is_fragment(st_dir: &Path, path: &Path) -> bool {
+    path.parent() == Some(&st_dir.join(DIR))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn names_and_listing() {
+        let st_dir =
+            std::env::temp_dir().join(format!("stignore-fragments-{}", std::process::id()));
+        fs::remove_dir_all(&st_dir).ok();
+        assert!(list(&st_dir).unwrap().is_empty());
+        let media = path(&st_dir, "media").unwrap();
+        assert_eq!(media, st_dir.join(".stignore.d/media.stignore"));
+        assert_eq!(path(&st_dir, "media.stignore").unwrap(), media);
+        for invalid in ["", "a/b", ".hidden"] {
+            assert!(path(&st_dir, invalid).is_err(), "{invalid}");
+        }
+        fs::create_dir_all(st_dir.join(DIR)).unwrap();
+        fs::write(st_dir.join(".stignore.d/dev.stignore"), "").unwrap();
+        fs::write(&media, "").unwrap();
+        fs::write(st_dir.join(".stignore.d/notes.txt"), "").unwrap();
+        assert_eq!(
+            list(&st_dir).unwrap(),
+            [st_dir.join(".stignore.d/dev.stignore"), media.clone()]
+        );
+        assert!(is_fragment(&st_dir, &media));
+        assert!(!is_fragment(&st_dir, &st_dir.join(".stignore")));
+        fs::remove_dir_all(st_dir).ok();
+    }
+}
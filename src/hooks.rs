@@ -0,0 +1,64 @@
+use std::{
+    io::Write,
+    path::Path,
+    process::{Command, Stdio},
+};
+
+use anyhow::{bail, Context, Result};
+use serde_json::json;
+
+use crate::journal::{self, Change};
+
+/// Runs the user's hook command through the shell. The changes are passed
+/// as JSON on stdin, the folder, changed files and added patterns also in
+/// `STIGNORE_*` environment variables.
+pub fn run(hook: &str, command: &str, folder: Option<&Path>, changes: &[Change]) -> Result<()> {
+    let files: Vec<String> = changes
+        .iter()
+        .map(|c| c.path.to_string_lossy().into_owned())
+        .collect();
+    let added: Vec<&str> = changes.iter().flat_map(Change::added).collect();
+    let input = json!({
+        "hook": hook,
+        "folder": folder.map(|f| f.to_string_lossy()),
+        "command": journal::command_line(),
+        "files": changes
+            .iter()
+            .map(|c| json!({
+                "path": c.path.to_string_lossy(),
+                "added": c.added(),
+                "removed": c.removed(),
+            }))
+            .collect::<Vec<_>>(),
+    });
+
+    let mut shell = if cfg!(windows) {
+        let mut shell = Command::new("cmd");
+        shell.arg("/C");
+        shell
+    } else {
+        let mut shell = Command::new("sh");
+        shell.arg("-c");
+        shell
+    };
+    let mut child = shell
+        .arg(command)
+        .env("STIGNORE_HOOK", hook)
+        .env("STIGNORE_FOLDER", folder.unwrap_or(Path::new("")))
+        .env("STIGNORE_FILES", files.join("\n"))
+        .env("STIGNORE_PATTERNS", added.join("\n"))
+        .stdin(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Can't run {hook} hook `{command}`"))?;
+    if let Some(mut stdin) = child.stdin.take() {
+        // the hook may not read its input
+        let _ = stdin.write_all(input.to_string().as_bytes());
+    }
+    let status = child
+        .wait()
+        .with_context(|| format!("Can't run {hook} hook `{command}`"))?;
+    if !status.success() {
+        bail!("{hook} hook `{command}` failed ({status})");
+    }
+    Ok(())
+}
@@ -0,0 +1,364 @@
+//! Ignore file as a list of lines that can be edited and written back
+//! without changing the lines nobody touched
+
+use std::{
+    fmt, fs,
+    io::{self, Read},
+    path::Path,
+};
+
+use anyhow::{Context, Result};
+
+use crate::{
+    include::included_path,
+    pattern::Pattern,
+    text::{self, LINE_ENDING},
+};
+
+/// Size of the largest file treated as an ignore file, bigger ones are
+/// surely something else given by mistake
+pub const MAX_SIZE: u64 = 16 * 1024 * 1024;
+
+/// Reads an ignore file as text
+pub fn read(path: &Path) -> io::Result<String> {
+    let content = read_from(&fs::File::open(path)?)?;
+    String::from_utf8(content).map_err(|e| io::Error::new(io::ErrorKind::InvalidData, e))
+}
+
+/// Reads the rest of an open ignore file. Fails for files that can't be
+/// ignore files: larger than 16 MiB, or binary ones.
+pub fn read_from(file: &fs::File) -> io::Result<Vec<u8>> {
+    let too_big = || {
+        io::Error::new(
+            io::ErrorKind::InvalidData,
+            "it's larger than 16 MiB, too big for an ignore file, is it the right one?",
+        )
+    };
+    if file.metadata()?.len() > MAX_SIZE {
+        return Err(too_big());
+    }
+    let mut content = Vec::new();
+    // it could have grown since
+    file.take(MAX_SIZE + 1).read_to_end(&mut content)?;
+    if content.len() as u64 > MAX_SIZE {
+        return Err(too_big());
+    }
+    // UTF-16 text has them as well, Syncthing reads only UTF-8
+    if content.contains(&0) {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            "it has NUL bytes, it's a binary or UTF-16 file, not an ignore file",
+        ));
+    }
+    Ok(content)
+}
+
+/// What a line of an ignore file is
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Kind<'a> {
+    Blank,
+    /// `// comment`
+    Comment,
+    /// `#include path`, with the path
+    Include(&'a str),
+    /// Pattern with its flags, `None` if it has flags, but no glob
+    Pattern(Option<Pattern<'a>>),
+}
+
+/// Line of an ignore file
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Entry {
+    /// Line as written, with spaces, but without the line break
+    line: String,
+    /// `\n` or `\r\n`, empty for the last line of a file not ending with a
+    /// line break
+    ending: &'static str,
+}
+
+impl Entry {
+    pub fn line(&self) -> &str {
+        &self.line
+    }
+
+    pub fn kind(&self) -> Kind<'_> {
+        let line = self.line.trim();
+        if line.is_empty() {
+            Kind::Blank
+        } else if line.starts_with("//") {
+            Kind::Comment
+        } else if let Some(path) = included_path(line) {
+            Kind::Include(path)
+        } else {
+            Kind::Pattern(Pattern::parse(line))
+        }
+    }
+}
+
+/// Lines of an ignore file in order. Written back unchanged, it's identical
+/// to the file read, byte order mark and line endings included.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct IgnoreFile {
+    bom: bool,
+    entries: Vec<Entry>,
+    /// Line ending of added lines, the one most lines of the file use
+    ending: &'static str,
+    /// The last line has a line break
+    final_newline: bool,
+}
+
+impl IgnoreFile {
+    pub fn parse(content: &str) -> Self {
+        let (bom, content) = match content.strip_prefix('\u{feff}') {
+            Some(rest) => (true, rest),
+            None => (false, content),
+        };
+        let entries = content
+            .split_inclusive('\n')
+            .map(|line| {
+                let (line, ending) = if let Some(l) = line.strip_suffix("\r\n") {
+                    (l, "\r\n")
+                } else if let Some(l) = line.strip_suffix('\n') {
+                    (l, "\n")
+                } else {
+                    (line, "")
+                };
+                Entry {
+                    line: line.to_owned(),
+                    ending,
+                }
+            })
+            .collect();
+        IgnoreFile {
+            bom,
+            entries,
+            ending: text::line_ending(content).unwrap_or(LINE_ENDING),
+            // files without lines get one when lines are added
+            final_newline: content.is_empty() || content.ends_with('\n'),
+        }
+    }
+
+    /// Reads the file with [read], a missing one is empty
+    pub fn load(path: &Path) -> Result<Self> {
+        match read(path) {
+            Ok(content) => Ok(IgnoreFile::parse(&content)),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(IgnoreFile::parse("")),
+            Err(e) => Err(e).with_context(|| format!("Can't read {}", path.display())),
+        }
+    }
+
+    pub fn entries(&self) -> &[Entry] {
+        &self.entries
+    }
+
+    /// Index of the line, compared without surrounding spaces
+    pub fn find(&self, line: &str) -> Option<usize> {
+        self.entries
+            .iter()
+            .position(|e| e.line.trim() == line.trim())
+    }
+
+    /// Inserts the line before the entry at `index`, `len()` appends it.
+    /// Lines are added with a line break, even to the end of a file not
+    /// ending with one.
+    pub fn insert(&mut self, index: usize, line: &str) {
+        if index == self.entries.len() {
+            self.final_newline = true;
+        }
+        self.entries.insert(
+            index,
+            Entry {
+                line: line.to_owned(),
+                ending: self.ending,
+            },
+        );
+        self.fix_endings(index);
+    }
+
+    /// Changes the text of the line at `index`, keeping its line break
+    pub fn replace(&mut self, index: usize, line: &str) {
+        self.entries[index].line = line.to_owned();
+    }
+
+    pub fn push(&mut self, line: &str) {
+        self.insert(self.entries.len(), line);
+    }
+
+    pub fn remove(&mut self, index: usize) -> Entry {
+        let entry = self.entries.remove(index);
+        self.fix_endings(index);
+        entry
+    }
+
+    /// Moves the entry so it ends up at index `to`
+    pub fn move_entry(&mut self, from: usize, to: usize) {
+        let entry = self.entries.remove(from);
+        self.entries.insert(to, entry);
+        self.fix_endings(from);
+        self.fix_endings(to);
+    }
+
+    /// Adds the lines of `other` missing from this file, patterns and
+    /// comments alike, each after the line preceding it in `other` (or at
+    /// the start), so the order of both files is kept where possible. Blank
+    /// lines aren't added. Returns the added lines.
+    pub fn merge(&mut self, other: &IgnoreFile) -> Vec<String> {
+        let mut added = Vec::new();
+        // index in this file of the last line of `other` seen so far
+        let mut previous: Option<usize> = None;
+        for entry in &other.entries {
+            if entry.kind() == Kind::Blank {
+                continue;
+            }
+            match self.find(&entry.line) {
+                Some(index) => previous = Some(index),
+                None => {
+                    let index = previous.map_or(0, |i| i + 1);
+                    self.insert(index, &entry.line);
+                    added.push(entry.line.trim().to_owned());
+                    previous = Some(index);
+                }
+            }
+        }
+        added
+    }
+
+    /// Indices of the comment lines directly above the entry at `index`,
+    /// which describe it
+    pub fn comments_above(&self, index: usize) -> std::ops::Range<usize> {
+        let count = self.entries[..index]
+            .iter()
+            .rev()
+            .take_while(|e| e.kind() == Kind::Comment)
+            .count();
+        index - count..index
+    }
+
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// Keeps line breaks between lines around the changed `index`, and the
+    /// file ending with one if it did. Only the neighbours and the last line
+    /// are touched, so adding many lines to a large file stays linear.
+    fn fix_endings(&mut self, index: usize) {
+        let last = self.entries.len().saturating_sub(1);
+        for i in [index.saturating_sub(1), index, last] {
+            let Some(entry) = self.entries.get_mut(i) else {
+                continue;
+            };
+            if i == last && !self.final_newline {
+                entry.ending = "";
+            } else if entry.ending.is_empty() {
+                entry.ending = self.ending;
+            }
+        }
+    }
+}
+
+impl fmt::Display for IgnoreFile {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.bom {
+            f.write_str("\u{feff}")?;
+        }
+        for entry in &self.entries {
+            f.write_str(&entry.line)?;
+            f.write_str(entry.ending)?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const CONTENT: &str = "\u{feff}// media\r\n*.mp4\r\n\r\n#include .stignore_sync\n  (?i)!Keep  ";
+
+    #[test]
+    fn unchanged_file_is_identical() {
+        for content in [CONTENT, "", "\n", "a\nb\n", "a\r\nb", "\r\n\r\n"] {
+            assert_eq!(IgnoreFile::parse(content).to_string(), content);
+        }
+    }
+
+    #[test]
+    fn kinds() {
+        let file = IgnoreFile::parse(CONTENT);
+        let kinds: Vec<Kind> = file.entries().iter().map(Entry::kind).collect();
+        assert_eq!(
+            kinds[..4],
+            [
+                Kind::Comment,
+                Kind::Pattern(Pattern::parse("*.mp4")),
+                Kind::Blank,
+                Kind::Include(".stignore_sync"),
+            ]
+        );
+        let Kind::Pattern(Some(pattern)) = kinds[4] else {
+            panic!("not a pattern: {:?}", kinds[4]);
+        };
+        assert!(pattern.negated && pattern.case_insensitive);
+        assert_eq!(pattern.glob, "Keep");
+    }
+
+    #[test]
+    fn edits_keep_other_lines() {
+        let mut file = IgnoreFile::parse(CONTENT);
+        file.push("new");
+        assert_eq!(file.to_string(), format!("{CONTENT}\r\nnew\r\n"));
+        let index = file.find("*.mp4").unwrap();
+        assert_eq!(file.remove(index).line(), "*.mp4");
+        file.move_entry(file.len() - 1, 0);
+        assert_eq!(
+            file.to_string(),
+            "\u{feff}new\r\n// media\r\n\r\n#include .stignore_sync\n  (?i)!Keep  \r\n"
+        );
+    }
+
+    #[test]
+    fn final_newline_is_kept() {
+        let mut file = IgnoreFile::parse("a\nb\n");
+        file.insert(1, "c");
+        file.move_entry(2, 0);
+        assert_eq!(file.to_string(), "b\na\nc\n");
+        let mut file = IgnoreFile::parse("");
+        file.push("a");
+        assert_eq!(file.to_string(), format!("a{LINE_ENDING}"));
+    }
+
+    /// File of a test in the temporary directory
+    fn temp_file(name: &str) -> std::path::PathBuf {
+        std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()))
+    }
+
+    #[test]
+    fn refuse_oversized_files() {
+        let path = temp_file("oversized");
+        let file = fs::File::create(&path).unwrap();
+        file.set_len(MAX_SIZE + 1).unwrap();
+        let err = IgnoreFile::load(&path).unwrap_err();
+        assert!(format!("{err:#}").contains("too big"));
+        file.set_len(MAX_SIZE).unwrap();
+        // sparse files are all NUL bytes, so it's still refused, but not
+        // for its size
+        let err = read(&path).unwrap_err();
+        assert!(err.to_string().contains("NUL"));
+        fs::remove_file(path).ok();
+    }
+
+    #[test]
+    fn refuse_files_with_nul_bytes() {
+        let path = temp_file("nul");
+        fs::write(&path, "*\0.tmp\n").unwrap();
+        let err = read(&path).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        assert!(IgnoreFile::load(&path).is_err());
+        fs::write(&path, "*.tmp\n").unwrap();
+        assert_eq!(read(&path).unwrap(), "*.tmp\n");
+        fs::remove_file(path).ok();
+    }
+}
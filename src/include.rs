@@ -0,0 +1,142 @@
+//! `#include` directives of ignore files
+
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+
+use crate::{ignore_file, text};
+
+/// Returns the path from `#include <path>` directive, `None` for any other line
+pub fn included_path(line: &str) -> Option<&str> {
+    let rest = line.trim().strip_prefix("#include")?;
+    if !rest.starts_with(char::is_whitespace) {
+        return None;
+    }
+    Some(rest.trim()).filter(|p| !p.is_empty())
+}
+
+/// Resolves the include target the same way syncthing does: relative to the
+/// directory of the including file, even if it starts with a slash.
+pub fn resolve(including: &Path, target: &str) -> PathBuf {
+    including
+        .parent()
+        .unwrap_or_else(|| Path::new(""))
+        .join(target.trim_start_matches('/'))
+}
+
+/// Reads the ignore file and recursively substitutes `#include` directives with
+/// the contents of included files, producing lines in the order syncthing
+/// evaluates them. Missing top-level file is treated as empty.
+pub fn flatten(path: &Path) -> Result<Vec<String>> {
+    flatten_edited(path, &[])
+}
+
+/// Like [flatten], but with the given contents in place of the files at the
+/// paths, which don't have to exist yet: the lines syncthing would evaluate
+/// once the files are written.
+pub fn flatten_edited(path: &Path, edited: &[(PathBuf, String)]) -> Result<Vec<String>> {
+    let mut lines = Vec::new();
+    if path.exists() || edited_content(edited, path).is_some() {
+        flatten_into(path, edited, &mut Vec::new(), &mut lines)?;
+    }
+    Ok(lines)
+}
+
+/// Content of the file among the edited ones, if it's there
+fn edited_content<'a>(edited: &'a [(PathBuf, String)], path: &Path) -> Option<&'a str> {
+    let canonical = fs::canonicalize(path).ok();
+    edited
+        .iter()
+        .find(|(p, _)| p == path || canonical.is_some() && fs::canonicalize(p).ok() == canonical)
+        .map(|(_, content)| content.as_str())
+}
+
+fn flatten_into(
+    path: &Path,
+    edited: &[(PathBuf, String)],
+    seen: &mut Vec<PathBuf>,
+    lines: &mut Vec<String>,
+) -> Result<()> {
+    let content = edited_content(edited, path);
+    let canonical = match (fs::canonicalize(path), content) {
+        (Ok(canonical), _) => canonical,
+        // a new file
+        (Err(_), Some(_)) => path.to_owned(),
+        (Err(e), None) => return Err(e).with_context(|| format!("Can't open {}", path.display())),
+    };
+    if seen.contains(&canonical) {
+        // syncthing refuses to load such ignore files, so do we
+        bail!("{} is included more than once", path.display());
+    }
+    seen.push(canonical);
+
+    let content = match content {
+        Some(content) => text::strip_bom(content.to_owned()),
+        None => ignore_file::read(path)
+            .map(text::strip_bom)
+            .with_context(|| format!("Can't read {}", path.display()))?,
+    };
+    for line in content.lines() {
+        match included_path(line) {
+            Some(target) => flatten_into(&resolve(path, target), edited, seen, lines)?,
+            None => lines.push(line.trim().to_owned()),
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()));
+        fs::remove_dir_all(&dir).ok();
+        fs::create_dir_all(dir.join("sub")).unwrap();
+        dir
+    }
+
+    #[test]
+    fn includes_are_substituted_in_place() {
+        let dir = temp_dir("flatten");
+        fs::write(dir.join(".stignore"), "a\n#include sub/common\nd\n").unwrap();
+        // relative to the including file, even with a leading slash
+        fs::write(dir.join("sub/common"), "\u{feff}b\n#include /nested\n").unwrap();
+        fs::write(dir.join("sub/nested"), "  c  \n").unwrap();
+        assert_eq!(
+            flatten(&dir.join(".stignore")).unwrap(),
+            ["a", "b", "c", "d"]
+        );
+        assert!(flatten(&dir.join("missing")).unwrap().is_empty());
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn broken_includes_fail() {
+        let dir = temp_dir("flatten-broken");
+        fs::write(dir.join(".stignore"), "#include sub/a\n#include sub/a\n").unwrap();
+        fs::write(dir.join("sub/a"), "x\n").unwrap();
+        assert!(flatten(&dir.join(".stignore")).is_err());
+        fs::write(dir.join(".stignore"), "#include sub/missing\n").unwrap();
+        assert!(flatten(&dir.join(".stignore")).is_err());
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn edited_files_replace_the_ones_on_disk() {
+        let dir = temp_dir("flatten-edited");
+        fs::write(dir.join(".stignore"), "a\n").unwrap();
+        let edited = [
+            (dir.join(".stignore"), "a\n#include new\n".to_owned()),
+            (dir.join("new"), "b\n".to_owned()),
+        ];
+        assert_eq!(
+            flatten_edited(&dir.join(".stignore"), &edited).unwrap(),
+            ["a", "b"]
+        );
+        fs::remove_dir_all(dir).ok();
+    }
+}
@@ -0,0 +1,290 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+
+use crate::{files, ignore_file, pattern::Pattern, text, LINE_ENDING};
+
+pub use stignore::include::{flatten, flatten_edited, included_path, resolve};
+
+/// Ignore file in the include graph
+pub struct Node {
+    pub path: PathBuf,
+    /// Number of patterns in the file itself, excluding included files
+    pub patterns: usize,
+    pub includes: Vec<Node>,
+    pub problem: Option<Problem>,
+}
+
+impl Node {
+    /// Checks if the file is reachable from this one through `#include`s
+    pub fn includes(&self, path: &Path) -> bool {
+        let path = normalize(path);
+        self.includes
+            .iter()
+            .any(|n| normalize(&n.path) == path || n.includes(&path))
+    }
+}
+
+/// Canonical path if the file exists, lexically normalized one otherwise
+fn normalize(path: &Path) -> PathBuf {
+    files::canonicalize(path).unwrap_or_else(|_| files::lexical(path))
+}
+
+pub enum Problem {
+    Missing,
+    IncludedAgain,
+    Unreadable(String),
+}
+
+impl std::fmt::Display for Problem {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Problem::Missing => write!(f, "missing"),
+            Problem::IncludedAgain => write!(f, "included more than once"),
+            Problem::Unreadable(e) => write!(f, "unreadable: {e}"),
+        }
+    }
+}
+
+/// Builds the include graph starting at `path`. Unlike [`flatten`] problems
+/// with the files are recorded in the graph instead of failing.
+pub fn tree(path: &Path) -> Node {
+    tree_from(path, &mut Vec::new())
+}
+
+/// Like [`tree`], with the given lines in place of the content of `path`,
+/// e.g. .stignore of another device fetched through the API. Included files
+/// are read from this device's copy of the folder.
+pub fn tree_with(path: &Path, lines: &[String]) -> Node {
+    let mut seen = vec![files::canonicalize(path).unwrap_or_else(|_| path.to_owned())];
+    let mut node = Node {
+        path: path.to_owned(),
+        patterns: 0,
+        includes: Vec::new(),
+        problem: None,
+    };
+    for line in lines {
+        if let Some(target) = included_path(line) {
+            node.includes
+                .push(tree_from(&resolve(path, target), &mut seen));
+        } else if Pattern::parse(line).is_some() {
+            node.patterns += 1;
+        }
+    }
+    node
+}
+
+/// Like [`tree`], but fails if `path` itself exists and can't be read, e.g.
+/// for deciding where patterns go, when treating it as empty would be wrong
+pub fn readable_tree(path: &Path) -> Result<Node> {
+    let node = tree(path);
+    if let Some(Problem::Unreadable(e)) = &node.problem {
+        bail!("Can't read {}: {e}", path.display());
+    }
+    Ok(node)
+}
+
+fn tree_from(path: &Path, seen: &mut Vec<PathBuf>) -> Node {
+    let mut node = Node {
+        path: path.to_owned(),
+        patterns: 0,
+        includes: Vec::new(),
+        problem: None,
+    };
+    if !path.exists() {
+        node.problem = Some(Problem::Missing);
+        return node;
+    }
+    let canonical = files::canonicalize(path).unwrap_or_else(|_| path.to_owned());
+    if seen.contains(&canonical) {
+        node.problem = Some(Problem::IncludedAgain);
+        return node;
+    }
+    seen.push(canonical);
+
+    match ignore_file::read(path).map(text::strip_bom) {
+        Ok(content) => {
+            for line in content.lines() {
+                if let Some(target) = included_path(line) {
+                    node.includes.push(tree_from(&resolve(path, target), seen));
+                } else if Pattern::parse(line).is_some() {
+                    node.patterns += 1;
+                }
+            }
+        }
+        Err(e) => node.problem = Some(Problem::Unreadable(e.to_string())),
+    }
+    node
+}
+
+/// The ignore file and the files it includes, in the order Syncthing reads
+/// them. Missing, repeated and unreadable ones are left out, they're for
+/// fix-includes and doctor to report.
+pub fn readable_files(path: &Path) -> Vec<PathBuf> {
+    let mut files = Vec::new();
+    let mut nodes = vec![tree(path)];
+    while let Some(node) = nodes.pop() {
+        if node.problem.is_none() {
+            files.push(node.path);
+        }
+        nodes.extend(node.includes.into_iter().rev());
+    }
+    files
+}
+
+/// Draws the include graph, paths are shown relative to `root`
+pub fn format_tree(node: &Node, root: &Path) -> String {
+    let mut out = String::new();
+    format_node(node, root, "", "", &mut out);
+    out
+}
+
+fn format_node(node: &Node, root: &Path, first: &str, rest: &str, out: &mut String) {
+    let path = node.path.strip_prefix(root).unwrap_or(&node.path);
+    out.push_str(&format!("{first}{}", path.display()));
+    match &node.problem {
+        Some(problem) => out.push_str(&format!(" ({problem})\n")),
+        None => out.push_str(&format!(
+            " ({} pattern{})\n",
+            node.patterns,
+            if node.patterns == 1 { "" } else { "s" }
+        )),
+    }
+    for (i, child) in node.includes.iter().enumerate() {
+        if i + 1 == node.includes.len() {
+            format_node(
+                child,
+                root,
+                &format!("{rest}└── "),
+                &format!("{rest}    "),
+                out,
+            );
+        } else {
+            format_node(
+                child,
+                root,
+                &format!("{rest}├── "),
+                &format!("{rest}│   "),
+                out,
+            );
+        }
+    }
+}
+
+/// Lists `(including file, missing file)` pairs of the include graph
+pub fn broken(node: &Node) -> Vec<(&Path, &Path)> {
+    let mut broken = Vec::new();
+    for child in &node.includes {
+        if let Some(Problem::Missing) = child.problem {
+            broken.push((node.path.as_path(), child.path.as_path()));
+        }
+        broken.extend(self::broken(child));
+    }
+    broken
+}
+
+/// Comment starting files created to be included from `including`
+pub fn header(including: &Path, root: &Path) -> String {
+    let including = including.strip_prefix(root).unwrap_or(including);
+    format!("// Ignore patterns included from {}", including.display())
+}
+
+/// Creates the missing included file with a header comment
+pub fn create(including: &Path, missing: &Path, root: &Path) -> Result<()> {
+    if let Some(dir) = missing.parent() {
+        fs::create_dir_all(dir).with_context(|| format!("Can't create {}", dir.display()))?;
+    }
+    files::write(missing, format!("{}{LINE_ENDING}", header(including, root)))
+        .with_context(|| format!("Can't create {}", missing.display()))
+}
+
+/// Removes `#include` directives of the `missing` file from `including` file
+pub fn remove_directive(including: &Path, missing: &Path) -> Result<()> {
+    let lock = files::lock(including)?;
+    let content = lock
+        .read_to_string()
+        .with_context(|| format!("Can't read {}", including.display()))?;
+    let kept: String = content
+        .split_inclusive('\n')
+        .filter(|line| !matches!(included_path(line), Some(t) if resolve(including, t) == missing))
+        .collect();
+    lock.write(kept)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()));
+        fs::remove_dir_all(&dir).ok();
+        fs::create_dir_all(&dir).unwrap();
+        files::canonicalize(&dir).unwrap()
+    }
+
+    #[test]
+    fn tree_shows_problems() {
+        let dir = temp_dir("tree");
+        fs::write(
+            dir.join(".stignore"),
+            "*.tmp\n#include a\n#include missing\n#include a\n",
+        )
+        .unwrap();
+        fs::write(dir.join("a"), "x\ny\n").unwrap();
+        let tree = tree(&dir.join(".stignore"));
+        assert_eq!(
+            format_tree(&tree, &dir),
+            ".stignore (1 pattern)\n\
+            ├── a (2 patterns)\n\
+            ├── missing (missing)\n\
+            └── a (included more than once)\n"
+        );
+        assert!(tree.includes(&dir.join("a")));
+        assert!(!tree.includes(&dir.join("b")));
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn indirect_includes_are_found() {
+        let dir = temp_dir("indirect-includes");
+        fs::create_dir(dir.join("sub")).unwrap();
+        fs::write(dir.join(".stignore"), "#include sub/common\n").unwrap();
+        fs::write(dir.join("sub/common"), "#include ../.stignore_sync\n").unwrap();
+        fs::write(dir.join(".stignore_sync"), "*.tmp\n").unwrap();
+        let tree = tree(&dir.join(".stignore"));
+        assert!(tree.includes(&dir.join(".stignore_sync")));
+        assert!(tree.includes(&dir.join("sub/../.stignore_sync")));
+        assert!(!tree.includes(&dir.join(".stignore")));
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn broken_includes_are_created_or_removed() {
+        let dir = temp_dir("broken-includes");
+        let stignore = dir.join(".stignore");
+        fs::write(&stignore, "#include sub/new\n#include gone\n*.tmp\n").unwrap();
+        let tree = tree(&stignore);
+        let broken = broken(&tree);
+        assert_eq!(
+            broken,
+            [
+                (stignore.as_path(), dir.join("sub/new").as_path()),
+                (stignore.as_path(), dir.join("gone").as_path())
+            ]
+        );
+        create(&stignore, &dir.join("sub/new"), &dir).unwrap();
+        assert_eq!(
+            fs::read_to_string(dir.join("sub/new")).unwrap(),
+            format!("// Ignore patterns included from .stignore{LINE_ENDING}")
+        );
+        remove_directive(&stignore, &dir.join("gone")).unwrap();
+        assert_eq!(
+            fs::read_to_string(&stignore).unwrap(),
+            "#include sub/new\n*.tmp\n"
+        );
+        fs::remove_dir_all(dir).ok();
+    }
+}
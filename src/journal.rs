@@ -0,0 +1,475 @@
+use std::{
+    fs,
+    io::Write,
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
+
+use anyhow::{Context, Result};
+use serde_json::{json, Value};
+
+use crate::{device, diff, includes::included_path, pattern::Pattern, versions};
+
+/// Number of operations kept in the journal, older ones are deleted
+const LIMIT: usize = 1000;
+
+/// Changes made by this invocation, saved as one operation
+static PENDING: Mutex<Vec<Change>> = Mutex::new(Vec::new());
+
+/// Change of a single ignore file
+#[derive(Clone)]
+pub struct Change {
+    /// Absolute path of the file
+    pub path: PathBuf,
+    /// Content before the change, `None` if the file was created
+    pub before: Option<String>,
+    /// Content after the change, `None` if the file was deleted
+    pub after: Option<String>,
+}
+
+impl Change {
+    /// Patterns and includes present only after the change
+    pub fn added(&self) -> Vec<&str> {
+        let before = directives(&self.before);
+        directives(&self.after)
+            .into_iter()
+            .filter(|l| !before.contains(l))
+            .collect()
+    }
+
+    /// Patterns and includes present only before the change
+    pub fn removed(&self) -> Vec<&str> {
+        let after = directives(&self.after);
+        directives(&self.before)
+            .into_iter()
+            .filter(|l| !after.contains(l))
+            .collect()
+    }
+}
+
+fn directives(content: &Option<String>) -> Vec<&str> {
+    directive_lines(content.as_deref().unwrap_or_default().lines())
+}
+
+fn directive_lines<'a>(lines: impl IntoIterator<Item = &'a str>) -> Vec<&'a str> {
+    lines
+        .into_iter()
+        .map(str::trim)
+        .filter(|l| Pattern::parse(l).is_some() || included_path(l).is_some())
+        .collect()
+}
+
+/// Change of a single ignore file as saved in the journal: only the edited
+/// lines are kept, not the contents
+pub struct Patch {
+    /// Absolute path of the file
+    pub path: PathBuf,
+    pub created: bool,
+    /// Hash of the content after the change, `None` if the file was deleted
+    after_hash: Option<u64>,
+    hunks: Vec<Hunk>,
+}
+
+/// Lines of the content before the change starting at `at` (zero-based)
+/// replaced with other lines, with their line endings
+struct Hunk {
+    at: usize,
+    removed: Vec<String>,
+    added: Vec<String>,
+}
+
+impl Patch {
+    pub fn new(change: &Change) -> Patch {
+        let (before, after) = (
+            change.before.as_deref().unwrap_or_default(),
+            change.after.as_deref().unwrap_or_default(),
+        );
+        let owned = |lines: Vec<&str>| lines.into_iter().map(str::to_owned).collect();
+        Patch {
+            path: change.path.clone(),
+            created: change.before.is_none(),
+            after_hash: change.after.as_deref().map(hash),
+            hunks: diff::hunks(before, after)
+                .into_iter()
+                .map(|h| Hunk {
+                    at: h.at,
+                    removed: owned(h.removed),
+                    added: owned(h.added),
+                })
+                .collect(),
+        }
+    }
+
+    pub fn deleted(&self) -> bool {
+        self.after_hash.is_none()
+    }
+
+    /// Patterns and includes present only after the change
+    pub fn added(&self) -> Vec<&str> {
+        let removed = self.removed_lines();
+        directive_lines(self.hunks.iter().flat_map(|h| &h.added).map(String::as_str))
+            .into_iter()
+            .filter(|l| !removed.contains(l))
+            .collect()
+    }
+
+    /// Patterns and includes present only before the change
+    pub fn removed(&self) -> Vec<&str> {
+        let added = self.added_lines();
+        directive_lines(
+            self.hunks
+                .iter()
+                .flat_map(|h| &h.removed)
+                .map(String::as_str),
+        )
+        .into_iter()
+        .filter(|l| !added.contains(l))
+        .collect()
+    }
+
+    /// Lines the change added, trimmed
+    pub fn added_lines(&self) -> Vec<&str> {
+        self.hunks
+            .iter()
+            .flat_map(|h| &h.added)
+            .map(|l| l.trim())
+            .collect()
+    }
+
+    /// Lines the change removed, trimmed
+    pub fn removed_lines(&self) -> Vec<&str> {
+        self.hunks
+            .iter()
+            .flat_map(|h| &h.removed)
+            .map(|l| l.trim())
+            .collect()
+    }
+
+    /// Checks if the file still has the content the change left, `None`
+    /// meaning that it doesn't exist
+    pub fn is_current(&self, content: Option<&str>) -> bool {
+        content.map(hash) == self.after_hash
+    }
+
+    /// Content before the change (`None` if the file was created), rebuilt
+    /// from the current content by reverting the edited lines. `None` if the
+    /// lines the change added aren't where it left them anymore.
+    pub fn revert(&self, content: Option<&str>) -> Option<Option<String>> {
+        if self.created {
+            return Some(None);
+        }
+        if self.deleted() {
+            let removed = self.hunks.iter().flat_map(|h| &h.removed);
+            return Some(Some(removed.map(String::as_str).collect()));
+        }
+        let lines: Vec<&str> = content?.split_inclusive('\n').collect();
+        let mut before = String::new();
+        let (mut next, mut shift) = (0, 0isize);
+        for hunk in &self.hunks {
+            let at = hunk.at.checked_add_signed(shift)?;
+            let end = at + hunk.added.len();
+            if at < next || end > lines.len() || !lines[at..end].iter().eq(&hunk.added) {
+                return None;
+            }
+            before.extend(lines[next..at].iter().copied());
+            before.extend(hunk.removed.iter().map(String::as_str));
+            next = end;
+            shift += hunk.added.len() as isize - hunk.removed.len() as isize;
+        }
+        before.extend(lines[next..].iter().copied());
+        Some(Some(before))
+    }
+
+    /// Diff of the edited lines, without the unchanged ones around them
+    pub fn diff(&self) -> String {
+        let mut out = String::new();
+        let mut shift = 0isize;
+        for hunk in &self.hunks {
+            out.push_str(&format!(
+                "@@ -{},{} +{},{} @@\n",
+                hunk.at + 1,
+                hunk.removed.len(),
+                hunk.at.saturating_add_signed(shift) + 1,
+                hunk.added.len()
+            ));
+            for (sign, lines) in [('-', &hunk.removed), ('+', &hunk.added)] {
+                for line in lines {
+                    out.push_str(&format!("{sign}{}\n", line.trim_end_matches(['\r', '\n'])));
+                }
+            }
+            shift += hunk.added.len() as isize - hunk.removed.len() as isize;
+        }
+        out
+    }
+
+    fn to_json(&self) -> Value {
+        json!({
+            "path": self.path.to_string_lossy(),
+            "created": self.created,
+            "after_hash": self.after_hash.map(|h| format!("{h:016x}")),
+            "hunks": self
+                .hunks
+                .iter()
+                .map(|h| json!({"at": h.at, "removed": h.removed, "added": h.added}))
+                .collect::<Vec<_>>(),
+        })
+    }
+
+    fn from_json(v: &Value) -> Option<Patch> {
+        let path = PathBuf::from(v["path"].as_str()?);
+        let Some(hunks) = v["hunks"].as_array() else {
+            // saved by earlier versions, with both contents
+            let text = |v: &Value| v.as_str().map(str::to_owned);
+            return Some(Patch::new(&Change {
+                path,
+                before: text(&v["before"]),
+                after: text(&v["after"]),
+            }));
+        };
+        let lines = |v: &Value| -> Option<Vec<String>> {
+            v.as_array()?
+                .iter()
+                .map(|l| l.as_str().map(str::to_owned))
+                .collect()
+        };
+        Some(Patch {
+            path,
+            created: v["created"].as_bool()?,
+            after_hash: match &v["after_hash"] {
+                Value::Null => None,
+                h => Some(u64::from_str_radix(h.as_str()?, 16).ok()?),
+            },
+            hunks: hunks
+                .iter()
+                .map(|h| {
+                    Some(Hunk {
+                        at: h["at"].as_u64()? as usize,
+                        removed: lines(&h["removed"])?,
+                        added: lines(&h["added"])?,
+                    })
+                })
+                .collect::<Option<_>>()?,
+        })
+    }
+}
+
+/// FNV-1a, enough to tell if a file was changed since
+fn hash(content: &str) -> u64 {
+    content.bytes().fold(0xcbf2_9ce4_8422_2325, |h, b| {
+        (h ^ u64::from(b)).wrapping_mul(0x0100_0000_01b3)
+    })
+}
+
+/// Operation recorded in the journal, all changes made by one invocation
+pub struct Entry {
+    pub id: u64,
+    /// Seconds since the Unix epoch
+    pub time: u64,
+    pub host: String,
+    /// Command line of the invocation
+    pub command: String,
+    /// Operation reverted by this one with `stignore undo`
+    pub undoes: Option<u64>,
+    pub changes: Vec<Patch>,
+}
+
+/// Remembers the change of the file, to be saved with [save]. Repeated
+/// changes of the same file are merged.
+pub fn record(path: &Path, before: Option<&[u8]>, after: Option<&[u8]>) {
+    let text = |c: &[u8]| String::from_utf8_lossy(c).into_owned();
+    let mut pending = PENDING.lock().unwrap_or_else(|e| e.into_inner());
+    match pending.iter_mut().find(|c| c.path == path) {
+        Some(change) => change.after = after.map(text),
+        None => pending.push(Change {
+            path: path.to_owned(),
+            before: before.map(text),
+            after: after.map(text),
+        }),
+    }
+}
+
+/// Changes recorded so far by this invocation
+pub fn pending() -> Vec<Change> {
+    PENDING.lock().unwrap_or_else(|e| e.into_inner()).clone()
+}
+
+/// Directory of the journal, in the user's state directory:
+/// `$XDG_STATE_HOME/stignore/journal` or `%LOCALAPPDATA%\stignore\journal`
+pub fn dir() -> Result<PathBuf> {
+    let env_dir = |var: &str| std::env::var_os(var).map(PathBuf::from);
+    let state = if cfg!(windows) {
+        env_dir("LOCALAPPDATA")
+    } else {
+        env_dir("XDG_STATE_HOME").or_else(|| env_dir("HOME").map(|h| h.join(".local/state")))
+    };
+    Ok(state
+        .context("Can't find the state directory for the journal")?
+        .join("stignore")
+        .join("journal"))
+}
+
+/// Saves the changes recorded so far as a new operation
+pub fn save(undoes: Option<u64>) -> Result<()> {
+    let mut changes = std::mem::take(&mut *PENDING.lock().unwrap_or_else(|e| e.into_inner()));
+    // e.g. changes of a rolled back transaction
+    changes.retain(|c| c.before != c.after);
+    if changes.is_empty() {
+        return Ok(());
+    }
+    let dir = dir()?;
+    fs::create_dir_all(&dir).with_context(|| format!("Can't create {}", dir.display()))?;
+
+    let mut ids = ids(&dir)?;
+    let entry = json!({
+        "time": versions::now(),
+        "host": device::hostname().unwrap_or_default(),
+        "command": command_line(),
+        "undoes": undoes,
+        "changes": changes
+            .iter()
+            .map(|c| Patch::new(c).to_json())
+            .collect::<Vec<_>>(),
+    })
+    .to_string();
+    // another invocation may be saving at the same time, the one that
+    // creates the file first gets the id
+    let mut id = ids.last().map_or(1, |id| id + 1);
+    loop {
+        let path = dir.join(format!("{id:06}.json"));
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(&path)
+        {
+            Ok(mut file) => {
+                file.write_all(entry.as_bytes())
+                    .with_context(|| format!("Can't write to {}", path.display()))?;
+                break;
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists => id += 1,
+            Err(e) => return Err(e).with_context(|| format!("Can't create {}", path.display())),
+        }
+    }
+
+    ids.push(id);
+    for old in &ids[..ids.len().saturating_sub(LIMIT)] {
+        let _ = fs::remove_file(dir.join(format!("{old:06}.json")));
+    }
+    Ok(())
+}
+
+/// Ids of the operations in the journal directory, in order, taken from the
+/// file names
+fn ids(dir: &Path) -> Result<Vec<u64>> {
+    let read_dir = match fs::read_dir(dir) {
+        Ok(read_dir) => read_dir,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Can't read {}", dir.display())),
+    };
+    let mut ids = Vec::new();
+    for file in read_dir {
+        let name = file
+            .with_context(|| format!("Can't read {}", dir.display()))?
+            .file_name();
+        if let Some(id) = name
+            .to_str()
+            .and_then(|n| n.strip_suffix(".json")?.parse().ok())
+        {
+            ids.push(id);
+        }
+    }
+    ids.sort_unstable();
+    Ok(ids)
+}
+
+/// Operations in the journal, oldest first
+pub fn load() -> Result<Vec<Entry>> {
+    let dir = dir()?;
+    let mut entries = Vec::new();
+    for id in ids(&dir)? {
+        let path = dir.join(format!("{id:06}.json"));
+        let content =
+            fs::read_to_string(&path).with_context(|| format!("Can't read {}", path.display()))?;
+        let entry = serde_json::from_str(&content)
+            .ok()
+            .and_then(|v| parse(id, &v))
+            .with_context(|| format!("Invalid journal entry {}", path.display()))?;
+        entries.push(entry);
+    }
+    Ok(entries)
+}
+
+fn parse(id: u64, v: &Value) -> Option<Entry> {
+    let text = |v: &Value| v.as_str().map(str::to_owned);
+    Some(Entry {
+        id,
+        time: v["time"].as_u64()?,
+        host: text(&v["host"])?,
+        command: text(&v["command"])?,
+        undoes: v["undoes"].as_u64(),
+        changes: v["changes"]
+            .as_array()?
+            .iter()
+            .map(Patch::from_json)
+            .collect::<Option<_>>()?,
+    })
+}
+
+/// Arguments of this invocation, quoted where needed
+pub fn command_line() -> String {
+    std::iter::once("stignore".to_owned())
+        .chain(std::env::args().skip(1))
+        .map(|a| {
+            if a.is_empty() || a.contains(|c: char| c.is_whitespace() || "'\"\\$*?".contains(c)) {
+                format!("'{}'", a.replace('\'', r"'\''"))
+            } else {
+                a
+            }
+        })
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn patch(before: Option<&str>, after: Option<&str>) -> Patch {
+        Patch::new(&Change {
+            path: PathBuf::from("/folder/.stignore"),
+            before: before.map(str::to_owned),
+            after: after.map(str::to_owned),
+        })
+    }
+
+    #[test]
+    fn revert_edited_lines() {
+        let change = patch(Some("a\nb\r\nc\nd"), Some("a\nx\nc\nd\ne\n"));
+        assert_eq!(change.added(), ["x", "e"]);
+        assert_eq!(change.removed(), ["b"]);
+        assert!(change.is_current(Some("a\nx\nc\nd\ne\n")));
+        assert_eq!(
+            change.revert(Some("a\nx\nc\nd\ne\n")),
+            Some(Some("a\nb\r\nc\nd".to_owned()))
+        );
+    }
+
+    #[test]
+    fn keep_later_changes() {
+        let change = patch(Some("a\nb\n"), Some("a\nb\nc\n"));
+        assert!(!change.is_current(Some("a\nb\nc\nz\n")));
+        assert_eq!(
+            change.revert(Some("a\nb\nc\nz\n")),
+            Some(Some("a\nb\nz\n".to_owned()))
+        );
+        assert_eq!(change.revert(Some("a\nb\nC\n")), None);
+    }
+
+    #[test]
+    fn revert_created_and_deleted_files() {
+        assert_eq!(patch(None, Some("a\n")).revert(Some("a\n")), Some(None));
+        let deleted = patch(Some("a\nb\n"), None);
+        assert!(deleted.is_current(None));
+        assert_eq!(deleted.revert(None), Some(Some("a\nb\n".to_owned())));
+    }
+}
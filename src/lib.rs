@@ -0,0 +1,16 @@
+//! Syncthing ignore patterns (https://docs.syncthing.net/users/ignoring):
+//! parsing them and matching paths the way Syncthing does.
+//!
+//! ```no_run
+//! let matcher = stignore::Matcher::load("/path/to/folder/.stignore".as_ref())?;
+//! assert!(matcher.matches("some/file.tmp").ignored);
+//! # Ok::<(), anyhow::Error>(())
+//! ```
+
+pub mod ignore_file;
+pub mod include;
+pub mod pattern;
+pub mod text;
+
+pub use ignore_file::IgnoreFile;
+pub use pattern::{Match, Matcher, Pattern};
@@ -1,19 +1,137 @@
 use std::{
-    fs::File,
-    io::{prelude::*, BufRead, BufReader, SeekFrom, Write},
+    cell::RefCell,
+    collections::HashSet,
+    ffi::{OsStr, OsString},
     path::{self, Path, PathBuf},
+    sync::OnceLock,
+    time::Duration,
 };
 
 use anyhow::{bail, Context, Result};
-use clap::{Parser, ValueEnum};
+use clap::{CommandFactory, Parser, Subcommand, ValueEnum};
 use regex::Regex;
+use stignore::{
+    ignore_file::{self, Kind},
+    pattern::{self, Matcher, Pattern},
+    text::{self, LINE_ENDING},
+    IgnoreFile,
+};
+use unicode_normalization::UnicodeNormalization;
+
+mod adopt;
+mod api;
+mod backup;
+mod backups;
+mod blame;
+mod completion;
+mod config;
+mod conflicts;
+mod coverage;
+mod daemon;
+mod device;
+mod devices;
+mod diff;
+mod doctor;
+mod files;
+mod finder;
+mod fragments;
+mod hooks;
+mod includes;
+mod journal;
+mod merge;
+mod preprocess;
+mod rename;
+mod resilio;
+mod rsync;
+mod simulate;
+mod ssh;
+mod stats;
+mod stconfig;
+mod templates;
+mod trash;
+mod tui;
+mod update;
+mod versions;
+mod watch;
+
+/// Default name of the file with patterns shared between devices
+const STIGNORE_SYNC: &str = ".stignore_sync";
+/// Device-specific rendering of .stignore_sync with `#if` blocks expanded
+const STIGNORE_DEVICE: &str = ".stignore_device";
+
+/// Unicode normalization form of written patterns
+#[derive(Copy, Clone, PartialEq, Debug, ValueEnum)]
+enum UnicodeForm {
+    /// Composed characters (`é` is one code point), used by most systems
+    Nfc,
+    /// Decomposed characters (`e` followed by a combining accent), used by
+    /// HFS+ on macOS
+    Nfd,
+    /// Keep patterns as typed
+    Unchanged,
+}
 
+static UNICODE_FORM: OnceLock<UnicodeForm> = OnceLock::new();
+
+/// Values completed by the shell completion scripts beyond the static ones
 #[derive(Copy, Clone, PartialEq, Debug, ValueEnum)]
-#[clap(rename_all = "snake_case")]
+enum Completed {
+    /// Labels and IDs of folders in Syncthing's config.xml, for --folder
+    Folders,
+    /// Names of fragments in .stignore.d, for --fragment
+    Fragments,
+    /// Targets including the topical shared files, for --target
+    Targets,
+    /// Profiles of the user's config file, for --profile
+    Profiles,
+    /// Patterns of .stignore, for `promote`
+    Stignore,
+    /// Patterns of the shared ignore file, for `demote`
+    StignoreSync,
+}
+
+#[derive(Clone, PartialEq, Debug)]
 enum Target {
     Auto,
     Stignore,
     StignoreSync,
+    /// Topical shared file, .stignore_sync_NAME
+    Topic(String),
+}
+
+impl std::str::FromStr for Target {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Ok(match s {
+            "auto" => Target::Auto,
+            "stignore" => Target::Stignore,
+            "stignore_sync" => Target::StignoreSync,
+            // a typo of the above mustn't silently create a topical file
+            _ => match s.strip_prefix("topic:") {
+                Some(name) if !name.is_empty() && !name.contains(['/', '\\']) => {
+                    Target::Topic(name.to_owned())
+                }
+                Some(name) => return Err(format!("invalid topic name: {name}")),
+                None => {
+                    return Err(format!(
+                        "unknown target {s}, expected auto, stignore, stignore_sync or topic:NAME"
+                    ))
+                }
+            },
+        })
+    }
+}
+
+impl std::fmt::Display for Target {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Target::Auto => write!(f, "auto"),
+            Target::Stignore => write!(f, "stignore"),
+            Target::StignoreSync => write!(f, "stignore_sync"),
+            Target::Topic(name) => write!(f, "topic:{name}"),
+        }
+    }
 }
 
 /// Adds syncthing ignore patterns (https://docs.syncthing.net/users/ignoring)
@@ -21,277 +139,5242 @@ enum Target {
 ///
 /// Source code & examples: https://github.com/Andrew-Morozko/stignore
 #[derive(Parser, Debug)]
-#[clap(version, about, global_setting(clap::AppSettings::DeriveDisplayOrder))]
+#[clap(
+    version,
+    about,
+    global_setting(clap::AppSettings::DeriveDisplayOrder),
+    args_conflicts_with_subcommands(true),
+    subcommand_negates_reqs(true)
+)]
 struct Args {
-    /// Patterns to add
-    #[clap(value_parser, required(true), min_values(1))]
-    pattern: Vec<String>,
+    #[clap(subcommand)]
+    command: Option<Command>,
 
-    /// Specify which file would be appended with patterns
+    #[clap(flatten)]
+    add: AddArgs,
+
+    #[clap(flatten)]
+    api: ApiOptions,
+
+    /// Don't display messages
+    #[clap(short, long, value_parser, global(true), env = "STIGNORE_SILENT")]
+    silent: bool,
+
+    /// Answer yes to confirmations instead of asking
+    #[clap(
+        short = 'y',
+        long,
+        value_parser,
+        global(true),
+        env = "STIGNORE_ASSUME_YES"
+    )]
+    assume_yes: bool,
+
+    /// Use settings of this profile of the config file, a [profile.NAME]
+    /// table
+    #[clap(long, value_parser, global(true), env = "STIGNORE_PROFILE")]
+    profile: Option<String>,
+
+    /// Run as if stignore was started in DIR
     ///
-    /// auto - append patterns to .stignore_sync if it is included in .stignore,
-    /// otherwise append to .stignore (create if doesn't exist)
+    /// The folder is found from DIR and patterns are relative to it, as are
+    /// relative paths given in other options
+    #[clap(short = 'C', value_parser, global(true), value_name = "DIR")]
+    directory: Option<PathBuf>,
+
+    /// Name of the marker file of syncthing folders besides .stfolder
     ///
-    /// stignore - append patterns to .stignore, create if doesn't exist
+    /// Custom markers configured in Syncthing's config.xml are recognized
+    /// automatically
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        value_name = "NAME",
+        env = "STIGNORE_MARKER",
+        value_delimiter = ','
+    )]
+    marker: Vec<String>,
+
+    /// Inside of nested syncthing folders, work with the outermost one
     ///
-    /// stignore_sync - append patterns to .stignore_sync, create if doesn't exist
-    #[clap(short, long, arg_enum, value_parser, default_value_t = Target::Auto)]
-    target: Target,
+    /// Without --outermost or --innermost the folder is picked interactively
+    #[clap(long, value_parser, global(true), env = "STIGNORE_OUTERMOST")]
+    outermost: bool,
 
-    /// Copy patterns as-is
+    /// Inside of nested syncthing folders, work with the innermost one
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        conflicts_with("outermost"),
+        env = "STIGNORE_INNERMOST"
+    )]
+    innermost: bool,
+
+    /// Don't resolve symlinks in the path of CWD
     ///
-    /// Don't prepend path to CWD relative to syncthing folder root
-    #[clap(short, long, value_parser)]
-    absolute: bool,
+    /// By default CWD is resolved to its real location, so patterns match the
+    /// layout Syncthing sees. With this option the path shown by the shell
+    /// ($PWD) is used to find the folder and to compute patterns.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_NO_RESOLVE_SYMLINKS")]
+    no_resolve_symlinks: bool,
 
-    /// Display planned changes and wait for confirmation
-    #[clap(short, long, value_parser, conflicts_with("silent"))]
-    preview: bool,
+    /// Don't look for the syncthing folder beyond the filesystem of CWD
+    ///
+    /// Prevents slow lookups on unresponsive network mounts above CWD
+    #[clap(long, value_parser, global(true), env = "STIGNORE_ONE_FILE_SYSTEM")]
+    one_file_system: bool,
 
-    /// Don't display messages
-    #[clap(short, long, value_parser)]
-    silent: bool,
-}
+    /// Unicode normalization of patterns and paths prepended to them
+    ///
+    /// File names typed in the terminal and the ones stored by the
+    /// filesystem may represent accented letters differently, and patterns
+    /// only match the same representation
+    #[clap(
+        long,
+        arg_enum,
+        value_parser,
+        global(true),
+        default_value = "nfc",
+        value_name = "FORM",
+        env = "STIGNORE_UNICODE"
+    )]
+    unicode: UnicodeForm,
 
-#[cfg(windows)]
-const LINE_ENDING: &str = "\r\n";
-#[cfg(not(windows))]
-const LINE_ENDING: &str = "\n";
+    /// Flush written ignore files to disk before exiting
+    ///
+    /// For ignore files on network or unreliable storage, where a lost write
+    /// could make Syncthing sync everything the patterns excluded
+    #[clap(long, value_parser, global(true), env = "STIGNORE_FSYNC")]
+    fsync: bool,
 
-fn find_syncthing_dir() -> Result<(PathBuf, PathBuf)> {
-    let cwd = std::env::current_dir()
-        .and_then(std::fs::canonicalize)
-        .context("Can't determine current working directory")?;
-    let mut st_dir = cwd.clone();
-    loop {
-        st_dir.push(".stfolder");
-        let found = st_dir.is_dir();
-        st_dir.pop();
-        if found {
-            break;
-        }
-        if !st_dir.pop() {
-            bail!("Current directory is not inside of a syncthing folder");
-        }
-    }
+    /// Save a copy of each ignore file before changing it
+    ///
+    /// Backups are kept in .stfolder/stignore-backups of the folder, which
+    /// Syncthing doesn't sync, e.g. .stignore.bak.20240101T120000 (UTC). List
+    /// and restore them with `stignore backups`.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_BACKUP")]
+    backup: bool,
 
-    let prefix = path::Path::join(
-        path::Path::new(path::Component::RootDir.as_os_str()),
-        cwd.strip_prefix(&st_dir).unwrap(),
-    );
+    /// Number of backups kept for each file, older ones are deleted
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        default_value_t = 5,
+        value_name = "N",
+        env = "STIGNORE_KEEP_BACKUPS"
+    )]
+    keep_backups: usize,
+
+    /// Commit changed ignore files to the git repository they are in
+    ///
+    /// Works for the syncthing folder itself as well as for ignore files
+    /// symlinked from a dotfiles repository
+    #[clap(long, value_parser, global(true), env = "STIGNORE_GIT_COMMIT")]
+    git_commit: bool,
+
+    /// Command run before each ignore file is written
+    ///
+    /// It gets the change as JSON on stdin, and the folder, the file and the
+    /// added patterns in STIGNORE_FOLDER, STIGNORE_FILES and
+    /// STIGNORE_PATTERNS. If the command fails, the file isn't written.
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        env = "STIGNORE_PRE_WRITE",
+        value_name = "COMMAND"
+    )]
+    pre_write: Option<String>,
+
+    /// Command run after ignore files were changed, with all the changes
+    /// passed like to --pre-write
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        env = "STIGNORE_POST_WRITE",
+        value_name = "COMMAND"
+    )]
+    post_write: Option<String>,
 
-    Ok((st_dir, prefix))
+    /// Name of the file with patterns shared between devices
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        default_value = STIGNORE_SYNC,
+        env = "STIGNORE_SYNC_FILE",
+        value_name = "NAME"
+    )]
+    sync_file: String,
+
+    /// Explain how the syncthing folder was found
+    #[clap(
+        short,
+        long,
+        value_parser,
+        global(true),
+        conflicts_with("silent"),
+        env = "STIGNORE_VERBOSE"
+    )]
+    verbose: bool,
 }
 
-fn process_patterns(patterns: &[String], prepend_prefix: Option<&PathBuf>) -> Result<String> {
-    let re = Regex::new(r"^((?:#include )|(?:(?:\(\?[di]\)|!))*) *(.+)$").unwrap();
+#[derive(clap::Args, Debug, Default)]
+struct ApiOptions {
+    /// Edit .stignore through Syncthing's REST API
+    ///
+    /// Syncthing applies the patterns immediately instead of waiting for the
+    /// next scan. Other files (e.g. .stignore_sync) are written directly and
+    /// Syncthing is asked to reload the patterns.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API")]
+    api: bool,
 
-    let mut out_str = String::new();
-    let mut errs = Vec::new();
+    /// Address of Syncthing's GUI and REST API
+    ///
+    /// [default: address from Syncthing's config.xml or http://127.0.0.1:8384]
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API_URL")]
+    api_url: Option<String>,
 
-    let patterns = patterns.iter().flat_map(|t| t.split('\n'));
+    /// API key, shown in Syncthing's Actions > Settings > GUI
+    ///
+    /// [default: key from Syncthing's config.xml]
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        env = "STIGNORE_API_KEY",
+        hide_env_values(true)
+    )]
+    api_key: Option<String>,
 
-    for mut pattern in patterns {
-        pattern = pattern.trim();
-        if pattern.is_empty() || pattern.starts_with("//") {
-            // empty pattern results in an extra new line inserted
-            out_str.push_str(pattern);
-            out_str.push_str(LINE_ENDING);
-            continue;
-        }
-        let m = re.captures(pattern);
-        if m.is_none() {
-            errs.push(pattern);
-            continue;
-        }
-        let m = m.unwrap();
-        let pattern_path = m.get(2);
-        if pattern_path.is_none() {
-            errs.push(pattern);
-            continue;
-        }
-        let pattern_path = pattern_path.unwrap();
+    /// Syncthing's config.xml to read the API address and key from
+    ///
+    /// [default: found in $STCONFDIR, $STHOMEDIR or the platform's default
+    /// location]
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API_CONFIG")]
+    api_config: Option<PathBuf>,
 
-        if let Some(m) = m.get(1) {
-            out_str.push_str(m.as_str());
+    /// Accept invalid TLS certificates, e.g. self-signed ones of Syncthing
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API_INSECURE")]
+    insecure: bool,
+
+    /// Trust this PEM certificate when connecting over HTTPS
+    ///
+    /// Syncthing's own certificate is https-cert.pem next to its config.xml
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        value_name = "FILE",
+        env = "STIGNORE_API_CA_CERT"
+    )]
+    ca_cert: Option<PathBuf>,
+
+    /// Authenticate with this PEM client certificate (e.g. to a reverse proxy)
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        value_name = "FILE",
+        requires("client-key"),
+        env = "STIGNORE_API_CLIENT_CERT"
+    )]
+    client_cert: Option<PathBuf>,
+
+    /// Private key of --client-cert, in PEM format
+    #[clap(
+        long,
+        value_parser,
+        global(true),
+        value_name = "FILE",
+        requires("client-cert"),
+        env = "STIGNORE_API_CLIENT_KEY"
+    )]
+    client_key: Option<PathBuf>,
+
+    /// Work with the folder with this ID or label instead of the one
+    /// containing CWD
+    ///
+    /// The folder is looked up in Syncthing's config.xml, or through the API
+    /// with --api. Without this option the folder is found by .stfolder in
+    /// CWD and its parents; with --api it's picked interactively if there is
+    /// none.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API_FOLDER")]
+    folder: Option<String>,
+
+    /// Rescan the folder after changing ignore patterns
+    ///
+    /// Only the subdirectory of CWD is rescanned if patterns were added
+    /// relative to it. Ignored without `--api`.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_RESCAN")]
+    rescan: bool,
+
+    /// Pause the folder while ignore files are changed, resume afterwards
+    ///
+    /// Prevents Syncthing from scanning the folder with partially written
+    /// ignore files during commands changing several files (e.g. adopt).
+    /// Ignored without `--api`.
+    #[clap(long, value_parser, global(true), env = "STIGNORE_API_PAUSE")]
+    pause: bool,
+}
+
+impl ApiOptions {
+    fn connect(&self) -> Result<Option<api::Client>> {
+        if !self.api {
+            return Ok(None);
         }
+        // explicit options take precedence over syncthing's own config
+        let gui = match (&self.api_url, &self.api_key) {
+            (Some(_), Some(_)) => None,
+            _ => match self.api_config.clone().or_else(stconfig::find) {
+                Some(path) => Some(stconfig::read_gui(&path)?),
+                None => None,
+            },
+        };
+        let url = self
+            .api_url
+            .clone()
+            .or_else(|| gui.as_ref().map(|g| g.url.clone()))
+            .unwrap_or_else(|| "http://127.0.0.1:8384".to_owned());
+        let key = self
+            .api_key
+            .clone()
+            .or_else(|| gui.and_then(|g| g.key))
+            .context(
+                "API key is required, pass --api-key or set STIGNORE_API_KEY \
+                (Syncthing's config.xml wasn't found)",
+            )?;
+        api::Client::new(&url, &key, &self.tls()).map(Some)
+    }
 
-        match prepend_prefix {
-            None => {
-                out_str.push_str(pattern_path.as_str());
-            }
-            Some(prefix) => {
-                let pattern_path = Path::new(pattern_path.as_str());
-                out_str.push_str(
-                    prefix
-                        .components()
-                        .chain(pattern_path.components().skip_while(|m| {
-                            matches!(
-                                m,
-                                path::Component::RootDir
-                                    | path::Component::Prefix(_)
-                                    | path::Component::CurDir
-                            )
-                        }))
-                        .collect::<PathBuf>()
-                        .display()
-                        .to_string()
-                        .as_str(),
-                );
+    /// Connects to another Syncthing instance at `url`. The API key is taken
+    /// from the environment (see [instance_key_var]) or read from stdin,
+    /// never from the command line where other users could see it.
+    fn connect_to(&self, url: &str) -> Result<api::Client> {
+        let (scheme, address) = url.split_once("://").unwrap_or(("http", url));
+        let authority = address.split('/').next().unwrap_or_default();
+        let var = instance_key_var(authority.rsplit_once('@').map_or(address, |(_, a)| a));
+        if authority.contains('@') {
+            bail!(
+                "Don't put the API key into {url}, other users can see command lines. \
+                Set {var} or enter the key when asked"
+            );
+        }
+        let key = match std::env::var(&var) {
+            Ok(key) => key,
+            Err(_) => {
+                eprint!("API key of {url} (or set {var}): ");
+                let mut key = String::new();
+                std::io::stdin()
+                    .read_line(&mut key)
+                    .context("Can't read the API key")?;
+                key.trim().to_owned()
             }
+        };
+        if key.is_empty() {
+            bail!("No API key for {url}");
         }
-        out_str.push_str(LINE_ENDING);
+        api::Client::new(&format!("{scheme}://{address}"), &key, &self.tls())
     }
 
-    if !errs.is_empty() {
-        bail!(
-            "Incorrect pattern{}:\n{}",
-            if errs.len() > 1 { "s" } else { "" },
-            errs.join("\n")
-        );
-    }
-    if out_str.trim().is_empty() {
-        bail!("No patterns supplied!")
+    /// Whether `--api-url` points at another machine, whose folders can't
+    /// be reached through the local filesystem even if the same paths exist
+    /// here
+    fn remote(&self) -> bool {
+        self.api_url
+            .as_deref()
+            .map_or(false, |url| !is_loopback_url(url))
     }
-    Ok(out_str)
-}
-
-enum PathOrFile {
-    Path(PathBuf),
-    File(PathBuf, File),
-}
 
-impl PathOrFile {
-    fn open(&mut self) -> Result<&mut File, std::io::Error> {
-        match self {
-            Self::File(_, ref mut f) => Ok(f),
-            Self::Path(ref mut p) => {
-                let f = File::options()
-                    .read(true)
-                    .write(true)
-                    .create(true)
-                    .open(&p)?;
-                *self = Self::File(std::mem::take(p), f);
-                if let Self::File(_, f) = self {
-                    return Ok(f);
-                }
-                unreachable!()
-            }
-        }
+    /// Syncthing's config.xml, for working without the API
+    fn config(&self) -> Result<PathBuf> {
+        self.api_config
+            .clone()
+            .or_else(stconfig::find)
+            .context("Syncthing's config.xml wasn't found, pass --api-config or use --api")
     }
-    fn path(&self) -> &Path {
-        match self {
-            Self::File(ref p, _) => p,
-            Self::Path(ref p) => p,
+
+    fn tls(&self) -> api::Tls {
+        api::Tls {
+            insecure: self.insecure,
+            ca_cert: self.ca_cert.clone(),
+            client_cert: self.client_cert.clone().zip(self.client_key.clone()),
         }
-        .as_path()
     }
 }
 
-fn is_stignore_sync_included(stignore: &mut PathOrFile) -> Result<bool> {
-    let re = Regex::new(r"^\s*#include\s+\.stignore_sync\s*$").unwrap();
-    let f = stignore.open()?;
-
-    Ok(BufReader::new(f)
-        .lines()
-        .find_map(|p| match p {
-            Ok(ref t) => {
-                if re.is_match(t) {
-                    Some(Ok(()))
-                } else {
-                    None
-                }
+/// Environment variable with the API key of another Syncthing instance:
+/// `STIGNORE_API_KEY_` and its host name in upper case, e.g.
+/// `STIGNORE_API_KEY_NAS_LOCAL` for `nas.local:8384`
+fn instance_key_var(address: &str) -> String {
+    let authority = address.split('/').next().unwrap_or_default();
+    let host = match authority.strip_prefix('[') {
+        Some(v6) => v6.split(']').next().unwrap_or_default(),
+        None => authority.split(':').next().unwrap_or_default(),
+    };
+    let host: String = host
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() {
+                c.to_ascii_uppercase()
+            } else {
+                '_'
             }
-            Err(e) => Some(Err(e)),
         })
-        .transpose()?
-        .is_some())
+        .collect();
+    format!("STIGNORE_API_KEY_{host}")
 }
 
-fn append(f: &mut PathOrFile, patterns: &String) -> Result<()> {
-    let f = f.open()?;
-    let file_len = f.seek(SeekFrom::End(0))?;
-    let prepend_new_line = if file_len == 0 {
-        false
-    } else if file_len < (LINE_ENDING.len() as u64) {
-        true
-    } else {
-        let mut buf = [0u8; LINE_ENDING.len()];
-        f.seek(SeekFrom::End(-(LINE_ENDING.len() as i64)))?;
-        f.read_exact(&mut buf)?;
-        !buf.ends_with(LINE_ENDING.as_bytes())
+/// Checks if the host of the URL is this machine: `localhost` or a loopback
+/// address
+fn is_loopback_url(url: &str) -> bool {
+    let rest = url.split_once("://").map_or(url, |(_, rest)| rest);
+    let authority = rest.split('/').next().unwrap_or_default();
+    let host_port = authority.rsplit_once('@').map_or(authority, |(_, h)| h);
+    let host = match host_port.strip_prefix('[') {
+        Some(v6) => v6.split(']').next().unwrap_or_default(),
+        None => host_port.split(':').next().unwrap_or_default(),
     };
+    host.eq_ignore_ascii_case("localhost")
+        || host
+            .parse::<std::net::IpAddr>()
+            .map_or(false, |ip| ip.is_loopback())
+}
 
-    if prepend_new_line {
-        f.write_all(LINE_ENDING.as_bytes())?;
-    };
+/// Folder chosen through the API, overrides the .stfolder search
+enum Selected {
+    /// Folder root on this device
+    Local(PathBuf),
+    /// Folder of a remote Syncthing instance, reachable only through the API
+    Remote(api::Folder),
+}
 
-    f.write_all(patterns.as_bytes())?;
+static SELECTED_FOLDER: OnceLock<Selected> = OnceLock::new();
 
-    Ok(())
+/// Names of files marking syncthing folder roots: `.stfolder` and custom
+/// ones (folder's `markerName` setting)
+static MARKERS: OnceLock<Vec<String>> = OnceLock::new();
+
+fn markers() -> &'static [String] {
+    MARKERS.get_or_init(|| vec![".stfolder".to_owned()])
 }
 
-fn go(args: &Args) -> Result<()> {
-    let (st_dir, prefix) = find_syncthing_dir()?;
+/// Sets the marker names once config files are applied, see [marker_names]
+fn init_markers(args: &Args) {
+    MARKERS.set(marker_names(args)).ok();
+}
 
-    let patterns = process_patterns(
-        &args.pattern,
-        if args.absolute { None } else { Some(&prefix) },
-    )?;
+/// Marker names: .stfolder, --marker and the ones of Syncthing's config.xml
+fn marker_names(args: &Args) -> Vec<String> {
+    let mut markers = vec![".stfolder".to_owned()];
+    let configured = args
+        .api
+        .config()
+        .and_then(|c| stconfig::read_markers(&c))
+        .unwrap_or_default();
+    for marker in args.marker.iter().chain(&configured) {
+        if !markers.contains(marker) {
+            markers.push(marker.clone());
+        }
+    }
+    markers
+}
+
+/// ID of the folder commands work with
+fn folder_id(api: &api::Client) -> Result<String> {
+    match SELECTED_FOLDER.get() {
+        Some(Selected::Remote(folder)) => Ok(folder.id.clone()),
+        _ => Ok(api.folder_at(&find_syncthing_dir()?.0)?.id),
+    }
+}
 
-    let mut stignore = PathOrFile::Path(st_dir.join(".stignore"));
-    let stignore_sync = st_dir.join(".stignore_sync");
+/// Selects the folder by --folder using Syncthing's config.xml
+fn select_configured_folder(opts: &ApiOptions, name: &str) -> Result<()> {
+    let folder = api::find_folder(stconfig::read_folders(&opts.config()?)?, name)?;
+    let root = files::canonicalize(&folder.path).with_context(|| {
+        format!(
+            "Folder {} isn't available on this device at {}",
+            folder.id,
+            folder.path.display()
+        )
+    })?;
+    SELECTED_FOLDER.set(Selected::Local(root)).ok();
+    Ok(())
+}
 
-    let resolved_target = if args.target == Target::Auto {
-        let sync_included =
-            is_stignore_sync_included(&mut stignore).context("Can't read .stignore file")?;
-        if sync_included {
-            Target::StignoreSync
-        } else {
-            if !args.silent && stignore_sync.is_file() {
-                eprintln!(
-                    "NOTE: .stignore_sync exists, but wasn't included in .stignore. \
-                    Working with .stignore"
-                );
+/// Selects the folder by --folder, or asks to pick one if CWD isn't inside of
+/// a syncthing folder
+fn select_folder(api: &api::Client, remote: bool, name: Option<&str>) -> Result<&'static str> {
+    let (folder, found_by) = match name {
+        Some(name) => (api.folder_named(name)?, "by --folder through the API"),
+        // a local copy of the folder isn't the remote one
+        None if !remote && find_syncthing_dir().is_ok() => return Ok("by .stfolder"),
+        None if remote => {
+            let folders = api.folders()?;
+            (pick_folder(folders)?, "interactively")
+        }
+        None => {
+            let folders = api.folders()?;
+            if let Some(root) = folder_containing_cwd(&folders) {
+                SELECTED_FOLDER.set(Selected::Local(root)).ok();
+                return Ok("by matching CWD against folders from the API");
             }
-            Target::Stignore
+            (pick_folder(folders)?, "interactively")
         }
-    } else {
-        args.target
     };
-
-    let mut tgt_file = match resolved_target {
-        Target::Stignore => stignore,
-        Target::StignoreSync => {
-            drop(stignore);
-            PathOrFile::Path(stignore_sync)
-        }
-        Target::Auto => unreachable!("Target::Auto was resolved into concrete targets"),
+    let selected = match files::canonicalize(&folder.path) {
+        Ok(root) if !remote => Selected::Local(root),
+        // e.g. a folder of a headless server managed through --api-url
+        _ => Selected::Remote(folder),
     };
+    SELECTED_FOLDER.set(selected).ok();
+    Ok(found_by)
+}
 
-    if !args.silent {
-        println!("Appending to {}:\n{patterns}", tgt_file.path().display());
+/// Asks which of the folders to work with
+fn pick_folder(folders: Vec<api::Folder>) -> Result<api::Folder> {
+    use question::{Answer, Question};
+
+    if folders.is_empty() {
+        bail!("Syncthing has no folders");
     }
-    if args.preview {
-        use question::{Answer, Question};
-        let res = Question::new("Proceed?")
-            .until_acceptable()
-            .default(Answer::YES)
-            .show_defaults()
-            .confirm();
-        if res == Answer::NO {
-            println!("Aborting.");
-            return Ok(());
+    for (i, f) in folders.iter().enumerate() {
+        println!("{}) {} ({}) {}", i + 1, f.label, f.id, f.path.display());
+    }
+    let numbers: Vec<String> = (1..=folders.len()).map(|i| i.to_string()).collect();
+    let answer = Question::new("Folder:")
+        .acceptable(numbers.iter().map(String::as_str).collect())
+        .until_acceptable()
+        .ask();
+    match answer {
+        Some(Answer::RESPONSE(n)) => {
+            let n: usize = n.parse().context("Invalid folder number")?;
+            folders
+                .into_iter()
+                .nth(n - 1)
+                .context("Invalid folder number")
         }
+        _ => bail!("No folder selected"),
     }
-    append(&mut tgt_file, &patterns).context("Can't append to file")
 }
 
-fn main() -> Result<()> {
-    let args = Args::parse();
-    let res = go(&args);
-    if args.silent && res.is_err() {
-        std::process::exit(1);
+/// Finds the folder containing CWD when there is no .stfolder to find it by
+/// (e.g. the marker was deleted), using folder paths from config.xml
+fn discover_folder(opts: &ApiOptions) -> Option<&'static str> {
+    if find_syncthing_dir().is_ok() {
+        return Some("by .stfolder");
+    }
+    let folders = stconfig::read_folders(&opts.config().ok()?).ok()?;
+    let root = folder_containing_cwd(&folders)?;
+    SELECTED_FOLDER.set(Selected::Local(root)).ok();
+    Some("by matching CWD against folders from config.xml")
+}
+
+/// Root of the innermost folder containing CWD
+fn folder_containing_cwd(folders: &[api::Folder]) -> Option<PathBuf> {
+    // $PWD of --no-resolve-symlinks doesn't match the roots
+    let cwd = files::canonicalize(&working_dir().ok()?).ok()?;
+    folders
+        .iter()
+        .filter_map(|f| files::canonicalize(&f.path).ok())
+        .filter(|root| cwd.starts_with(root))
+        .max_by_key(|root| root.components().count())
+}
+
+#[derive(clap::Args, Debug)]
+struct AddArgs {
+    /// Patterns to add
+    #[clap(value_parser, required(true), min_values(1))]
+    pattern: Vec<String>,
+
+    #[clap(flatten)]
+    opts: AddOptions,
+
+    /// Copy patterns as-is
+    ///
+    /// Don't prepend path to CWD relative to syncthing folder root
+    #[clap(short, long, value_parser)]
+    absolute: bool,
+
+    /// Prepend the path to this directory instead of the path to CWD
+    ///
+    /// Relative to CWD, or to the folder root if it starts with `/`, e.g.
+    /// `--prefix ../photos` for a sibling directory. The directory doesn't
+    /// have to exist.
+    #[clap(
+        long,
+        value_parser,
+        value_name = "PATH",
+        conflicts_with_all(&["absolute", "all-folders"])
+    )]
+    prefix: Option<String>,
+
+    /// Add patterns to every folder on this device, copying them as-is
+    ///
+    /// Folders are taken from Syncthing's config.xml, or from the API with
+    /// --api. Failing folders don't stop the rest.
+    #[clap(
+        long,
+        value_parser,
+        conflicts_with_all(&["folder", "ssh", "ignore-file", "pause", "rescan"])
+    )]
+    all_folders: bool,
+
+    /// Number of folders --all-folders handles at once [default: number of
+    /// CPUs]
+    ///
+    /// Only the result of each folder is shown when several are handled at
+    /// once. With --jobs 1, or when confirmations are asked, folders are
+    /// handled one by one with the full output.
+    #[clap(long, value_parser, env = "STIGNORE_JOBS", requires("all-folders"))]
+    jobs: Option<usize>,
+
+    /// With --all-folders, change either every folder or none: if one fails,
+    /// the folders already changed get their previous patterns back
+    #[clap(long, value_parser, requires("all-folders"))]
+    atomic: bool,
+}
+
+impl AddArgs {
+    fn run(&self, opts: &ApiOptions, api: Option<&api::Client>, silent: bool) -> Result<()> {
+        let patterns = expand_vars(&self.pattern)?;
+        if let Some(prefix) = &self.prefix {
+            PREFIX.set(prefix.clone()).ok();
+        }
+        if self.all_folders {
+            add_all_folders(
+                &patterns,
+                &self.opts,
+                opts,
+                api,
+                self.jobs,
+                self.atomic,
+                silent,
+            )
+        } else {
+            add(&patterns, self.absolute, &self.opts, api, silent)
+        }
+    }
+}
+
+#[derive(clap::Args, Debug)]
+struct RmArgs {
+    /// Patterns to remove, all patterns are offered with --interactive if
+    /// neither patterns nor lines are given
+    #[clap(
+        value_parser,
+        required_unless_present_any(&["interactive", "line", "regex"])
+    )]
+    pattern: Vec<String>,
+
+    /// Remove every pattern matching the regular expression, e.g.
+    /// 'node_modules'
+    ///
+    /// The changes are shown as a diff, and confirmed if more than
+    /// --confirm-over lines would be removed
+    #[clap(long, value_parser, value_name = "REGEX")]
+    regex: Option<String>,
+
+    /// Number of lines --regex removes without asking
+    #[clap(long, value_parser, value_name = "N", default_value_t = 10)]
+    confirm_over: usize,
+
+    /// Remove the line of the ignore file, e.g. .stignore_sync:42, can be
+    /// repeated
+    ///
+    /// The file is relative to CWD or to the folder root, and has to be
+    /// .stignore or a file it includes
+    #[clap(long, value_parser, value_name = "FILE:LINE")]
+    line: Vec<String>,
+
+    /// Remove comments directly above the removed lines even if the next
+    /// pattern takes them over
+    ///
+    /// Without it, the comments are removed only if nothing they could
+    /// describe is left below them
+    #[clap(long, value_parser)]
+    with_comments: bool,
+
+    /// Ask before removing each line, showing the lines around it
+    #[clap(short, long, value_parser)]
+    interactive: bool,
+
+    /// With --interactive, list the lines and ask which to remove at once
+    #[clap(long, value_parser, requires("interactive"))]
+    checklist: bool,
+
+    /// List the files that would stop being ignored or become ignored, and
+    /// wait for confirmation
+    #[clap(long, value_parser)]
+    impact: bool,
+}
+
+#[derive(clap::Args, Debug, Default)]
+struct AddOptions {
+    /// Specify which file would be appended with patterns
+    ///
+    /// auto - append patterns to .stignore_sync if it is included in .stignore,
+    /// otherwise append to .stignore (create if doesn't exist)
+    ///
+    /// stignore - append patterns to .stignore, create if doesn't exist
+    ///
+    /// stignore_sync - append patterns to .stignore_sync, create if doesn't exist
+    ///
+    /// topic:NAME - append patterns to topical .stignore_sync_NAME (e.g.
+    /// `topic:media` for .stignore_sync_media), create it and include from
+    /// .stignore if needed
+    ///
+    /// [default: `target` of the config file, or auto]
+    #[clap(short, long, value_parser)]
+    target: Option<Target>,
+
+    /// Append patterns to the file, path is relative to syncthing folder root
+    ///
+    /// The file should be included from .stignore (directly or through other
+    /// included files), otherwise syncthing won't apply the patterns.
+    #[clap(short, long, value_parser, conflicts_with("target"))]
+    into: Option<PathBuf>,
+
+    /// Append patterns to the file, bypassing syncthing folder detection
+    ///
+    /// Patterns are copied as-is, since there is no folder root to compute
+    /// the path to CWD against
+    #[clap(
+        short,
+        long = "file",
+        value_parser,
+        conflicts_with_all(&["target", "into"])
+    )]
+    ignore_file: Option<PathBuf>,
+
+    /// Append patterns to .stignore.d/NAME.stignore fragment
+    ///
+    /// The fragment is created and included from .stignore if needed
+    #[clap(
+        short = 'F',
+        long,
+        value_parser,
+        value_name = "NAME",
+        conflicts_with_all(&["target", "into", "ignore-file"])
+    )]
+    fragment: Option<String>,
+
+    /// Append patterns to .stignore_sync_HOSTNAME of this device
+    ///
+    /// The file is synced to all devices, but only this one includes it
+    #[clap(
+        short = 'H',
+        long,
+        value_parser,
+        conflicts_with_all(&["target", "into", "ignore-file", "fragment"])
+    )]
+    host_only: bool,
+
+    /// Add patterns to a syncthing folder on another host over SSH
+    ///
+    /// PATH plays the role of CWD: the folder is found by .stfolder in PATH
+    /// and its parents. Requires `ssh` and a POSIX shell on the host.
+    #[clap(
+        long,
+        value_parser,
+        value_name = "[USER@]HOST:PATH",
+        conflicts_with_all(&["ignore-file", "host-only"])
+    )]
+    ssh: Option<String>,
+
+    /// Check with Syncthing that the added paths are ignored now
+    ///
+    /// Patterns pointing to existing files or directories are verified, and
+    /// the reason is shown if Syncthing still doesn't ignore them (e.g. an
+    /// earlier `!` pattern). Ignored without `--api`.
+    #[clap(long, value_parser, env = "STIGNORE_VERIFY")]
+    verify: bool,
+
+    /// Delete files on this device that the added patterns ignore
+    ///
+    /// Syncthing leaves already synced files in place when they become
+    /// ignored. Affected files are listed and deleted after confirmation.
+    #[clap(
+        long,
+        value_parser,
+        conflicts_with_all(&["silent", "ignore-file", "ssh"])
+    )]
+    and_delete: bool,
+
+    /// Move files to the trash instead of deleting them (with --and-delete,
+    /// or `conflicts --delete`)
+    #[clap(long, value_parser)]
+    trash: bool,
+
+    /// Display planned changes and wait for confirmation
+    #[clap(short, long, value_parser, conflicts_with("silent"))]
+    preview: bool,
+
+    /// Before appending, list the first N files the patterns would ignore
+    /// [default: 10]
+    ///
+    /// Shows the number of such files as well, and patterns matching no
+    /// files, e.g. because of a typo. Folders with more than 100000 files
+    /// are only partially checked.
+    #[clap(
+        long,
+        value_parser,
+        value_name = "N",
+        min_values(0),
+        require_equals(true),
+        default_missing_value("10"),
+        conflicts_with_all(&["ignore-file", "ssh"])
+    )]
+    matches: Option<usize>,
+
+    /// List the files that would become ignored or stop being ignored, and
+    /// wait for confirmation
+    ///
+    /// The whole folder is checked against its patterns before and after
+    /// the change
+    #[clap(long, value_parser, conflicts_with_all(&["ignore-file", "ssh", "silent"]))]
+    impact: bool,
+}
+
+impl AddOptions {
+    /// Target given on the command line, otherwise the configured one
+    fn target(&self) -> Target {
+        self.target
+            .clone()
+            .or_else(|| DEFAULT_TARGET.get().cloned())
+            .unwrap_or(Target::Auto)
+    }
+
+    /// Whether to wait for confirmation, with --preview or `preview` of the
+    /// config file
+    fn preview(&self) -> bool {
+        self.preview || self.impact || PREVIEW.get() == Some(&true)
+    }
+}
+
+#[derive(Subcommand, Debug)]
+enum Command {
+    /// Add patterns, same as running stignore without a subcommand
+    Add(AddArgs),
+    /// Export effective patterns as rsync exclude rules
+    ///
+    /// Patterns of .stignore and all included files are converted to the
+    /// format accepted by `rsync --exclude-from=FILE`
+    ExportRsync {
+        /// Write rules to the file instead of stdout
+        #[clap(short, long, value_parser)]
+        output: Option<PathBuf>,
+    },
+    /// Print the include graph of .stignore with pattern counts
+    Tree,
+    /// Count patterns, flags, includes, comments and duplicates of each
+    /// ignore file
+    ///
+    /// A duplicate is a pattern that was already read before, in the same
+    /// file or in another one
+    Stats,
+    /// Count the files of the folder each pattern matches
+    ///
+    /// MATCHES counts every file the pattern matches, DECIDES the ones it's
+    /// the first matching pattern for, which Syncthing goes by. Patterns
+    /// are listed in the order Syncthing evaluates them.
+    Coverage {
+        /// Only list the patterns matching no files
+        #[clap(long, value_parser)]
+        unused: bool,
+    },
+    /// List the files of the folder its patterns ignore
+    ///
+    /// Every file is checked against the patterns of .stignore and the files
+    /// it includes, like Syncthing does
+    Simulate {
+        /// Show the number and size of ignored files in each directory
+        /// instead
+        #[clap(long, value_parser)]
+        summary: bool,
+
+        /// Ask Syncthing about every file and report the ones it decides
+        /// differently (one request per file)
+        #[clap(long, value_parser, requires("api"))]
+        compare: bool,
+    },
+    /// Find #include directives pointing to missing files and fix them
+    ///
+    /// For each broken include asks whether to create the file or to remove
+    /// the directive. Syncthing fails to load ignore patterns if any included
+    /// file is missing.
+    FixIncludes {
+        /// Create all missing files without asking
+        #[clap(short, long, value_parser, conflicts_with("remove"))]
+        create: bool,
+
+        /// Remove all broken directives without asking
+        #[clap(short, long, value_parser)]
+        remove: bool,
+    },
+    /// Set up synchronized patterns: create .stignore_sync and include it
+    /// from .stignore
+    Init {
+        /// Add patterns for common OS and editor junk files
+        #[clap(short, long, value_parser)]
+        junk: bool,
+    },
+    /// Move patterns from .stignore to .stignore_sync
+    ///
+    /// Asks which patterns should be shared with other devices, moves them
+    /// (along with comments above them) to .stignore_sync and includes it
+    /// from .stignore
+    Adopt {
+        /// Move all patterns without asking, except for --keep ones
+        #[clap(short, long, value_parser)]
+        all: bool,
+
+        /// Device-specific pattern to leave in .stignore
+        #[clap(short, long, value_parser)]
+        keep: Vec<String>,
+    },
+    /// Rename a file or directory and rewrite the patterns referencing it
+    ///
+    /// Anchored patterns of the path and of paths under it, e.g. /old and
+    /// /old/*.tmp, are changed to the new path in .stignore and the files it
+    /// includes, so the ignores follow the file. Unanchored patterns that may
+    /// refer to it are only listed.
+    Mv {
+        /// File or directory to rename, relative to CWD
+        #[clap(value_parser)]
+        old: PathBuf,
+
+        /// New path, relative to CWD, inside of the same folder
+        #[clap(value_parser)]
+        new: PathBuf,
+    },
+    /// Rewrite patterns of .stignore and the files it includes the canonical
+    /// way
+    ///
+    /// Flags are put in the order !, (?i), (?d), ./ and repeated slashes are
+    /// removed, repeated ** segments collapsed, and backslashes replaced
+    /// with slashes on Windows. Files with canonical patterns aren't touched.
+    Canonicalize {
+        /// Only show the changes as a diff
+        #[clap(long, value_parser)]
+        dry_run: bool,
+    },
+    /// Change the directory of patterns after reorganizing a subtree
+    ///
+    /// Anchored patterns of OLD_PREFIX and of paths under it are changed to
+    /// NEW_PREFIX in .stignore and the files it includes. Nothing is moved on
+    /// disk, see `mv` for that.
+    RewritePrefix {
+        /// Directory, relative to CWD, or to the folder root if it starts
+        /// with /
+        #[clap(value_parser)]
+        old_prefix: String,
+
+        /// Directory replacing OLD_PREFIX, given the same way
+        #[clap(value_parser)]
+        new_prefix: String,
+    },
+    /// Remove patterns from .stignore and the files it includes
+    ///
+    /// Patterns are matched either as written in the files or relative to
+    /// CWD, as `add` would write them. Every line with the pattern is
+    /// removed.
+    Rm(RmArgs),
+    /// Move patterns from .stignore to .stignore_sync
+    ///
+    /// Comments directly above the patterns are moved as well. Patterns are
+    /// matched either as written in the file or relative to CWD, as `add`
+    /// would write them.
+    Promote {
+        /// Patterns to move
+        #[clap(value_parser, required(true), min_values(1))]
+        pattern: Vec<String>,
+    },
+    /// Move patterns from .stignore_sync to .stignore
+    ///
+    /// Comments directly above the patterns are moved as well. Patterns are
+    /// matched either as written in the file or relative to CWD, as `add`
+    /// would write them.
+    Demote {
+        /// Patterns to move
+        #[clap(value_parser, required(true), min_values(1))]
+        pattern: Vec<String>,
+    },
+    /// Make sure .stignore includes the file, create both files if needed
+    ///
+    /// Doesn't change anything if the file is already included (directly or
+    /// through other included files)
+    EnsureInclude {
+        /// File to include, relative to syncthing folder root [default:
+        /// .stignore_sync, or --sync-file]
+        #[clap(value_parser)]
+        file: Option<PathBuf>,
+    },
+    /// List pattern fragments in .stignore.d
+    ///
+    /// Fragments are separate ignore files, e.g. .stignore.d/media.stignore,
+    /// each included from .stignore
+    Fragments {
+        /// Include all fragments from .stignore and remove includes of
+        /// deleted fragments
+        #[clap(long, value_parser)]
+        sync: bool,
+    },
+    /// Expand #if blocks of .stignore_sync for this device
+    ///
+    /// .stignore_sync may contain blocks like `#if os==windows` or
+    /// `#if host==laptop` ... `#else` ... `#endif`. The result is written to a
+    /// file included from .stignore instead of .stignore_sync, and excluded
+    /// from syncing since it differs between devices.
+    RenderDevice {
+        /// File with #if blocks, relative to syncthing folder root [default:
+        /// .stignore_sync, or --sync-file]
+        #[clap(long, value_parser)]
+        source: Option<PathBuf>,
+
+        /// Rendered file, relative to syncthing folder root
+        #[clap(short, long, value_parser, default_value = ".stignore_device")]
+        output: PathBuf,
+
+        /// Keep running and render again whenever the source changes
+        #[clap(short, long, value_parser)]
+        watch: bool,
+    },
+    /// Print .stignore with all includes substituted
+    ///
+    /// Resulting patterns are in the order syncthing evaluates them
+    Render {
+        /// Write patterns to the file instead of stdout
+        #[clap(short, long, value_parser)]
+        output: Option<PathBuf>,
+    },
+    /// Pick items Syncthing hasn't synchronized yet and ignore them
+    ///
+    /// Lists files the folder still needs and files that failed to sync
+    /// (requires --api), the chosen ones are added as patterns relative to
+    /// the folder root
+    OutOfSync {
+        #[clap(flatten)]
+        add: AddOptions,
+
+        /// Ignore all listed items without asking
+        #[clap(short, long, value_parser)]
+        all: bool,
+    },
+    /// Pick files and directories under CWD to ignore with a fuzzy search
+    ///
+    /// Lists the ones that aren't ignored yet. Type to narrow the list, Tab
+    /// selects, Enter adds exact patterns of the selected items (or the
+    /// highlighted one) relative to the folder root.
+    Pick {
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Compare effective ignore patterns of the folder on several devices
+    ///
+    /// Patterns (with includes expanded) are fetched from this device's
+    /// Syncthing (requires --api) and from the other instances, then the ones
+    /// missing on some of the devices are listed.
+    DiffDevices {
+        /// Syncthing instance, e.g. https://nas:8384. Its API key is read from
+        /// STIGNORE_API_KEY_NAS (the host name in upper case) or asked for
+        #[clap(value_parser, required(true), min_values(1), value_name = "URL")]
+        instance: Vec<String>,
+    },
+    /// Give every device the patterns any of the devices has
+    ///
+    /// Effective patterns are fetched like for diff-devices and merged, keeping
+    /// their order. Patterns a device lacks are inserted into its .stignore
+    /// next to their neighbours, through its Syncthing.
+    MergeDevices {
+        /// Syncthing instance, e.g. https://nas:8384. Its API key is read from
+        /// STIGNORE_API_KEY_NAS (the host name in upper case) or asked for
+        #[clap(value_parser, required(true), min_values(1), value_name = "URL")]
+        instance: Vec<String>,
+    },
+    /// Check that every device sharing the folder includes the synchronized
+    /// patterns
+    ///
+    /// Reads .stignore of the folder on this device (requires --api) and on
+    /// the other instances, and reports devices whose .stignore doesn't
+    /// include .stignore_sync (or the .stignore_device rendered from it)
+    CheckDevices {
+        /// Syncthing instance, e.g. https://nas:8384. Its API key is read from
+        /// STIGNORE_API_KEY_NAS (the host name in upper case) or asked for
+        #[clap(value_parser, value_name = "URL")]
+        instance: Vec<String>,
+    },
+    /// List sync conflict files, grouped by the original file
+    ///
+    /// Finds files named `*.sync-conflict-*` in the folder, then optionally
+    /// deletes them or adds patterns ignoring them
+    Conflicts {
+        /// Delete all found conflict files
+        #[clap(short, long, value_parser, conflicts_with("ignore"))]
+        delete: bool,
+
+        /// Ignore all found conflict files
+        #[clap(long, value_parser)]
+        ignore: bool,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Merge conflict copies of ignore files made by Syncthing
+    ///
+    /// Lines of each copy (e.g. .sync-conflict-20240101-120000-ABCDEFG.stignore_sync)
+    /// missing from the ignore file are added after the lines they follow in
+    /// the copy. The result is shown, and once confirmed written, and the
+    /// copies are deleted.
+    Resolve {
+        /// Move the conflict copies to the trash instead of deleting them
+        #[clap(long, value_parser)]
+        trash: bool,
+    },
+    /// Prune old file versions kept by Syncthing in .stversions
+    ///
+    /// Without options prints how much space the versions take
+    Versions {
+        /// Delete versions archived earlier than this, e.g. 30d, 12h or 2w
+        #[clap(long, value_parser = files::parse_age, value_name = "AGE")]
+        older_than: Option<Duration>,
+
+        /// Delete the oldest versions until the rest fit in this size, e.g.
+        /// 500M or 2G
+        #[clap(long, value_parser = files::parse_size, value_name = "SIZE")]
+        max_size: Option<u64>,
+
+        /// Delete versions of files that are ignored now
+        #[clap(long, value_parser)]
+        ignored: bool,
+
+        /// Only list versions that would be deleted
+        #[clap(short = 'n', long, value_parser)]
+        dry_run: bool,
+    },
+    /// Revert the last change of the folder's ignore files made by stignore
+    ///
+    /// Each invocation is recorded in the journal in the user's state
+    /// directory, and undone as a whole
+    Undo {
+        /// Undo even if the files were changed since, keeping the later
+        /// changes where the operation didn't edit the files
+        #[clap(long, value_parser)]
+        force: bool,
+    },
+    /// List changes of the folder's ignore files recorded in the journal
+    History {
+        /// Show changes of all folders
+        #[clap(long, value_parser)]
+        all: bool,
+
+        #[clap(subcommand)]
+        action: Option<HistoryAction>,
+    },
+    /// Show when and how each line of ignore files was added
+    ///
+    /// Lines are attributed to operations of stignore from the journal, or
+    /// to git commits for ignore files kept in git
+    Blame {
+        /// Ignore file to annotate, by default .stignore and the files it
+        /// includes
+        #[clap(value_parser)]
+        file: Option<PathBuf>,
+    },
+    /// List backups of ignore files made with --backup
+    Backups {
+        /// Put the backup with this number from the list back in place
+        #[clap(long, value_parser, value_name = "N")]
+        restore: Option<usize>,
+    },
+    /// Watch the folder and offer to ignore newly created junk
+    ///
+    /// Created paths that aren't ignored yet are matched against the rules,
+    /// and the matching rule (or the exact path of a large file) is offered
+    /// as a pattern. Runs until interrupted.
+    Watch {
+        /// Pattern of paths to offer ignoring, can be repeated [default:
+        /// node_modules, __pycache__, .venv, *.tmp, *.temp, *.swp, *~,
+        /// .DS_Store, Thumbs.db]
+        #[clap(long, value_parser, value_name = "PATTERN")]
+        rule: Vec<String>,
+
+        /// Offer ignoring files larger than this, e.g. 500M or 2G
+        #[clap(long, value_parser = files::parse_size, value_name = "SIZE", default_value = "1G")]
+        larger_than: u64,
+
+        /// Add the patterns without asking
+        #[clap(long, value_parser)]
+        auto: bool,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Print the root of the syncthing folder containing CWD
+    ///
+    /// Exits with code 2 outside of folders, so scripts can tell it from
+    /// other errors
+    Root,
+    /// Print the prefix prepended to patterns added in CWD or PATH
+    ///
+    /// The prefix is the path relative to the folder root with `/`
+    /// separators, e.g. `/photos/2024`
+    Rel {
+        /// Directory or file inside of the folder [default: CWD]
+        #[clap(value_parser)]
+        path: Option<PathBuf>,
+    },
+    /// Print which files adding patterns with the same options would change
+    Which {
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Show the folder containing CWD and whether CWD is ignored
+    ///
+    /// Answers come from `stignore daemon` if it's running, which is fast
+    /// enough to run on every shell prompt
+    Status {
+        /// Print only the folder name, followed by `(ignored)` if CWD is
+        /// ignored, and nothing outside of folders
+        #[clap(long, value_parser)]
+        prompt: bool,
+    },
+    /// Print the completion script of the shell
+    ///
+    /// E.g. `stignore completion bash > /etc/bash_completion.d/stignore`, or
+    /// `stignore completion fish | source`
+    Completion {
+        #[clap(arg_enum, value_parser)]
+        shell: clap_complete::Shell,
+    },
+    /// Check the folder, its ignore files and the API, with hints how to
+    /// fix the problems found
+    Doctor,
+    /// Browse the folder tree and edit .stignore in the terminal
+    ///
+    /// Ignored entries are checked, toggling one adds or removes its pattern.
+    /// The resulting patterns can be reviewed and reordered before writing
+    /// them.
+    Tui,
+    /// Print the version and build details, for bug reports
+    Version {
+        /// Print them as a JSON object
+        #[clap(long, value_parser)]
+        json: bool,
+    },
+    /// Update stignore to the latest release on GitHub
+    ///
+    /// The binary for this platform is downloaded, checked against the
+    /// published SHA-256 checksum, and replaces the running executable
+    SelfUpdate {
+        /// Only report whether a newer version is available
+        #[clap(long, value_parser)]
+        check: bool,
+    },
+    /// Print values to complete, one per line, for completion scripts
+    #[clap(name = "__complete", hide(true))]
+    Complete {
+        #[clap(arg_enum, value_parser)]
+        values: Completed,
+    },
+    /// Serve queries of shell prompts and editor plugins over a local socket
+    ///
+    /// Folder roots and parsed ignore files are kept in memory and parsed
+    /// again only once they change. Requests and answers are JSON objects,
+    /// one per line: {"command": "check", "path": PATH} tells if the path is
+    /// ignored, "ls" lists a directory marking ignored entries, and "add"
+    /// with "patterns" adds them as if stignore was run in PATH. Runs until
+    /// interrupted.
+    Daemon {
+        /// Socket to listen on [default: $XDG_RUNTIME_DIR/stignore.sock]
+        #[clap(long, value_parser, env = "STIGNORE_SOCKET")]
+        socket: Option<PathBuf>,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Add patterns from rsync exclude file
+    ///
+    /// Accepts files used with `rsync --exclude-from=FILE`. Rules are
+    /// interpreted relative to the current working directory, as if it was
+    /// the source directory of rsync.
+    ImportRsync {
+        /// Rsync exclude file
+        #[clap(value_parser)]
+        file: PathBuf,
+
+        #[clap(flatten)]
+        add: AddOptions,
+
+        /// Interpret rules relative to syncthing folder root
+        #[clap(short, long, value_parser)]
+        absolute: bool,
+    },
+    /// Add patterns from borgbackup exclude or patterns file
+    ///
+    /// Only patterns pointing inside of the syncthing folder are added,
+    /// `re:` patterns are not supported.
+    ImportBorg {
+        /// File used with `borg create --exclude-from` or `--patterns-from`
+        #[clap(value_parser)]
+        file: PathBuf,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Add patterns from restic exclude file
+    ///
+    /// Only absolute patterns pointing inside of the syncthing folder and
+    /// relative patterns are added.
+    ImportRestic {
+        /// File used with `restic backup --exclude-file`
+        #[clap(value_parser)]
+        file: PathBuf,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+    /// Add patterns from Resilio Sync IgnoreList
+    ImportResilio {
+        /// IgnoreList file [default: .sync/IgnoreList in syncthing folder]
+        #[clap(value_parser)]
+        file: Option<PathBuf>,
+
+        #[clap(flatten)]
+        add: AddOptions,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum HistoryAction {
+    /// Show the exact changes of the operation
+    Show {
+        /// Number of the operation from the list
+        #[clap(value_parser)]
+        number: u64,
+    },
+}
+
+/// Whether CWD is used as the shell shows it (`$PWD`), without resolving
+/// symlinks
+static LOGICAL_CWD: OnceLock<bool> = OnceLock::new();
+
+thread_local! {
+    /// Root of the folder the thread handles with --all-folders, used instead
+    /// of CWD shared by all threads
+    static FOLDER_CWD: RefCell<Option<PathBuf>> = const { RefCell::new(None) };
+}
+
+/// CWD with symlinks resolved, so paths match the layout Syncthing sees, or
+/// `$PWD` with --no-resolve-symlinks
+fn working_dir() -> Result<PathBuf> {
+    if let Some(dir) = FOLDER_CWD.with(|dir| dir.borrow().clone()) {
+        return files::canonicalize(&dir).with_context(|| format!("Can't enter {}", dir.display()));
+    }
+    let cwd = std::env::current_dir()
+        .and_then(|dir| files::canonicalize(&dir))
+        .context("Can't determine current working directory")?;
+    if LOGICAL_CWD.get() == Some(&true) {
+        // $PWD is stale if the shell didn't change it along with CWD
+        if let Some(pwd) = std::env::var_os("PWD").map(PathBuf::from) {
+            if pwd.is_absolute() && files::canonicalize(&pwd).ok().as_ref() == Some(&cwd) {
+                return Ok(pwd);
+            }
+        }
+    }
+    Ok(cwd)
+}
+
+/// Changes CWD for `-C DIR`, along with `$PWD` the way `cd` in a shell does
+fn change_dir(dir: &Path) -> Result<()> {
+    let pwd = std::env::var_os("PWD")
+        .map(PathBuf::from)
+        .filter(|pwd| pwd.is_absolute());
+    std::env::set_current_dir(dir).with_context(|| format!("Can't change to {}", dir.display()))?;
+    if let Some(pwd) = pwd {
+        let mut logical = PathBuf::new();
+        for component in pwd.join(dir).components() {
+            match component {
+                path::Component::CurDir => {}
+                path::Component::ParentDir => {
+                    logical.pop();
+                }
+                c => logical.push(c),
+            }
+        }
+        std::env::set_var("PWD", logical);
+    }
+    Ok(())
+}
+
+fn find_syncthing_dir() -> Result<(PathBuf, PathBuf)> {
+    let cwd = working_dir()?;
+    match SELECTED_FOLDER.get() {
+        Some(Selected::Local(root)) => {
+            return Ok((root.clone(), prefix_override(prefix_in(root, &cwd))?));
+        }
+        Some(Selected::Remote(folder)) => bail!(
+            "Folder {} isn't available on this device, \
+            only adding patterns to its .stignore is supported",
+            folder.id
+        ),
+        None => {}
+    }
+    let st_dir = match folder_roots(&cwd).into_iter().next() {
+        Some(st_dir) => st_dir,
+        None => bail!("Current directory is not inside of a syncthing folder"),
+    };
+
+    let prefix = path::Path::join(
+        path::Path::new(path::Component::RootDir.as_os_str()),
+        cwd.strip_prefix(&st_dir).unwrap(),
+    );
+
+    Ok((st_dir, prefix_override(prefix)?))
+}
+
+/// Prefix of CWD in the folder selected with --folder. Outside of the folder
+/// patterns are relative to its root.
+fn prefix_in(root: &Path, cwd: &Path) -> PathBuf {
+    let relative = cwd.strip_prefix(root).map(Path::to_owned).ok().or_else(|| {
+        // roots of configured folders have symlinks resolved
+        let physical = files::canonicalize(cwd).ok()?;
+        Some(physical.strip_prefix(root).ok()?.to_owned())
+    });
+    Path::new(path::Component::RootDir.as_os_str()).join(relative.unwrap_or_default())
+}
+
+/// Directory patterns are added to instead of CWD, set with --prefix
+static PREFIX: OnceLock<String> = OnceLock::new();
+
+/// The prefix of the directory given with --prefix, if any, otherwise the
+/// prefix of CWD
+fn prefix_override(cwd_prefix: PathBuf) -> Result<PathBuf> {
+    match PREFIX.get() {
+        Some(dir) => Ok(Path::new(path::Component::RootDir.as_os_str())
+            .join(folder_dir(&cwd_prefix, dir).context("Invalid --prefix")?)),
+        None => Ok(cwd_prefix),
+    }
+}
+
+/// Whether the folder search stops at mount points
+static ONE_FILE_SYSTEM: OnceLock<bool> = OnceLock::new();
+
+/// Whether written files are flushed to disk before returning
+static FSYNC: OnceLock<bool> = OnceLock::new();
+
+/// Command run before writing each ignore file, set with `--pre-write`
+static PRE_WRITE: OnceLock<String> = OnceLock::new();
+
+/// Number of backups kept for each ignore file, set with `--backup`
+static KEEP_BACKUPS: OnceLock<usize> = OnceLock::new();
+
+/// Name of the shared file, set with `--sync-file`
+static SYNC_FILE: OnceLock<String> = OnceLock::new();
+
+/// File with patterns shared between devices, included from each .stignore
+fn sync_file() -> &'static str {
+    SYNC_FILE.get().map_or(STIGNORE_SYNC, String::as_str)
+}
+
+/// Whether confirmations are answered without asking, set with -y
+static ASSUME_YES: OnceLock<bool> = OnceLock::new();
+
+/// Target used without --target, `target` of the config file
+static DEFAULT_TARGET: OnceLock<Target> = OnceLock::new();
+
+/// Whether changes wait for confirmation without --preview, `preview` of the
+/// config file
+static PREVIEW: OnceLock<bool> = OnceLock::new();
+
+/// Directories containing the path that have a folder marker, innermost
+/// first
+fn folder_roots(path: &Path) -> Vec<PathBuf> {
+    folder_roots_marked(path, markers())
+}
+
+/// Like [folder_roots], with the given marker names
+fn folder_roots_marked(path: &Path, markers: &[String]) -> Vec<PathBuf> {
+    let one_fs = ONE_FILE_SYSTEM.get() == Some(&true);
+    let filesystem = if one_fs {
+        files::filesystem(path)
+    } else {
+        None
+    };
+    path.ancestors()
+        .take_while(|dir| !one_fs || files::filesystem(dir) == filesystem)
+        .filter(|dir| markers.iter().any(|m| dir.join(m).exists()))
+        .map(Path::to_owned)
+        .collect()
+}
+
+/// Picks one of nested syncthing folders containing CWD by --outermost,
+/// --innermost or by asking
+fn choose_nested(args: &Args) -> Result<()> {
+    let mut roots = folder_roots(&working_dir()?);
+    if roots.len() < 2 {
+        return Ok(());
+    }
+    let root = if args.outermost {
+        roots.pop().unwrap()
+    } else if args.innermost || args.silent || matches!(args.command, Some(Command::Root)) {
+        // output of `root` is captured by scripts, nobody would see the question
+        roots.remove(0)
+    } else {
+        use question::{Answer, Question};
+
+        println!("Current directory is inside of nested syncthing folders:");
+        for (i, root) in roots.iter().enumerate() {
+            println!("{}) {}", i + 1, root.display());
+        }
+        let numbers: Vec<String> = (1..=roots.len()).map(|i| i.to_string()).collect();
+        let answer = Question::new("Folder:")
+            .acceptable(numbers.iter().map(String::as_str).collect())
+            .until_acceptable()
+            .ask();
+        match answer {
+            Some(Answer::RESPONSE(n)) => {
+                let n: usize = n.parse().context("Invalid folder number")?;
+                roots
+                    .into_iter()
+                    .nth(n - 1)
+                    .context("Invalid folder number")?
+            }
+            _ => bail!("No folder selected"),
+        }
+    };
+    SELECTED_FOLDER.set(Selected::Local(root)).ok();
+    Ok(())
+}
+
+fn process_patterns(
+    patterns: &[String],
+    prepend_prefix: Option<&PathBuf>,
+    silent: bool,
+) -> Result<String> {
+    let re = Regex::new(r"^((?:#include )|(?:(?:\(\?[di]\)|!))*) *(.+)$").unwrap();
+
+    let mut out_str = String::new();
+    let mut errs = Vec::new();
+
+    let patterns = patterns.iter().flat_map(|t| t.split('\n'));
+
+    for mut pattern in patterns {
+        pattern = pattern.trim();
+        if pattern.is_empty() || pattern.starts_with("//") {
+            // empty pattern results in an extra new line inserted
+            out_str.push_str(pattern);
+            out_str.push_str(LINE_ENDING);
+            continue;
+        }
+        let m = re.captures(pattern);
+        if m.is_none() {
+            errs.push(pattern);
+            continue;
+        }
+        let m = m.unwrap();
+        let pattern_path = m.get(2);
+        if pattern_path.is_none() {
+            errs.push(pattern);
+            continue;
+        }
+        let pattern_path = pattern_path.unwrap();
+
+        if let Some(m) = m.get(1) {
+            out_str.push_str(m.as_str());
+        }
+
+        // syncthing patterns use forward slashes on all platforms, backslash
+        // is an escape character everywhere except for Windows
+        let mut pattern_path = pattern_path.as_str().to_owned();
+        if cfg!(windows) && pattern_path.contains('\\') {
+            pattern_path = pattern_path.replace('\\', "/");
+            if !silent {
+                eprintln!("NOTE: replaced backslashes with slashes: {pattern_path}");
+            }
+        }
+
+        match prepend_prefix {
+            None => {
+                out_str.push_str(&pattern_path);
+            }
+            Some(prefix) => {
+                let prefix = prefix.components().filter_map(|c| match c {
+                    path::Component::Normal(part) => Some(part.to_string_lossy()),
+                    _ => None,
+                });
+                let parts: Vec<_> = prefix
+                    .chain(
+                        pattern_path
+                            .split('/')
+                            .filter(|p| !p.is_empty() && *p != ".")
+                            .map(Into::into),
+                    )
+                    .collect();
+                out_str.push('/');
+                out_str.push_str(&parts.join("/"));
+            }
+        }
+        out_str.push_str(LINE_ENDING);
+    }
+
+    if !errs.is_empty() {
+        bail!(
+            "Incorrect pattern{}:\n{}",
+            if errs.len() > 1 { "s" } else { "" },
+            errs.join("\n")
+        );
+    }
+    if out_str.trim().is_empty() {
+        bail!("No patterns supplied!")
+    }
+    Ok(match UNICODE_FORM.get() {
+        Some(UnicodeForm::Nfd) => out_str.nfd().collect(),
+        Some(UnicodeForm::Unchanged) => out_str,
+        _ => out_str.nfc().collect(),
+    })
+}
+
+/// Appends patterns starting from a new line, using the line ending most of
+/// the existing file uses. The file is created if needed.
+fn append(path: &Path, patterns: &str) -> Result<()> {
+    let lock = files::lock(path)?;
+    let mut file = read_locked(&lock, path)?;
+    for line in patterns.lines() {
+        file.push(line);
+    }
+    lock.write(file.to_string())
+}
+
+/// Writes a new file, creating its directory if needed
+fn create_file(path: &Path, content: impl AsRef<[u8]>) -> Result<()> {
+    if let Some(dir) = path.parent().filter(|d| !d.as_os_str().is_empty()) {
+        std::fs::create_dir_all(dir).with_context(|| format!("Can't create {}", dir.display()))?;
+    }
+    files::write(path, content)
+}
+
+/// Parses the ignore file read through its lock
+fn read_locked(lock: &files::Lock, path: &Path) -> Result<IgnoreFile> {
+    let content = lock
+        .read()
+        .with_context(|| format!("Can't read {}", path.display()))?;
+    let content =
+        std::str::from_utf8(content).with_context(|| format!("Can't read {}", path.display()))?;
+    Ok(IgnoreFile::parse(content))
+}
+
+/// Expands template variables in patterns supplied on the command line
+fn expand_vars(patterns: &[String]) -> Result<Vec<String>> {
+    patterns.iter().map(|p| device::expand_vars(p)).collect()
+}
+
+fn print_or_write(content: &str, output: Option<&Path>, silent: bool) -> Result<()> {
+    match output {
+        None => print!("{content}"),
+        Some(path) => {
+            files::write(path, content)?;
+            if !silent {
+                println!("Written to {}", path.display());
+            }
+        }
+    }
+    Ok(())
+}
+
+fn fix_includes(create: bool, remove: bool, silent: bool) -> Result<()> {
+    use question::{Answer, Question};
+
+    let (st_dir, _) = find_syncthing_dir()?;
+    let tree = includes::tree(&st_dir.join(".stignore"));
+    let broken = includes::broken(&tree);
+    if broken.is_empty() {
+        if !silent {
+            println!("All included files are present");
+        }
+        return Ok(());
+    }
+
+    for (including, missing) in broken {
+        let create = if create || remove {
+            create
+        } else {
+            let answer = Question::new(&format!(
+                "{} includes missing {}. Create it (c) or remove the directive (r)?",
+                including
+                    .strip_prefix(&st_dir)
+                    .unwrap_or(including)
+                    .display(),
+                missing.strip_prefix(&st_dir).unwrap_or(missing).display(),
+            ))
+            .acceptable(vec!["c", "r"])
+            .until_acceptable()
+            .ask();
+            answer == Some(Answer::RESPONSE("c".to_owned()))
+        };
+        if create {
+            includes::create(including, missing, &st_dir)?;
+            if !silent {
+                println!("Created {}", missing.display());
+            }
+        } else {
+            includes::remove_directive(including, missing)?;
+            if !silent {
+                println!(
+                    "Removed #include of {} from {}",
+                    missing.display(),
+                    including.display()
+                );
+            }
+        }
+    }
+    Ok(())
+}
+
+fn init(junk: bool, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let stignore_sync = st_dir.join(sync_file());
+    if !stignore_sync.exists() {
+        let header = [
+            "// Ignore patterns shared between all devices.",
+            "// Each device includes this file from its .stignore with",
+            &format!("// #include {}", sync_file()),
+            "",
+        ];
+        files::write(&stignore_sync, header.join(LINE_ENDING))
+            .with_context(|| format!("Can't create {}", sync_file()))?;
+        if !silent {
+            println!("Created {}", stignore_sync.display());
+        }
+    }
+    ensure_include(Path::new(sync_file()), silent)?;
+
+    if junk {
+        let existing = read_to_string(&stignore_sync)?;
+        let existing: Vec<&str> = existing.lines().map(str::trim).collect();
+        let template = device::expand_vars(templates::JUNK)?;
+        let missing: String = template
+            .lines()
+            .filter(|l| !existing.contains(l))
+            .map(|l| l.to_owned() + LINE_ENDING)
+            .collect();
+        if missing.lines().any(|l| Pattern::parse(l).is_some()) {
+            append(&stignore_sync, &missing)
+                .with_context(|| format!("Can't append to {}", sync_file()))?;
+            if !silent {
+                println!("Added junk patterns:{LINE_ENDING}{missing}");
+            }
+        }
+    }
+    Ok(())
+}
+
+fn confirm(question: &str) -> bool {
+    if assume_yes() {
+        println!("{question} yes");
+        return true;
+    }
+    ask(question, question::Answer::YES)
+}
+
+/// Asks before deleting or overwriting something that can't be taken back:
+/// only an explicit yes, or --assume-yes, proceeds. --silent doesn't answer.
+fn confirm_destructive(question: &str) -> bool {
+    if assume_yes() {
+        println!("{question} yes");
+        return true;
+    }
+    ask(question, question::Answer::NO)
+}
+
+/// Whether confirmations are answered with yes by --assume-yes
+fn assume_yes() -> bool {
+    ASSUME_YES.get() == Some(&true)
+}
+
+fn ask(question: &str, default: question::Answer) -> bool {
+    use question::{Answer, Question};
+    Question::new(question)
+        .until_acceptable()
+        .default(default)
+        .show_defaults()
+        .confirm()
+        == Answer::YES
+}
+
+/// Asks to pick some of `count` numbered items, e.g. `1 3-5` or `all`.
+/// Returns zero-based indices.
+fn pick(count: usize) -> Vec<usize> {
+    use question::{Answer, Question};
+    loop {
+        let answer = Question::new("Items (e.g. 1 3-5, all, or empty for none):").ask();
+        let answer = match answer {
+            Some(Answer::RESPONSE(answer)) => answer,
+            _ => return Vec::new(),
+        };
+        match parse_selection(&answer, count) {
+            Some(picked) => return picked,
+            None => println!("Expected numbers from 1 to {count}"),
+        }
+    }
+}
+
+fn parse_selection(answer: &str, count: usize) -> Option<Vec<usize>> {
+    if answer.trim() == "all" {
+        return Some((0..count).collect());
+    }
+    let mut picked = Vec::new();
+    for part in answer.split([' ', ',']).filter(|p| !p.is_empty()) {
+        let (from, to) = part.split_once('-').unwrap_or((part, part));
+        let (from, to): (usize, usize) = (from.parse().ok()?, to.parse().ok()?);
+        if from == 0 || from > to || to > count {
+            return None;
+        }
+        for i in from - 1..to {
+            if !picked.contains(&i) {
+                picked.push(i);
+            }
+        }
+    }
+    Some(picked)
+}
+
+fn out_of_sync(all: bool, opts: &AddOptions, api: &api::Client, silent: bool) -> Result<()> {
+    let items = api.out_of_sync(&folder_id(api)?)?;
+    if items.is_empty() {
+        if !silent {
+            println!("Folder is in sync");
+        }
+        return Ok(());
+    }
+    let picked = if all {
+        (0..items.len()).collect()
+    } else {
+        for (i, item) in items.iter().enumerate() {
+            println!("{}) {item}", i + 1);
+        }
+        pick(items.len())
+    };
+    if picked.is_empty() {
+        if !silent {
+            println!("Nothing to add");
+        }
+        return Ok(());
+    }
+    let patterns: Vec<String> = picked
+        .iter()
+        .map(|&i| pattern::literal(&items[i]))
+        .collect();
+    add(&patterns, true, opts, Some(api), silent)
+}
+
+/// Path relative to the folder root with `/` separators
+fn relative(st_dir: &Path, path: &Path) -> String {
+    let relative = path.strip_prefix(st_dir).unwrap_or(path).to_string_lossy();
+    if cfg!(windows) {
+        relative.replace('\\', "/")
+    } else {
+        relative.into_owned()
+    }
+}
+
+fn prune_versions(
+    older_than: Option<Duration>,
+    max_size: Option<u64>,
+    ignored: bool,
+    dry_run: bool,
+    silent: bool,
+) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let all = versions::list(&st_dir)?;
+    let total: u64 = all.iter().map(|v| v.size).sum();
+    if older_than.is_none() && max_size.is_none() && !ignored {
+        println!(
+            "{} versions in {}, {}",
+            all.len(),
+            versions::DIR,
+            files::format_size(total)
+        );
+        return Ok(());
+    }
+
+    let matcher = if ignored {
+        Matcher::new(&includes::flatten(&st_dir.join(".stignore"))?)
+    } else {
+        Matcher::new(&[])
+    };
+    let cutoff = older_than.map(|age| versions::now().saturating_sub(age.as_secs()));
+    let (mut prune, keep): (Vec<_>, Vec<_>) = all.iter().partition(|v| {
+        cutoff.is_some_and(|c| v.archived < c) || (ignored && matcher.is_ignored(&v.original))
+    });
+    if let Some(max_size) = max_size {
+        // versions are sorted from the oldest one
+        let mut kept: u64 = keep.iter().map(|v| v.size).sum();
+        for v in keep {
+            if kept <= max_size {
+                break;
+            }
+            kept -= v.size;
+            prune.push(v);
+        }
+    }
+    if prune.is_empty() {
+        if !silent {
+            println!("Nothing to prune");
+        }
+        return Ok(());
+    }
+
+    let size: u64 = prune.iter().map(|v| v.size).sum();
+    // versions to delete are always listed before asking
+    if !silent || dry_run || !assume_yes() {
+        for v in &prune {
+            println!("{}", relative(&st_dir, &v.path));
+        }
+        println!(
+            "{} of {} versions, {} of {}",
+            prune.len(),
+            all.len(),
+            files::format_size(size),
+            files::format_size(total)
+        );
+    }
+    if dry_run {
+        return Ok(());
+    }
+    if !confirm_destructive("Delete them?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    for v in prune {
+        versions::remove(&st_dir, v)?;
+    }
+    Ok(())
+}
+
+/// Commits the changed files to their git repositories, with the command
+/// and the changed patterns as the message
+fn git_commit(changes: &[journal::Change], silent: bool) -> Result<()> {
+    let git = |dir: &Path, args: &[&OsStr]| -> Result<String> {
+        let output = std::process::Command::new("git")
+            .arg("-C")
+            .arg(dir)
+            .args(args)
+            .output()
+            .context("Can't run git")?;
+        if !output.status.success() {
+            bail!(
+                "git {} failed: {}",
+                args[0].to_string_lossy(),
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(String::from_utf8_lossy(&output.stdout).trim().to_owned())
+    };
+
+    let mut repos: Vec<(PathBuf, Vec<&journal::Change>)> = Vec::new();
+    for change in changes {
+        let dir = change.path.parent().unwrap_or(Path::new("."));
+        let Ok(repo) = git(dir, &["rev-parse".as_ref(), "--show-toplevel".as_ref()]) else {
+            if !silent {
+                eprintln!(
+                    "NOTE: {} isn't in a git repository, not committing it",
+                    change.path.display()
+                );
+            }
+            continue;
+        };
+        let repo = PathBuf::from(repo);
+        match repos.iter_mut().find(|(r, _)| *r == repo) {
+            Some((_, changed)) => changed.push(change),
+            None => repos.push((repo, vec![change])),
+        }
+    }
+
+    for (repo, changed) in repos {
+        let body: Vec<String> = changed
+            .iter()
+            .map(|c| {
+                let patch = journal::Patch::new(c);
+                format!("{}: {}", relative(&repo, &c.path), changed_patterns(&patch))
+            })
+            .collect();
+        let subject = journal::command_line();
+        let body = body.join("\n");
+        let paths = changed.iter().map(|c| c.path.as_os_str());
+
+        let mut add: Vec<&OsStr> = vec!["add".as_ref(), "-A".as_ref(), "--".as_ref()];
+        add.extend(paths.clone());
+        git(&repo, &add)?;
+        let mut commit: Vec<&OsStr> = vec![
+            "commit".as_ref(),
+            "-q".as_ref(),
+            "-m".as_ref(),
+            subject.as_ref(),
+            "-m".as_ref(),
+            body.as_ref(),
+            "--".as_ref(),
+        ];
+        commit.extend(paths);
+        git(&repo, &commit)?;
+        if !silent {
+            println!("Committed to {}", repo.display());
+        }
+    }
+    Ok(())
+}
+
+/// Reverts the latest operation from the journal that changed the folder and
+/// wasn't undone yet. Files changed since are only reverted with `force`.
+fn undo(force: bool, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    // the journal has paths with symlinks resolved
+    let root = files::canonicalize(&st_dir).unwrap_or(st_dir.clone());
+    let entries = journal::load()?;
+    let undone: Vec<u64> = entries.iter().filter_map(|e| e.undoes).collect();
+    let Some(entry) = entries.iter().rev().find(|e| {
+        e.undoes.is_none()
+            && !undone.contains(&e.id)
+            && e.changes.iter().any(|c| c.path.starts_with(&root))
+    }) else {
+        bail!("Nothing to undo in {}", st_dir.display());
+    };
+
+    if !silent {
+        println!(
+            "Undoing `{}` from {} on {}:",
+            entry.command,
+            versions::format_utc(entry.time),
+            entry.host
+        );
+    }
+    let mut reverted = Vec::new();
+    for change in &entry.changes {
+        let current = std::fs::read_to_string(&change.path).ok();
+        if !change.is_current(current.as_deref()) {
+            if !force {
+                bail!(
+                    "{} was changed since `{}`, pass --force to undo it anyway",
+                    change.path.display(),
+                    entry.command
+                );
+            }
+            eprintln!(
+                "NOTE: {} was changed since, the changes are kept where the operation didn't \
+                edit it",
+                change.path.display()
+            );
+        }
+        let Some(before) = change.revert(current.as_deref()) else {
+            bail!(
+                "Can't undo `{}`: {} was changed where the operation edited it",
+                entry.command,
+                change.path.display()
+            );
+        };
+        // --silent only hides the diff when nobody is asked about it
+        if !silent || !assume_yes() {
+            println!(
+                "{}:\n{}",
+                change.path.display(),
+                diff::diff(
+                    current.as_deref().unwrap_or_default(),
+                    before.as_deref().unwrap_or_default()
+                )
+            );
+        }
+        reverted.push((&change.path, before));
+    }
+    if !confirm_destructive("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+
+    for (path, before) in reverted {
+        match before {
+            Some(before) => files::write(path, &before)?,
+            // the file was created by the operation
+            None => match std::fs::read(path) {
+                Ok(current) => {
+                    std::fs::remove_file(path)
+                        .with_context(|| format!("Can't delete {}", path.display()))?;
+                    journal::record(path, Some(&current), None);
+                }
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+                Err(e) => return Err(e).with_context(|| format!("Can't read {}", path.display())),
+            },
+        }
+    }
+    journal::save(Some(entry.id))
+}
+
+/// Lists operations from the journal with the patterns they added or removed
+fn history(all: bool) -> Result<()> {
+    let root = if all {
+        None
+    } else {
+        let (st_dir, _) = find_syncthing_dir()?;
+        Some(files::canonicalize(&st_dir).unwrap_or(st_dir))
+    };
+    let entries = journal::load()?;
+    let undone: Vec<u64> = entries.iter().filter_map(|e| e.undoes).collect();
+    let mut shown = 0;
+    for entry in &entries {
+        let changes: Vec<_> = entry
+            .changes
+            .iter()
+            .filter(|c| root.as_ref().is_none_or(|r| c.path.starts_with(r)))
+            .collect();
+        if changes.is_empty() {
+            continue;
+        }
+        shown += 1;
+        println!(
+            "{:>4}  {}  {}  {}{}",
+            entry.id,
+            versions::format_utc(entry.time),
+            entry.host,
+            entry.command,
+            if undone.contains(&entry.id) {
+                "  (undone)"
+            } else {
+                ""
+            }
+        );
+        for change in changes {
+            let path = match &root {
+                Some(root) => relative(root, &change.path),
+                None => change.path.display().to_string(),
+            };
+            println!("      {path}: {}", changed_patterns(change));
+        }
+    }
+    if shown == 0 {
+        println!("No changes recorded");
+    }
+    Ok(())
+}
+
+/// Patterns and includes added (`+`) or removed (`-`) by the change
+fn changed_patterns(change: &journal::Patch) -> String {
+    let mut out: Vec<String> = change.added().iter().map(|l| format!("+{l}")).collect();
+    out.extend(change.removed().iter().map(|l| format!("-{l}")));
+    match (change.created, change.deleted()) {
+        (true, _) => out.insert(0, "created".to_owned()),
+        (_, true) => out.insert(0, "deleted".to_owned()),
+        _ if out.is_empty() => out.push("reordered or comments changed".to_owned()),
+        _ => {}
+    }
+    out.join(" ")
+}
+
+/// Shows the diff of every file changed by the operation
+fn show_operation(number: u64) -> Result<()> {
+    let entries = journal::load()?;
+    let Some(entry) = entries.iter().find(|e| e.id == number) else {
+        bail!("No operation number {number} in the journal");
+    };
+    println!(
+        "{}  {}  {}",
+        versions::format_utc(entry.time),
+        entry.host,
+        entry.command
+    );
+    for change in &entry.changes {
+        println!("--- {}\n{}", change.path.display(), change.diff());
+    }
+    Ok(())
+}
+
+/// Prints ignore files with the origin of each pattern next to it
+fn blame(file: Option<&Path>) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let paths = match file {
+        Some(file) => vec![file.to_owned()],
+        None => {
+            let mut paths = Vec::new();
+            let mut nodes = vec![includes::tree(&st_dir.join(".stignore"))];
+            while let Some(node) = nodes.pop() {
+                if node.problem.is_none() {
+                    paths.push(node.path);
+                }
+                nodes.extend(node.includes.into_iter().rev());
+            }
+            paths
+        }
+    };
+    let journal = journal::load()?;
+
+    for path in paths {
+        let content = read_to_string(&path)?;
+        let canonical = files::canonicalize(&path).unwrap_or(path.clone());
+        let origins = blame::blame(&canonical, &content, &journal);
+        let described: Vec<String> = content
+            .lines()
+            .zip(&origins)
+            .map(|(line, origin)| {
+                if Pattern::parse(line).is_none() && includes::included_path(line).is_none() {
+                    return String::new();
+                }
+                origin
+                    .as_ref()
+                    .map_or_else(|| "unknown".to_owned(), blame::Origin::describe)
+            })
+            .collect();
+        let width = described.iter().map(|d| d.chars().count()).max();
+
+        println!("{}:", relative(&st_dir, &path));
+        for (line, origin) in content.lines().zip(described) {
+            println!(
+                "{origin:<width$} | {line}",
+                width = width.unwrap_or_default()
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Lists backups of the folder's ignore files, restores the selected one
+fn restore_backup(restore: Option<usize>, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let all = backups::list(&st_dir)?;
+
+    let Some(number) = restore else {
+        if all.is_empty() {
+            println!("No backups, make them with --backup");
+        }
+        for (i, b) in all.iter().enumerate() {
+            println!(
+                "{:>3}. {}  {}",
+                i + 1,
+                b.date(),
+                relative(&st_dir, &b.original)
+            );
+        }
+        return Ok(());
+    };
+    let Some(backup) = number.checked_sub(1).and_then(|i| all.get(i)) else {
+        bail!("No backup number {number}, there are {}", all.len());
+    };
+
+    let content = read_to_string(&backup.path)?;
+    // the changes are always shown before asking
+    if !silent || !assume_yes() {
+        let current = ignore_file::read(&backup.original).unwrap_or_default();
+        println!(
+            "{} as of {}:\n{}",
+            relative(&st_dir, &backup.original),
+            backup.date(),
+            diff::diff(&current, &content)
+        );
+    }
+    if !confirm_destructive("Restore?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    files::write(&backup.original, content)
+}
+
+fn adopt(all: bool, keep: &[String], silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let stignore = st_dir.join(".stignore");
+    let stignore_sync = st_dir.join(sync_file());
+
+    let lock = files::lock(&stignore)?;
+    let old = lock
+        .read_to_string()
+        .with_context(|| format!("Can't read {}", stignore.display()))?;
+    let include = format!("#include {}{LINE_ENDING}", sync_file());
+    let included = includes::tree(&stignore).includes(&stignore_sync);
+    let adoption = adopt::split(&old, (!included).then_some(include.as_str()), |pattern| {
+        keep.iter().any(|k| k.trim() == pattern)
+            || !(all || confirm(&format!("Share {pattern} with other devices?")))
+    });
+    if adoption.moved.is_empty() {
+        if !silent {
+            println!("No patterns to move");
+        }
+        return Ok(());
+    }
+
+    files::ensure_writable(&stignore)?;
+    files::ensure_writable(&stignore_sync)?;
+    // --silent only hides the diff when nobody is asked about it
+    if !silent || !assume_yes() {
+        println!(
+            "{}:\n{}\nAppending to {}:\n{}",
+            stignore.display(),
+            diff::diff(&old, &adoption.kept),
+            stignore_sync.display(),
+            adoption.moved
+        );
+    }
+    if !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    files::transaction(|| {
+        append(&stignore_sync, &adoption.moved)
+            .with_context(|| format!("Can't append to {}", sync_file()))?;
+        lock.write(adoption.kept)
+    })
+}
+
+/// Each pattern given on the command line as written and relative to CWD,
+/// as `add` would write it, to find it in ignore files either way
+fn candidates(patterns: &[String], prefix: &PathBuf) -> Vec<[String; 2]> {
+    patterns
+        .iter()
+        .map(|p| {
+            // only looked up, the note about backslashes is for added patterns
+            let prefixed = process_patterns(std::slice::from_ref(p), Some(prefix), true)
+                .map(|p| p.trim().to_owned())
+                .unwrap_or_default();
+            [p.trim().to_owned(), prefixed]
+        })
+        .collect()
+}
+
+fn move_patterns(patterns: &[String], promote: bool, silent: bool) -> Result<()> {
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    let stignore = st_dir.join(".stignore");
+    let stignore_sync = st_dir.join(sync_file());
+    let (from, to) = if promote {
+        (&stignore, &stignore_sync)
+    } else {
+        (&stignore_sync, &stignore)
+    };
+
+    let candidates = candidates(patterns, &prefix);
+
+    let lock = files::lock(from)?;
+    let content = lock
+        .read_to_string()
+        .with_context(|| format!("Can't read {}", from.display()))?;
+    let include = format!("#include {}{LINE_ENDING}", sync_file());
+    let add_include = promote && !includes::tree(&stignore).includes(&stignore_sync);
+    let mut found = Vec::new();
+    let split = adopt::split(
+        &content,
+        add_include.then_some(include.as_str()),
+        |p| match candidates.iter().position(|c| c.iter().any(|c| c == p)) {
+            Some(i) => {
+                found.push(i);
+                false
+            }
+            None => true,
+        },
+    );
+
+    let missing: Vec<&str> = (0..patterns.len())
+        .filter(|i| !found.contains(i))
+        .map(|i| patterns[i].as_str())
+        .collect();
+    if !missing.is_empty() {
+        bail!(
+            "Pattern{} not found in {}:\n{}",
+            if missing.len() > 1 { "s" } else { "" },
+            from.display(),
+            missing.join("\n")
+        );
+    }
+
+    files::ensure_writable(from)?;
+    files::ensure_writable(to)?;
+    if !silent {
+        println!("Moving to {}:\n{}", to.display(), split.moved);
+    }
+    files::transaction(|| {
+        append(to, &split.moved).with_context(|| format!("Can't append to {}", to.display()))?;
+        lock.write(split.kept)
+    })
+}
+
+/// Number of lines shown around a pattern offered for removal
+const CONTEXT_LINES: usize = 2;
+
+fn remove_patterns(args: &RmArgs, silent: bool) -> Result<()> {
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    let patterns = &args.pattern;
+    let candidates = candidates(patterns, &prefix);
+    let regex = match &args.regex {
+        Some(regex) => Some(Regex::new(regex).context("Invalid --regex")?),
+        None => None,
+    };
+
+    let mut ignore_files = Vec::new();
+    for path in includes::readable_files(&st_dir.join(".stignore")) {
+        let lock = files::lock(&path)?;
+        let file = read_locked(&lock, &path)?;
+        ignore_files.push((path, lock, file));
+    }
+
+    // file and line of each pattern to remove
+    let mut found = Vec::new();
+    let mut matched = vec![false; candidates.len()];
+    let all = patterns.is_empty() && args.line.is_empty() && regex.is_none();
+    for (f, (_, _, file)) in ignore_files.iter().enumerate() {
+        for (index, entry) in file.entries().iter().enumerate() {
+            if !matches!(entry.kind(), Kind::Pattern(_)) {
+                continue;
+            }
+            let line = entry.line().trim();
+            let hits: Vec<usize> = (0..candidates.len())
+                .filter(|&i| candidates[i].iter().any(|c| c == line))
+                .collect();
+            let by_regex = regex.as_ref().is_some_and(|re| re.is_match(line));
+            if all || by_regex || !hits.is_empty() {
+                found.push((f, index));
+            }
+            for i in hits {
+                matched[i] = true;
+            }
+        }
+    }
+    for address in &args.line {
+        let (file, number) = address
+            .rsplit_once(':')
+            .and_then(|(file, number)| Some((file, number.parse::<usize>().ok()?)))
+            .with_context(|| {
+                format!("Expected FILE:LINE, e.g. .stignore_sync:42, not {address}")
+            })?;
+        let path = [working_dir()?.join(file), st_dir.join(file)]
+            .into_iter()
+            .find(|p| p.exists())
+            .with_context(|| format!("{file} doesn't exist"))?;
+        let path = files::canonicalize(&path).with_context(|| format!("Can't open {file}"))?;
+        let f = ignore_files
+            .iter()
+            .position(|(p, ..)| files::canonicalize(p).is_ok_and(|p| p == path))
+            .with_context(|| format!("{file} isn't .stignore or a file included from it"))?;
+        let entries = ignore_files[f].2.entries();
+        if number == 0 || number > entries.len() {
+            bail!(
+                "{file} has {} lines, there is no line {number}",
+                entries.len()
+            );
+        }
+        if entries[number - 1].kind() == Kind::Blank {
+            bail!("Line {number} of {file} is empty");
+        }
+        if !found.contains(&(f, number - 1)) {
+            found.push((f, number - 1));
+        }
+    }
+    found.sort_unstable();
+    let missing: Vec<&str> = (0..patterns.len())
+        .filter(|&i| !matched[i])
+        .map(|i| patterns[i].as_str())
+        .collect();
+    if !missing.is_empty() {
+        bail!(
+            "Pattern{} not found:\n{}",
+            if missing.len() > 1 { "s" } else { "" },
+            missing.join("\n")
+        );
+    }
+    if found.is_empty() {
+        if !silent {
+            println!("No patterns to remove");
+        }
+        return Ok(());
+    }
+
+    let location = |(f, index): (usize, usize)| {
+        format!("{}:{}", relative(&st_dir, &ignore_files[f].0), index + 1)
+    };
+    let found = if !args.interactive {
+        found
+    } else if args.checklist {
+        for (n, &(f, index)) in found.iter().enumerate() {
+            let line = ignore_files[f].2.entries()[index].line().trim();
+            println!("{}. {line}  ({})", n + 1, location((f, index)));
+        }
+        pick(found.len()).into_iter().map(|i| found[i]).collect()
+    } else {
+        let mut chosen = Vec::new();
+        for &(f, index) in &found {
+            let entries = ignore_files[f].2.entries();
+            println!("{}", location((f, index)));
+            let start = index.saturating_sub(CONTEXT_LINES);
+            let end = (index + CONTEXT_LINES + 1).min(entries.len());
+            for (i, entry) in entries[start..end].iter().enumerate() {
+                let mark = if start + i == index { '>' } else { ' ' };
+                println!("{mark} {:>4}  {}", start + i + 1, entry.line());
+            }
+            if confirm("Remove?") {
+                chosen.push((f, index));
+            }
+        }
+        chosen
+    };
+    if found.is_empty() {
+        if !silent {
+            println!("Nothing removed");
+        }
+        return Ok(());
+    }
+
+    // new content of each changed file, written once all are known
+    let mut changes = Vec::new();
+    let mut removed = 0;
+    for (f, (path, _, file)) in ignore_files.iter().enumerate() {
+        let mut indices: Vec<usize> = found
+            .iter()
+            .filter(|(i, _)| *i == f)
+            .map(|&(_, index)| index)
+            .collect();
+        if indices.is_empty() {
+            continue;
+        }
+        // comments above a removed line go along unless a pattern right
+        // below takes them over
+        let removing: HashSet<usize> = indices.iter().copied().collect();
+        for index in indices.clone() {
+            let next = (index + 1..file.len()).find(|i| !removing.contains(i));
+            let orphaned = next.is_none_or(|next| {
+                !matches!(
+                    file.entries()[next].kind(),
+                    Kind::Pattern(_) | Kind::Include(_)
+                )
+            });
+            if args.with_comments || orphaned {
+                indices.extend(file.comments_above(index));
+            }
+        }
+        files::ensure_writable(path)?;
+        indices.sort_unstable();
+        indices.dedup();
+        if !silent && regex.is_none() {
+            println!("Removing from {}:", path.display());
+            for &index in &indices {
+                println!("{}", file.entries()[index].line().trim());
+            }
+        }
+        let mut edited = file.clone();
+        // from the end, so the indices of the rest stay valid
+        for &index in indices.iter().rev() {
+            edited.remove(index);
+        }
+        removed += indices.len();
+        changes.push((f, edited));
+    }
+
+    if regex.is_some() {
+        if !silent {
+            for (f, edited) in &changes {
+                let (path, _, file) = &ignore_files[*f];
+                let diff = diff::diff(&file.to_string(), &edited.to_string());
+                println!("{}:\n{diff}", path.display());
+            }
+        }
+        if removed > args.confirm_over
+            && !args.impact
+            && !confirm(&format!("Remove {removed} lines?"))
+        {
+            println!("Aborting.");
+            return Ok(());
+        }
+    }
+    if args.impact {
+        let stignore = st_dir.join(".stignore");
+        let edited: Vec<(PathBuf, String)> = changes
+            .iter()
+            .map(|(f, edited)| (ignore_files[*f].0.clone(), edited.to_string()))
+            .collect();
+        print!(
+            "{}",
+            simulate::impact(
+                &st_dir,
+                &includes::flatten(&stignore)?,
+                &includes::flatten_edited(&stignore, &edited)?
+            )?
+        );
+        if !confirm(&format!("Remove {removed} lines?")) {
+            println!("Aborting.");
+            return Ok(());
+        }
+    }
+    files::transaction(|| {
+        for (f, edited) in changes {
+            ignore_files[f].1.write(edited.to_string())?;
+        }
+        Ok(())
+    })
+}
+
+/// Path relative to the folder root, with `/` separators, of a file that
+/// may not exist yet, but whose directory does
+fn path_in_folder(st_dir: &Path, path: &Path) -> Result<String> {
+    let name = path
+        .file_name()
+        .with_context(|| format!("{} has no file name", path.display()))?;
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    let dir = files::canonicalize(dir).with_context(|| format!("Can't open {}", dir.display()))?;
+    let root = files::canonicalize(st_dir).unwrap_or_else(|_| st_dir.to_owned());
+    if !dir.starts_with(&root) {
+        bail!("{} isn't inside of the syncthing folder", path.display());
+    }
+    Ok(relative(&root, &dir.join(name)))
+}
+
+fn move_path(old: &Path, new: &Path, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let cwd = working_dir()?;
+    let (old_path, new_path) = (cwd.join(old), cwd.join(new));
+    if std::fs::symlink_metadata(&old_path).is_err() {
+        bail!("{} doesn't exist", old.display());
+    }
+    if std::fs::symlink_metadata(&new_path).is_ok() {
+        bail!("{} already exists", new.display());
+    }
+    let (old_rel, new_rel) = (
+        path_in_folder(&st_dir, &old_path)?,
+        path_in_folder(&st_dir, &new_path)?,
+    );
+    if old_rel.starts_with(".stignore") || files::INTERNAL.contains(&old_rel.as_str()) {
+        bail!("{old_rel} belongs to Syncthing or stignore, it can't be moved");
+    }
+
+    let plan = rename::plan(&st_dir, &old_rel, &new_rel)?;
+    for rewrite in &plan.files {
+        files::ensure_writable(&rewrite.path)?;
+    }
+    std::fs::rename(&old_path, &new_path)
+        .with_context(|| format!("Can't move {} to {}", old.display(), new.display()))?;
+    if !silent {
+        println!("Moved {old_rel} to {new_rel}");
+    }
+    let written = files::transaction(|| {
+        for rewrite in &plan.files {
+            if !silent {
+                println!("{}:\n{}", rewrite.path.display(), rewrite.diff());
+            }
+            rewrite.write()?;
+        }
+        Ok(())
+    });
+    if let Err(e) = written {
+        // the patterns written so far are rolled back already
+        let _ = std::fs::rename(&new_path, &old_path);
+        return Err(e.context(format!("{old_rel} was moved back")));
+    }
+    if !plan.unanchored.is_empty() {
+        eprintln!(
+            "NOTE: these patterns may refer to {old_rel} and weren't changed:\n{}",
+            plan.unanchored.join("\n")
+        );
+    }
+    Ok(())
+}
+
+fn canonicalize_patterns(dry_run: bool, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let mut changed = false;
+    files::transaction(|| {
+        for path in includes::readable_files(&st_dir.join(".stignore")) {
+            let lock = files::lock(&path)?;
+            let mut file = read_locked(&lock, &path)?;
+            let before = file.to_string();
+            for index in 0..file.len() {
+                let entry = &file.entries()[index];
+                let canonical = match entry.kind() {
+                    Kind::Pattern(Some(pattern)) => pattern.canonical(),
+                    _ => continue,
+                };
+                if canonical != entry.line().trim() {
+                    file.replace(index, &canonical);
+                }
+            }
+            let after = file.to_string();
+            if after == before {
+                continue;
+            }
+            changed = true;
+            if !silent || dry_run {
+                println!("{}:\n{}", path.display(), diff::diff(&before, &after));
+            }
+            if !dry_run {
+                files::ensure_writable(&path)?;
+                lock.write(after)?;
+            }
+        }
+        Ok(())
+    })?;
+    if !changed && !silent {
+        println!("All patterns are canonical already");
+    }
+    Ok(())
+}
+
+/// Directory given on the command line, relative to the folder root with
+/// `/` separators: as-is if it starts with `/`, otherwise relative to CWD.
+/// The directory doesn't have to exist.
+fn folder_dir(prefix: &Path, dir: &str) -> Result<String> {
+    let path = match dir.starts_with('/') {
+        true => PathBuf::from(dir),
+        false => prefix.join(dir),
+    };
+    let mut parts = Vec::new();
+    for component in path.components() {
+        match component {
+            path::Component::Normal(part) => parts.push(part.to_string_lossy()),
+            path::Component::ParentDir => {
+                if parts.pop().is_none() {
+                    bail!("{dir} is outside of the syncthing folder");
+                }
+            }
+            _ => {}
+        }
+    }
+    if parts.is_empty() {
+        bail!("{dir} is the root of the folder, not a directory in it");
+    }
+    Ok(parts.join("/"))
+}
+
+fn rewrite_prefix(old_prefix: &str, new_prefix: &str, silent: bool) -> Result<()> {
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    let old = folder_dir(&prefix, old_prefix)?;
+    let new = folder_dir(&prefix, new_prefix)?;
+
+    let plan = rename::plan(&st_dir, &old, &new)?;
+    if !plan.unanchored.is_empty() {
+        eprintln!(
+            "NOTE: these patterns may refer to {old} and won't be changed:\n{}",
+            plan.unanchored.join("\n")
+        );
+    }
+    if plan.files.is_empty() {
+        if !silent {
+            println!("No patterns start with /{old}");
+        }
+        return Ok(());
+    }
+    for rewrite in &plan.files {
+        files::ensure_writable(&rewrite.path)?;
+    }
+    // --silent only hides the diff when nobody is asked about it
+    if !silent || !assume_yes() {
+        for rewrite in &plan.files {
+            println!("{}:\n{}", rewrite.path.display(), rewrite.diff());
+        }
+    }
+    if !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    files::transaction(|| {
+        for rewrite in &plan.files {
+            rewrite.write()?;
+        }
+        Ok(())
+    })
+}
+
+fn ensure_include(file: &Path, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let included = st_dir.join(file);
+    if !include_from_stignore(&st_dir, &included, silent)? && !silent {
+        println!(
+            "{} is already included",
+            included
+                .strip_prefix(&st_dir)
+                .unwrap_or(&included)
+                .display()
+        );
+    }
+    Ok(())
+}
+
+/// Appends `#include` of the file to .stignore and creates the file if
+/// needed. Returns false if it was already included.
+fn include_from_stignore(st_dir: &Path, included: &Path, silent: bool) -> Result<bool> {
+    let stignore = st_dir.join(".stignore");
+    // `dir/../..` starts with the folder too
+    let included = &files::lexical(included);
+    if !included.starts_with(st_dir) {
+        bail!("Included file must be inside of the syncthing folder");
+    }
+    let relative = relative(st_dir, included);
+
+    if !included.exists() {
+        includes::create(&stignore, included, st_dir)?;
+        if !silent {
+            println!("Created {}", included.display());
+        }
+    }
+    if includes::tree(&stignore).includes(included) {
+        return Ok(false);
+    }
+    append(&stignore, &format!("#include {relative}{LINE_ENDING}"))
+        .context("Can't append to .stignore")?;
+    if !silent {
+        println!("Added #include {relative} to .stignore");
+    }
+    Ok(true)
+}
+
+fn list_fragments(sync: bool, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let stignore = st_dir.join(".stignore");
+
+    if sync {
+        for fragment in fragments::list(&st_dir)? {
+            include_from_stignore(&st_dir, &fragment, silent)?;
+        }
+        let tree = includes::tree(&stignore);
+        for (including, missing) in includes::broken(&tree) {
+            if including == stignore && fragments::is_fragment(&st_dir, missing) {
+                includes::remove_directive(including, missing)?;
+                if !silent {
+                    println!("Removed #include of deleted {}", missing.display());
+                }
+            }
+        }
+    }
+
+    let tree = includes::tree(&stignore);
+    for fragment in fragments::list(&st_dir)? {
+        let node = includes::tree(&fragment);
+        println!(
+            "{} ({} pattern{}){}",
+            fragment.file_stem().unwrap_or_default().to_string_lossy(),
+            node.patterns,
+            if node.patterns == 1 { "" } else { "s" },
+            if tree.includes(&fragment) {
+                ""
+            } else {
+                ", not included"
+            }
+        );
+    }
+    Ok(())
+}
+
+fn read_to_string(path: &Path) -> Result<String> {
+    ignore_file::read(path)
+        .map(text::strip_bom)
+        .with_context(|| format!("Can't read {}", path.display()))
+}
+
+fn resolve_target(st_dir: &Path, opts: &AddOptions, silent: bool) -> Result<PathBuf> {
+    let stignore_path = st_dir.join(".stignore");
+    let stignore_sync = st_dir.join(sync_file());
+    let tree = includes::readable_tree(&stignore_path)?;
+
+    let fragment = match &opts.fragment {
+        Some(name) => fragments::path(st_dir, name)?,
+        None => PathBuf::new(),
+    };
+
+    let target = if opts.host_only {
+        Target::Topic(device::hostname()?)
+    } else {
+        opts.target()
+    };
+
+    let resolved_target =
+        if target == Target::Auto && opts.into.is_none() && opts.fragment.is_none() {
+            // .stignore_sync may be included indirectly, through other files,
+            // or rendered for this device
+            if tree.includes(&stignore_sync) || tree.includes(&st_dir.join(STIGNORE_DEVICE)) {
+                Target::StignoreSync
+            } else {
+                if !silent && stignore_sync.is_file() {
+                    eprintln!(
+                        "NOTE: {} exists, but wasn't included in .stignore. \
+                    Working with .stignore",
+                        sync_file()
+                    );
+                }
+                Target::Stignore
+            }
+        } else {
+            target
+        };
+
+    let tgt_file = match (&opts.into, resolved_target) {
+        // fragments are included right before appending
+        (None, _) if opts.fragment.is_some() => fragment,
+        (Some(into), _) => {
+            let into = files::lexical(&st_dir.join(into));
+            if !into.starts_with(&st_dir) {
+                bail!(
+                    "{} is outside of the syncthing folder {}",
+                    into.display(),
+                    st_dir.display()
+                );
+            }
+            if !silent && into != stignore_path && !tree.includes(&into) {
+                eprintln!(
+                    "NOTE: {} isn't included from .stignore, syncthing won't apply its patterns",
+                    into.display()
+                );
+            }
+            into
+        }
+        (None, Target::Stignore) => stignore_path,
+        (None, Target::StignoreSync) => stignore_sync,
+        // topical and host files are included right before appending, like fragments
+        (None, Target::Topic(name)) => st_dir.join(format!("{}_{name}", sync_file())),
+        (None, Target::Auto) => {
+            unreachable!("Target::Auto was resolved into concrete targets")
+        }
+    };
+
+    // target file will be created by appending
+    if !silent
+        && includes::broken(&tree)
+            .iter()
+            .any(|&(_, missing)| missing != tgt_file.as_path())
+    {
+        eprintln!(
+            "NOTE: some included ignore files are missing, syncthing won't apply the patterns. \
+            Run `stignore fix-includes` to fix this."
+        );
+    }
+    Ok(tgt_file)
+}
+
+/// Drops patterns already present in the file
+fn skip_duplicates(patterns: &str, file: &Path, silent: bool) -> Result<String> {
+    let existing = match ignore_file::read(file) {
+        Ok(existing) => text::strip_bom(existing),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(patterns.to_owned()),
+        Err(e) => return Err(e).with_context(|| format!("Can't read {}", file.display())),
+    };
+    Ok(skip_existing(
+        patterns,
+        &existing,
+        &file.display().to_string(),
+        silent,
+    ))
+}
+
+/// Drops patterns present in `existing` content of the ignore file `name`
+fn skip_existing(patterns: &str, existing: &str, name: &str, silent: bool) -> String {
+    // generated ignore files may have hundreds of thousands of lines
+    let existing: HashSet<&str> = existing.lines().map(str::trim).collect();
+
+    let mut out = String::new();
+    for line in patterns.split_inclusive('\n') {
+        let trimmed = line.trim();
+        if has_directives(trimmed) && existing.contains(&trimmed) {
+            if !silent {
+                eprintln!("NOTE: {trimmed} is already in {name}, skipping");
+            }
+            continue;
+        }
+        out.push_str(line);
+    }
+    out
+}
+
+/// Checks if there are any patterns or includes, not just comments
+fn has_directives(patterns: &str) -> bool {
+    patterns
+        .lines()
+        .any(|l| Pattern::parse(l).is_some() || includes::included_path(l).is_some())
+}
+
+/// Adds patterns to a folder on another host, with the same target
+/// resolution as for local folders
+fn add_ssh(
+    patterns: &[String],
+    absolute: bool,
+    opts: &AddOptions,
+    spec: &str,
+    silent: bool,
+) -> Result<()> {
+    let remote = ssh::Remote::connect(spec)?;
+    let prefix = prefix_override(PathBuf::from(&remote.prefix))?;
+    let patterns = process_patterns(
+        patterns,
+        if absolute { None } else { Some(&prefix) },
+        silent,
+    )?;
+    let stignore = remote.path(".stignore");
+
+    // target relative to the folder root and whether .stignore has to include it
+    let (target, include) = match (&opts.into, &opts.fragment, &opts.target()) {
+        (Some(into), _, _) => (into.to_string_lossy().replace('\\', "/"), false),
+        (None, Some(name), _) => (
+            fragments::path(Path::new(""), name)?
+                .to_string_lossy()
+                .replace('\\', "/"),
+            true,
+        ),
+        (None, None, Target::Auto) => {
+            if remote.includes(&stignore, &remote.path(sync_file()))? {
+                (sync_file().to_owned(), false)
+            } else {
+                (".stignore".to_owned(), false)
+            }
+        }
+        (None, None, Target::Stignore) => (".stignore".to_owned(), false),
+        (None, None, Target::StignoreSync) => (sync_file().to_owned(), false),
+        (None, None, Target::Topic(name)) => (format!("{}_{name}", sync_file()), true),
+    };
+    let path = remote.path(&target);
+    let name = format!("{path} on {}", remote.host);
+
+    let existing = remote.read(&path)?.unwrap_or_default();
+    // unix line endings unless the file already uses others
+    let ending = text::line_ending(&existing).unwrap_or("\n");
+    let patterns = text::with_line_ending(&patterns, ending);
+    let patterns = skip_existing(&patterns, &existing, &name, silent);
+    if !has_directives(&patterns) {
+        if !silent {
+            println!("Nothing to add");
+        }
+        return Ok(());
+    }
+
+    if !silent {
+        println!("Appending to {name}:\n{patterns}");
+    }
+    if opts.preview() && !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    if include && !remote.includes(&stignore, &path)? {
+        remote.append(&stignore, &format!("#include {target}\n"))?;
+        if !silent {
+            println!("Added #include {target} to .stignore");
+        }
+    }
+    remote.append(&path, &patterns)
+}
+
+/// Adds patterns to each folder present on this device
+fn add_all_folders(
+    patterns: &[String],
+    opts: &AddOptions,
+    api_opts: &ApiOptions,
+    api: Option<&api::Client>,
+    jobs: Option<usize>,
+    atomic: bool,
+    silent: bool,
+) -> Result<()> {
+    let folders = match api {
+        Some(api) => api.folders()?,
+        None => stconfig::read_folders(&api_opts.config()?)?,
+    };
+    let name = |folder: &api::Folder| {
+        if folder.label.is_empty() {
+            folder.id.clone()
+        } else {
+            format!("{} ({})", folder.label, folder.id)
+        }
+    };
+    let (present, absent): (Vec<_>, Vec<_>) = folders.iter().partition(|f| f.path.is_dir());
+    if !silent {
+        for folder in absent {
+            println!("{}: skipped, not on this device", name(folder));
+        }
+    }
+    // each folder is handled as if stignore was run in its root
+    let add_to = |folder: &api::Folder, silent| {
+        FOLDER_CWD.with(|dir| *dir.borrow_mut() = Some(folder.path.clone()));
+        let res = add(patterns, true, opts, api, silent);
+        FOLDER_CWD.with(|dir| *dir.borrow_mut() = None);
+        res
+    };
+
+    // several folders can't ask for confirmation at once
+    // --and-delete asks even with --assume-yes
+    let asks = opts.preview() && !assume_yes() || opts.and_delete;
+    let jobs = match jobs {
+        _ if asks => 1,
+        Some(jobs) => jobs.max(1),
+        None => std::thread::available_parallelism().map_or(1, usize::from),
+    };
+    let mut failed = Vec::new();
+    let mut succeeded = Vec::new();
+    if jobs == 1 {
+        for folder in &present {
+            if !silent {
+                println!("{}:", name(folder));
+            }
+            match add_to(folder, silent) {
+                Ok(()) => succeeded.push(*folder),
+                // the rest would be rolled back anyway
+                Err(e) if atomic => {
+                    failed.push((name(folder), e));
+                    break;
+                }
+                Err(e) => failed.push((name(folder), e)),
+            }
+        }
+    } else {
+        let next = std::sync::atomic::AtomicUsize::new(0);
+        let (done, results) = std::sync::mpsc::channel();
+        std::thread::scope(|scope| {
+            for _ in 0..jobs.min(present.len()) {
+                let done = done.clone();
+                let (next, present, add_to) = (&next, &present, &add_to);
+                scope.spawn(move || loop {
+                    let i = next.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+                    let Some(folder) = present.get(i) else {
+                        break;
+                    };
+                    // output of folders handled at once would be mixed up
+                    if done.send((i, add_to(folder, true))).is_err() {
+                        break;
+                    }
+                });
+            }
+            drop(done);
+            for (i, res) in results {
+                match res {
+                    Ok(()) => {
+                        if !silent {
+                            println!("{}: done", name(present[i]));
+                        }
+                        succeeded.push(present[i]);
+                    }
+                    Err(e) => failed.push((name(present[i]), e)),
+                }
+            }
+        });
+    }
+
+    for (name, e) in &failed {
+        eprintln!("{name}: {e:#}");
+    }
+    if failed.is_empty() {
+        if !silent {
+            println!("Done for {} of {} folders", present.len(), folders.len());
+        }
+        return Ok(());
+    }
+    let names = |folders: &[&api::Folder]| {
+        folders
+            .iter()
+            .map(|f| name(f))
+            .collect::<Vec<_>>()
+            .join(", ")
+    };
+    if atomic {
+        files::roll_back_pending();
+        if let Some(api) = api {
+            // Syncthing reloads the patterns it has loaded already
+            for folder in &succeeded {
+                api.set_ignores(&folder.id, &api.ignores(&folder.id)?)?;
+            }
+        }
+        if !succeeded.is_empty() {
+            eprintln!("Rolled back: {}", names(&succeeded));
+        }
+        bail!(
+            "Failed for {} of {} folders, none was changed",
+            failed.len(),
+            folders.len()
+        );
+    }
+    let unchanged: Vec<&api::Folder> = present
+        .iter()
+        .copied()
+        .filter(|f| !succeeded.iter().any(|s| s.id == f.id))
+        .collect();
+    if !succeeded.is_empty() {
+        eprintln!("Changed: {}", names(&succeeded));
+    }
+    eprintln!("Not changed: {}", names(&unchanged));
+    bail!("Failed for {} of {} folders", failed.len(), folders.len());
+}
+
+/// Adds patterns to .stignore of a folder available only through the API
+fn add_remote(
+    patterns: &[String],
+    opts: &AddOptions,
+    api: &api::Client,
+    folder: &api::Folder,
+    silent: bool,
+) -> Result<()> {
+    // the configured target doesn't apply, it's meant for local folders
+    if !matches!(opts.target, None | Some(Target::Auto | Target::Stignore))
+        || opts.into.is_some()
+        || opts.ignore_file.is_some()
+        || opts.fragment.is_some()
+        || opts.host_only
+    {
+        bail!("Only .stignore of remote folders can be changed");
+    }
+    if opts.and_delete {
+        bail!("Files of remote folders can't be deleted");
+    }
+    if opts.matches.is_some() || opts.impact {
+        bail!(
+            "Files of remote folders can't be matched, --matches and --impact need the folder on this device"
+        );
+    }
+    // CWD is unrelated to the remote folder, so patterns are copied as-is
+    let patterns = process_patterns(patterns, None, silent)?;
+    let mut lines = api.ignores(&folder.id)?;
+    let name = format!(".stignore of {} ({})", folder.label, folder.id);
+    let patterns = skip_existing(&patterns, &lines.join("\n"), &name, silent);
+    if !has_directives(&patterns) {
+        if !silent {
+            println!("Nothing to add");
+        }
+        return Ok(());
+    }
+
+    if !silent {
+        println!("Appending to {name}:\n{patterns}");
+    }
+    if opts.preview() && !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    lines.extend(patterns.lines().map(str::to_owned));
+    api.set_ignores(&folder.id, &lines)?;
+    if opts.verify {
+        // includes of remote files can't be followed, only .stignore is inspected
+        verify(
+            api,
+            &folder.id,
+            &patterns,
+            silent,
+            |_| true,
+            || api.ignores(&folder.id),
+        )?;
+    }
+    if !silent {
+        offer_revert(api, &folder.id)?;
+    }
+    Ok(())
+}
+
+fn add(
+    patterns: &[String],
+    absolute: bool,
+    opts: &AddOptions,
+    api: Option<&api::Client>,
+    silent: bool,
+) -> Result<()> {
+    if let (Some(api), Some(Selected::Remote(folder))) = (api, SELECTED_FOLDER.get()) {
+        return add_remote(patterns, opts, api, folder, silent);
+    }
+    if opts.trash && !opts.and_delete {
+        bail!("--trash requires --and-delete");
+    }
+    if let Some(spec) = &opts.ssh {
+        if api.is_some() {
+            bail!("--ssh can't be used with --api");
+        }
+        return add_ssh(patterns, absolute, opts, spec, silent);
+    }
+    let (patterns, tgt_file, st_dir) = match &opts.ignore_file {
+        // without a syncthing folder there is no prefix to prepend, unless
+        // it's given, relative to the root
+        Some(file) => {
+            let prefix = match PREFIX.get() {
+                Some(_) => Some(prefix_override(PathBuf::from("/"))?),
+                None => None,
+            };
+            (
+                process_patterns(patterns, prefix.as_ref(), silent)?,
+                file.clone(),
+                None,
+            )
+        }
+        None => {
+            let (st_dir, prefix) = find_syncthing_dir()?;
+            let patterns = process_patterns(
+                patterns,
+                if absolute { None } else { Some(&prefix) },
+                silent,
+            )?;
+            let tgt_file = resolve_target(&st_dir, opts, silent)?;
+            (patterns, tgt_file, Some(st_dir))
+        }
+    };
+
+    let folder = match (api, &st_dir) {
+        (Some(api), Some(st_dir)) => Some(api.folder_at(st_dir)?.id),
+        (Some(_), None) => bail!("--file can't be used with --api"),
+        (None, _) => None,
+    };
+
+    let via_api =
+        api.is_some() && matches!(&st_dir, Some(st_dir) if tgt_file == st_dir.join(".stignore"));
+    // the target is read once, through its lock held until the patterns are
+    // written, unless it doesn't exist yet or Syncthing writes it
+    let lock = match via_api || !tgt_file.exists() {
+        true => None,
+        false => Some(files::lock(&tgt_file)?),
+    };
+    let mut file = match &lock {
+        Some(lock) => read_locked(lock, &tgt_file)?,
+        None => IgnoreFile::load(&tgt_file)?,
+    };
+    let patterns = skip_existing(
+        &patterns,
+        &text::strip_bom(file.to_string()),
+        &tgt_file.display().to_string(),
+        silent,
+    );
+    if !has_directives(&patterns) {
+        if !silent {
+            println!("Nothing to add");
+        }
+        return Ok(());
+    }
+
+    if !via_api {
+        files::ensure_writable(&tgt_file)?;
+    }
+
+    if !silent {
+        println!("Appending to {}:\n{patterns}", tgt_file.display());
+    }
+    if let (Some(shown), Some(st_dir)) = (opts.matches, &st_dir) {
+        preview_matches(st_dir, &patterns, shown)?;
+    }
+    let included =
+        opts.fragment.is_some() || opts.host_only || matches!(opts.target(), Target::Topic(_));
+    if let (true, Some(st_dir)) = (opts.impact, &st_dir) {
+        let mut edited = file.clone();
+        for line in patterns.lines() {
+            edited.push(line);
+        }
+        let mut changes = vec![(tgt_file.clone(), edited.to_string())];
+        let stignore = st_dir.join(".stignore");
+        if included && !includes::tree(&stignore).includes(&tgt_file) {
+            let content = ignore_file::read(&stignore).unwrap_or_default();
+            let include = format!("#include {}", relative(st_dir, &tgt_file));
+            changes.push((stignore.clone(), format!("{content}{LINE_ENDING}{include}")));
+        }
+        print!(
+            "{}",
+            simulate::impact(
+                st_dir,
+                &includes::flatten(&stignore)?,
+                &includes::flatten_edited(&stignore, &changes)?
+            )?
+        );
+    }
+    if opts.preview() && !confirm("Proceed?") {
+        println!("Aborting.");
+        return Ok(());
+    }
+    // the target, the #include of it and the rendered file change together,
+    // or none of them does
+    files::transaction(|| {
+        match (api, &folder) {
+            (Some(api), Some(folder)) if via_api => {
+                let before = std::fs::read(&tgt_file).ok();
+                let mut lines = api.ignores(folder)?;
+                lines.extend(patterns.lines().map(str::to_owned));
+                api.set_ignores(folder, &lines)?;
+                // Syncthing has written the file, record it for undo
+                if let Ok(after) = std::fs::read(&tgt_file) {
+                    let path = files::canonicalize(&tgt_file).unwrap_or(tgt_file.clone());
+                    journal::record(&path, before.as_deref(), Some(&after));
+                }
+            }
+            _ => {
+                if let (Some(st_dir), None) = (&st_dir, &lock) {
+                    if included && !tgt_file.exists() {
+                        file.push(&includes::header(&st_dir.join(".stignore"), st_dir));
+                    }
+                }
+                for line in patterns.lines() {
+                    file.push(line);
+                }
+                match &lock {
+                    Some(lock) => lock.write(file.to_string()),
+                    None => create_file(&tgt_file, file.to_string()),
+                }
+                .context("Can't append to file")?;
+            }
+        }
+        // the file exists now, only the #include is added
+        if let (Some(st_dir), true) = (&st_dir, included) {
+            include_from_stignore(st_dir, &tgt_file, silent)?;
+        }
+
+        if let Some(st_dir) = &st_dir {
+            // patterns reach syncthing through the rendered file
+            if tgt_file == st_dir.join(sync_file()) && st_dir.join(STIGNORE_DEVICE).exists() {
+                render_device(
+                    st_dir,
+                    Path::new(sync_file()),
+                    Path::new(STIGNORE_DEVICE),
+                    silent,
+                )?;
+            }
+        }
+        Ok(())
+    })?;
+    if let (Some(api), Some(folder)) = (api, &folder) {
+        if !via_api {
+            // posting .stignore makes syncthing reload included files as well
+            api.set_ignores(folder, &api.ignores(folder)?)?;
+        }
+        if opts.verify {
+            let root = st_dir.clone().unwrap_or_default();
+            let stignore = root.join(".stignore");
+            verify(
+                api,
+                folder,
+                &patterns,
+                silent,
+                |path| root.join(path).exists(),
+                || includes::flatten(&stignore),
+            )?;
+        }
+    }
+    if let (true, Some(st_dir)) = (opts.and_delete, &st_dir) {
+        delete_ignored(st_dir, &patterns, opts.trash)?;
+    }
+    if let (Some(api), Some(folder), false) = (api, &folder, silent) {
+        offer_revert(api, folder)?;
+    }
+    Ok(())
+}
+
+/// Picks paths under CWD that aren't ignored yet with the fuzzy finder and
+/// adds their exact patterns
+fn pick_files(opts: &AddOptions, api: Option<&api::Client>, silent: bool) -> Result<()> {
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    let cwd = st_dir.join(prefix.strip_prefix("/").unwrap_or(&prefix));
+    let paths = not_ignored(&st_dir, &cwd)?;
+    if paths.is_empty() {
+        if !silent {
+            println!("Nothing to pick, everything here is ignored");
+        }
+        return Ok(());
+    }
+    // shown relative to CWD, like patterns typed there
+    let shown: Vec<String> = paths
+        .iter()
+        .map(|(path, is_dir)| {
+            let path = relative(&cwd, &st_dir.join(path));
+            if *is_dir {
+                format!("{path}/")
+            } else {
+                path
+            }
+        })
+        .collect();
+
+    let picked = finder::select(&shown)?;
+    if picked.is_empty() {
+        if !silent {
+            println!("Nothing picked");
+        }
+        return Ok(());
+    }
+    let patterns: Vec<String> = picked
+        .iter()
+        .map(|&i| pattern::literal(&paths[i].0))
+        .collect();
+    add(&patterns, true, opts, api, silent)
+}
+
+/// Entries below `dir` that aren't ignored yet, relative to the folder root,
+/// sorted, and whether they are directories. Contents of ignored directories
+/// and of symlinks aren't listed.
+fn not_ignored(st_dir: &Path, dir: &Path) -> Result<Vec<(String, bool)>> {
+    let effective = Matcher::new(&includes::flatten(&st_dir.join(".stignore"))?);
+    let mut paths = Vec::new();
+    let mut dirs = vec![dir.to_owned()];
+    while let Some(dir) = dirs.pop() {
+        let entries =
+            std::fs::read_dir(&dir).with_context(|| format!("Can't read {}", dir.display()))?;
+        for entry in entries {
+            let entry = entry.with_context(|| format!("Can't read {}", dir.display()))?;
+            let path = entry.path();
+            let relative = relative(st_dir, &path);
+            if files::INTERNAL.contains(&relative.as_str()) || effective.is_ignored(&relative) {
+                continue;
+            }
+            let is_dir = entry.file_type().is_ok_and(|t| t.is_dir());
+            if is_dir {
+                dirs.push(path);
+            }
+            paths.push((relative, is_dir));
+        }
+    }
+    paths.sort();
+    Ok(paths)
+}
+
+/// Ignored files stop counting as local changes of a receive-only folder,
+/// offers to revert the remaining ones
+fn offer_revert(api: &api::Client, folder: &str) -> Result<()> {
+    use question::{Answer, Question};
+
+    if !api.is_receive_only(folder)? {
+        return Ok(());
+    }
+    // syncthing updates the list of local changes during the scan
+    api.scan(folder, None)?;
+    let changes = api.local_changes(folder)?;
+    if changes.is_empty() {
+        println!("Receive-only folder {folder} has no local changes left");
+        return Ok(());
+    }
+    println!("Receive-only folder {folder} still has local changes:");
+    for name in changes.iter().take(20) {
+        println!("  {name}");
+    }
+    if changes.len() > 20 {
+        println!("  ... and {} more", changes.len() - 20);
+    }
+    let answer = Question::new(
+        "Revert them? Files added on this device will be deleted, \
+        changed ones will be downloaded again",
+    )
+    .default(Answer::NO)
+    .show_defaults()
+    .confirm();
+    if answer == Answer::YES {
+        api.revert(folder)?;
+        println!("Reverted local changes of {folder}");
+    }
+    Ok(())
+}
+
+/// Deletes the file or moves it to the trash
+fn delete_file(path: &Path, to_trash: bool) -> Result<()> {
+    if to_trash {
+        trash::trash(path)
+    } else {
+        std::fs::remove_file(path).with_context(|| format!("Can't delete {}", path.display()))
+    }
+}
+
+/// Number of files of the folder [preview_matches] checks at most
+const MATCH_PREVIEW_LIMIT: usize = 100_000;
+
+/// Files of the folder the patterns would newly ignore, the patterns
+/// matching no files, and the number of files checked if not all of them
+/// were, checking at most `limit` files
+fn matches_of(
+    st_dir: &Path,
+    patterns: &str,
+    limit: usize,
+) -> Result<(Vec<String>, Vec<String>, Option<usize>)> {
+    let added: Vec<String> = patterns
+        .lines()
+        .filter(|l| Pattern::parse(l).is_some_and(|p| !p.negated))
+        .map(str::to_owned)
+        .collect();
+    let matcher = Matcher::new(&added);
+    let effective = Matcher::new(&includes::flatten(&st_dir.join(".stignore"))?);
+
+    let (all, complete) = files::walk_limited(st_dir, limit)?;
+    let mut unused: Vec<String> = added.iter().map(|l| l.trim().to_owned()).collect();
+    let mut ignored = Vec::new();
+    for file in &all {
+        let path = relative(st_dir, file);
+        let Some((line, _)) = matcher.first_match(&path) else {
+            continue;
+        };
+        unused.retain(|l| l != line.trim());
+        // already ignored files don't change
+        if !effective.is_ignored(&path) {
+            ignored.push(path);
+        }
+    }
+    Ok((ignored, unused, (!complete).then_some(all.len())))
+}
+
+/// Prints the first `shown` files the patterns would ignore, their number,
+/// and the patterns matching no files
+fn preview_matches(st_dir: &Path, patterns: &str, shown: usize) -> Result<()> {
+    let (ignored, unused, checked) = matches_of(st_dir, patterns, MATCH_PREVIEW_LIMIT)?;
+    let scope = match checked {
+        None => String::new(),
+        Some(n) => format!(" among the first {n} files"),
+    };
+    match ignored.len() {
+        0 => println!("No files would become ignored{scope}"),
+        n => {
+            println!("{n} files would become ignored{scope}:");
+            for path in ignored.iter().take(shown) {
+                println!("  {path}");
+            }
+            if n > shown {
+                println!("  ...");
+            }
+        }
+    }
+    if !unused.is_empty() {
+        eprintln!(
+            "NOTE: these patterns match no files{scope}, check them for typos:\n{}",
+            unused.join("\n")
+        );
+    }
+    Ok(())
+}
+
+/// Files matched by the added patterns that are ignored now, except for the
+/// ignore files themselves
+fn newly_ignored(st_dir: &Path, patterns: &str, effective: &Matcher) -> Result<Vec<PathBuf>> {
+    // patterns are compiled once, not for each file of the folder
+    let added: Vec<String> = patterns
+        .lines()
+        .filter(|l| Pattern::parse(l).is_some_and(|p| !p.negated))
+        .map(str::to_owned)
+        .collect();
+    let added = Matcher::new(&added);
+
+    let mut ignored = Vec::new();
+    for file in files::walk(st_dir)? {
+        let path = relative(st_dir, &file);
+        // never delete the ignore files themselves
+        if path
+            .rsplit('/')
+            .next()
+            .unwrap_or_default()
+            .starts_with(".stignore")
+        {
+            continue;
+        }
+        if added.first_match(&path).is_some() && effective.is_ignored(&path) {
+            ignored.push(file);
+        }
+    }
+    Ok(ignored)
+}
+
+/// Deletes files matched by the added patterns that are ignored now, after
+/// listing them and asking for confirmation
+fn delete_ignored(st_dir: &Path, patterns: &str, to_trash: bool) -> Result<()> {
+    let effective = Matcher::new(&includes::flatten(&st_dir.join(".stignore"))?);
+    let doomed = newly_ignored(st_dir, patterns, &effective)?;
+    let size: u64 = doomed
+        .iter()
+        .map(|f| f.metadata().map_or(0, |m| m.len()))
+        .sum();
+    if doomed.is_empty() {
+        println!("No files to delete");
+        return Ok(());
+    }
+    for file in &doomed {
+        println!("{}", relative(st_dir, file));
+    }
+    // asked even with --assume-yes, a setting left in the environment
+    // mustn't delete data without anyone looking
+    if !ask(
+        &format!(
+            "{} these {} files ({}) from this device?",
+            if to_trash { "Move to trash" } else { "Delete" },
+            doomed.len(),
+            files::format_size(size)
+        ),
+        question::Answer::NO,
+    ) {
+        println!("Nothing deleted.");
+        return Ok(());
+    }
+    for file in &doomed {
+        delete_file(file, to_trash)?;
+        // ignored directories left empty go too
+        let mut dir = file.parent();
+        while let Some(d) =
+            dir.filter(|d| *d != st_dir && effective.is_ignored(&relative(st_dir, d)))
+        {
+            if std::fs::remove_dir(d).is_err() {
+                break;
+            }
+            dir = d.parent();
+        }
+    }
+    println!(
+        "{} {} files",
+        if to_trash { "Trashed" } else { "Deleted" },
+        doomed.len()
+    );
+    Ok(())
+}
+
+/// Asks syncthing whether paths of the added patterns are ignored now and
+/// explains failures. Only patterns pointing to a specific path (anchored and
+/// without wildcards) are checked, if `exists` reports the path.
+fn verify(
+    api: &api::Client,
+    folder: &str,
+    patterns: &str,
+    silent: bool,
+    exists: impl Fn(&str) -> bool,
+    effective: impl Fn() -> Result<Vec<String>>,
+) -> Result<()> {
+    let mut failed = 0;
+    for line in patterns.lines() {
+        let Some(pattern) = Pattern::parse(line) else {
+            continue;
+        };
+        let path = match pattern.glob.strip_prefix('/') {
+            Some(path) if !pattern.negated && !path.contains(['*', '?', '[', '{', '\\']) => {
+                path.trim_end_matches('/')
+            }
+            _ => continue,
+        };
+        if !exists(path) {
+            continue;
+        }
+        // make syncthing evaluate the path against the new patterns
+        api.scan(folder, Some(path))?;
+        match api.is_ignored(folder, path)? {
+            Some(true) => {
+                if !silent {
+                    println!("Verified: {path} is ignored");
+                }
+            }
+            Some(false) => {
+                failed += 1;
+                eprintln!(
+                    "{path} is NOT ignored by Syncthing: {}",
+                    diagnose(path, effective())
+                );
+            }
+            None => {
+                if !silent {
+                    println!("Syncthing doesn't know {path}, skipping verification");
+                }
+            }
+        }
+    }
+    if failed > 0 {
+        bail!(
+            "{failed} pattern{} didn't take effect",
+            if failed > 1 { "s" } else { "" }
+        );
+    }
+    Ok(())
+}
+
+/// Explains why the path isn't ignored, given patterns in syncthing's order
+fn diagnose(path: &str, effective: Result<Vec<String>>) -> String {
+    let lines = match effective {
+        Ok(lines) => lines,
+        Err(e) => return format!("ignore patterns can't be loaded: {e:#}"),
+    };
+    match pattern::first_match(&lines, path) {
+        Some((line, p)) if p.negated => format!("it is un-ignored by `{line}`, which comes first"),
+        Some(_) => "the patterns match, but Syncthing hasn't applied them yet".to_owned(),
+        None => "no effective pattern matches, \
+            make sure the file with the pattern is included from .stignore"
+            .to_owned(),
+    }
+}
+
+fn render_device(st_dir: &Path, source: &Path, output: &Path, silent: bool) -> Result<()> {
+    let stignore = st_dir.join(".stignore");
+    let source_path = st_dir.join(source);
+    let output_path = st_dir.join(output);
+    let relative = output_path
+        .strip_prefix(st_dir)
+        .context("Rendered file must be inside of the syncthing folder")?;
+
+    let device = preprocess::Device {
+        os: std::env::consts::OS.to_owned(),
+        host: device::hostname()?,
+    };
+    let rendered = preprocess::render(&read_to_string(&source_path)?, &device)
+        .with_context(|| format!("Can't render {}", source_path.display()))?;
+    files::write(
+        &output_path,
+        format!(
+            "// Generated by `stignore render-device` from {}, don't edit{LINE_ENDING}{rendered}",
+            source.display()
+        ),
+    )?;
+    if !silent {
+        println!(
+            "Rendered {} for {} ({})",
+            output_path.display(),
+            device.host,
+            device.os
+        );
+    }
+
+    // each device has its own rendering, syncing it would cause conflicts
+    let exclude = skip_duplicates(
+        &format!("/{}{LINE_ENDING}", relative.display()),
+        &stignore,
+        true,
+    )?;
+    if !exclude.is_empty() {
+        append(&stignore, &exclude).context("Can't append to .stignore")?;
+    }
+    include_from_stignore(st_dir, &output_path, silent)?;
+
+    if !silent && includes::tree(&stignore).includes(&source_path) {
+        eprintln!(
+            "NOTE: {} is included from .stignore directly, its #if blocks won't work. \
+            Remove the #include, patterns are applied through {}",
+            source.display(),
+            relative.display()
+        );
+    }
+    Ok(())
+}
+
+fn watch_render_device(source: &Path, output: &Path, silent: bool) -> Result<()> {
+    let (st_dir, _) = find_syncthing_dir()?;
+    let source_path = st_dir.join(source);
+    let modified = || {
+        std::fs::metadata(&source_path)
+            .and_then(|m| m.modified())
+            .ok()
+    };
+
+    render_device(&st_dir, source, output, silent)?;
+    let mut last = modified();
+    loop {
+        std::thread::sleep(std::time::Duration::from_secs(2));
+        let current = modified();
+        if current == last {
+            continue;
+        }
+        last = current;
+        // keep watching, the source may be fixed by the next sync
+        if let Err(e) = render_device(&st_dir, source, output, silent) {
+            eprintln!("Error: {e:#}");
+        }
+    }
+}
+
+/// Exit code of `stignore root` outside of syncthing folders
+const EXIT_OUTSIDE_FOLDER: i32 = 2;
+
+fn print_root(silent: bool) -> Result<()> {
+    if SELECTED_FOLDER.get().is_none() && folder_roots(&working_dir()?).is_empty() {
+        if !silent {
+            eprintln!("Current directory is not inside of a syncthing folder");
+        }
+        std::process::exit(EXIT_OUTSIDE_FOLDER);
+    }
+    println!("{}", find_syncthing_dir()?.0.display());
+    Ok(())
+}
+
+fn print_rel(path: Option<&Path>) -> Result<()> {
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    let prefix = match path {
+        None => prefix,
+        Some(path) => {
+            let path = files::canonicalize(&working_dir()?.join(path))
+                .with_context(|| format!("Can't open {}", path.display()))?;
+            let root = files::canonicalize(&st_dir).unwrap_or(st_dir.clone());
+            let relative = path.strip_prefix(&root).with_context(|| {
+                format!("{} is outside of {}", path.display(), st_dir.display())
+            })?;
+            Path::new(path::Component::RootDir.as_os_str()).join(relative)
+        }
+    };
+    let parts: Vec<_> = prefix
+        .components()
+        .filter_map(|c| match c {
+            path::Component::Normal(part) => Some(part.to_string_lossy()),
+            _ => None,
+        })
+        .collect();
+    println!("/{}", parts.join("/"));
+    Ok(())
+}
+
+/// Prints the files [add] would change with the options, without changing
+/// anything
+fn which(opts: &AddOptions, api: Option<&api::Client>, silent: bool) -> Result<()> {
+    if let (Some(_), Some(Selected::Remote(folder))) = (api, SELECTED_FOLDER.get()) {
+        println!(
+            "Appends to .stignore of folder {} through the API",
+            folder.id
+        );
+        return Ok(());
+    }
+    if let Some(spec) = &opts.ssh {
+        println!("Appends to the ignore file of the folder at {spec} over SSH");
+        return Ok(());
+    }
+    let (tgt_file, st_dir) = match &opts.ignore_file {
+        Some(file) => (file.clone(), None),
+        None => {
+            let (st_dir, _) = find_syncthing_dir()?;
+            (resolve_target(&st_dir, opts, silent)?, Some(st_dir))
+        }
+    };
+    let created = if tgt_file.exists() { "" } else { " (created)" };
+    println!("Appends to {}{created}", tgt_file.display());
+
+    let Some(st_dir) = st_dir else {
+        return Ok(());
+    };
+    let stignore = st_dir.join(".stignore");
+    let included = includes::tree(&stignore).includes(&tgt_file);
+    if (opts.fragment.is_some() || opts.host_only || matches!(opts.target(), Target::Topic(_)))
+        && !included
+    {
+        println!("Includes it from {}", stignore.display());
+    }
+    if tgt_file == stignore && api.is_some() {
+        println!("Writes it through the Syncthing API");
+    }
+    let device = st_dir.join(STIGNORE_DEVICE);
+    if tgt_file == st_dir.join(sync_file()) && device.exists() {
+        println!("Renders {} from it", device.display());
+    }
+    Ok(())
+}
+
+fn completion(shell: clap_complete::Shell) -> Result<()> {
+    let mut script = Vec::new();
+    clap_complete::generate(shell, &mut Args::command(), "stignore", &mut script);
+    let script = String::from_utf8(script).context("Invalid completion script")?;
+    print!("{}", completion::dynamic(shell, &script));
+    Ok(())
+}
+
+/// Prints the version, the commit and date of the build, and the compiler,
+/// recorded by build.rs
+fn print_version(json: bool) -> Result<()> {
+    let date = env!("STIGNORE_BUILD_DATE")
+        .parse()
+        .map(versions::format_utc)
+        .unwrap_or_default();
+    let details = [
+        ("version", env!("CARGO_PKG_VERSION").to_owned()),
+        ("commit", env!("STIGNORE_COMMIT").to_owned()),
+        ("built", date),
+        ("rustc", env!("STIGNORE_RUSTC").to_owned()),
+        ("target", env!("STIGNORE_BUILD_TARGET").to_owned()),
+    ];
+    if json {
+        let details: serde_json::Map<String, serde_json::Value> = details
+            .into_iter()
+            .map(|(name, value)| (name.to_owned(), value.into()))
+            .collect();
+        println!("{}", serde_json::Value::Object(details));
+        return Ok(());
+    }
+    println!("stignore {}", env!("CARGO_PKG_VERSION"));
+    for (name, value) in &details[1..] {
+        if !value.is_empty() {
+            println!("{name}: {value}");
+        }
+    }
+    Ok(())
+}
+
+fn self_update(check: bool, silent: bool) -> Result<()> {
+    let current = env!("CARGO_PKG_VERSION");
+    let release = update::latest()?;
+    if !update::is_newer(&release.version, current) {
+        if !silent {
+            println!("stignore {current} is the latest version");
+        }
+        return Ok(());
+    }
+    if check {
+        println!(
+            "stignore {} is available, {current} is installed",
+            release.version
+        );
+        return Ok(());
+    }
+    let exe = std::env::current_exe().context("Can't find the stignore executable")?;
+    let exe = files::canonicalize(&exe).unwrap_or(exe);
+    if !confirm(&format!(
+        "Update stignore {current} to {}?",
+        release.version
+    )) {
+        return Ok(());
+    }
+    update::install(&exe, &release.download()?)?;
+    if !silent {
+        println!("Updated {} to {}", exe.display(), release.version);
+    }
+    Ok(())
+}
+
+/// Prints values for the completion scripts. Errors are not reported: a
+/// completion that can't be computed is just empty.
+fn complete(values: Completed, api_opts: &ApiOptions) -> Result<()> {
+    let candidates = || -> Result<Vec<String>> {
+        let patterns = |path: PathBuf| -> Result<Vec<String>> {
+            Ok(ignore_file::read(&path)?
+                .lines()
+                .map(str::trim)
+                .filter(|l| Pattern::parse(l).is_some())
+                .map(str::to_owned)
+                .collect())
+        };
+        Ok(match values {
+            Completed::Folders => stconfig::read_folders(&api_opts.config()?)?
+                .into_iter()
+                .flat_map(|f| [f.label, f.id])
+                .filter(|name| !name.is_empty())
+                .collect(),
+            Completed::Fragments => fragments::list(&find_syncthing_dir()?.0)?
+                .iter()
+                .filter_map(|f| Some(f.file_stem()?.to_string_lossy().into_owned()))
+                .collect(),
+            Completed::Targets => {
+                let mut targets: Vec<String> = ["auto", "stignore", "stignore_sync"]
+                    .map(str::to_owned)
+                    .into();
+                let prefix = format!("{}_", sync_file());
+                if let Ok((st_dir, _)) = find_syncthing_dir() {
+                    for entry in std::fs::read_dir(st_dir)?.flatten() {
+                        let name = entry.file_name().to_string_lossy().into_owned();
+                        targets.extend(name.strip_prefix(&prefix).map(|t| format!("topic:{t}")));
+                    }
+                }
+                targets
+            }
+            Completed::Profiles => config::profiles()?,
+            Completed::Stignore => patterns(find_syncthing_dir()?.0.join(".stignore"))?,
+            Completed::StignoreSync => patterns(find_syncthing_dir()?.0.join(sync_file()))?,
+        })
+    };
+    for candidate in candidates().unwrap_or_default() {
+        println!("{candidate}");
+    }
+    Ok(())
+}
+
+fn status(prompt: bool) -> Result<()> {
+    let cwd = working_dir()?;
+    let request = serde_json::json!({ "command": "check", "path": cwd.to_string_lossy() });
+    let answer = match daemon::socket_path().and_then(|s| daemon::query(&s, &request)) {
+        Ok(answer) => answer,
+        Err(_) => daemon::check(&cwd)?,
+    };
+    let Some(root) = answer["folder"].as_str().map(Path::new) else {
+        if !prompt {
+            println!("Not inside of a syncthing folder");
+        }
+        return Ok(());
+    };
+    let ignored = answer["ignored"].as_bool() == Some(true);
+    if prompt {
+        let name = root
+            .file_name()
+            .unwrap_or(root.as_os_str())
+            .to_string_lossy();
+        println!("{name}{}", if ignored { " (ignored)" } else { "" });
+        return Ok(());
+    }
+    println!("Folder: {}", root.display());
+    match answer["pattern"].as_str() {
+        Some(pattern) if ignored => println!("Ignored by {pattern}"),
+        Some(pattern) => println!("Not ignored, excluded by {pattern}"),
+        None => println!("Not ignored"),
+    }
+    Ok(())
+}
+
+/// Offers patterns for junk created in the folder, see `stignore watch`
+fn watch(
+    rules: &[String],
+    larger_than: u64,
+    auto: bool,
+    opts: &AddOptions,
+    api: Option<&api::Client>,
+    silent: bool,
+) -> Result<()> {
+    use notify::{RecursiveMode, Watcher};
+
+    let rules: Vec<String> = match rules {
+        [] => watch::DEFAULT_RULES.map(str::to_owned).to_vec(),
+        rules => rules.to_vec(),
+    };
+    if let Some(rule) = rules.iter().find(|r| Pattern::parse(r).is_none()) {
+        bail!("Invalid rule: {rule}");
+    }
+    let (st_dir, _) = find_syncthing_dir()?;
+    let stignore = st_dir.join(".stignore");
+    let (tx, rx) = std::sync::mpsc::channel();
+    let mut watcher = notify::recommended_watcher(tx).context("Can't watch the folder")?;
+    watcher
+        .watch(&st_dir, RecursiveMode::Recursive)
+        .with_context(|| format!("Can't watch {}", st_dir.display()))?;
+    if !silent {
+        println!("Watching {}, press Ctrl+C to stop", st_dir.display());
+    }
+
+    // suggestions that were declined or added already
+    let mut offered: Vec<String> = Vec::new();
+    while let Ok(event) = rx.recv() {
+        let mut paths = Vec::new();
+        let mut collect = |event: notify::Result<notify::Event>| match event {
+            Ok(e) if e.kind.is_create() || e.kind.is_modify() => paths.extend(e.paths),
+            Ok(_) => {}
+            Err(e) => eprintln!("NOTE: watching failed: {e}"),
+        };
+        collect(event);
+        // let the burst settle, files being written reach their final size
+        while let Ok(event) = rx.recv_timeout(Duration::from_millis(500)) {
+            collect(event);
+        }
+
+        let matcher = Matcher::new(&includes::flatten(&stignore).unwrap_or_default());
+        for path in paths {
+            let path = relative(&st_dir, &path);
+            if path.is_empty() || watch::is_internal(&path) || matcher.is_ignored(&path) {
+                continue;
+            }
+            let suggestion = match watch::suggest(&rules, larger_than, &st_dir, &path) {
+                Some(s) if !offered.contains(&s) => s,
+                _ => continue,
+            };
+            offered.push(suggestion.clone());
+            if !auto && !confirm(&format!("{path} was created, ignore {suggestion}?")) {
+                continue;
+            }
+            // keep watching, the target may become writable later
+            if let Err(e) = add(&[suggestion], true, opts, api, silent) {
+                eprintln!("Error: {e:#}");
+            }
+            // each addition is an operation of its own, undone separately
+            if let Err(e) = journal::save(None) {
+                eprintln!("NOTE: the change can't be undone, failed to record it: {e:#}");
+            }
+        }
+    }
+    Ok(())
+}
+
+impl Command {
+    /// Checks if the command may change ignore patterns
+    fn modifies_patterns(&self) -> bool {
+        match self {
+            Command::ExportRsync { .. }
+            | Command::Tree
+            | Command::Stats
+            | Command::Simulate { .. }
+            | Command::Coverage { .. }
+            | Command::Render { .. }
+            | Command::DiffDevices { .. }
+            | Command::CheckDevices { .. }
+            | Command::Versions { .. }
+            | Command::History { .. }
+            | Command::Blame { .. }
+            | Command::Root
+            | Command::Rel { .. }
+            | Command::Which { .. }
+            | Command::Status { .. }
+            | Command::Completion { .. }
+            | Command::Complete { .. }
+            | Command::Version { .. }
+            | Command::SelfUpdate { .. }
+            | Command::Doctor => false,
+            Command::MergeDevices { .. } => true,
+            Command::Fragments { sync } => *sync,
+            Command::Canonicalize { dry_run } => !dry_run,
+            Command::Conflicts { ignore, .. } => *ignore,
+            Command::Backups { restore } => restore.is_some(),
+            Command::Undo { .. } => true,
+            // run until interrupted, the folder can't stay paused
+            Command::Watch { .. } | Command::Daemon { .. } => false,
+            // interactive, writes whenever the user asks
+            Command::Tui => false,
+            _ => true,
+        }
+    }
+}
+
+/// Replaces an alias from the config file with the arguments it stands
+/// for. Like in git, the alias is the first argument after global options,
+/// and can't shadow a subcommand.
+fn expand_alias(mut argv: Vec<OsString>) -> Result<Vec<OsString>> {
+    let command = Args::command();
+    // options taking a separate value, e.g. `-C DIR` or `--api-key KEY`
+    let takes_value = |arg: &str| {
+        command.get_arguments().any(|a| {
+            a.is_takes_value_set()
+                && !a.is_require_equals_set()
+                && (a.get_long().is_some_and(|l| arg == format!("--{l}"))
+                    || a.get_short().is_some_and(|s| arg == format!("-{s}")))
+        })
+    };
+    let mut i = 1;
+    while let Some(arg) = argv.get(i).and_then(|a| a.to_str()) {
+        match arg {
+            "--" => return Ok(argv),
+            _ if takes_value(arg) => i += 2,
+            _ if arg.starts_with('-') => i += 1,
+            _ => break,
+        }
+    }
+    let Some(name) = argv.get(i).and_then(|a| a.to_str()) else {
+        return Ok(argv);
+    };
+    if command.find_subcommand(name).is_some() {
+        return Ok(argv);
+    }
+    let Some(command) = config::alias(name)? else {
+        return Ok(argv);
+    };
+    let words = config::split_words(&command).with_context(|| format!("Invalid alias {name}"))?;
+    argv.splice(i..=i, words.into_iter().map(OsString::from));
+    Ok(argv)
+}
+
+/// Applies config files of the user and of the folder the command runs in,
+/// see [config::apply]
+fn load_config(args: &Args) -> Result<()> {
+    // the markers are set once `marker` of the config files is known
+    let markers = marker_names(args);
+    let cwd = std::env::current_dir().context("Can't determine current working directory")?;
+    let dir = match &args.directory {
+        Some(dir) => cwd.join(dir),
+        None => cwd,
+    };
+    config::apply(
+        folder_roots_marked(&dir, &markers)
+            .first()
+            .map(PathBuf::as_path),
+        args.profile.as_deref(),
+    )
+}
+
+fn go(args: &Args) -> Result<()> {
+    if let Some(dir) = &args.directory {
+        change_dir(dir)?;
+    }
+    init_markers(args);
+    LOGICAL_CWD.set(args.no_resolve_symlinks).ok();
+    ONE_FILE_SYSTEM.set(args.one_file_system).ok();
+    FSYNC.set(args.fsync).ok();
+    if args.backup {
+        KEEP_BACKUPS.set(args.keep_backups).ok();
+    }
+    if let Some(hook) = &args.pre_write {
+        PRE_WRITE.set(hook.clone()).ok();
+    }
+    if args.sync_file.is_empty() || args.sync_file.contains(['/', '\\']) {
+        bail!("Invalid --sync-file: {}", args.sync_file);
+    }
+    SYNC_FILE.set(args.sync_file.clone()).ok();
+    ASSUME_YES.set(args.assume_yes).ok();
+    if let Some(target) = config::var("STIGNORE_TARGET") {
+        let target = target
+            .parse()
+            .map_err(anyhow::Error::msg)
+            .context("Invalid STIGNORE_TARGET")?;
+        DEFAULT_TARGET.set(target).ok();
+    }
+    if let Some(preview) = config::var("STIGNORE_PREVIEW") {
+        PREVIEW.set(!args.silent && config::is_true(&preview)).ok();
+    }
+    UNICODE_FORM.set(args.unicode).ok();
+    match &args.command {
+        // runs on every prompt: no API, no questions about nested folders
+        Some(Command::Status { prompt }) => return status(*prompt),
+        Some(Command::Completion { shell }) => return completion(*shell),
+        Some(Command::Complete { values }) => return complete(*values, &args.api),
+        Some(Command::Version { json }) => return print_version(*json),
+        Some(Command::SelfUpdate { check }) => return self_update(*check, args.silent),
+        // problems with the API and the folder are reported, not fatal
+        Some(Command::Doctor) => return doctor::run(&args.api, args.silent),
+        _ => {}
+    }
+    let api = args.api.connect()?;
+    let api = api.as_ref();
+    let all_folders = match &args.command {
+        Some(Command::Add(a)) => a.all_folders,
+        Some(_) => false,
+        None => args.add.all_folders,
+    };
+    // the daemon finds the folder of each request by the request's directory,
+    // and nobody is there to answer questions
+    let per_request = matches!(args.command, Some(Command::Daemon { .. }));
+    if !all_folders && !per_request && args.api.folder.is_none() {
+        choose_nested(args)?;
+    }
+    let found_by = match (api, &args.api.folder) {
+        _ if all_folders || per_request => None,
+        (Some(api), folder) => Some(select_folder(api, args.api.remote(), folder.as_deref())?),
+        (None, Some(name)) => {
+            select_configured_folder(&args.api, name)?;
+            Some("by --folder in config.xml")
+        }
+        (None, None) => discover_folder(&args.api),
+    };
+    if let (true, Some(found_by), Ok((root, _))) = (args.verbose, found_by, find_syncthing_dir()) {
+        eprintln!("Folder {} found {found_by}", root.display());
+    }
+    let modifies = !matches!(&args.command, Some(c) if !c.modifies_patterns());
+
+    // folder that was paused by us and has to be resumed
+    let paused = match api {
+        Some(api) if args.api.pause && modifies => pause(api)?,
+        _ => None,
+    };
+    let res = run(args, api);
+    let changes = journal::pending();
+    // changes made before a failure are recorded too
+    if let Err(e) = journal::save(None) {
+        eprintln!("NOTE: the change can't be undone, failed to record it: {e:#}");
+    }
+    if let (Some(api), Some(folder)) = (api, &paused) {
+        // resume even if the command failed
+        api.set_paused(folder, false)
+            .context("Can't resume the folder, resume it in Syncthing")?;
+    }
+    res?;
+    if args.git_commit {
+        git_commit(&changes, args.silent)?;
+    }
+    if let (Some(hook), false) = (&args.post_write, changes.is_empty()) {
+        let folder = find_syncthing_dir().ok().map(|(root, _)| root);
+        hooks::run("post-write", hook, folder.as_deref(), &changes)?;
+    }
+
+    if let (Some(api), true) = (api, args.api.rescan && modifies) {
+        let absolute = match &args.command {
+            Some(Command::Add(a)) => a.absolute,
+            Some(_) => true,
+            None => args.add.absolute,
+        };
+        rescan(api, absolute, args.silent)?;
+    }
+    Ok(())
+}
+
+/// Pauses the folder while its ignore files are edited. Returns its ID if it
+/// was paused by this call and has to be resumed, the user's pause is kept.
+fn pause(api: &api::Client) -> Result<Option<String>> {
+    let folder = folder_id(api)?;
+    if api.is_paused(&folder)? {
+        return Ok(None);
+    }
+    api.set_paused(&folder, true)?;
+    Ok(Some(folder))
+}
+
+/// Asks Syncthing to rescan the folder after its patterns changed, only the
+/// subdirectory of CWD unless the patterns are `absolute`
+fn rescan(api: &api::Client, absolute: bool, silent: bool) -> Result<()> {
+    if let Some(Selected::Remote(folder)) = SELECTED_FOLDER.get() {
+        api.scan(&folder.id, None)?;
+        if !silent {
+            println!("Rescan of {} requested", folder.id);
+        }
+        return Ok(());
+    }
+    let (st_dir, prefix) = find_syncthing_dir()?;
+    // patterns relative to CWD only affect files below it
+    let sub = prefix
+        .to_string_lossy()
+        .trim_start_matches(['/', '\\'])
+        .to_owned();
+    let sub = (!absolute && !sub.is_empty()).then_some(sub.replace('\\', "/"));
+    api.scan(&api.folder_at(&st_dir)?.id, sub.as_deref())?;
+    if !silent {
+        println!(
+            "Rescan of {} requested",
+            st_dir.join(sub.unwrap_or_default()).display()
+        );
+    }
+    Ok(())
+}
+
+fn run(args: &Args, api: Option<&api::Client>) -> Result<()> {
+    match &args.command {
+        Some(Command::Add(a)) => a.run(&args.api, api, args.silent),
+        Some(Command::ExportRsync { output }) => {
+            let lines = includes::flatten(&find_syncthing_dir()?.0.join(".stignore"))?;
+            print_or_write(&rsync::export(&lines), output.as_deref(), args.silent)
+        }
+        Some(Command::Tree) => {
+            let (st_dir, _) = find_syncthing_dir()?;
+            let tree = includes::tree(&st_dir.join(".stignore"));
+            print!("{}", includes::format_tree(&tree, &st_dir));
+            Ok(())
+        }
+        Some(Command::Stats) => stats::print(&find_syncthing_dir()?.0),
+        Some(Command::Coverage { unused }) => coverage::print(&find_syncthing_dir()?.0, *unused),
+        Some(Command::Simulate { summary, compare }) => {
+            let (st_dir, _) = find_syncthing_dir()?;
+            let folder = match (api, compare) {
+                (Some(api), true) => Some(api.folder_at(&st_dir)?.id),
+                _ => None,
+            };
+            simulate::run(&st_dir, *summary, api.zip(folder.as_deref()), args.silent)
+        }
+        Some(Command::Resolve { trash }) => conflicts::resolve(*trash, args.silent),
+        Some(Command::FixIncludes { create, remove }) => {
+            fix_includes(*create, *remove, args.silent)
+        }
+        Some(Command::Init { junk }) => init(*junk, args.silent),
+        Some(Command::Adopt { all, keep }) => adopt(*all, keep, args.silent),
+        Some(Command::Rm(rm)) => remove_patterns(rm, args.silent),
+        Some(Command::Mv { old, new }) => move_path(old, new, args.silent),
+        Some(Command::Canonicalize { dry_run }) => canonicalize_patterns(*dry_run, args.silent),
+        Some(Command::RewritePrefix {
+            old_prefix,
+            new_prefix,
+        }) => rewrite_prefix(old_prefix, new_prefix, args.silent),
+        Some(Command::Promote { pattern }) => move_patterns(pattern, true, args.silent),
+        Some(Command::Demote { pattern }) => move_patterns(pattern, false, args.silent),
+        Some(Command::EnsureInclude { file }) => ensure_include(
+            file.as_deref().unwrap_or(Path::new(sync_file())),
+            args.silent,
+        ),
+        Some(Command::Fragments { sync }) => list_fragments(*sync, args.silent),
+        Some(Command::RenderDevice {
+            source,
+            output,
+            watch,
+        }) => {
+            let source = source.as_deref().unwrap_or(Path::new(sync_file()));
+            if *watch {
+                watch_render_device(source, output, args.silent)
+            } else {
+                render_device(&find_syncthing_dir()?.0, source, output, args.silent)
+            }
+        }
+        Some(Command::Render { output }) => {
+            let lines = includes::flatten(&find_syncthing_dir()?.0.join(".stignore"))?;
+            let rendered: String = lines.iter().map(|l| l.clone() + LINE_ENDING).collect();
+            print_or_write(&rendered, output.as_deref(), args.silent)
+        }
+        Some(Command::OutOfSync { add: opts, all }) => out_of_sync(
+            *all,
+            opts,
+            api.context("out-of-sync requires --api")?,
+            args.silent,
+        ),
+        Some(Command::DiffDevices { instance }) => devices::diff(
+            api.context("diff-devices requires --api")?,
+            instance,
+            &args.api,
+        ),
+        Some(Command::MergeDevices { instance }) => devices::merge(
+            api.context("merge-devices requires --api")?,
+            instance,
+            &args.api,
+            args.silent,
+        ),
+        Some(Command::CheckDevices { instance }) => devices::check(
+            api.context("check-devices requires --api")?,
+            instance,
+            &args.api,
+            args.silent,
+        ),
+        Some(Command::Conflicts {
+            delete,
+            ignore,
+            add: opts,
+        }) => conflicts::run(*delete, *ignore, opts, api, args.silent),
+        Some(Command::Versions {
+            older_than,
+            max_size,
+            ignored,
+            dry_run,
+        }) => prune_versions(*older_than, *max_size, *ignored, *dry_run, args.silent),
+        Some(Command::Backups { restore }) => restore_backup(*restore, args.silent),
+        Some(Command::Undo { force }) => undo(*force, args.silent),
+        Some(Command::Blame { file }) => blame(file.as_deref()),
+        Some(Command::History { all, action: None }) => history(*all),
+        Some(Command::History {
+            action: Some(HistoryAction::Show { number }),
+            ..
+        }) => show_operation(*number),
+        Some(Command::Watch {
+            rule,
+            larger_than,
+            auto,
+            add: opts,
+        }) => watch(rule, *larger_than, *auto, opts, api, args.silent),
+        Some(Command::Root) => print_root(args.silent),
+        Some(Command::Rel { path }) => print_rel(path.as_deref()),
+        Some(Command::Which { add: opts }) => which(opts, api, args.silent),
+        Some(Command::Status { prompt }) => status(*prompt),
+        Some(Command::Completion { shell }) => completion(*shell),
+        Some(Command::Complete { values }) => complete(*values, &args.api),
+        Some(Command::Version { json }) => print_version(*json),
+        Some(Command::SelfUpdate { check }) => self_update(*check, args.silent),
+        Some(Command::Doctor) => doctor::run(&args.api, args.silent),
+        Some(Command::Tui) => tui::run(api, args.silent),
+        Some(Command::Pick { add: opts }) => pick_files(opts, api, args.silent),
+        Some(Command::Daemon { socket, add: opts }) => {
+            let socket = match socket {
+                Some(socket) => socket.clone(),
+                None => daemon::socket_path()?,
+            };
+            daemon::serve(&socket, args.silent, &mut |dir, patterns| {
+                // patterns are relative to the client's directory, like CWD
+                std::env::set_current_dir(dir)
+                    .with_context(|| format!("Can't open {}", dir.display()))?;
+                let res = add(patterns, false, opts, api, true);
+                if let Err(e) = journal::save(None) {
+                    eprintln!("NOTE: the change can't be undone, failed to record it: {e:#}");
+                }
+                res
+            })
+        }
+        Some(Command::ImportRsync {
+            file,
+            add: opts,
+            absolute,
+        }) => {
+            let content = read_to_string(file)?;
+            add(
+                &rsync::import(&content, !absolute)?,
+                *absolute,
+                opts,
+                api,
+                args.silent,
+            )
+        }
+        Some(Command::ImportBorg { file, add: opts }) => {
+            backup::import(file, backup::import_borg, opts, api, args.silent)
+        }
+        Some(Command::ImportRestic { file, add: opts }) => {
+            backup::import(file, backup::import_restic, opts, api, args.silent)
+        }
+        Some(Command::ImportResilio { file, add: opts }) => {
+            let file = match file {
+                Some(file) => file.clone(),
+                None => find_syncthing_dir()?.0.join(".sync").join("IgnoreList"),
+            };
+            // IgnoreList patterns are relative to the folder root
+            add(
+                &resilio::import(&read_to_string(&file)?),
+                true,
+                opts,
+                api,
+                args.silent,
+            )
+        }
+        None => args.add.run(&args.api, api, args.silent),
+    }
+}
+
+fn main() -> Result<()> {
+    let argv = expand_alias(std::env::args_os().collect())?;
+    let mut args = Args::parse_from(&argv);
+    let mut res = load_config(&args);
+    if res.is_ok() {
+        // settings of config files reach clap as STIGNORE_* variables
+        args = Args::parse_from(&argv);
+        config::unset();
+        res = go(&args);
+    }
+    if args.silent && res.is_err() {
+        std::process::exit(1);
+    }
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Fresh directory for a test
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()));
+        std::fs::remove_dir_all(&dir).ok();
+        std::fs::create_dir_all(&dir).unwrap();
+        files::canonicalize(&dir).unwrap()
+    }
+
+    /// Fresh syncthing folder, commands of the test's thread run in its root
+    fn folder(name: &str) -> PathBuf {
+        let dir = temp_dir(name);
+        std::fs::create_dir(dir.join(".stfolder")).unwrap();
+        FOLDER_CWD.with(|cwd| *cwd.borrow_mut() = Some(dir.clone()));
+        // confirmations would wait for stdin
+        ASSUME_YES.set(true).ok();
+        dir
+    }
+
+    #[test]
+    fn folder_search_ends_at_root() {
+        let root = Path::new(path::Component::RootDir.as_os_str());
+        assert!(folder_roots(root).iter().all(|r| r == root));
+        let dir = temp_dir("no-marker");
+        assert!(!folder_roots(&dir).contains(&dir));
+    }
+
+    #[test]
+    fn nested_folders_innermost_first() {
+        let outer = temp_dir("nested");
+        let inner = outer.join("inner");
+        std::fs::create_dir_all(outer.join(".stfolder")).unwrap();
+        std::fs::create_dir_all(inner.join(".stfolder")).unwrap();
+        std::fs::create_dir_all(inner.join("a/b")).unwrap();
+        let roots = folder_roots(&inner.join("a/b"));
+        assert_eq!(roots[..2], [inner, outer.clone()]);
+        std::fs::remove_dir_all(outer).ok();
+    }
+
+    #[test]
+    fn marker_from_folder_config_finds_root() {
+        let outer = temp_dir("config-marker");
+        let inner = outer.join("inner");
+        std::fs::create_dir_all(outer.join(".stfolder")).unwrap();
+        std::fs::create_dir_all(inner.join("a")).unwrap();
+        std::fs::write(inner.join(".marker"), "").unwrap();
+        std::fs::write(
+            outer.join(config::FOLDER_CONFIG),
+            "marker = [\".marker\"]\n",
+        )
+        .unwrap();
+        // only the folder's config file
+        std::env::set_var("STIGNORE_CONFIG", outer.join("no-user-config.toml"));
+        config::apply(Some(&outer), None).unwrap();
+        // clap splits the variable the same way
+        let marker = config::var("STIGNORE_MARKER").unwrap();
+        let markers: Vec<String> = std::iter::once(".stfolder")
+            .chain(marker.split(','))
+            .map(str::to_owned)
+            .collect();
+        assert_eq!(folder_roots_marked(&inner.join("a"), &markers)[0], inner);
+        std::fs::remove_dir_all(outer).ok();
+    }
+
+    #[test]
+    fn include_outside_folder_is_refused() {
+        let dir = temp_dir("include-outside");
+        let st_dir = dir.join("folder");
+        std::fs::create_dir_all(st_dir.join("sub")).unwrap();
+        std::fs::write(st_dir.join(".stignore"), "").unwrap();
+        assert!(include_from_stignore(&st_dir, &st_dir.join("../escaped"), true).is_err());
+        assert!(!dir.join("escaped").exists());
+        assert!(include_from_stignore(&st_dir, &st_dir.join("sub/../inside"), true).unwrap());
+        assert_eq!(
+            std::fs::read_to_string(st_dir.join(".stignore")).unwrap(),
+            format!("#include inside{LINE_ENDING}")
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn instance_key_vars() {
+        assert_eq!(instance_key_var("nas:8384"), "STIGNORE_API_KEY_NAS");
+        assert_eq!(
+            instance_key_var("nas.local:8384/"),
+            "STIGNORE_API_KEY_NAS_LOCAL"
+        );
+        assert_eq!(instance_key_var("[::1]:8384"), "STIGNORE_API_KEY___1");
+    }
+
+    #[test]
+    fn loopback_urls() {
+        for url in [
+            "http://127.0.0.1:8384",
+            "https://localhost:8384/",
+            "http://[::1]:8384",
+            "localhost",
+            "http://key@127.0.0.2:8384",
+        ] {
+            assert!(is_loopback_url(url), "{url}");
+        }
+        for url in [
+            "https://nas:8384",
+            "http://192.168.1.2:8384",
+            "http://[fe80::1]:8384",
+        ] {
+            assert!(!is_loopback_url(url), "{url}");
+        }
+    }
+
+    #[test]
+    fn topics_need_prefix() {
+        assert_eq!("stignore_sync".parse(), Ok(Target::StignoreSync));
+        assert_eq!("topic:media".parse(), Ok(Target::Topic("media".to_owned())));
+        assert_eq!(Target::Topic("media".to_owned()).to_string(), "topic:media");
+        for invalid in ["stignore-sync", "media", "topic:", "topic:a/b"] {
+            assert!(invalid.parse::<Target>().is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn unreadable_stignore_is_an_error() {
+        let dir = temp_dir("unreadable-stignore");
+        let stignore = dir.join(".stignore");
+        assert!(includes::readable_tree(&stignore).is_ok());
+        std::fs::write(&stignore, "*.tmp\0\0").unwrap();
+        assert!(includes::readable_tree(&stignore).is_err());
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn prefixed_patterns_use_slashes() {
+        let prefix = Path::new(path::Component::RootDir.as_os_str())
+            .join("some")
+            .join("dir");
+        let patterns = ["./foo/*.png".to_owned(), "(?d)/bar".to_owned()];
+        assert_eq!(
+            process_patterns(&patterns, Some(&prefix), true).unwrap(),
+            format!("/some/dir/foo/*.png{LINE_ENDING}(?d)/some/dir/bar{LINE_ENDING}")
+        );
+    }
+
+    #[cfg(windows)]
+    #[test]
+    fn folder_search_ends_at_windows_roots() {
+        for path in [r"C:\no\such\dir", r"\\server\share\no\such\dir"] {
+            let path = Path::new(path);
+            assert!(folder_roots(path).is_empty());
+            let top = path.ancestors().last().unwrap();
+            assert!(top.has_root() && top.parent().is_none());
+        }
+    }
+
+    #[test]
+    fn init_sets_up_shared_file() {
+        let dir = folder("init");
+        init(true, true).unwrap();
+        let sync = std::fs::read_to_string(dir.join(".stignore_sync")).unwrap();
+        assert!(sync.starts_with("// Ignore patterns shared between all devices."));
+        assert!(sync.contains("(?d).DS_Store"));
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            format!("#include .stignore_sync{LINE_ENDING}")
+        );
+        // nothing is added twice
+        init(true, true).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore_sync")).unwrap(),
+            sync
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            format!("#include .stignore_sync{LINE_ENDING}")
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn adopt_moves_all_but_kept_patterns() {
+        let dir = folder("adopt");
+        std::fs::write(dir.join(".stignore"), "*.local\n// build output\nbuild\n").unwrap();
+        adopt(true, &["*.local".to_owned()], true).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            "*.local\n#include .stignore_sync\n"
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore_sync")).unwrap(),
+            "// build output\nbuild\n"
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn promote_and_demote_keep_comments() {
+        let dir = folder("promote");
+        std::fs::write(dir.join(".stignore"), "// logs\n*.log\n*.tmp\n").unwrap();
+        move_patterns(&["*.log".to_owned()], true, true).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            "#include .stignore_sync\n*.tmp\n"
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore_sync")).unwrap(),
+            "// logs\n*.log\n"
+        );
+        move_patterns(&["*.log".to_owned()], false, true).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            "#include .stignore_sync\n*.tmp\n// logs\n*.log\n"
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore_sync")).unwrap(),
+            ""
+        );
+        assert!(move_patterns(&["missing".to_owned()], true, true).is_err());
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn file_outside_of_folders() {
+        let dir = temp_dir("add-file");
+        let file = dir.join("dotfiles/stignore");
+        std::fs::create_dir(dir.join("dotfiles")).unwrap();
+        std::fs::write(&file, "*.tmp\n").unwrap();
+        let opts = AddOptions {
+            ignore_file: Some(file.clone()),
+            ..Default::default()
+        };
+        add(
+            &["*.tmp".to_owned(), "build".to_owned()],
+            false,
+            &opts,
+            None,
+            true,
+        )
+        .unwrap();
+        assert_eq!(std::fs::read_to_string(&file).unwrap(), "*.tmp\nbuild\n");
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn fragments_are_included_and_synced() {
+        let dir = folder("add-fragment");
+        let opts = AddOptions {
+            fragment: Some("media".to_owned()),
+            ..Default::default()
+        };
+        add(&["*.mkv".to_owned()], false, &opts, None, true).unwrap();
+        assert!(
+            std::fs::read_to_string(dir.join(".stignore.d/media.stignore"))
+                .unwrap()
+                .ends_with("/*.mkv\n")
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            format!("#include .stignore.d/media.stignore{LINE_ENDING}")
+        );
+        // deleted fragments lose their #include, new ones get one
+        std::fs::remove_file(dir.join(".stignore.d/media.stignore")).unwrap();
+        std::fs::write(dir.join(".stignore.d/dev.stignore"), "target\n").unwrap();
+        list_fragments(true, true).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            format!("#include .stignore.d/dev.stignore{LINE_ENDING}")
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn host_only_patterns_go_to_host_file() {
+        let dir = folder("host-only");
+        let opts = AddOptions {
+            host_only: true,
+            ..Default::default()
+        };
+        add(&["*.iso".to_owned()], false, &opts, None, true).unwrap();
+        let name = format!(".stignore_sync_{}", device::hostname().unwrap());
+        assert!(std::fs::read_to_string(dir.join(&name))
+            .unwrap()
+            .ends_with("/*.iso\n"));
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            format!("#include {name}{LINE_ENDING}")
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn api_mode_posts_stignore() {
+        let dir = folder("api-add");
+        std::fs::write(dir.join(".stignore"), "*.tmp\n").unwrap();
+        let path = dir.to_string_lossy().into_owned();
+        let syncthing = api::fake::Syncthing::start(move |r| match r.path.as_str() {
+            "/rest/config/folders" => (
+                200,
+                serde_json::json!([{ "id": "photos", "label": "Photos", "path": path }])
+                    .to_string(),
+            ),
+            "/rest/db/ignores" if r.method == "GET" => {
+                (200, serde_json::json!({ "ignore": ["*.tmp"] }).to_string())
+            }
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        add(
+            &["build".to_owned()],
+            false,
+            &AddOptions::default(),
+            Some(&api),
+            true,
+        )
+        .unwrap();
+        let posted = syncthing
+            .requests()
+            .into_iter()
+            .find(|r| r.method == "POST")
+            .unwrap();
+        assert_eq!(posted.path, "/rest/db/ignores");
+        assert_eq!(posted.param("folder"), Some("photos"));
+        let body: serde_json::Value = serde_json::from_str(&posted.body).unwrap();
+        assert_eq!(body["ignore"], serde_json::json!(["*.tmp", "/build"]));
+        // Syncthing writes the file, not stignore
+        assert_eq!(
+            std::fs::read_to_string(dir.join(".stignore")).unwrap(),
+            "*.tmp\n"
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn rescan_is_limited_to_cwd() {
+        let dir = folder("rescan");
+        let path = dir.to_string_lossy().into_owned();
+        let syncthing = api::fake::Syncthing::start(move |r| match r.path.as_str() {
+            "/rest/config/folders" => (
+                200,
+                serde_json::json!([{ "id": "photos", "label": "Photos", "path": path }])
+                    .to_string(),
+            ),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        std::fs::create_dir_all(dir.join("2024/raw")).unwrap();
+        FOLDER_CWD.with(|cwd| *cwd.borrow_mut() = Some(dir.join("2024/raw")));
+        rescan(&api, false, true).unwrap();
+        rescan(&api, true, true).unwrap();
+        let scans: Vec<_> = syncthing
+            .requests()
+            .into_iter()
+            .filter(|r| r.path == "/rest/db/scan")
+            .collect();
+        assert_eq!(scans.len(), 2);
+        assert!(scans
+            .iter()
+            .all(|r| r.method == "POST" && r.param("folder") == Some("photos")));
+        assert_eq!(scans[0].param("sub"), Some("2024/raw"));
+        assert_eq!(scans[1].param("sub"), None);
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn only_running_folders_are_paused() {
+        let dir = folder("pause");
+        let path = dir.to_string_lossy().into_owned();
+        let paused = std::sync::Arc::new(std::sync::Mutex::new(false));
+        let state = paused.clone();
+        let syncthing = api::fake::Syncthing::start(move |r| match r.path.as_str() {
+            "/rest/config/folders" => (
+                200,
+                serde_json::json!([{ "id": "photos", "label": "Photos", "path": path }])
+                    .to_string(),
+            ),
+            "/rest/config/folders/photos" if r.method == "GET" => (
+                200,
+                serde_json::json!({ "id": "photos", "paused": *state.lock().unwrap() }).to_string(),
+            ),
+            "/rest/config/folders/photos" => {
+                let body: serde_json::Value = serde_json::from_str(&r.body).unwrap();
+                *state.lock().unwrap() = body["paused"].as_bool().unwrap();
+                (200, String::new())
+            }
+            _ => (404, String::new()),
+        });
+        let api = syncthing.client();
+        assert_eq!(pause(&api).unwrap().as_deref(), Some("photos"));
+        assert!(*paused.lock().unwrap());
+        // paused by the user, stays paused afterwards
+        assert_eq!(pause(&api).unwrap(), None);
+        api.set_paused("photos", false).unwrap();
+        assert!(!*paused.lock().unwrap());
+        let patches = syncthing
+            .requests()
+            .into_iter()
+            .filter(|r| r.method == "PATCH")
+            .count();
+        assert_eq!(patches, 2);
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn verification_reports_patterns_without_effect() {
+        let syncthing = api::fake::Syncthing::start(|r| match (r.path.as_str(), r.param("file")) {
+            ("/rest/db/file", Some("big")) => (
+                200,
+                serde_json::json!({ "local": { "ignored": true } }).to_string(),
+            ),
+            ("/rest/db/file", Some("kept")) => (
+                200,
+                serde_json::json!({ "local": { "ignored": false } }).to_string(),
+            ),
+            ("/rest/db/file", _) => (404, "No such object in the index".to_owned()),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        let patterns = "/big/\n/kept\n/unknown\n*.tmp\n/not-here\n";
+        let effective = || Ok(vec!["!/kept".to_owned(), "/kept".to_owned()]);
+        let e = verify(
+            &api,
+            "photos",
+            patterns,
+            true,
+            |p| p != "not-here",
+            effective,
+        )
+        .unwrap_err();
+        assert_eq!(e.to_string(), "1 pattern didn't take effect");
+        let scanned: Vec<_> = syncthing
+            .requests()
+            .into_iter()
+            .filter(|r| r.path == "/rest/db/scan")
+            .map(|r| r.param("sub").unwrap_or_default().to_owned())
+            .collect();
+        assert_eq!(scanned, ["big", "kept", "unknown"]);
+        assert!(verify(&api, "photos", "/big\n", true, |_| true, effective).is_ok());
+    }
+
+    #[test]
+    fn diagnosis_of_patterns_without_effect() {
+        let lines = |l: &[&str]| Ok(l.iter().map(|l| l.to_string()).collect());
+        assert!(diagnose("a.log", lines(&["!a.log", "*.log"])).contains("un-ignored by `!a.log`"));
+        assert!(diagnose("a.log", lines(&["*.log"])).contains("hasn't applied them yet"));
+        assert!(diagnose("a.log", lines(&["*.tmp"])).contains("no effective pattern matches"));
+        assert!(diagnose("a.log", Err(anyhow::anyhow!("gone"))).contains("can't be loaded: gone"));
+    }
+
+    #[test]
+    fn selections() {
+        assert_eq!(parse_selection("all", 3), Some(vec![0, 1, 2]));
+        assert_eq!(parse_selection("3 1-2, 2", 3), Some(vec![2, 0, 1]));
+        assert_eq!(parse_selection("", 3), Some(vec![]));
+        for invalid in ["0", "4", "2-1", "x", "1-"] {
+            assert_eq!(parse_selection(invalid, 3), None, "{invalid}");
+        }
+    }
+
+    #[test]
+    fn out_of_sync_items_are_ignored() {
+        let dir = folder("out-of-sync");
+        let path = dir.to_string_lossy().into_owned();
+        let syncthing = api::fake::Syncthing::start(move |r| match r.path.as_str() {
+            "/rest/config/folders" => (
+                200,
+                serde_json::json!([{ "id": "photos", "label": "Photos", "path": path }])
+                    .to_string(),
+            ),
+            "/rest/db/need" => (
+                200,
+                serde_json::json!({ "rest": [{ "name": "raw/[1].cr2" }] }).to_string(),
+            ),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        out_of_sync(true, &AddOptions::default(), &api, true).unwrap();
+        let posted = syncthing
+            .requests()
+            .into_iter()
+            .find(|r| r.method == "POST" && r.path == "/rest/db/ignores")
+            .unwrap();
+        let body: serde_json::Value = serde_json::from_str(&posted.body).unwrap();
+        assert_eq!(
+            body["ignore"],
+            serde_json::json!([pattern::literal("raw/[1].cr2")])
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn only_newly_ignored_files_are_deleted() {
+        let dir = folder("and-delete");
+        std::fs::create_dir_all(dir.join("logs")).unwrap();
+        for file in [
+            "logs/a.log",
+            "logs/keep.log",
+            "b.log",
+            "c.txt",
+            ".stignore_sync",
+        ] {
+            std::fs::write(dir.join(file), "12345").unwrap();
+        }
+        let stignore = "!/logs/keep.log\n*.log\n.stignore*\n";
+        std::fs::write(dir.join(".stignore"), stignore).unwrap();
+        let effective = Matcher::new(&includes::flatten(&dir.join(".stignore")).unwrap());
+        let mut ignored = newly_ignored(&dir, "*.log\n.stignore*\n", &effective).unwrap();
+        ignored.sort();
+        assert_eq!(ignored, [dir.join("b.log"), dir.join("logs/a.log")]);
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn revert_is_offered_for_receive_only_folders() {
+        let syncthing = api::fake::Syncthing::start(|r| match r.path.as_str() {
+            "/rest/config/folders/photos" => (
+                200,
+                serde_json::json!({ "type": "receiveonly" }).to_string(),
+            ),
+            "/rest/config/folders/music" => (200, serde_json::json!({}).to_string()),
+            "/rest/db/localchanged" => (200, serde_json::json!({ "files": [] }).to_string()),
+            _ => (200, String::new()),
+        });
+        let api = syncthing.client();
+        offer_revert(&api, "music").unwrap();
+        assert_eq!(syncthing.requests().len(), 1);
+        // nothing left to revert after the scan, nothing is asked
+        offer_revert(&api, "photos").unwrap();
+        let paths: Vec<_> = syncthing.requests().into_iter().map(|r| r.path).collect();
+        assert_eq!(
+            paths[1..],
+            [
+                "/rest/config/folders/photos",
+                "/rest/db/scan",
+                "/rest/db/localchanged"
+            ]
+        );
+    }
+
+    #[test]
+    fn prefix_in_selected_folder() {
+        let dir = temp_dir("selected-folder");
+        let root = dir.join("photos");
+        std::fs::create_dir_all(root.join("2024/raw")).unwrap();
+        let prefix = |cwd: &Path| prefix_in(&root, cwd).to_string_lossy().replace('\\', "/");
+        assert_eq!(prefix(&root.join("2024/raw")), "/2024/raw");
+        assert_eq!(prefix(&root), "/");
+        assert_eq!(prefix(&dir), "/");
+        #[cfg(unix)]
+        {
+            std::os::unix::fs::symlink(root.join("2024"), dir.join("link")).unwrap();
+            assert_eq!(prefix(&dir.join("link/raw")), "/2024/raw");
+        }
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn all_folders_fail_separately() {
+        let dir = temp_dir("all-folders");
+        for folder in ["photos", "broken"] {
+            std::fs::create_dir_all(dir.join(folder).join(".stfolder")).unwrap();
+        }
+        // can't be read
+        std::fs::create_dir(dir.join("broken/.stignore")).unwrap();
+        let folder = |id: &str| {
+            format!(
+                "<folder id=\"{id}\" label=\"\" path=\"{}\"></folder>",
+                dir.join(id).display()
+            )
+        };
+        let config = dir.join("config.xml");
+        std::fs::write(
+            &config,
+            [folder("photos"), folder("broken"), folder("elsewhere")].join("\n"),
+        )
+        .unwrap();
+        let api_opts = ApiOptions {
+            api_config: Some(config),
+            ..Default::default()
+        };
+        let patterns = ["(?d).DS_Store".to_owned()];
+        let opts = AddOptions::default();
+        for jobs in [1, 2] {
+            std::fs::write(dir.join("photos/.stignore"), "").unwrap();
+            let e = add_all_folders(&patterns, &opts, &api_opts, None, Some(jobs), false, true)
+                .unwrap_err();
+            assert_eq!(e.to_string(), "Failed for 1 of 3 folders");
+            assert_eq!(
+                std::fs::read_to_string(dir.join("photos/.stignore")).unwrap(),
+                format!("(?d).DS_Store{LINE_ENDING}")
+            );
+        }
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn folder_found_by_config_without_marker() {
+        let dir = temp_dir("no-stfolder");
+        std::fs::create_dir_all(dir.join("music/a/b")).unwrap();
+        std::fs::create_dir_all(dir.join("music/a/nested")).unwrap();
+        let folder = |path: &Path| api::Folder {
+            id: String::new(),
+            label: String::new(),
+            path: path.to_owned(),
+        };
+        let folders = [
+            folder(&dir.join("music")),
+            folder(&dir.join("music/a/nested")),
+        ];
+        FOLDER_CWD.with(|cwd| *cwd.borrow_mut() = Some(dir.join("music/a/b")));
+        assert_eq!(folder_containing_cwd(&folders), Some(dir.join("music")));
+        FOLDER_CWD.with(|cwd| *cwd.borrow_mut() = Some(dir.join("music/a/nested")));
+        assert_eq!(
+            folder_containing_cwd(&folders),
+            Some(dir.join("music/a/nested"))
+        );
+        FOLDER_CWD.with(|cwd| *cwd.borrow_mut() = Some(dir.clone()));
+        assert_eq!(folder_containing_cwd(&folders), None);
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn custom_markers_find_roots() {
+        let dir = temp_dir("custom-marker");
+        std::fs::create_dir_all(dir.join("music/album")).unwrap();
+        std::fs::write(dir.join("music/.music"), "").unwrap();
+        let markers = [".stfolder".to_owned(), ".music".to_owned()];
+        assert_eq!(
+            folder_roots_marked(&dir.join("music/album"), &markers)[0],
+            dir.join("music")
+        );
+        assert!(
+            !folder_roots_marked(&dir.join("music/album"), &markers[..1])
+                .contains(&dir.join("music"))
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn only_entries_not_ignored_are_offered() {
+        let dir = folder("pick");
+        std::fs::create_dir_all(dir.join("src/target/debug")).unwrap();
+        std::fs::create_dir_all(dir.join("docs")).unwrap();
+        for file in [
+            "src/main.rs",
+            "src/target/debug/app",
+            "src/a.tmp",
+            "docs/x.md",
+        ] {
+            std::fs::write(dir.join(file), "").unwrap();
+        }
+        std::fs::write(dir.join(".stignore"), "*.tmp\ntarget\n").unwrap();
+        assert_eq!(
+            not_ignored(&dir, &dir.join("src")).unwrap(),
+            [("src/main.rs".to_owned(), false)]
+        );
+        let all = not_ignored(&dir, &dir).unwrap();
+        let paths: Vec<&str> = all.iter().map(|(p, _)| p.as_str()).collect();
+        assert_eq!(
+            paths,
+            [".stignore", "docs", "docs/x.md", "src", "src/main.rs"]
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn prefix_of_another_directory() {
+        let cwd = Path::new(path::Component::RootDir.as_os_str())
+            .join("a")
+            .join("b");
+        assert_eq!(folder_dir(&cwd, "../c").unwrap(), "a/c");
+        assert_eq!(folder_dir(&cwd, "/x/y").unwrap(), "x/y");
+        assert_eq!(folder_dir(&cwd, "new").unwrap(), "a/b/new");
+        assert!(folder_dir(&cwd, "../../..").is_err());
+        assert!(folder_dir(&cwd, "/").is_err());
+
+        let prefix = Path::new(path::Component::RootDir.as_os_str()).join("a/c");
+        assert_eq!(
+            process_patterns(&["*.log".to_owned()], Some(&prefix), true).unwrap(),
+            format!("/a/c/*.log{LINE_ENDING}")
+        );
+    }
+
+    #[test]
+    fn preview_of_newly_ignored_files() {
+        let dir = folder("preview");
+        std::fs::create_dir_all(dir.join("logs")).unwrap();
+        for file in ["a.log", "logs/b.log", "c.tmp", "d.txt"] {
+            std::fs::write(dir.join(file), "").unwrap();
+        }
+        std::fs::write(dir.join(".stignore"), "*.tmp\n").unwrap();
+        let (ignored, unused, checked) =
+            matches_of(&dir, "*.log\n*.tmp\n/typo\n!d.txt\n", 100).unwrap();
+        assert_eq!(ignored, ["a.log", "logs/b.log"]);
+        // c.tmp is already ignored, but the pattern matches it
+        assert_eq!(unused, ["/typo"]);
+        assert_eq!(checked, None);
+        let (_, _, checked) = matches_of(&dir, "*.log\n", 1).unwrap();
+        assert!(checked.is_some());
+        std::fs::remove_dir_all(dir).ok();
     }
-    res
 }
@@ -0,0 +1,161 @@
+use std::collections::{HashMap, HashSet};
+
+use anyhow::{bail, Result};
+
+/// Lines that take part in merging: patterns, not comments or blank lines
+fn patterns(lines: &[String]) -> Vec<&str> {
+    let mut seen = HashSet::new();
+    lines
+        .iter()
+        .map(|l| l.trim())
+        .filter(|l| !l.is_empty() && !l.starts_with("//"))
+        .filter(|l| seen.insert(*l))
+        .collect()
+}
+
+/// Union of the patterns of all lists, in an order that keeps the order of
+/// each list. Ties are broken by the first list, so its order is preserved.
+/// Fails if two lists order the same patterns differently, since then no
+/// order fits both and first-match-wins would change the meaning of one.
+pub fn order(lists: &[&[String]]) -> Result<Vec<String>> {
+    // pattern -> (list, position) of its first appearance
+    let mut first = HashMap::new();
+    let mut predecessors: HashMap<&str, HashSet<&str>> = HashMap::new();
+    for (i, list) in lists.iter().enumerate() {
+        let list = patterns(list);
+        for (j, line) in list.iter().enumerate() {
+            first.entry(*line).or_insert((i, j));
+            let before = predecessors.entry(*line).or_default();
+            if j > 0 {
+                before.insert(list[j - 1]);
+            }
+        }
+    }
+
+    let mut remaining: Vec<&str> = first.keys().copied().collect();
+    remaining.sort_by_key(|l| first[l]);
+    let mut placed = HashSet::new();
+    let mut merged = Vec::new();
+    while !remaining.is_empty() {
+        let ready = remaining
+            .iter()
+            .position(|l| predecessors[l].iter().all(|p| placed.contains(p)));
+        let Some(ready) = ready else {
+            let stuck = remaining[0];
+            let before = predecessors[stuck]
+                .iter()
+                .find(|p| !placed.contains(*p))
+                .copied()
+                .unwrap_or_default();
+            bail!(
+                "Patterns `{before}` and `{stuck}` are in a different order on the devices, \
+                merge them by hand"
+            );
+        };
+        let line = remaining.remove(ready);
+        placed.insert(line);
+        merged.push(line.to_owned());
+    }
+    Ok(merged)
+}
+
+/// Inserts the patterns of `merged` that are missing from `effective` (the
+/// patterns of the device, with included files expanded) into `lines` (its
+/// .stignore), next to their neighbours in the merged order: after the
+/// closest earlier pattern the device has, or before the closest later one.
+/// Returns the inserted patterns. Fails if both neighbours come from
+/// included files, since the place between them isn't in .stignore.
+pub fn insert(
+    lines: &mut Vec<String>,
+    effective: &[String],
+    merged: &[String],
+) -> Result<Vec<String>> {
+    let mut present: HashSet<String> = patterns(effective).into_iter().map(str::to_owned).collect();
+    let position = |lines: &[String], pattern: &str| lines.iter().position(|l| l.trim() == pattern);
+    let mut inserted = Vec::new();
+    for (k, pattern) in merged.iter().enumerate() {
+        if present.contains(pattern) {
+            continue;
+        }
+        let before = merged[..k].iter().rev().find(|p| present.contains(*p));
+        let after = merged[k + 1..].iter().find(|p| present.contains(*p));
+        let at = match (before, after) {
+            (None, None) => lines.len(),
+            (Some(before), after) => match (position(lines, before), after) {
+                (Some(i), _) => i + 1,
+                (None, None) => lines.len(),
+                (None, Some(after)) => match position(lines, after) {
+                    Some(i) => i,
+                    None => bail!(
+                        "Can't place `{pattern}`: its neighbours `{before}` and `{after}` \
+                        are in included files"
+                    ),
+                },
+            },
+            (None, Some(after)) => position(lines, after).unwrap_or(0),
+        };
+        lines.insert(at, pattern.clone());
+        present.insert(pattern.clone());
+        inserted.push(pattern.clone());
+    }
+    Ok(inserted)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn lines(s: &str) -> Vec<String> {
+        s.lines().map(str::to_owned).collect()
+    }
+
+    #[test]
+    fn order_keeps_order_of_each_device() {
+        let a = lines("!keep\n*.tmp\nbuild");
+        let b = lines("!keep\n!important.log\n*.log\n*.tmp");
+        assert_eq!(
+            order(&[&a, &b]).unwrap(),
+            lines("!keep\n!important.log\n*.log\n*.tmp\nbuild")
+        );
+    }
+
+    #[test]
+    fn order_conflict_is_refused() {
+        let a = lines("*.log\n!important.log");
+        let b = lines("!important.log\n*.log");
+        assert!(order(&[&a, &b]).is_err());
+    }
+
+    #[test]
+    fn negation_is_inserted_before_the_pattern_it_excepts() {
+        let a = lines("!important.log\n*.log");
+        let b = lines("// logs\n*.log\n*.tmp");
+        let merged = order(&[&a, &b]).unwrap();
+        let mut stignore = b.clone();
+        let inserted = insert(&mut stignore, &b, &merged).unwrap();
+        assert_eq!(inserted, ["!important.log"]);
+        assert_eq!(stignore, lines("// logs\n!important.log\n*.log\n*.tmp"));
+    }
+
+    #[test]
+    fn missing_patterns_follow_their_predecessor() {
+        let a = lines("a\nb\nc\nd");
+        let b = lines("a\nd");
+        let merged = order(&[&a, &b]).unwrap();
+        let mut stignore = b.clone();
+        insert(&mut stignore, &b, &merged).unwrap();
+        assert_eq!(stignore, a);
+    }
+
+    #[test]
+    fn neighbours_in_included_files() {
+        let merged = lines("a\nb\nc");
+        // `a` comes from the included file, `c` is in .stignore
+        let mut stignore = lines("#include common\nc");
+        insert(&mut stignore, &lines("a\nc"), &merged).unwrap();
+        assert_eq!(stignore, lines("#include common\nb\nc"));
+        // both neighbours are included, the place is unknown
+        let mut stignore = lines("#include common");
+        assert!(insert(&mut stignore, &lines("a\nc"), &merged).is_err());
+    }
+}
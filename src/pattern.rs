@@ -0,0 +1,762 @@
+use std::{collections::HashMap, path::Path};
+
+use anyhow::Result;
+use regex::Regex;
+
+use crate::include::{self, included_path};
+
+/// Syncthing matches all patterns ignoring case on these platforms, as if
+/// they had the `(?i)` prefix
+const IGNORE_CASE: bool = cfg!(any(target_os = "macos", windows));
+
+/// Lowercases the path where patterns ignore case, for looking up patterns
+/// without wildcards
+fn fold_case(path: String) -> String {
+    match IGNORE_CASE {
+        true => path.to_lowercase(),
+        false => path,
+    }
+}
+
+/// Syncthing ignore pattern split into its prefix flags and the glob itself
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Pattern<'a> {
+    /// `!` prefix: matching files are explicitly not ignored
+    pub negated: bool,
+    /// `(?i)` prefix
+    pub case_insensitive: bool,
+    /// `(?d)` prefix: ignored files may be deleted if they block directory removal
+    pub deletable: bool,
+    pub glob: &'a str,
+}
+
+impl<'a> Pattern<'a> {
+    /// Parses a line of an ignore file. Returns `None` for empty lines,
+    /// comments and `#include` directives.
+    pub fn parse(line: &'a str) -> Option<Self> {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with("//") || included_path(line).is_some() {
+            return None;
+        }
+
+        let mut pattern = Pattern {
+            negated: false,
+            case_insensitive: false,
+            deletable: false,
+            glob: line,
+        };
+        // syncthing accepts prefixes in any order, but each one only once
+        loop {
+            if let (false, Some(rest)) = (pattern.negated, pattern.glob.strip_prefix('!')) {
+                pattern.negated = true;
+                pattern.glob = rest;
+            } else if let (false, Some(rest)) =
+                (pattern.case_insensitive, pattern.glob.strip_prefix("(?i)"))
+            {
+                pattern.case_insensitive = true;
+                pattern.glob = rest;
+            } else if let (false, Some(rest)) =
+                (pattern.deletable, pattern.glob.strip_prefix("(?d)"))
+            {
+                pattern.deletable = true;
+                pattern.glob = rest;
+            } else {
+                break;
+            }
+        }
+        if pattern.glob.is_empty() {
+            return None;
+        }
+        Some(pattern)
+    }
+
+    /// The pattern written the canonical way: flags in the order `!`, `(?i)`,
+    /// `(?d)`, without `.` path segments and repeated slashes, and with
+    /// repeated `**` segments collapsed. `./x` becomes `/x`, the path from
+    /// the folder root. Backslashes are replaced with slashes on Windows,
+    /// elsewhere they escape characters.
+    pub fn canonical(&self) -> String {
+        let mut glob = self.glob.to_owned();
+        if cfg!(windows) {
+            glob = glob.replace('\\', "/");
+        }
+        if let Some(rest) = glob.strip_prefix("./") {
+            glob = format!("/{rest}");
+        }
+        let mut parts: Vec<&str> = glob
+            .split('/')
+            .filter(|p| !p.is_empty() && *p != ".")
+            .collect();
+        parts.dedup_by(|a, b| *a == "**" && *b == "**");
+        if !parts.is_empty() {
+            glob = format!(
+                "{}{}{}",
+                if glob.starts_with('/') { "/" } else { "" },
+                parts.join("/"),
+                if glob.ends_with('/') { "/" } else { "" }
+            );
+        }
+        format!(
+            "{}{}{}{glob}",
+            if self.negated { "!" } else { "" },
+            if self.case_insensitive { "(?i)" } else { "" },
+            if self.deletable { "(?d)" } else { "" }
+        )
+    }
+
+    /// Checks if the pattern matches the path (relative to the folder root,
+    /// with `/` separators) or one of its parent directories, ignoring the
+    /// `!` prefix
+    pub fn matches(&self, path: &str) -> bool {
+        self.regex()
+            .is_some_and(|re| re.is_match(path.trim_matches('/')))
+    }
+
+    /// Path the pattern matches if it has no wildcards and braces, with the
+    /// leading `/` if it's anchored. Such patterns match the path and
+    /// everything inside of it.
+    fn literal(&self) -> Option<String> {
+        if self.case_insensitive || self.glob.contains(['*', '?', '[', '{', '\\']) {
+            return None;
+        }
+        let (anchor, path) = match self.glob.strip_prefix('/') {
+            Some(path) => ("/", path),
+            None => ("", self.glob),
+        };
+        let path = path.trim_end_matches('/');
+        if path.is_empty() || path.starts_with('/') || path.contains("//") {
+            return None;
+        }
+        Some(fold_case(format!("{anchor}{path}")))
+    }
+
+    /// Regular expression matching the same paths as [`Pattern::matches`],
+    /// `None` if the glob can't be converted
+    pub fn regex(&self) -> Option<Regex> {
+        let globs: Vec<String> = expand_braces(self.glob)
+            .iter()
+            .map(|glob| {
+                let (anchor, glob) = match glob.strip_prefix('/') {
+                    Some(glob) => ("^", glob),
+                    // unanchored patterns match at any depth, syncthing
+                    // lets `**/` match the root level too
+                    None => (
+                        "^(?:.*/)?",
+                        glob.strip_prefix("**/").unwrap_or(glob.as_str()),
+                    ),
+                };
+                format!(
+                    "{anchor}{}(?:/.*)?$",
+                    glob_to_regex(glob.trim_end_matches('/'))
+                )
+            })
+            .collect();
+        let re = format!(
+            "{}(?:{})",
+            if self.case_insensitive || IGNORE_CASE {
+                "(?i)"
+            } else {
+                ""
+            },
+            globs.join("|")
+        );
+        Regex::new(&re).ok()
+    }
+}
+
+/// Result of matching a path against ignore patterns
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct Match {
+    /// The first matching pattern isn't negated
+    pub ignored: bool,
+    /// The first matching pattern has the `(?d)` prefix
+    pub deletable: bool,
+}
+
+/// Patterns of an ignore file compiled once, for matching many paths.
+/// Patterns without wildcards, most of the generated ones, are looked up by
+/// path instead of being tried one by one.
+pub struct Matcher {
+    /// Line of each pattern and the result of matching it
+    patterns: Vec<(String, Match)>,
+    /// Expressions of patterns with wildcards, with their indices, in order
+    globs: Vec<(usize, Regex)>,
+    /// Index of the first pattern without wildcards matching the path,
+    /// anchored ones keyed with the leading `/`
+    literals: HashMap<String, usize>,
+}
+
+impl Matcher {
+    /// Compiles the patterns of the lines (with includes already expanded),
+    /// skipping ones that can't be converted
+    pub fn new(lines: &[String]) -> Self {
+        let mut matcher = Matcher {
+            patterns: Vec::new(),
+            globs: Vec::new(),
+            literals: HashMap::new(),
+        };
+        for line in lines {
+            let Some(p) = Pattern::parse(line) else {
+                continue;
+            };
+            let index = matcher.patterns.len();
+            match p.literal() {
+                Some(key) => {
+                    matcher.literals.entry(key).or_insert(index);
+                }
+                None => match p.regex() {
+                    Some(re) => matcher.globs.push((index, re)),
+                    None => continue,
+                },
+            }
+            let result = Match {
+                ignored: !p.negated,
+                deletable: p.deletable,
+            };
+            matcher.patterns.push((line.clone(), result));
+        }
+        matcher
+    }
+
+    /// Reads the ignore file with the files it includes. A missing file has
+    /// no patterns, like in Syncthing.
+    pub fn load(path: &Path) -> Result<Self> {
+        Ok(Matcher::new(&include::flatten(path)?))
+    }
+
+    /// Index of the first pattern matching the path
+    fn position(&self, path: &str) -> Option<usize> {
+        let path = path.trim_matches('/');
+        let folded = fold_case(path.to_owned());
+        let components: Vec<&str> = folded.split('/').collect();
+        // patterns match the path and its parent directories, unanchored
+        // ones at any depth
+        let mut literal: Option<usize> = None;
+        for end in 1..=components.len() {
+            let parent = components[..end].join("/");
+            let anchored = self.literals.get(&format!("/{parent}"));
+            let unanchored =
+                (0..end).filter_map(|start| self.literals.get(&components[start..end].join("/")));
+            for &index in anchored.into_iter().chain(unanchored) {
+                literal = Some(literal.map_or(index, |l| l.min(index)));
+            }
+        }
+        // only patterns before the matching literal one can decide
+        self.globs
+            .iter()
+            .take_while(|(index, _)| literal.is_none_or(|l| *index < l))
+            .find(|(_, re)| re.is_match(path))
+            .map(|(index, _)| *index)
+            .or(literal)
+    }
+
+    /// Line of the first pattern matching the path (relative to the folder
+    /// root) and whether it's negated, see [`first_match`]
+    pub fn first_match(&self, path: &str) -> Option<(&str, bool)> {
+        let (line, result) = &self.patterns[self.position(path)?];
+        Some((line.as_str(), !result.ignored))
+    }
+
+    /// Decides the path (relative to the folder root, with `/` separators)
+    /// by the first matching pattern. Paths no pattern matches aren't
+    /// ignored.
+    pub fn matches(&self, path: &str) -> Match {
+        self.position(path)
+            .map(|index| self.patterns[index].1)
+            .unwrap_or_default()
+    }
+
+    /// Checks if the patterns ignore the path (relative to the folder root)
+    pub fn is_ignored(&self, path: &str) -> bool {
+        self.matches(path).ignored
+    }
+}
+
+/// Pattern deciding whether the path is ignored: syncthing applies the first
+/// matching one. Returns the line along with the parsed pattern.
+pub fn first_match<'a>(lines: &'a [String], path: &str) -> Option<(&'a str, Pattern<'a>)> {
+    lines.iter().find_map(|l| {
+        Pattern::parse(l)
+            .filter(|p| p.matches(path))
+            .map(|p| (l.as_str(), p))
+    })
+}
+
+/// Checks if the patterns ignore the path (relative to the folder root)
+pub fn is_ignored(lines: &[String], path: &str) -> bool {
+    matches!(first_match(lines, path), Some((_, p)) if !p.negated)
+}
+
+/// Converts a brace-free glob into a regular expression: `*`, `?` and
+/// negated classes don't match path separators, `**` does
+fn glob_to_regex(glob: &str) -> String {
+    let mut re = String::with_capacity(glob.len() * 2);
+    let mut chars = glob.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' if chars.peek() == Some(&'*') => {
+                chars.next();
+                re.push_str(".*");
+            }
+            '*' => re.push_str("[^/]*"),
+            '?' => re.push_str("[^/]"),
+            '\\' => re.push_str(&regex::escape(&chars.next().unwrap_or('\\').to_string())),
+            '[' => {
+                re.push('[');
+                // negated classes don't match path separators either
+                if let Some('!' | '^') = chars.peek() {
+                    re.push_str("^/");
+                    chars.next();
+                }
+                let mut first = true;
+                let mut prev = None;
+                while let Some(c) = chars.next() {
+                    if c == ']' && !first {
+                        break;
+                    }
+                    // a dash between two characters is a range, `&&`, `--`
+                    // and `~~` would be set operations of the regex
+                    let range = c == '-'
+                        && !first
+                        && prev != Some('-')
+                        && chars.peek().is_some_and(|&next| next != ']');
+                    if !range && "\\[]^-&~".contains(c) {
+                        re.push('\\');
+                    }
+                    re.push(c);
+                    prev = Some(c);
+                    first = false;
+                }
+                re.push(']');
+            }
+            c => re.push_str(&regex::escape(&c.to_string())),
+        }
+    }
+    re
+}
+
+/// Expands `{a,b}` alternatives into separate globs, as tools other than
+/// syncthing usually don't support them.
+pub fn expand_braces(glob: &str) -> Vec<String> {
+    let Some((open, close)) = find_braces(glob) else {
+        return vec![glob.to_owned()];
+    };
+    let (prefix, body, suffix) = (&glob[..open], &glob[open + 1..close], &glob[close + 1..]);
+
+    let mut alternatives = Vec::new();
+    let mut depth = 0;
+    let mut start = 0;
+    let mut escaped = false;
+    for (i, c) in body.char_indices() {
+        match c {
+            _ if escaped => escaped = false,
+            '\\' => escaped = true,
+            '{' => depth += 1,
+            '}' => depth -= 1,
+            ',' if depth == 0 => {
+                alternatives.push(&body[start..i]);
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    alternatives.push(&body[start..]);
+
+    alternatives
+        .into_iter()
+        .flat_map(|alt| expand_braces(&format!("{prefix}{alt}{suffix}")))
+        .collect()
+}
+
+/// Finds byte offsets of the first top-level `{` and its matching `}`
+fn find_braces(glob: &str) -> Option<(usize, usize)> {
+    let mut open = None;
+    let mut depth = 0;
+    let mut escaped = false;
+    let mut in_class = false;
+    for (i, c) in glob.char_indices() {
+        match c {
+            _ if escaped => escaped = false,
+            '\\' => escaped = true,
+            '[' if !in_class => in_class = true,
+            ']' if in_class => in_class = false,
+            _ if in_class => {}
+            '{' => {
+                if depth == 0 {
+                    open = Some(i);
+                }
+                depth += 1;
+            }
+            '}' if depth > 0 => {
+                depth -= 1;
+                if depth == 0 {
+                    return open.map(|o| (o, i));
+                }
+            }
+            _ => {}
+        }
+    }
+    None
+}
+
+/// Turns a path relative to the folder root into a pattern matching exactly
+/// that path. Syncthing doesn't support escaping on Windows, where `\` is the
+/// path separator.
+pub fn literal(path: &str) -> String {
+    let mut out = String::from("/");
+    for c in path.trim_start_matches('/').chars() {
+        if !cfg!(windows) && matches!(c, '\\' | '*' | '?' | '[' | ']' | '{' | '}') {
+            out.push('\\');
+        }
+        out.push(c);
+    }
+    out
+}
+
+/// Rewrites the glob to match letters in both cases using character classes,
+/// for tools lacking a case-insensitive mode.
+pub fn case_fold(glob: &str) -> String {
+    let mut out = String::with_capacity(glob.len() * 2);
+    let mut chars = glob.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => {
+                out.push(c);
+                out.extend(chars.next());
+            }
+            '[' => {
+                out.push(c);
+                if let Some(&n) = chars.peek() {
+                    if n == '!' || n == '^' {
+                        out.push(n);
+                        chars.next();
+                    }
+                }
+                let mut class = Vec::new();
+                for c in chars.by_ref() {
+                    if c == ']' && !class.is_empty() {
+                        break;
+                    }
+                    class.push(c);
+                }
+                let mut i = 0;
+                while i < class.len() {
+                    if i + 2 < class.len() && class[i + 1] == '-' {
+                        let (from, to) = (class[i], class[i + 2]);
+                        out.extend([from, '-', to]);
+                        if let (Some(f), Some(t)) = (other_case(from), other_case(to)) {
+                            out.extend([f, '-', t]);
+                        }
+                        i += 3;
+                    } else {
+                        out.push(class[i]);
+                        out.extend(other_case(class[i]));
+                        i += 1;
+                    }
+                }
+                out.push(']');
+            }
+            _ => match other_case(c) {
+                Some(o) => out.extend(['[', c, o, ']']),
+                None => out.push(c),
+            },
+        }
+    }
+    out
+}
+
+fn other_case(c: char) -> Option<char> {
+    let mut other: Box<dyn Iterator<Item = char>> = if c.is_lowercase() {
+        Box::new(c.to_uppercase())
+    } else if c.is_uppercase() {
+        Box::new(c.to_lowercase())
+    } else {
+        return None;
+    };
+    match (other.next(), other.next()) {
+        (Some(o), None) if o != c => Some(o),
+        _ => None,
+    }
+}
+
+/// Cases from Syncthing's documentation and lib/ignore tests
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn matcher(patterns: &str) -> Matcher {
+        let lines: Vec<String> = patterns.lines().map(str::to_owned).collect();
+        Matcher::new(&lines)
+    }
+
+    /// Checks the paths, `true` for ones that should be ignored
+    fn check(matcher: &Matcher, cases: &[(&str, bool)]) {
+        for &(path, ignored) in cases {
+            assert_eq!(matcher.is_ignored(path), ignored, "{path}");
+        }
+    }
+
+    #[test]
+    fn syncthing_test_data() {
+        // lib/ignore/testdata with .stignore and the files it includes
+        let dir = std::env::temp_dir().join(format!("stignore-matcher-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let files = [
+            (
+                ".stignore",
+                "#include excludes\n\nbfile\ndir1/cfile\n**/efile\n/ffile\n\nlost+found\n",
+            ),
+            ("excludes", "dir2/dfile\n#include further-excludes\n"),
+            ("further-excludes", "dir3\n"),
+        ];
+        for (name, content) in files {
+            std::fs::write(dir.join(name), content).unwrap();
+        }
+        let matcher = Matcher::load(&dir.join(".stignore")).unwrap();
+        std::fs::remove_dir_all(&dir).ok();
+        check(
+            &matcher,
+            &[
+                ("afile", false),
+                ("bfile", true),
+                ("cfile", false),
+                ("dfile", false),
+                ("efile", true),
+                ("ffile", true),
+                ("dir1", false),
+                ("dir1/cfile", true),
+                ("dir1/dfile", false),
+                ("dir1/efile", true),
+                ("dir1/ffile", false),
+                ("dir2", false),
+                ("dir2/cfile", false),
+                ("dir2/dfile", true),
+                ("dir2/efile", true),
+                ("dir2/ffile", false),
+                ("dir3", true),
+                ("dir3/afile", true),
+                ("lost+found", true),
+            ],
+        );
+    }
+
+    #[test]
+    fn missing_file_has_no_patterns() {
+        let matcher = Matcher::load(Path::new("no/such/.stignore")).unwrap();
+        assert_eq!(matcher.matches("file"), Match::default());
+    }
+
+    #[test]
+    fn first_match_wins() {
+        let m = matcher("!/foo/bar\n/foo\n!/foo/baz");
+        check(
+            &m,
+            &[
+                ("foo", true),
+                ("foo/bar", false),
+                ("foo/bar/file", false),
+                ("foo/baz", true),
+            ],
+        );
+    }
+
+    #[test]
+    fn literal_and_wildcard_patterns_keep_their_order() {
+        let patterns = "!/a/keep\n/a\n!*.c\nb/c\n*.o\n!x.o\nx.o\n(?i)/Upper\nlost+found";
+        let m = matcher(patterns);
+        let lines: Vec<String> = patterns.lines().map(str::to_owned).collect();
+        for path in [
+            "a",
+            "a/keep",
+            "a/keep/x",
+            "a/b.c",
+            "b/c",
+            "x/b/c",
+            "x/b/c.c",
+            "b/c/d",
+            "x.o",
+            "d/x.o",
+            "upper",
+            "UPPER/x",
+            "lost+found",
+            "lost_found",
+            "bc",
+        ] {
+            assert_eq!(m.is_ignored(path), is_ignored(&lines, path), "{path}");
+        }
+        check(
+            &m,
+            &[
+                ("a/b.c", true),
+                ("x/b/c", true),
+                ("x.o", true),
+                ("lost_found", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn wildcards() {
+        let m = matcher("*2\nte?t\n**/deep\n/root*/**/leaf\n[ab]x\n[!c]y");
+        check(
+            &m,
+            &[
+                ("test2", true),
+                ("2", true),
+                ("dir/sub2", true),
+                ("test", true),
+                ("teest", false),
+                ("te/t", false),
+                ("a/b/deep", true),
+                ("rootdir/a/b/leaf", true),
+                ("rootdir/leaf", false),
+                ("ax", true),
+                ("cx", false),
+                ("by", true),
+                ("cy", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn classes_with_regex_operators() {
+        let m = matcher("/[&&a]1\n/[a~~b]2\n/[x-]3\n/[-a]4\n/[a-c]5\n/[^]x]6");
+        check(
+            &m,
+            &[
+                ("&1", true),
+                ("a1", true),
+                ("b1", false),
+                ("~2", true),
+                ("b2", true),
+                ("-3", true),
+                ("x3", true),
+                ("-4", true),
+                ("b5", true),
+                ("d5", false),
+                ("y6", true),
+                ("x6", false),
+                ("]6", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn negated_classes_stay_in_directory() {
+        let m = matcher("/a[!b]c\n/d[^x]e");
+        check(
+            &m,
+            &[
+                ("axc", true),
+                ("abc", false),
+                ("a/c", false),
+                ("dye", true),
+                ("d/e", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn anchored_and_unanchored() {
+        let m = matcher("/top\nany");
+        check(
+            &m,
+            &[
+                ("top", true),
+                ("top/file", true),
+                ("dir/top", false),
+                ("any", true),
+                ("dir/any", true),
+                ("dir/any/file", true),
+                ("dir/many", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn braces() {
+        let m = matcher("*.{jpg,png}\n/{a,b{c,d}}");
+        check(
+            &m,
+            &[
+                ("x.jpg", true),
+                ("dir/x.png", true),
+                ("x.gif", false),
+                ("a", true),
+                ("bc", true),
+                ("bd", true),
+                ("b", false),
+            ],
+        );
+    }
+
+    #[test]
+    fn flags() {
+        let m = matcher("(?i)/Case\n(?d)*.tmp\n!(?i)keep.TXT\n*.txt");
+        check(
+            &m,
+            &[
+                ("case", true),
+                ("CASE/file", true),
+                ("Keep.txt", false),
+                ("a.txt", true),
+            ],
+        );
+        assert_eq!(
+            m.matches("x.tmp"),
+            Match {
+                ignored: true,
+                deletable: true
+            }
+        );
+        assert!(!m.matches("a.txt").deletable);
+    }
+
+    #[test]
+    fn comments_and_blank_lines() {
+        let m = matcher("// comment\n\n  \n// *\n#include\nfile");
+        check(&m, &[("comment", false), ("x", false), ("file", true)]);
+    }
+
+    #[cfg(not(windows))]
+    #[test]
+    fn escapes() {
+        let m = matcher("a\\*b\n\\[x\\]");
+        check(
+            &m,
+            &[("a*b", true), ("axb", false), ("[x]", true), ("x", false)],
+        );
+    }
+
+    #[cfg(any(target_os = "macos", windows))]
+    #[test]
+    fn case_ignored_where_file_systems_ignore_it() {
+        let m = matcher("/Photos\n*.JPG\n/R[a-c]w");
+        check(
+            &m,
+            &[
+                ("photos/a", true),
+                ("PHOTOS", true),
+                ("x.jpg", true),
+                ("rAw", true),
+            ],
+        );
+    }
+
+    #[cfg(not(any(target_os = "macos", windows)))]
+    #[test]
+    fn case_matters_elsewhere() {
+        let m = matcher("/Photos\n*.JPG\n/R[a-c]w");
+        check(
+            &m,
+            &[
+                ("photos/a", false),
+                ("Photos/a", true),
+                ("x.jpg", false),
+                ("x.JPG", true),
+                ("rAw", false),
+                ("Raw", true),
+            ],
+        );
+    }
+}
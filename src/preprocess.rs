@@ -0,0 +1,133 @@
+use anyhow::{bail, Result};
+
+/// Properties of the device conditions are evaluated against
+pub struct Device {
+    pub os: String,
+    pub host: String,
+}
+
+/// Expands `#if KEY==VALUE` / `#if KEY!=VALUE` blocks (with optional `#else`
+/// and closed by `#endif`) for the device. Supported keys are `os` (`linux`,
+/// `macos`, `windows`, ...) and `host`, values are compared case-insensitively.
+/// Blocks may be nested.
+pub fn render(content: &str, device: &Device) -> Result<String> {
+    let mut out = String::new();
+    // open blocks, a line is kept only if all of them are in active branches
+    let mut stack: Vec<Block> = Vec::new();
+
+    for (n, line) in content.split_inclusive('\n').enumerate() {
+        let n = n + 1;
+        let active = stack.iter().all(|b| b.active);
+        match directive(line.trim()) {
+            Some(Directive::If(condition)) => stack.push(Block {
+                active: evaluate(condition, device, n)?,
+                seen_else: false,
+            }),
+            Some(Directive::Else) => match stack.last_mut() {
+                Some(b) if !b.seen_else => {
+                    b.active = !b.active;
+                    b.seen_else = true;
+                }
+                _ => bail!("Line {n}: #else without #if"),
+            },
+            Some(Directive::EndIf) => {
+                if stack.pop().is_none() {
+                    bail!("Line {n}: #endif without #if");
+                }
+            }
+            None if active => out.push_str(line),
+            None => {}
+        }
+    }
+    if !stack.is_empty() {
+        bail!("#if without #endif");
+    }
+    Ok(out)
+}
+
+struct Block {
+    active: bool,
+    seen_else: bool,
+}
+
+enum Directive<'a> {
+    If(&'a str),
+    Else,
+    EndIf,
+}
+
+fn directive(line: &str) -> Option<Directive<'_>> {
+    match line {
+        "#else" => Some(Directive::Else),
+        "#endif" => Some(Directive::EndIf),
+        _ => line
+            .strip_prefix("#if")
+            .filter(|rest| rest.starts_with(char::is_whitespace))
+            .map(|rest| Directive::If(rest.trim())),
+    }
+}
+
+fn evaluate(condition: &str, device: &Device, line: usize) -> Result<bool> {
+    let (key, value, equal) = match condition.split_once("!=") {
+        Some((key, value)) => (key, value, false),
+        None => match condition.split_once("==") {
+            Some((key, value)) => (key, value, true),
+            None => bail!("Line {line}: expected KEY==VALUE or KEY!=VALUE, got {condition}"),
+        },
+    };
+    let actual = match key.trim() {
+        "os" => &device.os,
+        "host" => &device.host,
+        key => bail!("Line {line}: unknown key {key}, expected os or host"),
+    };
+    Ok(actual.eq_ignore_ascii_case(value.trim()) == equal)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn laptop() -> Device {
+        Device {
+            os: "linux".to_owned(),
+            host: "laptop".to_owned(),
+        }
+    }
+
+    #[test]
+    fn blocks_are_rendered_for_device() {
+        let content = "*.tmp\n\
+            #if os==Windows\n\
+            Thumbs.db\n\
+            #else\n\
+            .cache\n\
+            #if host!=laptop\n\
+            big\n\
+            #endif\n\
+            #endif\n\
+            build\n";
+        assert_eq!(
+            render(content, &laptop()).unwrap(),
+            "*.tmp\n.cache\nbuild\n"
+        );
+    }
+
+    #[test]
+    fn unbalanced_and_unknown_directives_fail() {
+        for content in [
+            "#if os==linux\n",
+            "#endif\n",
+            "#else\n",
+            "#if os==linux\n#else\n#else\n#endif\n",
+            "#if arch==x86\n#endif\n",
+            "#if os\n#endif\n",
+        ] {
+            assert!(render(content, &laptop()).is_err(), "{content}");
+        }
+        // other `#` lines are patterns or directives of syncthing
+        assert_eq!(
+            render("#include a\n#iffy\n", &laptop()).unwrap(),
+            "#include a\n#iffy\n"
+        );
+    }
+}
@@ -0,0 +1,87 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::Result;
+
+use crate::{
+    diff, files, includes,
+    pattern::{self, Pattern},
+    IgnoreFile,
+};
+
+/// The line with its anchored pattern moved from the path `old` to `new`
+/// (relative to the folder root), prefix flags kept. Patterns of paths under
+/// `old` move along, e.g. `/old/*.tmp`. `None` if the pattern isn't about
+/// `old` or paths under it.
+pub fn move_pattern(line: &str, old: &str, new: &str) -> Option<String> {
+    let line = line.trim();
+    let glob = Pattern::parse(line)?.glob;
+    let flags = &line[..line.len() - glob.len()];
+    let rest = glob.strip_prefix(pattern::literal(old).as_str())?;
+    if !rest.is_empty() && !rest.starts_with('/') {
+        return None;
+    }
+    Some(format!("{flags}{}{rest}", pattern::literal(new)))
+}
+
+/// Ignore file with patterns moved to the new path, locked until written
+pub struct Rewrite {
+    pub path: PathBuf,
+    lock: files::Lock,
+    before: String,
+    file: IgnoreFile,
+}
+
+impl Rewrite {
+    pub fn diff(&self) -> String {
+        diff::diff(&self.before, &self.file.to_string())
+    }
+
+    pub fn write(&self) -> Result<()> {
+        self.lock.write(self.file.to_string())
+    }
+}
+
+/// Changes of the ignore files moving patterns from the path `old` to `new`
+pub struct Plan {
+    /// Files with moved patterns
+    pub files: Vec<Rewrite>,
+    /// Patterns without the leading `/` starting with the old path. They
+    /// match it at any depth, so it's up to the user to change them.
+    pub unanchored: Vec<String>,
+}
+
+/// Moves patterns of .stignore and the files it includes from the path
+/// `old` to `new`, see [move_pattern]. Nothing is written yet.
+pub fn plan(root: &Path, old: &str, new: &str) -> Result<Plan> {
+    let mut plan = Plan {
+        files: Vec::new(),
+        unanchored: Vec::new(),
+    };
+    let unanchored = pattern::literal(old)[1..].to_owned();
+    for path in includes::readable_files(&root.join(".stignore")) {
+        let lock = files::lock(&path)?;
+        let mut file = crate::read_locked(&lock, &path)?;
+        let before = file.to_string();
+        let mut moved = false;
+        for index in 0..file.len() {
+            let line = file.entries()[index].line();
+            if let Some(line) = move_pattern(line, old, new) {
+                file.replace(index, &line);
+                moved = true;
+            } else if Pattern::parse(line).is_some_and(|p| {
+                p.glob == unanchored || p.glob.starts_with(&format!("{unanchored}/"))
+            }) {
+                plan.unanchored.push(line.trim().to_owned());
+            }
+        }
+        if moved {
+            plan.files.push(Rewrite {
+                path,
+                lock,
+                before,
+                file,
+            });
+        }
+    }
+    Ok(plan)
+}
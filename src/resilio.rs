@@ -0,0 +1,37 @@
+/// Converts Resilio Sync's `.sync/IgnoreList` into syncthing patterns.
+///
+/// Resilio's syntax is a subset of syncthing's: patterns starting with a
+/// slash are anchored to the folder root, the rest match at any depth.
+/// Windows-style separators are converted to slashes.
+pub fn import(content: &str) -> Vec<String> {
+    content
+        .trim_start_matches('\u{feff}')
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .map(|line| match line.strip_prefix('#') {
+            Some(comment) => format!("//{comment}"),
+            None => line.replace('\\', "/"),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ignore_list_becomes_patterns() {
+        let content =
+            "\u{feff}# Resilio defaults\r\n.DS_Store\r\n\r\n\\Photos\\*.tmp\r\n/build\r\n";
+        assert_eq!(
+            import(content),
+            [
+                "// Resilio defaults",
+                ".DS_Store",
+                "/Photos/*.tmp",
+                "/build"
+            ]
+        );
+    }
+}
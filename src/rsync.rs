@@ -0,0 +1,231 @@
+use anyhow::{bail, Result};
+
+use crate::pattern::{case_fold, expand_braces, Pattern};
+
+/// Files syncthing never synchronizes, regardless of the ignore patterns
+const INTERNAL_FILES: [&str; 5] = [
+    "/.stfolder",
+    "/.stignore",
+    "/.stversions",
+    ".syncthing.*.tmp",
+    "~syncthing~*.tmp",
+];
+
+/// Converts syncthing ignore lines into rsync's `--exclude-from` filter rules.
+///
+/// Both syncthing and rsync act on the first matching rule and anchor patterns
+/// with a leading slash to the folder root, so the order and the globs are
+/// kept, negated patterns become include rules, `{a,b}` alternatives are
+/// expanded and `(?i)` patterns are rewritten with character classes.
+/// `(?d)` has no rsync counterpart and is dropped.
+pub fn export(lines: &[String]) -> String {
+    let mut out = String::from(
+        "# rsync filter rules exported by stignore\n\
+        # Usage: rsync --exclude-from=THIS_FILE path_to/syncthing_folder/ destination\n",
+    );
+    for rule in INTERNAL_FILES {
+        out.push_str("- ");
+        out.push_str(rule);
+        out.push('\n');
+    }
+
+    for line in lines {
+        if let Some(comment) = line.strip_prefix("//") {
+            out.push('#');
+            out.push_str(comment);
+            out.push('\n');
+            continue;
+        }
+        let Some(pattern) = Pattern::parse(line) else {
+            continue;
+        };
+        for glob in expand_braces(pattern.glob) {
+            out.push_str(if pattern.negated { "+ " } else { "- " });
+            if pattern.case_insensitive {
+                out.push_str(&case_fold(&glob));
+            } else {
+                out.push_str(&glob);
+            }
+            out.push('\n');
+        }
+    }
+    out
+}
+
+/// Long names of filter rules and their short forms
+const RULES: [(&str, char); 9] = [
+    ("exclude", '-'),
+    ("include", '+'),
+    ("merge", '.'),
+    ("dir-merge", ':'),
+    ("hide", 'H'),
+    ("show", 'S'),
+    ("protect", 'P'),
+    ("risk", 'R'),
+    ("clear", '!'),
+];
+
+/// Characters of rule modifiers, e.g. `/` in `-/ pattern`
+const MODIFIERS: &str = "/!Csrpxenw+-";
+
+/// Splits a filter rule into its short rule name, modifiers and pattern.
+/// Lines without a rule prefix are `None`, they are plain exclude patterns.
+fn split_rule(line: &str) -> Option<(char, &str, &str)> {
+    let separator = |c: char| c == ' ' || c == '_';
+    let long = RULES.iter().find_map(|&(name, rule)| {
+        let rest = line.strip_prefix(name)?;
+        match rest.strip_prefix(',') {
+            Some(rest) => Some((rule, rest)),
+            None if rest.is_empty() || rest.starts_with(separator) => Some((rule, rest)),
+            None => None,
+        }
+    });
+    let (rule, rest) = match long {
+        Some(long) => long,
+        None => {
+            let rule = line.chars().next()?;
+            if !RULES.iter().any(|&(_, r)| r == rule) {
+                return None;
+            }
+            (rule, &line[rule.len_utf8()..])
+        }
+    };
+    let end = rest.find(separator).unwrap_or(rest.len());
+    let (modifiers, pattern) = rest.split_at(end);
+    if !modifiers.chars().all(|c| MODIFIERS.contains(c)) {
+        // e.g. `-foo` is a pattern starting with a dash
+        return None;
+    }
+    Some((rule, modifiers, pattern.get(1..).unwrap_or_default()))
+}
+
+/// Converts rsync's `--exclude-from` file into patterns for `stignore`.
+///
+/// `+ `/`- ` rule prefixes and their long forms `include `/`exclude ` are
+/// honored, as are `hide` and `show` rules. Rules with modifiers (e.g.
+/// `-/ ` or `+! `) and other rules (merge, protect, clear...) have no
+/// syncthing counterpart and are refused. `dir/***` becomes `dir` (syncthing
+/// ignores directory contents anyway) and a trailing slash is dropped, as
+/// syncthing can't limit a pattern to directories only. Unanchored rsync
+/// rules match at any depth; when the patterns are going to be prefixed with
+/// the path to CWD, an extra `**/` copy of such rules preserves that.
+pub fn import(content: &str, prefixed: bool) -> Result<Vec<String>> {
+    let mut patterns = Vec::new();
+    let mut errs = Vec::new();
+
+    for line in content.lines() {
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        if let Some(comment) = line.strip_prefix(['#', ';']) {
+            patterns.push(format!("//{comment}"));
+            continue;
+        }
+        let (negated, glob) = match split_rule(line) {
+            None => (false, line),
+            Some(('-' | 'H', "", glob)) => (false, glob),
+            Some(('+' | 'S', "", glob)) => (true, glob),
+            Some(_) => {
+                errs.push(line);
+                continue;
+            }
+        };
+
+        let glob = glob.strip_suffix("/***").unwrap_or(glob);
+        let glob = match glob.strip_suffix('/') {
+            Some(g) if !g.ends_with('\\') => g,
+            _ => glob,
+        };
+        if glob.is_empty() {
+            errs.push(line);
+            continue;
+        }
+
+        let negated = if negated { "!" } else { "" };
+        patterns.push(format!("{negated}{glob}"));
+        if prefixed && !glob.starts_with('/') && !glob.starts_with("**") {
+            patterns.push(format!("{negated}**/{glob}"));
+        }
+    }
+
+    if !errs.is_empty() {
+        bail!(
+            "Unsupported rsync rule{}:\n{}",
+            if errs.len() > 1 { "s" } else { "" },
+            errs.join("\n")
+        );
+    }
+    Ok(patterns)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn export_keeps_order() {
+        let lines: Vec<String> = [
+            "// media",
+            "*.{mkv,mp4}",
+            "!/keep",
+            "(?d).DS_Store",
+            "(?i)ab",
+        ]
+        .map(str::to_owned)
+        .into();
+        let exported = export(&lines);
+        let rules: Vec<&str> = exported
+            .lines()
+            .filter(|l| !l.starts_with("# rsync") && !l.starts_with("# Usage"))
+            .skip(INTERNAL_FILES.len())
+            .collect();
+        assert_eq!(
+            rules,
+            [
+                "# media",
+                "- *.mkv",
+                "- *.mp4",
+                "+ /keep",
+                "- .DS_Store",
+                "- [aA][bB]"
+            ]
+        );
+        assert!(exported.contains("- /.stfolder\n"));
+    }
+
+    #[test]
+    fn short_and_long_rules() {
+        let content =
+            "- *.tmp\n+ keep/\nexclude cache/***\ninclude src/\nH_hidden\nS shown\nplain\n-dash";
+        assert_eq!(
+            import(content, false).unwrap(),
+            ["*.tmp", "!keep", "cache", "!src", "hidden", "!shown", "plain", "-dash"]
+        );
+    }
+
+    #[test]
+    fn unanchored_rules_match_at_any_depth() {
+        assert_eq!(
+            import("- *.tmp\n- /build", true).unwrap(),
+            ["*.tmp", "**/*.tmp", "/build"]
+        );
+    }
+
+    #[test]
+    fn rules_without_counterpart_are_refused() {
+        for rule in [
+            "-/ /abs",
+            "+! keep",
+            "exclude,/ abs",
+            ". merged",
+            "dir-merge .rsync-filter",
+            "P protected",
+            "!",
+            "clear",
+            "- ",
+        ] {
+            assert!(import(rule, false).is_err(), "{rule}");
+        }
+    }
+}
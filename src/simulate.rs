@@ -0,0 +1,219 @@
+use std::{collections::BTreeMap, path::Path};
+
+use anyhow::{bail, Result};
+
+use crate::{api, files, includes, pattern::Matcher};
+
+/// Regular file of the folder
+pub struct File {
+    /// Path relative to the folder root with `/` separators
+    pub path: String,
+    pub size: u64,
+}
+
+/// Files of the folder, except .stignore which Syncthing never syncs
+pub fn files(root: &Path) -> Result<Vec<File>> {
+    Ok(files::walk(root)?
+        .into_iter()
+        .map(|path| File {
+            size: path.metadata().map_or(0, |m| m.len()),
+            path: crate::relative(root, &path),
+        })
+        .filter(|f| f.path != ".stignore")
+        .collect())
+}
+
+/// Table of the number and total size of the files in each directory
+pub fn summary<'a>(files: impl IntoIterator<Item = &'a File>) -> String {
+    let mut dirs: BTreeMap<&str, (usize, u64)> = BTreeMap::new();
+    for file in files {
+        let dir = file.path.rsplit_once('/').map_or(".", |(dir, _)| dir);
+        let counts = dirs.entry(dir).or_default();
+        counts.0 += 1;
+        counts.1 += file.size;
+    }
+    let mut out = format!("{:>8} {:>10}  DIRECTORY\n", "FILES", "SIZE");
+    for (dir, (count, size)) in dirs {
+        out.push_str(&format!(
+            "{count:>8} {:>10}  {dir}\n",
+            files::format_size(size)
+        ));
+    }
+    out
+}
+
+/// Lists the files of the folder that become ignored and the ones that stop
+/// being ignored when its patterns (with includes expanded) change from
+/// `before` to `after`, with their number and size
+pub fn impact(root: &Path, before: &[String], after: &[String]) -> Result<String> {
+    let (before, after) = (Matcher::new(before), Matcher::new(after));
+    let mut ignored = Vec::new();
+    let mut unignored = Vec::new();
+    for file in files(root)? {
+        match (before.is_ignored(&file.path), after.is_ignored(&file.path)) {
+            (false, true) => ignored.push(file),
+            (true, false) => unignored.push(file),
+            _ => {}
+        }
+    }
+    let mut out = String::new();
+    for (files, change) in [
+        (ignored, "become ignored"),
+        (unignored, "stop being ignored"),
+    ] {
+        if files.is_empty() {
+            continue;
+        }
+        let size = files::format_size(files.iter().map(|f| f.size).sum());
+        out.push_str(&format!("{} files ({size}) would {change}:\n", files.len()));
+        for file in files {
+            out.push_str(&format!("  {}\n", file.path));
+        }
+    }
+    if out.is_empty() {
+        out.push_str("No files would become ignored or stop being ignored\n");
+    }
+    Ok(out)
+}
+
+/// Prints the files of the folder its patterns ignore, or the summary of
+/// them by directory. With `compare`, Syncthing is asked about every file
+/// and the ones it decides differently are reported.
+pub fn run(
+    root: &Path,
+    by_dir: bool,
+    compare: Option<(&api::Client, &str)>,
+    silent: bool,
+) -> Result<()> {
+    let matcher = Matcher::new(&includes::flatten(&root.join(".stignore"))?);
+    let all = files(root)?;
+    let ignored: Vec<&File> = all.iter().filter(|f| matcher.is_ignored(&f.path)).collect();
+    if by_dir {
+        if !ignored.is_empty() {
+            print!("{}", summary(ignored.iter().copied()));
+        }
+    } else {
+        for file in &ignored {
+            println!("{}", file.path);
+        }
+    }
+    if !silent {
+        println!(
+            "{} of {} files ignored ({})",
+            ignored.len(),
+            all.len(),
+            files::format_size(ignored.iter().map(|f| f.size).sum())
+        );
+    }
+
+    let Some((api, folder)) = compare else {
+        return Ok(());
+    };
+    let mut mismatches = 0;
+    let mut unknown = 0;
+    for file in &all {
+        let ours = matcher.is_ignored(&file.path);
+        match api.is_ignored(folder, &file.path)? {
+            Some(theirs) if theirs != ours => {
+                mismatches += 1;
+                println!(
+                    "{}: {} by the patterns, but {} by Syncthing",
+                    file.path,
+                    if ours { "ignored" } else { "not ignored" },
+                    if theirs { "ignored" } else { "not ignored" }
+                );
+            }
+            Some(_) => {}
+            None => unknown += 1,
+        }
+    }
+    if unknown > 0 {
+        eprintln!(
+            "NOTE: Syncthing has no record of {unknown} files (usually ignored or new ones), \
+            they weren't compared"
+        );
+    }
+    if mismatches > 0 {
+        bail!("Syncthing decides {mismatches} files differently");
+    }
+    if !silent {
+        println!(
+            "Syncthing agrees on all {} files it knows about",
+            all.len() - unknown
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::api::fake::Syncthing;
+
+    fn folder(name: &str) -> std::path::PathBuf {
+        let dir = std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("logs")).unwrap();
+        std::fs::write(dir.join(".stignore"), "*.log\n").unwrap();
+        std::fs::write(dir.join("a.log"), "abc").unwrap();
+        std::fs::write(dir.join("logs/b.log"), "de").unwrap();
+        std::fs::write(dir.join("logs/c.txt"), "f").unwrap();
+        dir
+    }
+
+    #[test]
+    fn files_are_summarized_by_directory() {
+        let dir = folder("simulate");
+        let all = files(&dir).unwrap();
+        let mut paths: Vec<&str> = all.iter().map(|f| f.path.as_str()).collect();
+        paths.sort();
+        assert_eq!(paths, ["a.log", "logs/b.log", "logs/c.txt"]);
+        let table = summary(&all);
+        assert!(table.contains(&format!("{:>8} {:>10}  .\n", 1, "3 B")));
+        assert!(table.contains(&format!("{:>8} {:>10}  logs\n", 2, "3 B")));
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn syncthing_disagreeing_is_an_error() {
+        let dir = folder("simulate-compare");
+        let syncthing = Syncthing::start(|r| {
+            let ignored = match r.param("file") {
+                Some("a.log") => true,
+                // Syncthing ignores c.txt, the patterns don't
+                Some("logs/c.txt") => true,
+                _ => return (404, String::new()),
+            };
+            let info = serde_json::json!({ "local": { "ignored": ignored } });
+            (200, info.to_string())
+        });
+        let api = syncthing.client();
+        let err = run(&dir, false, Some((&api, "photos")), true).unwrap_err();
+        assert!(err.to_string().contains("1 files"));
+        assert!(syncthing
+            .requests()
+            .iter()
+            .all(|r| r.path == "/rest/db/file" && r.param("folder") == Some("photos")));
+
+        std::fs::write(dir.join(".stignore"), "*.log\nc.txt\n").unwrap();
+        assert!(run(&dir, true, Some((&api, "photos")), true).is_ok());
+        std::fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn impact_of_changed_patterns() {
+        let dir = folder("impact");
+        let lines = |s: &str| s.lines().map(str::to_owned).collect::<Vec<_>>();
+        let before = lines("*.log");
+        let after = lines("!a.log\n*.log\n*.txt");
+        assert_eq!(
+            impact(&dir, &before, &after).unwrap(),
+            "1 files (1 B) would become ignored:\n  logs/c.txt\n\
+            1 files (3 B) would stop being ignored:\n  a.log\n"
+        );
+        assert_eq!(
+            impact(&dir, &before, &before).unwrap(),
+            "No files would become ignored or stop being ignored\n"
+        );
+        std::fs::remove_dir_all(dir).ok();
+    }
+}
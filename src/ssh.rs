@@ -0,0 +1,262 @@
+use std::{
+    io::Write,
+    process::{Command, Output, Stdio},
+};
+
+use anyhow::{bail, Context, Result};
+
+use crate::{includes::included_path, text};
+
+/// Exit code of remote scripts for a missing file or folder
+const MISSING: i32 = 3;
+
+/// Syncthing folder on another host, accessed with the system's `ssh`
+pub struct Remote {
+    pub host: String,
+    /// Folder root on the remote host
+    pub root: String,
+    /// Path to the requested directory relative to the folder root, starting
+    /// with a slash
+    pub prefix: String,
+}
+
+impl Remote {
+    /// Connects to `[user@]host:/path` and finds the syncthing folder
+    /// containing the path, just like it's done for CWD
+    pub fn connect(spec: &str) -> Result<Self> {
+        let (host, path) = spec
+            .split_once(':')
+            .filter(|(h, p)| !h.is_empty() && !p.is_empty())
+            .with_context(|| format!("Expected [user@]host:/path, got {spec}"))?;
+        // ssh would take it for an option
+        if host.starts_with('-') {
+            bail!("Invalid host {host}");
+        }
+        let mut remote = Remote {
+            host: host.to_owned(),
+            root: String::new(),
+            prefix: String::new(),
+        };
+        let found = crate::markers()
+            .iter()
+            .map(|m| format!("[ -e {} ]", quote(m)))
+            .collect::<Vec<_>>()
+            .join(" || ");
+        let script = format!(
+            "cd {} || exit {MISSING}; \
+            while ! {{ {found}; }}; do [ \"$PWD\" = / ] && exit {MISSING}; cd ..; done; pwd -P",
+            quote_path(path)
+        );
+        let output = remote.run(&script, None)?;
+        if output.status.code() == Some(MISSING) {
+            bail!("{path} on {host} is not inside of a syncthing folder");
+        }
+        remote.check(&output)?;
+        remote.root = String::from_utf8_lossy(&output.stdout).trim().to_owned();
+
+        let output = remote.run(&format!("cd {} && pwd -P", quote_path(path)), None)?;
+        remote.check(&output)?;
+        let dir = String::from_utf8_lossy(&output.stdout).trim().to_owned();
+        remote.prefix = format!(
+            "/{}",
+            dir.strip_prefix(&remote.root)
+                .unwrap_or_default()
+                .trim_start_matches('/')
+        );
+        Ok(remote)
+    }
+
+    /// Path of the file inside of the folder
+    pub fn path(&self, relative: &str) -> String {
+        format!("{}/{}", self.root, relative.trim_start_matches('/'))
+    }
+
+    fn run(&self, script: &str, input: Option<&str>) -> Result<Output> {
+        let mut child = Command::new("ssh")
+            .arg("--")
+            .arg(&self.host)
+            .arg(script)
+            .stdin(if input.is_some() {
+                Stdio::piped()
+            } else {
+                Stdio::null()
+            })
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .context("Can't run ssh")?;
+        if let (Some(input), Some(mut stdin)) = (input, child.stdin.take()) {
+            stdin
+                .write_all(input.as_bytes())
+                .with_context(|| format!("Can't send data to {}", self.host))?;
+        }
+        child
+            .wait_with_output()
+            .with_context(|| format!("Can't run ssh {}", self.host))
+    }
+
+    fn check(&self, output: &Output) -> Result<()> {
+        if !output.status.success() {
+            bail!(
+                "ssh {} failed: {}",
+                self.host,
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(())
+    }
+
+    /// Content of the file, `None` if it doesn't exist
+    pub fn read(&self, path: &str) -> Result<Option<String>> {
+        let path = quote(path);
+        let output = self.run(
+            &format!("[ -e {path} ] || exit {MISSING}; cat {path}"),
+            None,
+        )?;
+        if output.status.code() == Some(MISSING) {
+            return Ok(None);
+        }
+        self.check(&output)?;
+        Ok(Some(text::strip_bom(
+            String::from_utf8_lossy(&output.stdout).into_owned(),
+        )))
+    }
+
+    /// Appends to the file starting from a new line, creates the file and
+    /// its directory if needed
+    pub fn append(&self, path: &str, content: &str) -> Result<()> {
+        let path = quote(path);
+        let script = format!(
+            "mkdir -p \"$(dirname {path})\" && \
+            {{ [ ! -s {path} ] || [ -z \"$(tail -c 1 {path})\" ] || echo >> {path}; }} && \
+            cat >> {path}"
+        );
+        let output = self.run(&script, Some(content))?;
+        self.check(&output)
+    }
+
+    /// Checks if `target` is reachable from `from` through `#include`s
+    pub fn includes(&self, from: &str, target: &str) -> Result<bool> {
+        self.includes_from(from, &normalize(target), &mut Vec::new())
+    }
+
+    fn includes_from(&self, from: &str, target: &str, seen: &mut Vec<String>) -> Result<bool> {
+        if seen.iter().any(|s| s == from) {
+            return Ok(false);
+        }
+        seen.push(from.to_owned());
+        let content = match self.read(from)? {
+            Some(content) => content,
+            None => return Ok(false),
+        };
+        let dir = from.rsplit_once('/').map_or("", |(dir, _)| dir);
+        for line in content.lines() {
+            if let Some(included) = included_path(line) {
+                let included = normalize(&format!("{dir}/{}", included.trim_start_matches('/')));
+                if included == target || self.includes_from(&included, target, seen)? {
+                    return Ok(true);
+                }
+            }
+        }
+        Ok(false)
+    }
+}
+
+/// Quotes the string for a POSIX shell
+fn quote(s: &str) -> String {
+    format!("'{}'", s.replace('\'', r"'\''"))
+}
+
+/// Quotes the path for a POSIX shell, keeping a leading `~/` to be expanded
+/// to the home directory like it would be unquoted
+fn quote_path(path: &str) -> String {
+    match path.strip_prefix('~') {
+        Some("") => "\"$HOME\"".to_owned(),
+        Some(rest) if rest.starts_with('/') => format!("\"$HOME\"{}", quote(rest)),
+        _ => quote(path),
+    }
+}
+
+/// Lexically resolves `.` and `..` in an absolute path
+fn normalize(path: &str) -> String {
+    let mut parts: Vec<&str> = Vec::new();
+    for part in path.split('/') {
+        match part {
+            "" | "." => {}
+            ".." => {
+                parts.pop();
+            }
+            part => parts.push(part),
+        }
+    }
+    format!("/{}", parts.join("/"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn quoting_and_normalizing() {
+        assert_eq!(quote("it's"), r"'it'\''s'");
+        assert_eq!(quote_path("~"), "\"$HOME\"");
+        assert_eq!(quote_path("~/sync dir"), "\"$HOME\"'/sync dir'");
+        assert_eq!(quote_path("~user/sync"), "'~user/sync'");
+        assert_eq!(
+            normalize("/srv/sync/./a/../.stignore"),
+            "/srv/sync/.stignore"
+        );
+        assert_eq!(normalize("/../a"), "/a");
+    }
+
+    /// Runs remote scripts locally, with a fake `ssh` first in `$PATH`
+    #[cfg(unix)]
+    #[test]
+    fn remote_folder_is_edited_through_ssh() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = std::env::temp_dir().join(format!("stignore-ssh-{}", std::process::id()));
+        std::fs::remove_dir_all(&dir).ok();
+        let bin = dir.join("bin");
+        std::fs::create_dir_all(&bin).unwrap();
+        // ssh -- HOST SCRIPT
+        std::fs::write(bin.join("ssh"), "#!/bin/sh\nshift 2\nexec sh -c \"$1\"\n").unwrap();
+        std::fs::set_permissions(bin.join("ssh"), std::fs::Permissions::from_mode(0o755)).unwrap();
+        let path = std::env::var_os("PATH").unwrap_or_default();
+        let mut paths = vec![bin.clone()];
+        paths.extend(std::env::split_paths(&path));
+        std::env::set_var("PATH", std::env::join_paths(paths).unwrap());
+
+        let root = crate::files::canonicalize(&dir).unwrap().join("folder");
+        std::fs::create_dir_all(root.join(".stfolder")).unwrap();
+        std::fs::create_dir_all(root.join("photos/2024")).unwrap();
+        std::fs::write(root.join(".stignore"), "#include common\n").unwrap();
+        std::fs::write(root.join("common"), "#include ./.stignore_sync\n").unwrap();
+
+        let spec = format!("nas:{}", root.join("photos/2024").display());
+        let remote = Remote::connect(&spec).unwrap();
+        assert_eq!(remote.root, root.to_string_lossy());
+        assert_eq!(remote.prefix, "/photos/2024");
+        let stignore = remote.path(".stignore");
+        let sync = remote.path(".stignore_sync");
+        assert!(remote.includes(&stignore, &sync).unwrap());
+        assert!(!remote.includes(&stignore, &remote.path("other")).unwrap());
+
+        assert_eq!(remote.read(&sync).unwrap(), None);
+        remote.append(&sync, "*.tmp\n").unwrap();
+        // appended lines start on a new line
+        std::fs::write(root.join(".stignore_sync"), "*.tmp").unwrap();
+        remote.append(&sync, "build\n").unwrap();
+        assert_eq!(remote.read(&sync).unwrap().unwrap(), "*.tmp\nbuild\n");
+        remote.append(&remote.path("sub/new"), "x\n").unwrap();
+        assert_eq!(
+            std::fs::read_to_string(root.join("sub/new")).unwrap(),
+            "x\n"
+        );
+
+        let outside = format!("nas:{}", dir.join("bin").display());
+        assert!(Remote::connect(&outside).is_err());
+        assert!(Remote::connect("-oProxyCommand=x:/srv").is_err());
+        std::fs::remove_dir_all(dir).ok();
+    }
+}
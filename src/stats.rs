@@ -0,0 +1,138 @@
+use std::{collections::HashSet, fs, path::Path, time::UNIX_EPOCH};
+
+use anyhow::Result;
+use stignore::ignore_file::Kind;
+
+use crate::{includes, versions, IgnoreFile};
+
+/// Counts of the lines of an ignore file
+#[derive(Default)]
+struct Counts {
+    patterns: usize,
+    negated: usize,
+    deletable: usize,
+    case_insensitive: usize,
+    includes: usize,
+    comments: usize,
+    /// Patterns repeating one read before, in this or another file
+    duplicates: usize,
+}
+
+impl Counts {
+    fn add(&mut self, other: &Counts) {
+        self.patterns += other.patterns;
+        self.negated += other.negated;
+        self.deletable += other.deletable;
+        self.case_insensitive += other.case_insensitive;
+        self.includes += other.includes;
+        self.comments += other.comments;
+        self.duplicates += other.duplicates;
+    }
+
+    fn row(&self, name: &str, modified: &str) -> String {
+        format!(
+            "{name:<24} {:>8} {:>7} {:>4} {:>4} {:>8} {:>8} {:>10}  {modified}",
+            self.patterns,
+            self.negated,
+            self.deletable,
+            self.case_insensitive,
+            self.includes,
+            self.comments,
+            self.duplicates,
+        )
+    }
+}
+
+/// Counts the lines of the file, `seen` holds the patterns read before
+fn count(file: &IgnoreFile, seen: &mut HashSet<String>) -> Counts {
+    let mut counts = Counts::default();
+    for entry in file.entries() {
+        match entry.kind() {
+            Kind::Blank => {}
+            Kind::Comment => counts.comments += 1,
+            Kind::Include(_) => counts.includes += 1,
+            Kind::Pattern(pattern) => {
+                counts.patterns += 1;
+                if let Some(pattern) = pattern {
+                    counts.negated += usize::from(pattern.negated);
+                    counts.deletable += usize::from(pattern.deletable);
+                    counts.case_insensitive += usize::from(pattern.case_insensitive);
+                }
+                if !seen.insert(entry.line().trim().to_owned()) {
+                    counts.duplicates += 1;
+                }
+            }
+        }
+    }
+    counts
+}
+
+/// Prints the counts of the lines of .stignore and each file it includes
+pub fn print(root: &Path) -> Result<()> {
+    let header = format!(
+        "{:<24} {:>8} {:>7} {:>4} {:>4} {:>8} {:>8} {:>10}  MODIFIED",
+        "FILE", "PATTERNS", "NEGATED", "(?d)", "(?i)", "INCLUDES", "COMMENTS", "DUPLICATES"
+    );
+    println!("{header}");
+    let mut seen = HashSet::new();
+    let mut total = Counts::default();
+    let files = includes::readable_files(&root.join(".stignore"));
+    for path in &files {
+        let counts = count(&IgnoreFile::load(path)?, &mut seen);
+        let modified = fs::metadata(path)
+            .and_then(|m| m.modified())
+            .ok()
+            .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+            .map_or_else(|| "-".to_owned(), |d| versions::format_utc(d.as_secs()));
+        println!("{}", counts.row(&crate::relative(root, path), &modified));
+        total.add(&counts);
+    }
+    if files.len() > 1 {
+        println!("{}", total.row("total", ""));
+    }
+    if files.is_empty() {
+        println!("{}", Counts::default().row(".stignore", "doesn't exist"));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn lines_are_counted() {
+        let dir = std::env::temp_dir().join(format!("stignore-stats-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let stignore = dir.join(".stignore");
+        let common = dir.join("common");
+        fs::write(
+            &stignore,
+            "// build\n#include common\n\n!keep\n(?d)(?i)*.tmp\nbuild\n",
+        )
+        .unwrap();
+        fs::write(&common, "build\n*.log\n").unwrap();
+
+        let mut seen = HashSet::new();
+        let counts = count(&IgnoreFile::load(&stignore).unwrap(), &mut seen);
+        assert_eq!(
+            (
+                counts.patterns,
+                counts.negated,
+                counts.deletable,
+                counts.case_insensitive
+            ),
+            (3, 1, 1, 1)
+        );
+        assert_eq!(
+            (counts.includes, counts.comments, counts.duplicates),
+            (1, 1, 0)
+        );
+        // `build` was already read from .stignore
+        let mut total = counts;
+        total.add(&count(&IgnoreFile::load(&common).unwrap(), &mut seen));
+        assert_eq!((total.patterns, total.duplicates), (5, 1));
+        assert!(total.row("total", "").starts_with("total"));
+        fs::remove_dir_all(dir).ok();
+    }
+}
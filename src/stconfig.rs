@@ -0,0 +1,210 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use regex::Regex;
+
+use crate::api::{expand_home, Folder};
+
+/// Address and key of the local Syncthing's REST API
+pub struct Gui {
+    pub url: String,
+    pub key: Option<String>,
+}
+
+/// Locates config.xml of the local Syncthing: `$STCONFDIR` or `$STHOMEDIR`
+/// if set, otherwise the platform's default locations
+pub fn find() -> Option<PathBuf> {
+    let mut dirs: Vec<PathBuf> = ["STCONFDIR", "STHOMEDIR"]
+        .iter()
+        .filter_map(std::env::var_os)
+        .map(PathBuf::from)
+        .collect();
+    let env_dir = |var: &str| std::env::var_os(var).map(PathBuf::from);
+    let home = env_dir(if cfg!(windows) { "USERPROFILE" } else { "HOME" });
+
+    if cfg!(windows) {
+        dirs.extend(env_dir("LOCALAPPDATA").map(|d| d.join("Syncthing")));
+    } else if cfg!(target_os = "macos") {
+        dirs.extend(
+            home.as_ref()
+                .map(|h| h.join("Library/Application Support/Syncthing")),
+        );
+    } else {
+        // syncthing 1.27+ keeps the config in the state directory
+        let state =
+            env_dir("XDG_STATE_HOME").or_else(|| home.as_ref().map(|h| h.join(".local/state")));
+        let config =
+            env_dir("XDG_CONFIG_HOME").or_else(|| home.as_ref().map(|h| h.join(".config")));
+        dirs.extend(state.map(|d| d.join("syncthing")));
+        dirs.extend(config.map(|d| d.join("syncthing")));
+    }
+    dirs.into_iter()
+        .map(|d| d.join("config.xml"))
+        .find(|f| f.is_file())
+}
+
+/// Reads the `<gui>` section of config.xml
+pub fn read_gui(path: &Path) -> Result<Gui> {
+    let config =
+        std::fs::read_to_string(path).with_context(|| format!("Can't read {}", path.display()))?;
+    let gui = Regex::new(r"(?s)<gui\b([^>]*)>(.*?)</gui>")
+        .unwrap()
+        .captures(&config)
+        .with_context(|| format!("No <gui> section in {}", path.display()))?;
+    let element = |name: &str| {
+        Regex::new(&format!(r"(?s)<{name}>(.*?)</{name}>"))
+            .unwrap()
+            .captures(&gui[2])
+            .map(|c| unescape(c[1].trim()))
+    };
+
+    let tls = gui[1].contains(r#"tls="true""#);
+    let address = element("address").unwrap_or_else(|| "127.0.0.1:8384".to_owned());
+    // listening on all interfaces, connect to the loopback one
+    let address = match address.rsplit_once(':') {
+        Some(("0.0.0.0" | "[::]" | "", port)) => format!("127.0.0.1:{port}"),
+        _ => address,
+    };
+    Ok(Gui {
+        url: format!("{}://{address}", if tls { "https" } else { "http" }),
+        key: element("apikey").filter(|k| !k.is_empty()),
+    })
+}
+
+/// Reads folders configured in config.xml
+pub fn read_folders(path: &Path) -> Result<Vec<Folder>> {
+    let config =
+        std::fs::read_to_string(path).with_context(|| format!("Can't read {}", path.display()))?;
+    let attribute = Regex::new(r#"\b(\w+)="([^"]*)""#).unwrap();
+    let mut folders = Vec::new();
+    for folder in Regex::new(r"<folder\b([^>]*)>")
+        .unwrap()
+        .captures_iter(&config)
+    {
+        let mut f = Folder {
+            id: String::new(),
+            label: String::new(),
+            path: PathBuf::new(),
+        };
+        for a in attribute.captures_iter(&folder[1]) {
+            match &a[1] {
+                "id" => f.id = unescape(&a[2]),
+                "label" => f.label = unescape(&a[2]),
+                "path" => f.path = expand_home(&unescape(&a[2])),
+                _ => {}
+            }
+        }
+        // <defaults> contains a template folder without ID
+        if !f.id.is_empty() {
+            folders.push(f);
+        }
+    }
+    Ok(folders)
+}
+
+/// Marker names of the folders configured in config.xml
+pub fn read_markers(path: &Path) -> Result<Vec<String>> {
+    let config =
+        std::fs::read_to_string(path).with_context(|| format!("Can't read {}", path.display()))?;
+    let mut markers: Vec<String> = Vec::new();
+    for m in Regex::new(r"<markerName>(.*?)</markerName>")
+        .unwrap()
+        .captures_iter(&config)
+    {
+        let marker = unescape(m[1].trim());
+        if !marker.is_empty() && !markers.contains(&marker) {
+            markers.push(marker);
+        }
+    }
+    Ok(markers)
+}
+
+fn unescape(s: &str) -> String {
+    s.replace("&lt;", "<")
+        .replace("&gt;", ">")
+        .replace("&quot;", "\"")
+        .replace("&apos;", "'")
+        .replace("&amp;", "&")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const CONFIG: &str = r#"<configuration version="37">
+    <folder id="abcd-1234" label="Photos &amp; Videos" path="~/Photos" type="sendreceive">
+        <markerName>.stfolder</markerName>
+    </folder>
+    <folder id="efgh-5678" label="" path="/srv/music" type="receiveonly">
+        <markerName>.music</markerName>
+    </folder>
+    <gui enabled="true" tls="true" debugging="false">
+        <address>0.0.0.0:8385</address>
+        <apikey>abc&amp;def</apikey>
+    </gui>
+    <defaults>
+        <folder id="" label="" path="~">
+            <markerName>.stfolder</markerName>
+        </folder>
+    </defaults>
+</configuration>
+"#;
+
+    /// config.xml with the content in a fresh directory
+    fn config(name: &str, content: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("stignore-{name}-{}", std::process::id()));
+        std::fs::remove_dir_all(&dir).ok();
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("config.xml"), content).unwrap();
+        dir.join("config.xml")
+    }
+
+    #[test]
+    fn gui_address_and_key() {
+        let path = config("config-gui", CONFIG);
+        let gui = read_gui(&path).unwrap();
+        assert_eq!(gui.url, "https://127.0.0.1:8385");
+        assert_eq!(gui.key.as_deref(), Some("abc&def"));
+
+        std::fs::write(
+            &path,
+            "<gui><address>nas:8384</address><apikey></apikey></gui>",
+        )
+        .unwrap();
+        let gui = read_gui(&path).unwrap();
+        assert_eq!(gui.url, "http://nas:8384");
+        assert_eq!(gui.key, None);
+
+        std::fs::write(&path, "<configuration/>").unwrap();
+        assert!(read_gui(&path).is_err());
+        std::fs::remove_dir_all(path.parent().unwrap()).ok();
+    }
+
+    #[test]
+    fn config_dir_from_environment() {
+        let path = config("config-find", CONFIG);
+        std::env::set_var("STCONFDIR", path.parent().unwrap());
+        assert_eq!(find(), Some(path.clone()));
+        std::env::remove_var("STCONFDIR");
+        std::fs::remove_dir_all(path.parent().unwrap()).ok();
+    }
+
+    #[test]
+    fn folders_of_config() {
+        let path = config("config-folders", CONFIG);
+        let folders = read_folders(&path).unwrap();
+        assert_eq!(folders.len(), 2);
+        assert_eq!(folders[0].id, "abcd-1234");
+        assert_eq!(folders[0].label, "Photos & Videos");
+        assert_eq!(folders[0].path, expand_home("~/Photos"));
+        assert_eq!(folders[1].path, Path::new("/srv/music"));
+        std::fs::remove_dir_all(path.parent().unwrap()).ok();
+    }
+
+    #[test]
+    fn marker_names_of_config() {
+        let path = config("config-markers", CONFIG);
+        assert_eq!(read_markers(&path).unwrap(), [".stfolder", ".music"]);
+        std::fs::remove_dir_all(path.parent().unwrap()).ok();
+    }
+}
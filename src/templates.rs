@@ -0,0 +1,17 @@
+/// Files commonly created by operating systems and editors
+pub const JUNK: &str = "\
+// OS and editor junk
+(?d).DS_Store
+(?d)._*
+(?d).Spotlight-V100
+(?d).Trashes
+(?d).fseventsd
+(?d)Thumbs.db
+(?d)ehthumbs.db
+(?d)desktop.ini
+(?d)$RECYCLE.BIN
+(?d).directory
+(?d).Trash-*
+(?d)*~
+(?d).*.swp
+";
@@ -0,0 +1,37 @@
+/// Line ending of new files on this platform
+#[cfg(windows)]
+pub const LINE_ENDING: &str = "\r\n";
+/// Line ending of new files on this platform
+#[cfg(not(windows))]
+pub const LINE_ENDING: &str = "\n";
+
+/// Line ending used by most lines of the content, `None` if it has no line
+/// breaks
+pub fn line_ending(content: &str) -> Option<&'static str> {
+    let lf = content.matches('\n').count();
+    let crlf = content.matches("\r\n").count();
+    match lf {
+        0 => None,
+        _ if crlf * 2 > lf => Some("\r\n"),
+        _ => Some("\n"),
+    }
+}
+
+/// Converts all line breaks of the text to `ending`
+pub fn with_line_ending(text: &str, ending: &str) -> String {
+    text.split_inclusive('\n')
+        .map(|line| match line.strip_suffix('\n') {
+            Some(line) => format!("{}{ending}", line.strip_suffix('\r').unwrap_or(line)),
+            None => line.to_owned(),
+        })
+        .collect()
+}
+
+/// Drops the UTF-8 byte order mark some Windows editors put at the start of
+/// files, it would otherwise become a part of the first pattern
+pub fn strip_bom(content: String) -> String {
+    match content.strip_prefix('\u{feff}') {
+        Some(rest) => rest.to_owned(),
+        None => content,
+    }
+}
@@ -0,0 +1,194 @@
+use std::{
+    fs,
+    io::ErrorKind,
+    path::{Path, PathBuf},
+    process::Command,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+use anyhow::{bail, Context, Result};
+
+use crate::files;
+
+/// Moves the file to the trash of the platform: Recycle Bin on Windows,
+/// Finder's Trash on macOS, the freedesktop.org trash elsewhere
+pub fn trash(path: &Path) -> Result<()> {
+    let path =
+        files::canonicalize(path).with_context(|| format!("Can't find {}", path.display()))?;
+    if cfg!(windows) {
+        let script = format!(
+            "Add-Type -AssemblyName Microsoft.VisualBasic; \
+            [Microsoft.VisualBasic.FileIO.FileSystem]::DeleteFile('{}', 'OnlyErrorDialogs', 'SendToRecycleBin')",
+            path.display().to_string().replace('\'', "''")
+        );
+        run(
+            Command::new("powershell").args(["-NoProfile", "-Command", &script]),
+            &path,
+        )
+    } else if cfg!(target_os = "macos") {
+        let script = format!(
+            "tell application \"Finder\" to delete POSIX file \"{}\"",
+            path.display()
+                .to_string()
+                .replace('\\', "\\\\")
+                .replace('"', "\\\"")
+        );
+        run(Command::new("osascript").args(["-e", &script]), &path)
+    } else {
+        // gio knows about trash directories of other mounts
+        match Command::new("gio").arg("trash").arg(&path).output() {
+            Ok(output) if output.status.success() => Ok(()),
+            // not installed or failed
+            _ => trash_home(&path),
+        }
+    }
+}
+
+fn run(command: &mut Command, path: &Path) -> Result<()> {
+    let output = command
+        .output()
+        .with_context(|| format!("Can't move {} to trash", path.display()))?;
+    if !output.status.success() {
+        bail!(
+            "Can't move {} to trash: {}",
+            path.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Moves the file to the home trash as described by the freedesktop.org
+/// Trash specification
+fn trash_home(path: &Path) -> Result<()> {
+    let data = match std::env::var_os("XDG_DATA_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => {
+            PathBuf::from(std::env::var_os("HOME").context("Can't find trash: HOME isn't set")?)
+                .join(".local/share")
+        }
+    };
+    let (files, info) = (data.join("Trash/files"), data.join("Trash/info"));
+    fs::create_dir_all(&files)
+        .and_then(|_| fs::create_dir_all(&info))
+        .with_context(|| format!("Can't create {}", data.join("Trash").display()))?;
+
+    let name = path.file_name().unwrap_or_default().to_string_lossy();
+    let mut unique = name.to_string();
+    let mut n = 1;
+    // claim the name by creating the info file
+    let info_file = loop {
+        let info_file = info.join(format!("{unique}.trashinfo"));
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(&info_file)
+        {
+            Ok(_) => break info_file,
+            Err(e) if e.kind() == ErrorKind::AlreadyExists => {
+                n += 1;
+                unique = format!("{name}.{n}");
+            }
+            Err(e) => {
+                return Err(e).with_context(|| format!("Can't create {}", info_file.display()))
+            }
+        }
+    };
+    let content = format!(
+        "[Trash Info]\nPath={}\nDeletionDate={}\n",
+        percent_encode(&path.to_string_lossy()),
+        deletion_date()
+    );
+    fs::write(&info_file, content)
+        .with_context(|| format!("Can't write {}", info_file.display()))?;
+    if let Err(e) = fs::rename(path, files.join(&unique)) {
+        fs::remove_file(&info_file).ok();
+        return Err(e).with_context(|| {
+            format!(
+                "Can't move {} to trash (is it on another filesystem?)",
+                path.display()
+            )
+        });
+    }
+    Ok(())
+}
+
+fn percent_encode(path: &str) -> String {
+    let mut out = String::with_capacity(path.len());
+    for b in path.bytes() {
+        if b.is_ascii_alphanumeric() || b"/-_.~".contains(&b) {
+            out.push(b as char);
+        } else {
+            out.push_str(&format!("%{b:02X}"));
+        }
+    }
+    out
+}
+
+/// Current UTC time as `YYYY-MM-DDThh:mm:ss`
+fn deletion_date() -> String {
+    let secs = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_secs());
+    let (days, rem) = (secs / 86400, secs % 86400);
+    // civil date from days since the epoch, proleptic Gregorian calendar
+    let z = days + 719468;
+    let era = z / 146097;
+    let day_of_era = z - era * 146097;
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36524 - day_of_era / 146096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = year_of_era + era * 400 + u64::from(month <= 2);
+    format!(
+        "{year:04}-{month:02}-{day:02}T{:02}:{:02}:{:02}",
+        rem / 3600,
+        rem % 3600 / 60,
+        rem % 60
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn home_trash_keeps_both_files_with_same_name() {
+        let dir = std::env::temp_dir().join(format!("stignore-trash-{}", std::process::id()));
+        fs::remove_dir_all(&dir).ok();
+        fs::create_dir_all(dir.join("a")).unwrap();
+        fs::create_dir_all(dir.join("b c")).unwrap();
+        let dir = files::canonicalize(&dir).unwrap();
+        std::env::set_var("XDG_DATA_HOME", dir.join("data"));
+        for file in ["a/junk.tmp", "b c/junk.tmp"] {
+            fs::write(dir.join(file), file).unwrap();
+            trash_home(&dir.join(file)).unwrap();
+            assert!(!dir.join(file).exists());
+        }
+        let trash = dir.join("data/Trash");
+        assert_eq!(
+            fs::read_to_string(trash.join("files/junk.tmp")).unwrap(),
+            "a/junk.tmp"
+        );
+        assert_eq!(
+            fs::read_to_string(trash.join("files/junk.tmp.2")).unwrap(),
+            "b c/junk.tmp"
+        );
+        let info = fs::read_to_string(trash.join("info/junk.tmp.2.trashinfo")).unwrap();
+        let path = percent_encode(&dir.join("b c/junk.tmp").to_string_lossy());
+        assert!(info.starts_with(&format!("[Trash Info]\nPath={path}\nDeletionDate=")));
+        assert!(path.contains("b%20c"));
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn deletion_date_format() {
+        let date = deletion_date();
+        assert_eq!(date.len(), "2024-01-31T12:00:00".len());
+        assert_eq!(&date[4..5], "-");
+        assert_eq!(&date[10..11], "T");
+        assert!(date.as_str() >= "2024");
+    }
+}
@@ -0,0 +1,510 @@
+use std::{
+    collections::HashSet,
+    fs,
+    io::{self, Write},
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+use crossterm::{
+    cursor,
+    event::{self, Event, KeyCode, KeyEventKind, KeyModifiers},
+    execute, queue,
+    style::{Attribute, Print, SetAttribute},
+    terminal::{self, ClearType},
+};
+use stignore::ignore_file::Kind;
+
+use crate::{
+    api, files, includes,
+    pattern::{self, Matcher},
+    IgnoreFile,
+};
+
+/// Entry of the folder tree shown on the screen
+struct Row {
+    /// Path relative to the folder root, with `/` separators
+    path: String,
+    depth: usize,
+    dir: bool,
+    expanded: bool,
+}
+
+impl Row {
+    fn name(&self) -> &str {
+        self.path.rsplit('/').next().unwrap_or_default()
+    }
+}
+
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum View {
+    Tree,
+    Patterns,
+}
+
+const TREE_KEYS: &str =
+    "space toggle  enter/\u{2190}/\u{2192} open/close  tab patterns  w write  q quit";
+const PATTERNS_KEYS: &str = "K/J move up/down  d delete  tab tree  w write  q quit";
+
+/// State of the editor: .stignore as edited so far and the visible part of
+/// the folder tree
+struct Tui<'a> {
+    root: PathBuf,
+    stignore: PathBuf,
+    /// .stignore as it was read or last written
+    saved: IgnoreFile,
+    file: IgnoreFile,
+    /// Patterns of the edited .stignore with the included files
+    matcher: Matcher,
+    rows: Vec<Row>,
+    view: View,
+    /// Selected row of the tree and line of the patterns
+    tree_cursor: usize,
+    pattern_cursor: usize,
+    message: String,
+    /// Quitting with unsaved changes was asked once
+    quitting: bool,
+    api: Option<(&'a api::Client, String)>,
+}
+
+/// Full-screen mode of the terminal, restored when dropped, on errors too
+pub struct Screen;
+
+impl Screen {
+    pub fn enter() -> Result<Self> {
+        terminal::enable_raw_mode().context("Can't set up the terminal")?;
+        let screen = Screen;
+        execute!(io::stdout(), terminal::EnterAlternateScreen, cursor::Hide)
+            .context("Can't set up the terminal")?;
+        Ok(screen)
+    }
+}
+
+impl Drop for Screen {
+    fn drop(&mut self) {
+        let _ = execute!(io::stdout(), cursor::Show, terminal::LeaveAlternateScreen);
+        let _ = terminal::disable_raw_mode();
+    }
+}
+
+/// Shows the folder tree with ignored entries checked, and lets the user
+/// toggle them, review and reorder the resulting patterns of .stignore and
+/// write them
+pub fn run(api: Option<&api::Client>, silent: bool) -> Result<()> {
+    let (root, _) = crate::find_syncthing_dir()?;
+    let mut tui = Tui::new(root, api)?;
+    let screen = Screen::enter()?;
+    tui.event_loop()?;
+    drop(screen);
+    if !silent && tui.file != tui.saved {
+        println!("Changes of {} discarded", tui.stignore.display());
+    }
+    Ok(())
+}
+
+/// Entries of the directory, directories first, without Syncthing's
+/// internal ones
+fn children(root: &Path, dir: &str, depth: usize) -> Result<Vec<Row>> {
+    let path = root.join(dir);
+    let mut rows: Vec<Row> = fs::read_dir(&path)
+        .with_context(|| format!("Can't read {}", path.display()))?
+        .filter_map(|e| {
+            let e = e.ok()?;
+            let name = e.file_name().to_string_lossy().into_owned();
+            if dir.is_empty() && files::INTERNAL.contains(&name.as_str()) {
+                return None;
+            }
+            Some(Row {
+                path: match dir {
+                    "" => name,
+                    dir => format!("{dir}/{name}"),
+                },
+                depth,
+                // symlinks aren't followed by Syncthing
+                dir: e.file_type().ok()?.is_dir(),
+                expanded: false,
+            })
+        })
+        .collect();
+    rows.sort_by(|a, b| b.dir.cmp(&a.dir).then_with(|| a.name().cmp(b.name())));
+    Ok(rows)
+}
+
+impl<'a> Tui<'a> {
+    /// Editor of .stignore of the folder, showing its top-level entries
+    fn new(root: PathBuf, api: Option<&'a api::Client>) -> Result<Self> {
+        let stignore = root.join(".stignore");
+        let api = match api {
+            Some(api) => Some((api, api.folder_at(&root)?.id)),
+            None => None,
+        };
+        let file = IgnoreFile::load(&stignore)?;
+        let mut tui = Tui {
+            matcher: Matcher::new(&[]),
+            rows: children(&root, "", 0)?,
+            saved: file.clone(),
+            file,
+            root,
+            stignore,
+            view: View::Tree,
+            tree_cursor: 0,
+            pattern_cursor: 0,
+            message: String::new(),
+            quitting: false,
+            api,
+        };
+        tui.update()?;
+        Ok(tui)
+    }
+
+    /// Compiles the edited patterns along with the included files
+    fn update(&mut self) -> Result<()> {
+        let mut lines = Vec::new();
+        for entry in self.file.entries() {
+            match entry.kind() {
+                Kind::Include(target) => lines.extend(includes::flatten(&includes::resolve(
+                    &self.stignore,
+                    target,
+                ))?),
+                _ => lines.push(entry.line().trim().to_owned()),
+            }
+        }
+        self.matcher = Matcher::new(&lines);
+        self.pattern_cursor = self.pattern_cursor.min(self.file.len().saturating_sub(1));
+        Ok(())
+    }
+
+    fn event_loop(&mut self) -> Result<()> {
+        let mut out = io::stdout();
+        loop {
+            self.draw(&mut out).context("Can't draw the screen")?;
+            let Event::Key(key) = event::read().context("Can't read the keyboard")? else {
+                // e.g. resizing draws the screen again
+                continue;
+            };
+            if key.kind != KeyEventKind::Press {
+                continue;
+            }
+            let quit = matches!(key.code, KeyCode::Char('q') | KeyCode::Esc)
+                || key.code == KeyCode::Char('c') && key.modifiers.contains(KeyModifiers::CONTROL);
+            if quit {
+                if self.file == self.saved || self.quitting {
+                    return Ok(());
+                }
+                self.quitting = true;
+                self.message = "Changes aren't written, press w to write or q again to discard \
+                    them"
+                    .to_owned();
+                continue;
+            }
+            self.quitting = false;
+            self.message.clear();
+            if let Err(e) = self.handle(key.code) {
+                self.message = format!("{e:#}");
+            }
+        }
+    }
+
+    fn handle(&mut self, key: KeyCode) -> Result<()> {
+        match (self.view, key) {
+            (_, KeyCode::Tab) => {
+                self.view = match self.view {
+                    View::Tree => View::Patterns,
+                    View::Patterns => View::Tree,
+                }
+            }
+            (_, KeyCode::Char('w')) => self.write()?,
+            (View::Tree, KeyCode::Up | KeyCode::Char('k')) => {
+                self.tree_cursor = self.tree_cursor.saturating_sub(1)
+            }
+            (View::Tree, KeyCode::Down | KeyCode::Char('j')) => {
+                self.tree_cursor = (self.tree_cursor + 1).min(self.rows.len().saturating_sub(1))
+            }
+            (View::Tree, KeyCode::Right | KeyCode::Char('l') | KeyCode::Enter) => self.expand()?,
+            (View::Tree, KeyCode::Left | KeyCode::Char('h')) => self.collapse(),
+            (View::Tree, KeyCode::Char(' ')) => self.toggle()?,
+            (View::Patterns, KeyCode::Up | KeyCode::Char('k')) => {
+                self.pattern_cursor = self.pattern_cursor.saturating_sub(1)
+            }
+            (View::Patterns, KeyCode::Down | KeyCode::Char('j')) => {
+                self.pattern_cursor =
+                    (self.pattern_cursor + 1).min(self.file.len().saturating_sub(1))
+            }
+            (View::Patterns, KeyCode::Char('K')) if self.pattern_cursor > 0 => {
+                self.file
+                    .move_entry(self.pattern_cursor, self.pattern_cursor - 1);
+                self.pattern_cursor -= 1;
+                self.update()?;
+            }
+            (View::Patterns, KeyCode::Char('J')) if self.pattern_cursor + 1 < self.file.len() => {
+                self.file
+                    .move_entry(self.pattern_cursor, self.pattern_cursor + 1);
+                self.pattern_cursor += 1;
+                self.update()?;
+            }
+            (View::Patterns, KeyCode::Char('d') | KeyCode::Delete) if !self.file.is_empty() => {
+                self.file.remove(self.pattern_cursor);
+                self.update()?;
+            }
+            _ => {}
+        }
+        Ok(())
+    }
+
+    fn expand(&mut self) -> Result<()> {
+        let Some(row) = self.rows.get(self.tree_cursor) else {
+            return Ok(());
+        };
+        if !row.dir || row.expanded {
+            return Ok(());
+        }
+        let children = children(&self.root, &row.path, row.depth + 1)?;
+        self.rows[self.tree_cursor].expanded = true;
+        let at = self.tree_cursor + 1;
+        self.rows.splice(at..at, children);
+        Ok(())
+    }
+
+    /// Closes the selected directory, or selects the parent one
+    fn collapse(&mut self) {
+        let Some(row) = self.rows.get(self.tree_cursor) else {
+            return;
+        };
+        let depth = row.depth;
+        if row.expanded {
+            let end = self.rows[self.tree_cursor + 1..]
+                .iter()
+                .position(|r| r.depth <= depth)
+                .map_or(self.rows.len(), |n| self.tree_cursor + 1 + n);
+            self.rows.drain(self.tree_cursor + 1..end);
+            self.rows[self.tree_cursor].expanded = false;
+        } else if let Some(parent) = self.rows[..self.tree_cursor]
+            .iter()
+            .rposition(|r| r.depth < depth)
+        {
+            self.tree_cursor = parent;
+        }
+    }
+
+    /// Ignores the selected entry or stops ignoring it. The line of
+    /// .stignore matching exactly this path is removed if it decides, else
+    /// the opposite pattern is added: at the end, or at the start if another
+    /// pattern would decide before it.
+    fn toggle(&mut self) -> Result<()> {
+        let Some(path) = self.rows.get(self.tree_cursor).map(|r| r.path.clone()) else {
+            return Ok(());
+        };
+        let literal = pattern::literal(&path);
+        let ignored = self.matcher.is_ignored(&path);
+        let (own, opposite) = match ignored {
+            true => (literal.clone(), format!("!{literal}")),
+            false => (format!("!{literal}"), literal),
+        };
+        let decided_by = self.matcher.first_match(&path).map(|(line, _)| line == own);
+        match (decided_by, self.file.find(&own)) {
+            (Some(true), Some(index)) => {
+                self.file.remove(index);
+            }
+            (Some(_), _) => self.file.insert(0, &opposite),
+            (None, _) => self.file.push(&opposite),
+        }
+        self.update()?;
+        if self.matcher.is_ignored(&path) == ignored {
+            self.message = format!("{path} is still decided by the same pattern, see the patterns");
+        }
+        Ok(())
+    }
+
+    /// Writes .stignore unless another program has changed it meanwhile
+    fn write(&mut self) -> Result<()> {
+        if self.file == self.saved {
+            self.message = "Nothing to write".to_owned();
+            return Ok(());
+        }
+        let lock = files::lock(&self.stignore)?;
+        if crate::read_locked(&lock, &self.stignore)? != self.saved {
+            bail!(
+                "{} was changed by another program, quit and run stignore tui again",
+                self.stignore.display()
+            );
+        }
+        lock.write(self.file.to_string())
+            .with_context(|| format!("Can't write {}", self.stignore.display()))?;
+        drop(lock);
+        if let Some((api, folder)) = &self.api {
+            // posting .stignore makes syncthing reload included files as well
+            api.set_ignores(folder, &api.ignores(folder)?)?;
+        }
+        self.saved = self.file.clone();
+        self.message = format!("Written {}", self.stignore.display());
+        Ok(())
+    }
+
+    fn draw(&self, out: &mut impl Write) -> io::Result<()> {
+        let (width, height) = terminal::size()?;
+        let (width, height) = (usize::from(width), usize::from(height));
+        // the title at the top, the status at the bottom
+        let visible = height.saturating_sub(2);
+
+        let (lines, cursor) = match self.view {
+            View::Tree => (self.tree_lines(), self.tree_cursor),
+            View::Patterns => (self.pattern_lines(), self.pattern_cursor),
+        };
+        let title = format!(
+            "{} {}{}",
+            match self.view {
+                View::Tree => "Folder",
+                View::Patterns => "Patterns of",
+            },
+            match self.view {
+                View::Tree => self.root.display(),
+                View::Patterns => self.stignore.display(),
+            },
+            if self.file == self.saved {
+                ""
+            } else {
+                " (not written)"
+            }
+        );
+        let status = match (&self.message, self.view) {
+            (message, _) if !message.is_empty() => message.clone(),
+            (_, View::Tree) => match self.rows.get(self.tree_cursor) {
+                Some(row) => match self.matcher.first_match(&row.path) {
+                    Some((line, false)) => format!("ignored by {line}   {TREE_KEYS}"),
+                    Some((line, true)) => format!("kept by {line}   {TREE_KEYS}"),
+                    None => TREE_KEYS.to_owned(),
+                },
+                None => TREE_KEYS.to_owned(),
+            },
+            (_, View::Patterns) => {
+                let (added, removed) = self.changes();
+                format!("{added} added, {removed} removed   {PATTERNS_KEYS}")
+            }
+        };
+
+        queue!(out, terminal::Clear(ClearType::All), cursor::MoveTo(0, 0))?;
+        queue!(
+            out,
+            SetAttribute(Attribute::Bold),
+            Print(cut(&title, width))
+        )?;
+        queue!(out, SetAttribute(Attribute::Reset))?;
+        // the selected line stays on the screen
+        let offset = (cursor + 1).saturating_sub(visible);
+        for (y, line) in lines.iter().skip(offset).take(visible).enumerate() {
+            queue!(out, cursor::MoveTo(0, (y + 1) as u16))?;
+            if offset + y == cursor {
+                queue!(out, SetAttribute(Attribute::Reverse))?;
+            }
+            queue!(out, Print(cut(line, width)), SetAttribute(Attribute::Reset))?;
+        }
+        queue!(
+            out,
+            cursor::MoveTo(0, height.saturating_sub(1) as u16),
+            Print(cut(&status, width))
+        )?;
+        out.flush()
+    }
+
+    fn tree_lines(&self) -> Vec<String> {
+        self.rows
+            .iter()
+            .map(|row| {
+                let check = if self.matcher.is_ignored(&row.path) {
+                    "[x]"
+                } else {
+                    "[ ]"
+                };
+                let (arrow, slash) = match (row.dir, row.expanded) {
+                    (true, true) => ("\u{25be} ", "/"),
+                    (true, false) => ("\u{25b8} ", "/"),
+                    (false, _) => ("  ", ""),
+                };
+                let indent = "  ".repeat(row.depth);
+                format!("{check} {indent}{arrow}{}{slash}", row.name())
+            })
+            .collect()
+    }
+
+    /// Lines of the edited .stignore, the ones not written yet marked with `+`
+    fn pattern_lines(&self) -> Vec<String> {
+        let saved: HashSet<&str> = self.saved.entries().iter().map(|e| e.line()).collect();
+        let lines: Vec<String> = self
+            .file
+            .entries()
+            .iter()
+            .map(|e| {
+                let mark = if saved.contains(e.line()) { ' ' } else { '+' };
+                format!("{mark} {}", e.line())
+            })
+            .collect();
+        if lines.is_empty() {
+            return vec!["  (no patterns)".to_owned()];
+        }
+        lines
+    }
+
+    /// Numbers of lines added and removed since .stignore was written
+    fn changes(&self) -> (usize, usize) {
+        let lines = |f: &IgnoreFile| -> HashSet<String> {
+            f.entries().iter().map(|e| e.line().to_owned()).collect()
+        };
+        let (saved, edited) = (lines(&self.saved), lines(&self.file));
+        (
+            edited.difference(&saved).count(),
+            saved.difference(&edited).count(),
+        )
+    }
+}
+
+/// The line shortened to the width of the screen
+fn cut(line: &str, width: usize) -> String {
+    line.chars().take(width).collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn entries_are_toggled_and_patterns_written() {
+        let root = std::env::temp_dir().join(format!("stignore-tui-{}", std::process::id()));
+        fs::remove_dir_all(&root).ok();
+        fs::create_dir_all(root.join(".stfolder")).unwrap();
+        fs::create_dir_all(root.join("build/out")).unwrap();
+        fs::write(root.join("a.log"), "").unwrap();
+        fs::write(root.join(".stignore"), "*.log\n").unwrap();
+        let mut tui = Tui::new(root.clone(), None).unwrap();
+        assert_eq!(
+            tui.tree_lines(),
+            ["[ ] \u{25b8} build/", "[ ]   .stignore", "[x]   a.log"]
+        );
+
+        tui.handle(KeyCode::Enter).unwrap();
+        assert_eq!(tui.rows[1].path, "build/out");
+        // ignores the directory
+        tui.handle(KeyCode::Char(' ')).unwrap();
+        tui.handle(KeyCode::Left).unwrap();
+        assert_eq!(tui.rows.len(), 3);
+        // a.log is un-ignored before *.log decides
+        tui.handle(KeyCode::Down).unwrap();
+        tui.handle(KeyCode::Down).unwrap();
+        tui.handle(KeyCode::Char(' ')).unwrap();
+        assert!(!tui.matcher.is_ignored("a.log"));
+        assert_eq!(tui.file.to_string(), "!/a.log\n*.log\n/build\n");
+        assert_eq!(tui.changes(), (2, 0));
+
+        tui.handle(KeyCode::Tab).unwrap();
+        tui.handle(KeyCode::Char('J')).unwrap();
+        assert_eq!(tui.file.to_string(), "*.log\n!/a.log\n/build\n");
+        assert!(tui.matcher.is_ignored("a.log"));
+        tui.handle(KeyCode::Char('d')).unwrap();
+        tui.handle(KeyCode::Char('w')).unwrap();
+        assert_eq!(
+            fs::read_to_string(root.join(".stignore")).unwrap(),
+            "*.log\n/build\n"
+        );
+        assert_eq!(tui.changes(), (0, 0));
+        fs::remove_dir_all(root).ok();
+    }
+}
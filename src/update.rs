@@ -0,0 +1,141 @@
+use std::{fs, path::Path};
+
+use anyhow::{bail, Context, Result};
+use reqwest::blocking::Client;
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+
+const LATEST_RELEASE: &str = "https://api.github.com/repos/Andrew-Morozko/stignore/releases/latest";
+
+/// Release published on GitHub
+pub struct Release {
+    /// Version without the `v` prefix of the tag
+    pub version: String,
+    /// Names and download URLs of the attached files
+    assets: Vec<(String, String)>,
+}
+
+fn client() -> Result<Client> {
+    // GitHub rejects requests without User-Agent
+    Client::builder()
+        .user_agent(concat!("stignore/", env!("CARGO_PKG_VERSION")))
+        .build()
+        .context("Can't create HTTP client")
+}
+
+fn download(client: &Client, url: &str) -> Result<Vec<u8>> {
+    let response = client
+        .get(url)
+        .send()
+        .and_then(|r| r.error_for_status())
+        .with_context(|| format!("Can't download {url}"))?;
+    Ok(response
+        .bytes()
+        .with_context(|| format!("Can't download {url}"))?
+        .to_vec())
+}
+
+/// The latest release of stignore
+pub fn latest() -> Result<Release> {
+    let body = download(&client()?, LATEST_RELEASE)?;
+    let release: Value = serde_json::from_slice(&body).context("Invalid release information")?;
+    let tag = release["tag_name"]
+        .as_str()
+        .context("Invalid release information")?;
+    let assets = release["assets"]
+        .as_array()
+        .map(Vec::as_slice)
+        .unwrap_or_default()
+        .iter()
+        .filter_map(|a| {
+            let name = a["name"].as_str()?;
+            let url = a["browser_download_url"].as_str()?;
+            Some((name.to_owned(), url.to_owned()))
+        })
+        .collect();
+    Ok(Release {
+        version: tag.trim_start_matches('v').to_owned(),
+        assets,
+    })
+}
+
+/// Compares versions like `1.10.0` by their numeric parts
+pub fn is_newer(version: &str, than: &str) -> bool {
+    let parts = |v: &str| -> Vec<u64> {
+        v.split(['.', '-', '+'])
+            .map_while(|p| p.parse().ok())
+            .collect()
+    };
+    parts(version) > parts(than)
+}
+
+/// Name of the release file with the binary for this platform, e.g.
+/// `stignore-x86_64-unknown-linux-gnu`. Its SHA-256 checksum is published
+/// next to it with the `.sha256` extension.
+fn asset_name() -> String {
+    let name = format!("stignore-{}", env!("STIGNORE_BUILD_TARGET"));
+    if cfg!(windows) {
+        name + ".exe"
+    } else {
+        name
+    }
+}
+
+impl Release {
+    fn asset(&self, name: &str) -> Result<&str> {
+        match self.assets.iter().find(|(n, _)| n == name) {
+            Some((_, url)) => Ok(url),
+            None => bail!("Release {} has no {name}", self.version),
+        }
+    }
+
+    /// Downloads the binary for this platform and checks it against the
+    /// published checksum
+    pub fn download(&self) -> Result<Vec<u8>> {
+        let name = asset_name();
+        let client = client()?;
+        let checksum = download(&client, self.asset(&format!("{name}.sha256"))?)?;
+        let checksum = String::from_utf8_lossy(&checksum);
+        let expected = checksum
+            .split_whitespace()
+            .next()
+            .with_context(|| format!("Empty checksum of {name}"))?;
+        let binary = download(&client, self.asset(&name)?)?;
+        let actual = format!("{:x}", Sha256::digest(&binary));
+        if !actual.eq_ignore_ascii_case(expected) {
+            bail!("Checksum of the downloaded {name} doesn't match, it wasn't installed");
+        }
+        Ok(binary)
+    }
+}
+
+/// Replaces the executable with the new binary. It's written next to the
+/// executable and renamed over it, so an interrupted update leaves the old
+/// binary in place.
+pub fn install(exe: &Path, binary: &[u8]) -> Result<()> {
+    let tmp = exe.with_file_name(format!(".stignore.{}.tmp", std::process::id()));
+    let replace = || -> std::io::Result<()> {
+        fs::write(&tmp, binary)?;
+        fs::set_permissions(&tmp, fs::metadata(exe)?.permissions())?;
+        if cfg!(windows) {
+            // a running executable can't be replaced, but can be renamed
+            let old = exe.with_extension("old.exe");
+            let _ = fs::remove_file(&old);
+            fs::rename(exe, &old)?;
+            return fs::rename(&tmp, exe).inspect_err(|_| {
+                let _ = fs::rename(&old, exe);
+            });
+        }
+        fs::rename(&tmp, exe)
+    };
+    if let Err(e) = replace() {
+        let _ = fs::remove_file(&tmp);
+        return Err(e).with_context(|| {
+            format!(
+                "Can't replace {}, update it the way it was installed",
+                exe.display()
+            )
+        });
+    }
+    Ok(())
+}
@@ -0,0 +1,161 @@
+use std::{
+    path::{Path, PathBuf},
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+use anyhow::{Context, Result};
+use regex::Regex;
+
+use crate::files;
+
+/// Directory where Syncthing keeps old versions of files
+pub const DIR: &str = ".stversions";
+
+/// Old version of a file, `name~YYYYMMDD-HHMMSS.ext`
+pub struct Version {
+    pub path: PathBuf,
+    /// Path of the versioned file relative to the folder root, with `/`
+    /// separators
+    pub original: String,
+    /// When the version was archived, seconds since the Unix epoch
+    pub archived: u64,
+    pub size: u64,
+}
+
+/// Versions kept in the folder's .stversions, oldest first
+pub fn list(st_dir: &Path) -> Result<Vec<Version>> {
+    let dir = st_dir.join(DIR);
+    if !dir.is_dir() {
+        return Ok(Vec::new());
+    }
+    let re = Regex::new(r"^(.*)~(\d{4})(\d\d)(\d\d)-(\d\d)(\d\d)(\d\d)(\.[^.~]*)?$").unwrap();
+    let mut versions = Vec::new();
+    for path in files::walk(&dir)? {
+        let name = path
+            .file_name()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .into_owned();
+        let c = match re.captures(&name) {
+            Some(c) => c,
+            None => continue,
+        };
+        let n = |i: usize| c[i].parse::<u64>().unwrap_or_default();
+        // not a timestamp Syncthing would write, the date can't be computed
+        if n(2) == 0 || !(1..=12).contains(&n(3)) || !(1..=31).contains(&n(4)) {
+            continue;
+        }
+        let original =
+            path.with_file_name(format!("{}{}", &c[1], c.get(8).map_or("", |e| e.as_str())));
+        let size = path
+            .metadata()
+            .with_context(|| format!("Can't read {}", path.display()))?
+            .len();
+        versions.push(Version {
+            original: original
+                .strip_prefix(&dir)
+                .unwrap_or(&original)
+                .to_string_lossy()
+                .replace('\\', "/"),
+            // timestamps are in local time, the difference doesn't matter for
+            // ages measured in days
+            archived: days_since_epoch(n(2), n(3), n(4)) * 86400 + n(5) * 3600 + n(6) * 60 + n(7),
+            size,
+            path,
+        });
+    }
+    versions.sort_by_key(|v| v.archived);
+    Ok(versions)
+}
+
+/// Current time, seconds since the Unix epoch
+pub fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_secs())
+}
+
+/// UTC date and time of seconds since the Unix epoch: year, month, day,
+/// hours, minutes and seconds
+pub fn utc(secs: u64) -> [u64; 6] {
+    let (days, time) = (secs / 86400, secs % 86400);
+    // inverse of days_since_epoch
+    let z = days + 719468;
+    let era = z / 146097;
+    let day_of_era = z - era * 146097;
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36524 - day_of_era / 146096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = year_of_era + era * 400 + u64::from(month <= 2);
+    [year, month, day, time / 3600, time % 3600 / 60, time % 60]
+}
+
+/// Time in a readable form, e.g. `2024-01-01 12:00:00 UTC`
+pub fn format_utc(secs: u64) -> String {
+    let [year, month, day, h, m, s] = utc(secs);
+    format!("{year:04}-{month:02}-{day:02} {h:02}:{m:02}:{s:02} UTC")
+}
+
+/// Days from 1970-01-01 to the date of the proleptic Gregorian calendar.
+/// The year must be at least 1, the month 1 to 12 and the day 1 to 31.
+fn days_since_epoch(year: u64, month: u64, day: u64) -> u64 {
+    let year = if month <= 2 { year - 1 } else { year };
+    let era = year / 400;
+    let year_of_era = year - era * 400;
+    let day_of_year = (153 * ((month + 9) % 12) + 2) / 5 + day - 1;
+    let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year;
+    (era * 146097 + day_of_era).saturating_sub(719468)
+}
+
+/// Deletes the version and directories of .stversions left empty
+pub fn remove(st_dir: &Path, version: &Version) -> Result<()> {
+    std::fs::remove_file(&version.path)
+        .with_context(|| format!("Can't delete {}", version.path.display()))?;
+    let root = st_dir.join(DIR);
+    let mut dir = version.path.parent();
+    while let Some(d) = dir.filter(|d| *d != root && d.starts_with(&root)) {
+        if std::fs::remove_dir(d).is_err() {
+            break;
+        }
+        dir = d.parent();
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn days_round_trip() {
+        assert_eq!(days_since_epoch(1970, 1, 1), 0);
+        assert_eq!(days_since_epoch(2000, 3, 1), 11017);
+        assert_eq!(
+            utc(days_since_epoch(2024, 2, 29) * 86400)[..3],
+            [2024, 2, 29]
+        );
+    }
+
+    #[test]
+    fn invalid_dates_are_skipped() {
+        let st_dir = std::env::temp_dir().join(format!("stignore-versions-{}", std::process::id()));
+        let dir = st_dir.join(DIR);
+        std::fs::create_dir_all(&dir).unwrap();
+        for name in [
+            "a~20240000-120000.txt",
+            "b~20240100-120000.txt",
+            "c~00000101-120000.txt",
+            "d~20240229-120000.txt",
+        ] {
+            std::fs::write(dir.join(name), "").unwrap();
+        }
+        let versions = list(&st_dir).unwrap();
+        std::fs::remove_dir_all(&st_dir).ok();
+        assert_eq!(versions.len(), 1);
+        assert_eq!(versions[0].original, "d.txt");
+        assert_eq!(format_utc(versions[0].archived), "2024-02-29 12:00:00 UTC");
+    }
+}
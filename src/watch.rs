@@ -0,0 +1,44 @@
+use std::path::Path;
+
+use crate::{
+    files,
+    pattern::{self, Pattern},
+};
+
+/// Rules used by `stignore watch` when none are given: directories of
+/// dependencies and caches, temporary and editor backup files, OS metadata
+pub const DEFAULT_RULES: [&str; 9] = [
+    "node_modules",
+    "__pycache__",
+    ".venv",
+    "*.tmp",
+    "*.temp",
+    "*.swp",
+    "*~",
+    ".DS_Store",
+    "Thumbs.db",
+];
+
+/// Pattern to suggest for the created path (relative to the folder root):
+/// the first rule matching it or one of its parent directories, otherwise
+/// the exact path of a file larger than `larger_than` bytes
+pub fn suggest(rules: &[String], larger_than: u64, root: &Path, path: &str) -> Option<String> {
+    if let Some(rule) = rules
+        .iter()
+        .find(|r| Pattern::parse(r).is_some_and(|p| !p.negated && p.matches(path)))
+    {
+        return Some(rule.clone());
+    }
+    let meta = root.join(path).metadata().ok()?;
+    (meta.is_file() && meta.len() > larger_than).then(|| pattern::literal(path))
+}
+
+/// Checks if the path belongs to Syncthing or to files being written by it
+/// or by stignore, `.syncthing.NAME.tmp`
+pub fn is_internal(path: &str) -> bool {
+    if path.split('/').any(|p| files::INTERNAL.contains(&p)) {
+        return true;
+    }
+    let name = path.rsplit('/').next().unwrap_or_default();
+    name.starts_with(".syncthing.") && name.ends_with(".tmp")
+}